@@ -0,0 +1,238 @@
+// Command audit queries, exports and verifies the server's hash-chained
+// audit log.
+//
+//	audit keygen -o audit.key
+//	audit verify [-file audit.jsonl] [-key audit.key]
+//	audit query  [-file audit.jsonl] [filters]
+//	audit export [-file audit.jsonl] [-format jsonl|csv] [-o out] [filters]
+//
+// A server started with -audit-key writes an HMAC chain that only verifies
+// with the same key. Keep the key off the machine the log lives on, or at
+// least out of reach of the accounts that can write the log.
+//
+// Filters are -operator, -client, -action, -status, -since, -until (RFC 3339
+// times) and -limit.
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/E2klime/HAXinceL2/internal"
+)
+
+func main() {
+	log.SetFlags(0)
+
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	switch os.Args[1] {
+	case "keygen":
+		keygen(os.Args[2:])
+	case "verify":
+		verify(os.Args[2:])
+	case "query":
+		query(os.Args[2:])
+	case "export":
+		export(os.Args[2:])
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: audit keygen|verify|query|export [flags]")
+	os.Exit(2)
+}
+
+func keygen(args []string) {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	out := fs.String("o", "", "File to write the new key to (must not exist)")
+	fs.Parse(args)
+
+	if *out == "" {
+		log.Fatal("-o is required")
+	}
+	if err := internal.GenerateAuditKey(*out); err != nil {
+		log.Fatalf("Failed to generate audit key: %v", err)
+	}
+	fmt.Printf("Audit key written to %s; start the server with -audit-key %s\n", *out, *out)
+}
+
+func verify(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	file := fs.String("file", envOr("AUDIT_FILE", "audit.jsonl"), "Audit log to check")
+	keyFile := fs.String("key", os.Getenv("AUDIT_KEY_FILE"), "Key the server wrote the log with (its -audit-key)")
+	fs.Parse(args)
+
+	var key []byte
+	if *keyFile != "" {
+		var err error
+		if key, err = internal.LoadAuditKey(*keyFile); err != nil {
+			log.Fatalf("Failed to read audit key: %v", err)
+		}
+	}
+
+	f, err := os.Open(*file)
+	if err != nil {
+		log.Fatalf("Failed to open audit log: %v", err)
+	}
+	defer f.Close()
+
+	n, err := internal.VerifyAudit(f, key)
+	if errors.Is(err, internal.ErrAuditChain) && key == nil {
+		log.Fatalf("%s: %v (if the server ran with -audit-key, pass the same key with -key)", *file, err)
+	}
+	if err != nil {
+		log.Fatalf("%s: %v", *file, err)
+	}
+
+	last := "-"
+	if n > 0 {
+		records, _ := internal.QueryAudit(*file, internal.AuditFilter{Limit: 1})
+		if len(records) == 1 {
+			last = records[0].Hash
+		}
+	}
+	fmt.Printf("%s: %d record(s), chain intact, last hash %s\n", *file, n, last)
+}
+
+// filterFlags registers the flags shared by query and export.
+func filterFlags(fs *flag.FlagSet) (file *string, build func() internal.AuditFilter) {
+	file = fs.String("file", envOr("AUDIT_FILE", "audit.jsonl"), "Audit log to read")
+	operator := fs.String("operator", "", "Only records of this operator (e.g. telegram:123)")
+	client := fs.String("client", "", "Only records about this client")
+	action := fs.String("action", "", "Only this action (e.g. command, token.mint)")
+	status := fs.String("status", "", "Only this status (ok, failed, denied, ...)")
+	since := fs.String("since", "", "Only records at or after this RFC 3339 time")
+	until := fs.String("until", "", "Only records before this RFC 3339 time")
+	limit := fs.Int("limit", 0, "Only the most recent N matches (0 for all)")
+
+	return file, func() internal.AuditFilter {
+		return internal.AuditFilter{
+			Operator: *operator,
+			ClientID: *client,
+			Action:   *action,
+			Status:   *status,
+			Since:    parseTime("since", *since),
+			Until:    parseTime("until", *until),
+			Limit:    *limit,
+		}
+	}
+}
+
+func query(args []string) {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	file, filter := filterFlags(fs)
+	fs.Parse(args)
+
+	records, err := internal.QueryAudit(*file, filter())
+	if err != nil {
+		log.Fatalf("Failed to query audit log: %v", err)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SEQ\tTIME\tOPERATOR\tCLIENT\tACTION\tSTATUS\tMS\tSUMMARY")
+	for _, rec := range records {
+		summary := rec.Summary
+		if rec.Error != "" {
+			summary += " [" + rec.Error + "]"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%d\t%s\n",
+			rec.Seq, rec.Time.Local().Format("2006-01-02 15:04:05"), rec.Operator, rec.ClientID, rec.Action, rec.Status, rec.DurationMS, summary)
+	}
+	tw.Flush()
+}
+
+func export(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	file, filter := filterFlags(fs)
+	format := fs.String("format", "jsonl", "Output format: jsonl or csv")
+	out := fs.String("o", "", "Output file (default: stdout)")
+	fs.Parse(args)
+
+	if *format != "jsonl" && *format != "csv" {
+		log.Fatalf("Unknown format %q (use jsonl or csv)", *format)
+	}
+
+	records, err := internal.QueryAudit(*file, filter())
+	if err != nil {
+		log.Fatalf("Failed to query audit log: %v", err)
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			log.Fatalf("Failed to create %s: %v", *out, err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if *format == "csv" {
+		err = writeCSV(w, records)
+	} else {
+		enc := json.NewEncoder(w)
+		for _, rec := range records {
+			if err = enc.Encode(rec); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		log.Fatalf("Failed to export: %v", err)
+	}
+}
+
+func writeCSV(w io.Writer, records []internal.AuditRecord) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"seq", "time", "operator", "client_id", "action", "request_id", "summary", "status", "error", "duration_ms", "prev_hash", "hash"})
+	for _, rec := range records {
+		cw.Write([]string{
+			strconv.FormatUint(rec.Seq, 10),
+			rec.Time.Format(time.RFC3339Nano),
+			rec.Operator,
+			rec.ClientID,
+			rec.Action,
+			rec.RequestID,
+			rec.Summary,
+			rec.Status,
+			rec.Error,
+			strconv.FormatInt(rec.DurationMS, 10),
+			rec.PrevHash,
+			rec.Hash,
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func parseTime(name, v string) time.Time {
+	if v == "" {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		log.Fatalf("Invalid -%s: %v", name, err)
+	}
+	return t
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -1,20 +1,47 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
-	"time"
 
 	"github.com/E2klime/HAXinceL2/internal"
+	"github.com/E2klime/HAXinceL2/internal/protocol"
 )
 
 func main() {
 	serverURL := flag.String("server", os.Getenv("SERVER_URL"), "Server WebSocket URL (e.g., ws://server.com:8080/ws)")
+	token := flag.String("token", os.Getenv("CLIENT_TOKEN"), "Enrollment token issued by the server operator (client-id:secret)")
+	caFile := flag.String("ca", os.Getenv("CLIENT_CA"), "Pin the server certificate to this CA bundle instead of system roots")
+	certFile := flag.String("cert", os.Getenv("CLIENT_CERT"), "Client certificate for mutual TLS")
+	keyFile := flag.String("key", os.Getenv("CLIENT_KEY"), "Client private key for mutual TLS")
+	stateDir := flag.String("state-dir", envOr("CLIENT_STATE_DIR", internal.DefaultStateDir()), "Directory for persistent client state (identity)")
+	clientID := flag.String("id", os.Getenv("CLIENT_ID"), "Override the persisted client ID (e.g. for cloned machine images)")
+	retryMin := flag.Duration("retry-min", internal.DefaultMinRetryInterval, "Initial reconnect delay")
+	retryMax := flag.Duration("retry-max", internal.DefaultMaxRetryInterval, "Maximum reconnect delay")
+	encoding := flag.String("encoding", envOr("CLIENT_ENCODING", protocol.EncodingBinary), "Preferred wire encoding: binary, or json for debugging")
+	noCompression := flag.Bool("no-compression", false, "Do not offer permessage-deflate compression")
+	policyFile := flag.String("policy", os.Getenv("CLIENT_POLICY"), "Local policy file limiting what the server may do on this machine")
+	consentModes := flag.String("consent", envOr("CLIENT_CONSENT", string(internal.ConsentNotify)), "Tell the local user about remote operations: allow, notify or require, for all or per class (e.g. screen=require,files=notify,commands=require), or off")
+	consentDir := flag.String("consent-dir", os.Getenv("CLIENT_CONSENT_DIR"), "Directory the consent helper in the user's desktop session watches (default: desktop notifications if this runs in one, else this terminal)")
+	consentUser := flag.String("consent-user", os.Getenv("CLIENT_CONSENT_USER"), "Local user allowed to answer consent requests in -consent-dir (default: any local user)")
+	consentLog := flag.String("consent-log", os.Getenv("CLIENT_CONSENT_LOG"), "Log of remote operations for the local user (default: consent.log in -consent-dir, or in -state-dir without one)")
+	consentTimeout := flag.Duration("consent-timeout", internal.DefaultConsentTimeout, "How long to wait for the local user to approve an operation")
+	consentApproval := flag.Duration("consent-approval", internal.DefaultConsentApproval, "How long approving one operation covers the rest of its class (0 to ask for every operation)")
+	maxJobs := flag.Int("max-jobs", internal.DefaultMaxJobs, "Number of requests handled concurrently")
+	showVersion := flag.Bool("version", false, "Print the agent and protocol version and exit")
 	flag.Parse()
 
+	if *showVersion {
+		fmt.Printf("agent %s, protocol %d\n", internal.AgentVersion, protocol.ProtocolVersion)
+		return
+	}
+
 	if *serverURL == "" {
 		log.Fatal("Server URL is required (use -server or SERVER_URL env)")
 	}
@@ -24,27 +51,122 @@ func main() {
 		log.Fatalf("Failed to create client: %v", err)
 	}
 
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	identity, err := internal.LoadOrCreateIdentity(*stateDir)
+	if err != nil {
+		log.Fatalf("Failed to load client identity: %v", err)
+	}
+	c.ID = identity.ClientID
+
+	// The certificate or token fixes the ID the server will accept.
+	boundBy := ""
 
-	for {
-		err := c.Connect()
+	if *caFile != "" || *certFile != "" || *keyFile != "" {
+		tlsConfig, err := internal.LoadClientTLS(*caFile, *certFile, *keyFile)
 		if err != nil {
-			log.Printf("Failed to connect: %v. Retrying in 10 seconds...", err)
-			time.Sleep(10 * time.Second)
-			continue
+			log.Fatalf("Failed to configure TLS: %v", err)
+		}
+		if err := c.UseTLS(tlsConfig); err != nil {
+			log.Fatalf("Failed to configure TLS: %v", err)
+		}
+		if certID, _ := internal.CertificateIdentity(tlsConfig); certID != "" {
+			boundBy = "client certificate"
+		}
+	}
+
+	if *token != "" {
+		if err := c.UseEnrollmentToken(*token); err != nil {
+			log.Fatalf("Invalid enrollment token: %v", err)
 		}
+		boundBy = "enrollment token"
+	}
+
+	if *clientID != "" {
+		if boundBy != "" && *clientID != c.ID {
+			log.Fatalf("-id %q conflicts with the identity %q of the %s", *clientID, c.ID, boundBy)
+		}
+		c.ID = *clientID
+	}
+
+	c.MinRetryInterval = *retryMin
+	c.MaxRetryInterval = *retryMax
 
-		go func() {
-			if err := c.Run(); err != nil {
-				log.Printf("Client error: %v. Reconnecting...", err)
-				time.Sleep(5 * time.Second)
+	if *encoding != protocol.EncodingBinary && *encoding != protocol.EncodingJSON {
+		log.Fatalf("Unknown encoding %q (use binary or json)", *encoding)
+	}
+	c.Encoding = *encoding
+	c.DisableCompression = *noCompression
+
+	if *maxJobs < 1 {
+		log.Fatal("-max-jobs must be at least 1")
+	}
+	c.MaxJobs = *maxJobs
+
+	if *policyFile != "" {
+		policy, err := internal.LoadLocalPolicy(*policyFile)
+		if err != nil {
+			log.Fatalf("Failed to load local policy: %v", err)
+		}
+		c.Policy = policy
+		log.Printf("Enforcing local policy from %s", *policyFile)
+	}
+
+	if *consentModes == "off" {
+		log.Printf("Local user consent is off: remote operations run without telling the user")
+	} else {
+		modes, err := internal.ParseConsentModes(*consentModes)
+		if err != nil {
+			log.Fatalf("Invalid -consent: %v", err)
+		}
+
+		var provider internal.ConsentProvider
+		switch {
+		case *consentDir != "":
+			if provider, err = internal.NewFileConsent(*consentDir, *consentUser); err != nil {
+				log.Fatalf("Failed to create consent directory: %v", err)
+			}
+			if *consentLog == "" {
+				*consentLog = filepath.Join(*consentDir, "consent.log")
+			}
+			log.Printf("Consent requests go to %s; run the consent helper in the user's session to show them", *consentDir)
+		case internal.DesktopConsentAvailable():
+			provider = internal.NewDesktopConsent()
+		default:
+			if info, err := os.Stdin.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+				log.Printf("Warning: no desktop session or terminal to reach the local user; use -consent-dir with the consent helper")
 			}
-		}()
+			provider = internal.NewStdioConsent(os.Stdin, os.Stderr)
+		}
 
-		break
+		// Without a consent directory the provider runs in the user's own
+		// session, so the state directory is theirs to read.
+		if *consentLog == "" {
+			*consentLog = filepath.Join(*stateDir, "consent.log")
+		}
+		consent, err := internal.NewConsent(provider, modes, *consentLog)
+		if err != nil {
+			log.Fatalf("Failed to open consent log: %v", err)
+		}
+		defer consent.Close()
+
+		consent.Timeout = *consentTimeout
+		consent.ApprovalTTL = *consentApproval
+		c.Consent = consent
+		log.Printf("Local user consent enabled, logging to %s", *consentLog)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if err := c.Serve(ctx); err != nil {
+		log.Fatalf("Client error: %v", err)
 	}
 
-	<-sigChan
 	log.Println("Shutting down...")
 }
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,43 @@
+// Command consent shows a client's consent requests, notices and session
+// indicator on the local user's desktop. The client usually runs as a
+// service that cannot reach the desktop itself, so it writes them to a
+// consent directory (its -consent-dir) and this helper, started in the
+// user's session, relays them:
+//
+//	client -consent require -consent-dir /run/haxincel2-consent -consent-user alice
+//	consent -dir /run/haxincel2-consent      (as alice, e.g. from desktop autostart)
+//
+// Operations are logged to consent.log in the same directory.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/E2klime/HAXinceL2/internal"
+)
+
+func main() {
+	dir := flag.String("dir", os.Getenv("CLIENT_CONSENT_DIR"), "Consent directory of the client (its -consent-dir)")
+	flag.Parse()
+
+	if *dir == "" {
+		log.Fatal("Consent directory is required (use -dir or CLIENT_CONSENT_DIR env)")
+	}
+	if !internal.DesktopConsentAvailable() {
+		log.Fatal("No desktop session to show consent requests in")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	log.Printf("Relaying consent requests from %s", *dir)
+	if err := internal.WatchConsent(ctx, *dir, internal.NewDesktopConsent()); err != nil && !errors.Is(err, context.Canceled) {
+		log.Fatalf("Consent helper error: %v", err)
+	}
+}
@@ -2,37 +2,147 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strings"
 
 	"github.com/E2klime/HAXinceL2/internal"
+	"github.com/E2klime/HAXinceL2/internal/protocol"
 	"github.com/E2klime/HAXinceL2/telegram"
 )
 
 func main() {
 	addr := flag.String("addr", ":8080", "Server address")
 	botToken := flag.String("bot-token", os.Getenv("TELEGRAM_BOT_TOKEN"), "Telegram bot token")
-	adminIDs := flag.String("admin-ids", os.Getenv("TELEGRAM_ADMIN_IDS"), "Comma-separated list of admin Telegram IDs")
+	adminIDs := flag.String("admin-ids", os.Getenv("TELEGRAM_ADMIN_IDS"), "Comma-separated list of Telegram IDs granted the admin role")
+	rbacFile := flag.String("rbac", os.Getenv("RBAC_FILE"), "Access policy file with operators, roles and client groups")
+	tokensFile := flag.String("tokens", envOr("TOKENS_FILE", "tokens.json"), "Path to the client enrollment token store")
+	mintToken := flag.String("mint-token", "", "Mint an enrollment token for the given client ID, print it and exit")
+	revokeToken := flag.String("revoke-token", "", "Revoke the enrollment token of the given client ID and exit")
+	inventoryFile := flag.String("inventory", envOr("INVENTORY_FILE", "inventory.json"), "Path to the persistent client inventory")
+	queueFile := flag.String("queue", envOr("QUEUE_FILE", "queue.json"), "Path to the persistent command queue for offline clients")
+	tlsCert := flag.String("tls-cert", os.Getenv("TLS_CERT"), "TLS certificate file (enables HTTPS/WSS)")
+	tlsKey := flag.String("tls-key", os.Getenv("TLS_KEY"), "TLS private key file")
+	clientCA := flag.String("client-ca", os.Getenv("TLS_CLIENT_CA"), "CA bundle for client certificates (enables mutual TLS on /ws)")
+	auditFile := flag.String("audit", envOr("AUDIT_FILE", "audit.jsonl"), "Path to the hash-chained audit log of operator actions")
+	auditKeyFile := flag.String("audit-key", os.Getenv("AUDIT_KEY_FILE"), "Secret key for the audit chain (create one with \"audit keygen\"); keep it where the log's writers cannot read it")
+	transferDir := flag.String("transfer-dir", os.Getenv("TRANSFER_DIR"), "Directory for files downloaded from clients (default: system temp dir)")
+	approveTypes := flag.String("approve", envOr("APPROVE_TYPES", "file_delete,reg_delete"), "Comma-separated operation types held until a second operator approves them (\"none\" to disable)")
+	approvalsFile := flag.String("approvals", envOr("APPROVALS_FILE", "approvals.json"), "Path to the persistent store of operations held for approval")
+	approvalTTL := flag.Duration("approval-ttl", internal.DefaultApprovalTTL, "How long a held operation waits for a second operator")
+	operatorToken := flag.String("operator-token", os.Getenv("OPERATOR_TOKEN"), "Admin bearer token for the /shell, /api/v1 and /ui operator endpoints")
 	flag.Parse()
 
+	tokens, err := internal.NewTokenStore(*tokensFile)
+	if err != nil {
+		log.Fatalf("Failed to open token store: %v", err)
+	}
+
+	if *mintToken != "" || *revokeToken != "" {
+		if *mintToken != "" {
+			token, err := tokens.Mint(*mintToken)
+			if err != nil {
+				log.Fatalf("Failed to mint token: %v", err)
+			}
+			fmt.Println(protocol.FormatEnrollmentToken(token.ClientID, token.Secret))
+		}
+		if *revokeToken != "" {
+			if err := tokens.Revoke(*revokeToken); err != nil {
+				log.Fatalf("Failed to revoke token: %v", err)
+			}
+		}
+		return
+	}
+
 	if *botToken == "" {
 		log.Fatal("Telegram bot token is required (use -bot-token or TELEGRAM_BOT_TOKEN env)")
 	}
 
-	if *adminIDs == "" {
-		log.Fatal("Admin IDs are required (use -admin-ids or TELEGRAM_ADMIN_IDS env)")
+	if *adminIDs == "" && *rbacFile == "" {
+		log.Fatal("Admin IDs or an access policy are required (use -admin-ids / TELEGRAM_ADMIN_IDS or -rbac / RBAC_FILE)")
+	}
+
+	policy := internal.NewPolicy()
+	if *rbacFile != "" {
+		policy, err = internal.LoadPolicy(*rbacFile)
+		if err != nil {
+			log.Fatalf("Failed to load access policy: %v", err)
+		}
 	}
 
 	parsedAdminIDs, err := telegram.ParseAdminIDs(*adminIDs)
 	if err != nil {
 		log.Fatalf("Failed to parse admin IDs: %v", err)
 	}
+	for _, id := range parsedAdminIDs {
+		if err := policy.AddGrant(telegram.TelegramOperatorID(id), internal.Grant{Role: internal.RoleAdmin}); err != nil {
+			log.Fatalf("Failed to grant admin to %d: %v", id, err)
+		}
+	}
+
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatal("Both -tls-cert and -tls-key are required to enable TLS")
+	}
+	if *clientCA != "" && *tlsCert == "" {
+		log.Fatal("-client-ca requires -tls-cert and -tls-key")
+	}
+
+	inventory, err := internal.NewFileInventory(*inventoryFile)
+	if err != nil {
+		log.Fatalf("Failed to open inventory: %v", err)
+	}
+
+	queue, err := internal.NewFileQueue(*queueFile)
+	if err != nil {
+		log.Fatalf("Failed to open command queue: %v", err)
+	}
+
+	var auditKey []byte
+	if *auditKeyFile != "" {
+		auditKey, err = internal.LoadAuditKey(*auditKeyFile)
+		if err != nil {
+			log.Fatalf("Failed to read audit key: %v", err)
+		}
+	} else {
+		log.Printf("Warning: no -audit-key; anyone who can write %s can rewrite its chain undetected", *auditFile)
+	}
+
+	auditLog, err := internal.OpenAuditLog(*auditFile, auditKey)
+	if err != nil {
+		log.Fatalf("Failed to open audit log: %v", err)
+	}
 
-	srv := internal.NewServer()
+	opts := []internal.ServerOption{
+		internal.WithTokenStore(tokens),
+		internal.WithInventory(inventory),
+		internal.WithQueue(queue),
+		internal.WithPolicy(policy),
+		internal.WithAuditLog(auditLog),
+	}
+	if *clientCA != "" {
+		opts = append(opts, internal.WithClientCertAuth())
+	}
+	if *operatorToken != "" {
+		opts = append(opts, internal.WithOperatorToken(*operatorToken))
+	}
+	if *transferDir != "" {
+		opts = append(opts, internal.WithTransferDir(*transferDir))
+	}
+	if types := parseApproveTypes(*approveTypes); len(types) > 0 {
+		approvals, err := internal.NewFileApprovals(*approvalsFile)
+		if err != nil {
+			log.Fatalf("Failed to open approvals: %v", err)
+		}
+		opts = append(opts, internal.WithApprovals(types, *approvalTTL), internal.WithApprovalStore(approvals))
+		log.Printf("Operations held for a second operator's approval: %v", types)
+	}
+
+	srv := internal.NewServer(opts...)
 	go srv.Run()
 
-	bot, err := telegram.NewBot(*botToken, srv, parsedAdminIDs)
+	bot, err := telegram.NewBot(*botToken, srv)
 	if err != nil {
 		log.Fatalf("Failed to create Telegram bot: %v", err)
 	}
@@ -40,15 +150,70 @@ func main() {
 	go bot.Start()
 
 	http.HandleFunc("/ws", srv.HandleWebSocket)
+	if *operatorToken != "" || *rbacFile != "" {
+		http.HandleFunc("/shell", srv.HandleShell)
+		http.HandleFunc(internal.APIPrefix, srv.HandleAPI)
+		http.Handle(internal.DashboardPrefix, internal.DashboardHandler())
+		http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/" {
+				http.NotFound(w, r)
+				return
+			}
+			http.Redirect(w, r, internal.DashboardPrefix, http.StatusFound)
+		})
+	}
 	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
 	})
 
-	log.Printf("Server started on %s", *addr)
-	log.Printf("Telegram bot started with %d admin(s)", len(parsedAdminIDs))
+	log.Printf("Telegram bot started; access policy has %d operator(s)", len(policy.Operators))
+	log.Printf("Loaded %d enrollment token(s) from %s", len(tokens.List()), *tokensFile)
 
-	if err := http.ListenAndServe(*addr, nil); err != nil {
+	if *tlsCert == "" {
+		log.Printf("Server started on %s", *addr)
+		if err := http.ListenAndServe(*addr, nil); err != nil {
+			log.Fatalf("Server error: %v", err)
+		}
+		return
+	}
+
+	tlsConfig, err := internal.LoadServerTLS(*tlsCert, *tlsKey, *clientCA)
+	if err != nil {
+		log.Fatalf("Failed to configure TLS: %v", err)
+	}
+
+	httpServer := &http.Server{
+		Addr:      *addr,
+		TLSConfig: tlsConfig,
+	}
+
+	log.Printf("Server started on %s (TLS, mutual TLS: %t)", *addr, *clientCA != "")
+	if err := httpServer.ListenAndServeTLS("", ""); err != nil {
 		log.Fatalf("Server error: %v", err)
 	}
 }
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// parseApproveTypes reads the -approve list of operation types.
+func parseApproveTypes(list string) []protocol.MessageType {
+	var types []protocol.MessageType
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || name == "none" {
+			continue
+		}
+		t := protocol.MessageType(name)
+		if !internal.Approvable(t) {
+			log.Fatalf("Invalid -approve: %q cannot be held for approval", name)
+		}
+		types = append(types, t)
+	}
+	return types
+}
@@ -0,0 +1,151 @@
+// Command shell attaches the local terminal to an interactive shell on a
+// managed client, like ssh.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/E2klime/HAXinceL2/internal"
+	"github.com/E2klime/HAXinceL2/internal/protocol"
+	"github.com/gorilla/websocket"
+	"golang.org/x/term"
+)
+
+func main() {
+	serverURL := flag.String("server", os.Getenv("SHELL_SERVER_URL"), "Server shell endpoint (e.g., wss://server.com:8080/shell)")
+	token := flag.String("token", os.Getenv("OPERATOR_TOKEN"), "Operator bearer token")
+	clientID := flag.String("client", "", "ID of the client to attach to")
+	shell := flag.String("shell", "", "Shell to start on the client (default: the client's login shell)")
+	caFile := flag.String("ca", os.Getenv("SHELL_CA"), "Pin the server certificate to this CA bundle instead of system roots")
+	flag.Parse()
+
+	if *serverURL == "" || *clientID == "" {
+		log.Fatal("Server URL and client are required (use -server and -client)")
+	}
+
+	os.Exit(run(*serverURL, *token, *clientID, *shell, *caFile))
+}
+
+func run(serverURL, token, clientID, shell, caFile string) int {
+	stdinFd := int(os.Stdin.Fd())
+	interactive := term.IsTerminal(stdinFd)
+
+	cols, rows := 80, 24
+	if interactive {
+		if w, h, err := term.GetSize(stdinFd); err == nil {
+			cols, rows = w, h
+		}
+	}
+
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		log.Fatalf("Invalid server URL: %v", err)
+	}
+	query := u.Query()
+	query.Set("client", clientID)
+	query.Set("cols", strconv.Itoa(cols))
+	query.Set("rows", strconv.Itoa(rows))
+	if shell != "" {
+		query.Set("shell", shell)
+	}
+	u.RawQuery = query.Encode()
+
+	dialer := *websocket.DefaultDialer
+	if caFile != "" {
+		tlsConfig, err := internal.LoadClientTLS(caFile, "", "")
+		if err != nil {
+			log.Fatalf("Failed to configure TLS: %v", err)
+		}
+		dialer.TLSClientConfig = tlsConfig
+	}
+
+	header := http.Header{}
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+
+	conn, resp, err := dialer.Dial(u.String(), header)
+	if err != nil {
+		if resp != nil {
+			log.Fatalf("Failed to attach: %s", resp.Status)
+		}
+		log.Fatalf("Failed to attach: %v", err)
+	}
+	defer conn.Close()
+
+	if interactive {
+		state, err := term.MakeRaw(stdinFd)
+		if err != nil {
+			log.Fatalf("Failed to put terminal in raw mode: %v", err)
+		}
+		defer term.Restore(stdinFd, state)
+	}
+
+	var writeMutex sync.Mutex
+	write := func(frameType int, data []byte) error {
+		writeMutex.Lock()
+		defer writeMutex.Unlock()
+		return conn.WriteMessage(frameType, data)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if interactive {
+		go watchResize(ctx, stdinFd, func(cols, rows int) {
+			data, _ := json.Marshal(protocol.ShellControl{Type: protocol.ShellResize, Cols: cols, Rows: rows})
+			write(websocket.TextMessage, data)
+		})
+	}
+
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if n > 0 {
+				if werr := write(websocket.BinaryMessage, buf[:n]); werr != nil {
+					return
+				}
+			}
+			if err != nil {
+				// Stdin closed (e.g. piped input ran out): end the shell's input.
+				write(websocket.BinaryMessage, []byte{4})
+				return
+			}
+		}
+	}()
+
+	for {
+		frameType, data, err := conn.ReadMessage()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "\r\nConnection closed: %v\r\n", err)
+			return 1
+		}
+
+		switch frameType {
+		case websocket.BinaryMessage:
+			os.Stdout.Write(data)
+		case websocket.TextMessage:
+			var ctrl protocol.ShellControl
+			if json.Unmarshal(data, &ctrl) != nil || ctrl.Type != protocol.ShellExit {
+				continue
+			}
+			if ctrl.Reason != "" {
+				fmt.Fprintf(os.Stderr, "\r\nSession ended: %s\r\n", ctrl.Reason)
+			}
+			if ctrl.ExitCode < 0 {
+				return 1
+			}
+			return ctrl.ExitCode
+		}
+	}
+}
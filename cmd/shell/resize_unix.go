@@ -0,0 +1,29 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/term"
+)
+
+func watchResize(ctx context.Context, fd int, onResize func(cols, rows int)) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGWINCH)
+	defer signal.Stop(sigs)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigs:
+			if cols, rows, err := term.GetSize(fd); err == nil {
+				onResize(cols, rows)
+			}
+		}
+	}
+}
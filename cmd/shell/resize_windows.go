@@ -0,0 +1,32 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// Windows consoles have no SIGWINCH, so poll for size changes.
+func watchResize(ctx context.Context, fd int, onResize func(cols, rows int)) {
+	lastCols, lastRows, _ := term.GetSize(fd)
+
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			cols, rows, err := term.GetSize(fd)
+			if err != nil || (cols == lastCols && rows == lastRows) {
+				continue
+			}
+			lastCols, lastRows = cols, rows
+			onResize(cols, rows)
+		}
+	}
+}
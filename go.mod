@@ -3,11 +3,13 @@ module github.com/E2klime/HAXinceL2
 go 1.21
 
 require (
+	github.com/creack/pty v1.1.21
 	github.com/go-telegram-bot-api/telegram-bot-api/v5 v5.5.1
 	github.com/google/uuid v1.6.0
 	github.com/gorilla/websocket v1.5.1
 	github.com/kbinani/screenshot v0.0.0-20230812210009-b87d31814237
 	golang.org/x/sys v0.16.0
+	golang.org/x/term v0.15.0
 )
 
 require (
@@ -0,0 +1,472 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/E2klime/HAXinceL2/internal/protocol"
+)
+
+const (
+	// APIPrefix is where HandleAPI expects to be mounted.
+	APIPrefix = "/api/v1/"
+
+	// maxAPIBody bounds operation requests, which may carry file contents.
+	// Larger files belong in chunked transfers.
+	maxAPIBody = 64 << 20
+	// maxAPIWait caps how long a request may block waiting for a result.
+	maxAPIWait = 10 * time.Minute
+	// defaultAuditLimit is how many records an audit query returns unless
+	// it asks otherwise; limit=0 returns all.
+	defaultAuditLimit = 1000
+)
+
+var errAPINotFound = errors.New("not found")
+
+// apiOperations are the message types operators may submit through the API.
+// Handshake, shell session and transfer messages have their own flows.
+var apiOperations = map[protocol.MessageType]bool{
+	protocol.TypeCommand:      true,
+	protocol.TypeScreenshot:   true,
+	protocol.TypeWebcam:       true,
+	protocol.TypeShowImage:    true,
+	protocol.TypeFileRead:     true,
+	protocol.TypeFileWrite:    true,
+	protocol.TypeFileDelete:   true,
+	protocol.TypeFileList:     true,
+	protocol.TypeFileDownload: true,
+	protocol.TypeRegRead:      true,
+	protocol.TypeRegWrite:     true,
+	protocol.TypeRegDelete:    true,
+	protocol.TypeRegList:      true,
+}
+
+// ClientDetails is the API view of one client.
+type ClientDetails struct {
+	*ClientRecord
+	// Jobs lists what an online client is working on right now.
+	Jobs []protocol.JobInfo `json:"jobs"`
+	// Queue holds operations not yet answered by the client.
+	Queue []*QueueItem `json:"queue"`
+}
+
+// OperationRequest submits one protocol message to a client. The operation
+// is queued when the client is offline and its result kept as a job.
+type OperationRequest struct {
+	Type    protocol.MessageType `json:"type"`
+	Payload json.RawMessage      `json:"payload"`
+	// Binary carries file contents for file_write, base64-encoded.
+	Binary []byte `json:"binary,omitempty"`
+	// TTL is how many seconds an offline client has to pick the operation
+	// up; zero means DefaultQueueTTL.
+	TTL int `json:"ttl,omitempty"`
+	// Wait is how many seconds to wait for the result before answering
+	// with the job still pending.
+	Wait int `json:"wait,omitempty"`
+}
+
+// OperatorInfo describes the caller of GET /api/v1/me.
+type OperatorInfo struct {
+	ID          string       `json:"id"`
+	Grants      []Grant      `json:"grants"`
+	Permissions []Permission `json:"permissions"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// HandleAPI serves the operator REST API under APIPrefix:
+//
+//	GET    /api/v1/clients                    inventory, online and offline
+//	GET    /api/v1/clients/{id}               one client with its jobs and queue
+//	GET    /api/v1/clients/{id}/jobs          jobs running on the client
+//	POST   /api/v1/clients/{id}/operations    submit an OperationRequest
+//	GET    /api/v1/jobs?client={id}           submitted operations, without file data
+//	GET    /api/v1/jobs/{id}?wait={seconds}   one operation and its result
+//	DELETE /api/v1/jobs/{id}                  cancel an operation
+//	GET    /api/v1/events                     live Event stream (text/event-stream)
+//	GET    /api/v1/approvals?client={id}      operations held for a second operator
+//	GET    /api/v1/approvals/{id}             one held operation
+//	POST   /api/v1/approvals/{id}/approve     run a held operation
+//	POST   /api/v1/approvals/{id}/reject      drop a held operation
+//	GET    /api/v1/me                         the caller's operator ID and permissions
+//	GET    /api/v1/audit?client=&operator=&action=&status=&since=&until=&limit=
+//	                                          audit records, oldest first
+//
+// Requests authenticate with an operator bearer token and only see and act
+// on the clients the operator's roles cover. Operations that need a second
+// operator's approval are answered with 202 Accepted and the Approval; once
+// approved they run as the job with the same ID.
+func (s *Server) HandleAPI(w http.ResponseWriter, r *http.Request) {
+	op, ok := s.authenticateOperator(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeAPIError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, APIPrefix), "/")
+	parts := strings.Split(path, "/")
+
+	switch {
+	case path == "clients":
+		if allowMethods(w, r, http.MethodGet) {
+			s.apiListClients(w, op)
+		}
+	case len(parts) == 2 && parts[0] == "clients":
+		if allowMethods(w, r, http.MethodGet) {
+			s.apiGetClient(w, r, op, parts[1])
+		}
+	case len(parts) == 3 && parts[0] == "clients" && parts[2] == "jobs":
+		if allowMethods(w, r, http.MethodGet) {
+			s.apiClientJobs(w, r, op, parts[1])
+		}
+	case len(parts) == 3 && parts[0] == "clients" && parts[2] == "operations":
+		if allowMethods(w, r, http.MethodPost) {
+			s.apiSubmit(w, r, op, parts[1])
+		}
+	case path == "jobs":
+		if allowMethods(w, r, http.MethodGet) {
+			s.apiListJobs(w, r, op)
+		}
+	case len(parts) == 2 && parts[0] == "jobs":
+		if !allowMethods(w, r, http.MethodGet, http.MethodDelete) {
+			return
+		}
+		if r.Method == http.MethodDelete {
+			s.apiCancelJob(w, r, op, parts[1])
+		} else {
+			s.apiGetJob(w, r, op, parts[1])
+		}
+	case path == "events":
+		if allowMethods(w, r, http.MethodGet) {
+			s.serveEvents(w, r, op)
+		}
+	case path == "audit":
+		if allowMethods(w, r, http.MethodGet) {
+			s.apiAudit(w, r, op)
+		}
+	case path == "approvals":
+		if allowMethods(w, r, http.MethodGet) {
+			s.apiListApprovals(w, r, op)
+		}
+	case len(parts) == 2 && parts[0] == "approvals":
+		if allowMethods(w, r, http.MethodGet) {
+			s.apiGetApproval(w, op, parts[1])
+		}
+	case len(parts) == 3 && parts[0] == "approvals" && (parts[2] == "approve" || parts[2] == "reject"):
+		if allowMethods(w, r, http.MethodPost) {
+			s.apiDecideApproval(w, r, op, parts[1], parts[2] == "approve")
+		}
+	case path == "me":
+		if allowMethods(w, r, http.MethodGet) {
+			writeJSON(w, http.StatusOK, OperatorInfo{ID: op.ID, Grants: op.Grants(), Permissions: op.Permissions()})
+		}
+	default:
+		writeAPIError(w, http.StatusNotFound, errAPINotFound)
+	}
+}
+
+func (s *Server) apiListClients(w http.ResponseWriter, op *Operator) {
+	records, err := op.Inventory()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, records)
+}
+
+func (s *Server) apiGetClient(w http.ResponseWriter, r *http.Request, op *Operator, clientID string) {
+	rec, err := op.ClientRecord(clientID)
+	if err != nil {
+		writeAPIError(w, apiStatus(err), err)
+		return
+	}
+
+	details := ClientDetails{ClientRecord: rec, Jobs: []protocol.JobInfo{}, Queue: []*QueueItem{}}
+	if rec.Online && rec.Supports(protocol.TypeJobList) {
+		if jobs, err := op.Jobs(r.Context(), clientID); err == nil {
+			details.Jobs = jobs
+		} else {
+			log.Printf("API: failed to list jobs of client %s: %v", clientID, err)
+		}
+	}
+
+	items, err := op.QueueItems(clientID)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	for _, item := range items {
+		if !item.Done() {
+			details.Queue = append(details.Queue, item.summary())
+		}
+	}
+
+	writeJSON(w, http.StatusOK, details)
+}
+
+func (s *Server) apiClientJobs(w http.ResponseWriter, r *http.Request, op *Operator, clientID string) {
+	jobs, err := op.Jobs(r.Context(), clientID)
+	if err != nil {
+		writeAPIError(w, apiStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+func (s *Server) apiSubmit(w http.ResponseWriter, r *http.Request, op *Operator, clientID string) {
+	var req OperationRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIBody)).Decode(&req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Errorf("malformed request: %w", err))
+		return
+	}
+
+	msg, err := operationMessage(req)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	item, err := op.Enqueue(clientID, msg, time.Duration(req.TTL)*time.Second, "api")
+	var pending *PendingApprovalError
+	if errors.As(err, &pending) {
+		log.Printf("API: %s (%s) submitted %s %s for client %s, held for approval", op.ID, r.RemoteAddr, msg.Type, pending.Approval.ID, clientID)
+		writeJSON(w, http.StatusAccepted, pending.Approval)
+		return
+	}
+	if err != nil {
+		writeAPIError(w, apiStatus(err), err)
+		return
+	}
+	log.Printf("API: %s (%s) submitted %s %s for client %s", op.ID, r.RemoteAddr, msg.Type, item.ID, clientID)
+
+	s.writeJob(w, r, op, item.ID, time.Duration(req.Wait)*time.Second)
+}
+
+// operationMessage builds the message for req, validating its payload
+// against the schema.
+func operationMessage(req OperationRequest) (*protocol.Message, error) {
+	if !apiOperations[req.Type] {
+		return nil, fmt.Errorf("unsupported operation: %q", req.Type)
+	}
+	if len(req.Payload) == 0 {
+		req.Payload = json.RawMessage("{}")
+	}
+
+	msg := &protocol.Message{
+		Type:      req.Type,
+		Payload:   req.Payload,
+		Binary:    req.Binary,
+		Timestamp: time.Now().Unix(),
+	}
+
+	payload, _ := protocol.NewPayload(req.Type)
+	if err := msg.Decode(payload); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (s *Server) apiListJobs(w http.ResponseWriter, r *http.Request, op *Operator) {
+	items, err := op.QueueItems(r.URL.Query().Get("client"))
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// Results can hold whole files; GET /api/v1/jobs/{id} returns those.
+	summaries := make([]*QueueItem, len(items))
+	for i, item := range items {
+		summaries[i] = item.summary()
+	}
+	writeJSON(w, http.StatusOK, summaries)
+}
+
+func (s *Server) apiGetJob(w http.ResponseWriter, r *http.Request, op *Operator, id string) {
+	var wait int
+	if v := r.URL.Query().Get("wait"); v != "" {
+		var err error
+		if wait, err = strconv.Atoi(v); err != nil {
+			writeAPIError(w, http.StatusBadRequest, fmt.Errorf("invalid wait: %q", v))
+			return
+		}
+	}
+	s.writeJob(w, r, op, id, time.Duration(wait)*time.Second)
+}
+
+// writeJob answers with the queue item id, waiting up to wait for it to
+// finish. Finished jobs are 200 OK, pending ones 202 Accepted.
+func (s *Server) writeJob(w http.ResponseWriter, r *http.Request, op *Operator, id string, wait time.Duration) {
+	var item *QueueItem
+	var err error
+	if wait > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), min(wait, maxAPIWait))
+		defer cancel()
+		item, err = op.WaitQueued(ctx, id)
+	} else {
+		item, err = op.QueueItem(id)
+	}
+	if err != nil {
+		writeAPIError(w, apiStatus(err), err)
+		return
+	}
+
+	status := http.StatusOK
+	if !item.Done() {
+		status = http.StatusAccepted
+	}
+	writeJSON(w, status, item)
+}
+
+// apiCancelJob drops an operation still waiting in the queue, or asks the
+// client to stop it if it was already delivered.
+func (s *Server) apiCancelJob(w http.ResponseWriter, r *http.Request, op *Operator, id string) {
+	item, err := op.QueueItem(id)
+	if err != nil {
+		writeAPIError(w, apiStatus(err), err)
+		return
+	}
+
+	switch item.Status {
+	case QueueQueued:
+		item, err = op.CancelQueued(id)
+	case QueueSent:
+		err = op.StopJob(r.Context(), item.ClientID, item.ID)
+	default:
+		writeAPIError(w, http.StatusConflict, fmt.Errorf("job %s is already %s", id, item.Status))
+		return
+	}
+	if err != nil {
+		writeAPIError(w, apiStatus(err), err)
+		return
+	}
+
+	log.Printf("API: %s (%s) cancelled job %s", op.ID, r.RemoteAddr, id)
+	writeJSON(w, http.StatusOK, item)
+}
+
+func (s *Server) apiListApprovals(w http.ResponseWriter, r *http.Request, op *Operator) {
+	approvals := op.Approvals(r.URL.Query().Get("client"))
+	for i, a := range approvals {
+		approvals[i] = a.summary()
+	}
+	writeJSON(w, http.StatusOK, approvals)
+}
+
+func (s *Server) apiGetApproval(w http.ResponseWriter, op *Operator, id string) {
+	a, err := op.Approval(id)
+	if err != nil {
+		writeAPIError(w, apiStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, a)
+}
+
+func (s *Server) apiDecideApproval(w http.ResponseWriter, r *http.Request, op *Operator, id string, approve bool) {
+	var a *Approval
+	var err error
+	if approve {
+		a, err = op.Approve(id)
+	} else {
+		a, err = op.Reject(id)
+	}
+	if err != nil {
+		writeAPIError(w, apiStatus(err), err)
+		return
+	}
+
+	log.Printf("API: %s (%s) %s approval %s", op.ID, r.RemoteAddr, a.Status, id)
+	writeJSON(w, http.StatusOK, a)
+}
+
+// apiAudit answers an audit query. since and until are RFC 3339 times;
+// limit defaults to defaultAuditLimit.
+func (s *Server) apiAudit(w http.ResponseWriter, r *http.Request, op *Operator) {
+	query := r.URL.Query()
+	filter := AuditFilter{
+		Operator: query.Get("operator"),
+		ClientID: query.Get("client"),
+		Action:   query.Get("action"),
+		Status:   query.Get("status"),
+		Limit:    defaultAuditLimit,
+	}
+
+	for name, dst := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if v := query.Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				writeAPIError(w, http.StatusBadRequest, fmt.Errorf("invalid %s: %q", name, v))
+				return
+			}
+			*dst = t
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			writeAPIError(w, http.StatusBadRequest, fmt.Errorf("invalid limit: %q", v))
+			return
+		}
+		filter.Limit = limit
+	}
+
+	records, err := op.AuditRecords(filter)
+	if err != nil {
+		writeAPIError(w, apiStatus(err), err)
+		return
+	}
+	if records == nil {
+		records = []AuditRecord{}
+	}
+	writeJSON(w, http.StatusOK, records)
+}
+
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeAPIError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	return false
+}
+
+func apiStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrForbidden), errors.Is(err, ErrClientPolicy), errors.Is(err, ErrClientConsent):
+		return http.StatusForbidden
+	case errors.Is(err, ErrClientUnknown), errors.Is(err, ErrQueueNotFound), errors.Is(err, ErrApprovalNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, protocol.ErrInvalidPayload):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrUnsupported):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, ErrClientOffline), errors.Is(err, ErrApprovalDecided):
+		return http.StatusConflict
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, ErrClientDisconnected):
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("API: failed to write response: %v", err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, apiError{Error: err.Error()})
+}
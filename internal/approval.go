@@ -0,0 +1,456 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/E2klime/HAXinceL2/internal/protocol"
+	"github.com/google/uuid"
+)
+
+const (
+	DefaultApprovalTTL = time.Hour
+
+	approvalSweepInterval = 30 * time.Second
+	// Decided approvals are kept this long so requesters can look them up.
+	approvalRetention = 24 * time.Hour
+)
+
+type ApprovalStatus string
+
+const (
+	ApprovalPending  ApprovalStatus = "pending"
+	ApprovalApproved ApprovalStatus = "approved"
+	ApprovalRejected ApprovalStatus = "rejected"
+	ApprovalExpired  ApprovalStatus = "expired"
+)
+
+var (
+	ErrApprovalPending  = errors.New("held for approval by a second operator")
+	ErrApprovalNotFound = errors.New("approval not found")
+	ErrApprovalDecided  = errors.New("approval already decided")
+	ErrSelfApproval     = fmt.Errorf("%w: operators cannot approve their own requests", ErrForbidden)
+	// ErrApprovalRequired refuses interactive flows, which cannot wait for
+	// a second operator, while the operations they stand for need approval.
+	ErrApprovalRequired = fmt.Errorf("%w: needs a second operator's approval", ErrForbidden)
+)
+
+// PendingApprovalError is returned instead of running an operation that
+// needs a second operator's approval. It wraps ErrApprovalPending.
+type PendingApprovalError struct {
+	Approval *Approval
+}
+
+func (e *PendingApprovalError) Error() string {
+	return fmt.Sprintf("%v: %s on %s (approval %s, expires %s)", ErrApprovalPending,
+		e.Approval.Message.Type, e.Approval.ClientID, e.Approval.ID, e.Approval.ExpiresAt.Format(time.RFC3339))
+}
+
+func (e *PendingApprovalError) Unwrap() error {
+	return ErrApprovalPending
+}
+
+// Approval is an operation held until a second operator decides on it. Its
+// ID is the message RequestID, so once approved it runs as the queue item
+// with the same ID.
+type Approval struct {
+	ID       string            `json:"id"`
+	ClientID string            `json:"client_id"`
+	Operator string            `json:"operator"`
+	Origin   string            `json:"origin,omitempty"`
+	Message  *protocol.Message `json:"message"`
+	Status   ApprovalStatus    `json:"status"`
+	// TTL is the queue TTL the operation was submitted with.
+	TTL       time.Duration `json:"ttl,omitempty"`
+	CreatedAt time.Time     `json:"created_at"`
+	ExpiresAt time.Time     `json:"expires_at"`
+	DecidedBy string        `json:"decided_by,omitempty"`
+	DecidedAt time.Time     `json:"decided_at,omitempty"`
+	// Error is why an approved operation could not be queued.
+	Error string `json:"error,omitempty"`
+}
+
+// summary returns a snapshot of a without the raw bytes of its message.
+func (a *Approval) summary() *Approval {
+	cp := *a
+	cp.Message = withoutBinary(a.Message)
+	return &cp
+}
+
+// ApprovalStore persists approvals so held operations survive a restart.
+// Implementations must be safe for concurrent use.
+type ApprovalStore interface {
+	List() ([]*Approval, error)
+	Put(a *Approval) error
+	Delete(id string) error
+}
+
+// FileApprovals is an ApprovalStore that rewrites a JSON file on every
+// change. There are rarely more than a handful of approvals, so unlike
+// FileQueue it keeps message bytes inline.
+type FileApprovals struct {
+	mutex     sync.Mutex
+	path      string
+	approvals map[string]*Approval
+}
+
+func NewFileApprovals(path string) (*FileApprovals, error) {
+	f := &FileApprovals{
+		path:      path,
+		approvals: make(map[string]*Approval),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read approvals: %w", err)
+	}
+
+	var list []*Approval
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse approvals %s: %w", path, err)
+	}
+	for _, a := range list {
+		f.approvals[a.ID] = a
+	}
+	return f, nil
+}
+
+func (f *FileApprovals) List() ([]*Approval, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	list := make([]*Approval, 0, len(f.approvals))
+	for _, a := range f.approvals {
+		cp := *a
+		list = append(list, &cp)
+	}
+	return list, nil
+}
+
+func (f *FileApprovals) Put(a *Approval) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	cp := *a
+	f.approvals[a.ID] = &cp
+	return f.save()
+}
+
+func (f *FileApprovals) Delete(id string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	delete(f.approvals, id)
+	return f.save()
+}
+
+// save writes every approval to disk. Callers hold f.mutex.
+func (f *FileApprovals) save() error {
+	list := make([]*Approval, 0, len(f.approvals))
+	for _, a := range f.approvals {
+		list = append(list, a)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(f.path, data, 0600)
+}
+
+// WithApprovalStore persists approvals in store, so operations held when
+// the server stops can still be decided after it restarts.
+func WithApprovalStore(store ApprovalStore) ServerOption {
+	return func(s *Server) {
+		s.approvalStore = store
+	}
+}
+
+// loadApprovals restores the approvals kept in the approval store. Pending
+// ones that expired while the server was down are expired by the first sweep.
+func (s *Server) loadApprovals() {
+	if s.approvalStore == nil {
+		return
+	}
+
+	list, err := s.approvalStore.List()
+	if err != nil {
+		log.Printf("Failed to load approvals: %v", err)
+		return
+	}
+	for _, a := range list {
+		s.approvals[a.ID] = a
+	}
+}
+
+// WithApprovals holds operations of the given types until a second operator
+// approves them. Pending approvals expire after ttl (DefaultApprovalTTL
+// when zero).
+func WithApprovals(types []protocol.MessageType, ttl time.Duration) ServerOption {
+	return func(s *Server) {
+		if ttl <= 0 {
+			ttl = DefaultApprovalTTL
+		}
+		s.approvalTypes = make(map[protocol.MessageType]bool)
+		for _, t := range types {
+			s.approvalTypes[t] = true
+		}
+		s.approvalTTL = ttl
+	}
+}
+
+// Approvable reports whether operations of msgType can be held for a second
+// operator. Only the operations submitted as single messages can; shells
+// and transfers are refused instead while what they stand for needs
+// approval.
+func Approvable(msgType protocol.MessageType) bool {
+	return apiOperations[msgType]
+}
+
+// RequiresApproval reports whether operations of msgType are held for a
+// second operator.
+func (s *Server) RequiresApproval(msgType protocol.MessageType) bool {
+	return s.approvalTypes[msgType]
+}
+
+// OnApprovalUpdate registers fn to be called whenever an approval is
+// created or decided. fn runs on server goroutines and must not block.
+func (s *Server) OnApprovalUpdate(fn func(a *Approval)) {
+	s.approvalsMutex.Lock()
+	s.approvalListeners = append(s.approvalListeners, fn)
+	s.approvalsMutex.Unlock()
+}
+
+// listApprovals lists the approvals of clientID, or of all clients when it is
+// empty, oldest first.
+func (s *Server) listApprovals(clientID string) []*Approval {
+	s.approvalsMutex.Lock()
+	defer s.approvalsMutex.Unlock()
+
+	list := make([]*Approval, 0)
+	for _, a := range s.approvals {
+		if clientID == "" || a.ClientID == clientID {
+			cp := *a
+			list = append(list, &cp)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+	return list
+}
+
+func (s *Server) lookupApproval(id string) (*Approval, error) {
+	s.approvalsMutex.Lock()
+	defer s.approvalsMutex.Unlock()
+
+	a, ok := s.approvals[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrApprovalNotFound, id)
+	}
+	cp := *a
+	return &cp, nil
+}
+
+// hold stores msg as a pending approval instead of sending it.
+func (s *Server) hold(clientID string, msg *protocol.Message, ttl time.Duration, origin, operator string) (*Approval, error) {
+	if err := s.checkOperation(clientID, msg.Type); err != nil {
+		return nil, err
+	}
+	if msg.RequestID == "" {
+		msg.RequestID = uuid.New().String()
+	}
+
+	now := time.Now()
+	a := &Approval{
+		ID:        msg.RequestID,
+		ClientID:  clientID,
+		Operator:  operator,
+		Origin:    origin,
+		Message:   msg,
+		Status:    ApprovalPending,
+		TTL:       ttl,
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.approvalTTL),
+	}
+
+	s.approvalsMutex.Lock()
+	if _, exists := s.approvals[a.ID]; exists {
+		s.approvalsMutex.Unlock()
+		return nil, fmt.Errorf("duplicate request id: %s", a.ID)
+	}
+	s.approvals[a.ID] = a
+	s.storeApproval(a)
+	cp := *a
+	s.approvalsMutex.Unlock()
+
+	s.notifyApprovals(&cp)
+	log.Printf("Holding %s %s for client %s until a second operator approves (requested by %s)", msg.Type, a.ID, clientID, operator)
+	return a, nil
+}
+
+// decide approves or rejects a pending approval on behalf of operator. An
+// approved operation is queued as if its requester had just submitted it,
+// provided the requester is still allowed to run it.
+func (s *Server) decide(id, operator string, approve bool) (*Approval, error) {
+	s.approvalsMutex.Lock()
+	a, ok := s.approvals[id]
+	switch {
+	case !ok:
+		s.approvalsMutex.Unlock()
+		return nil, fmt.Errorf("%w: %s", ErrApprovalNotFound, id)
+	case a.Status == ApprovalPending && time.Now().After(a.ExpiresAt):
+		expired := s.expireApproval(a, time.Now())
+		s.approvalsMutex.Unlock()
+		s.notifyExpired(expired)
+		return nil, fmt.Errorf("%w: %s is %s", ErrApprovalDecided, id, expired.Status)
+	case a.Status != ApprovalPending:
+		s.approvalsMutex.Unlock()
+		return nil, fmt.Errorf("%w: %s is %s", ErrApprovalDecided, id, a.Status)
+	case a.Operator == operator:
+		s.approvalsMutex.Unlock()
+		return nil, fmt.Errorf("%w: %s requested %s", ErrSelfApproval, operator, id)
+	}
+
+	// Deciding under the lock is what keeps a second approval from queueing
+	// the operation again; queueing it can wait until the lock is released.
+	a.DecidedBy = operator
+	a.DecidedAt = time.Now()
+	a.Status = ApprovalRejected
+	if approve {
+		a.Status = ApprovalApproved
+	}
+	s.storeApproval(a)
+	cp := *a
+	s.approvalsMutex.Unlock()
+
+	if approve {
+		if err := s.runApproved(&cp); err != nil {
+			cp.Error = err.Error()
+			s.approvalsMutex.Lock()
+			a.Error = cp.Error
+			s.storeApproval(a)
+			s.approvalsMutex.Unlock()
+		}
+	}
+
+	s.notifyApprovals(&cp)
+	log.Printf("Approval %s (%s for client %s) %s by %s", id, cp.Message.Type, cp.ClientID, cp.Status, operator)
+	return &cp, nil
+}
+
+// runApproved queues an approved operation. Its requester's permissions are
+// checked again first: they may have been revoked while it was held.
+func (s *Server) runApproved(a *Approval) error {
+	requester, err := s.Operator(a.Operator)
+	if err != nil {
+		return err
+	}
+	if err := requester.Authorize(OperationPermission(a.Message.Type), a.ClientID); err != nil {
+		return err
+	}
+
+	_, err = s.enqueue(a.ClientID, a.Message, a.TTL, a.Origin, a.Operator)
+	return err
+}
+
+func (s *Server) runApprovalSweeper() {
+	ticker := time.NewTicker(approvalSweepInterval)
+	defer ticker.Stop()
+
+	// Approvals restored from the store may have expired while the server
+	// was down.
+	s.sweepApprovals()
+	for range ticker.C {
+		s.sweepApprovals()
+	}
+}
+
+// sweepApprovals expires pending approvals and prunes old decided ones.
+func (s *Server) sweepApprovals() {
+	s.approvalsMutex.Lock()
+	var expired []*Approval
+	now := time.Now()
+	for id, a := range s.approvals {
+		switch {
+		case a.Status == ApprovalPending && now.After(a.ExpiresAt):
+			expired = append(expired, s.expireApproval(a, now))
+		case a.Status != ApprovalPending && now.Sub(a.DecidedAt) > approvalRetention:
+			delete(s.approvals, id)
+			if s.approvalStore != nil {
+				if err := s.approvalStore.Delete(id); err != nil {
+					log.Printf("Failed to delete approval %s: %v", id, err)
+				}
+			}
+		}
+	}
+	s.approvalsMutex.Unlock()
+
+	s.notifyExpired(expired...)
+}
+
+// expireApproval marks a as expired and returns a snapshot of it for
+// notifyExpired. Callers hold approvalsMutex.
+func (s *Server) expireApproval(a *Approval, now time.Time) *Approval {
+	a.Status = ApprovalExpired
+	a.DecidedAt = now
+	s.storeApproval(a)
+	cp := *a
+	return &cp
+}
+
+// notifyExpired audits and announces approvals expireApproval expired.
+// Callers must not hold approvalsMutex.
+func (s *Server) notifyExpired(expired ...*Approval) {
+	for _, a := range expired {
+		s.audit(AuditRecord{
+			Operator:   a.Operator,
+			ClientID:   a.ClientID,
+			Action:     "approval.expire",
+			RequestID:  a.ID,
+			Summary:    auditSummary(a.Message),
+			Status:     AuditExpired,
+			DurationMS: a.DecidedAt.Sub(a.CreatedAt).Milliseconds(),
+		})
+		log.Printf("Approval %s (%s for client %s) expired", a.ID, a.Message.Type, a.ClientID)
+	}
+	s.notifyApprovals(expired...)
+}
+
+// storeApproval persists a change to a. Callers hold approvalsMutex.
+func (s *Server) storeApproval(a *Approval) {
+	if s.approvalStore == nil {
+		return
+	}
+	if err := s.approvalStore.Put(a); err != nil {
+		log.Printf("Failed to store approval %s: %v", a.ID, err)
+	}
+}
+
+// notifyApprovals tells listeners and event subscribers about changed
+// approvals. Callers must not hold approvalsMutex.
+func (s *Server) notifyApprovals(approvals ...*Approval) {
+	s.approvalsMutex.Lock()
+	listeners := s.approvalListeners
+	s.approvalsMutex.Unlock()
+
+	for _, a := range approvals {
+		for _, fn := range listeners {
+			cp := *a
+			fn(&cp)
+		}
+		s.publish(Event{Type: EventApproval, Data: a.summary()})
+	}
+}
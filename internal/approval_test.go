@@ -0,0 +1,228 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/E2klime/HAXinceL2/internal/protocol"
+)
+
+func newApprovalServer(t *testing.T, opts ...ServerOption) *Server {
+	t.Helper()
+
+	policy := NewPolicy()
+	policy.Operators = []OperatorPolicy{
+		{ID: "api:alice", Grants: []Grant{{Role: RoleAdmin}}},
+		{ID: "api:bob", Grants: []Grant{{Role: RoleAdmin}}},
+	}
+
+	inventory := NewMemoryInventory()
+	if err := inventory.Put(&ClientRecord{ID: "c1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	opts = append([]ServerOption{
+		WithPolicy(policy),
+		WithInventory(inventory),
+		WithApprovals([]protocol.MessageType{protocol.TypeFileDelete}, time.Hour),
+	}, opts...)
+	return NewServer(opts...)
+}
+
+func holdDelete(t *testing.T, s *Server, operator string) *Approval {
+	t.Helper()
+
+	msg := protocol.NewFileDelete(protocol.FileDeletePayload{Path: "/tmp/x"})
+	a, err := s.hold("c1", msg, 0, "", operator)
+	if err != nil {
+		t.Fatalf("hold: %v", err)
+	}
+	return a
+}
+
+func TestDecide(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(t *testing.T, s *Server, a *Approval)
+		decider string
+		approve bool
+		// wantErr is nil when the decision should go through.
+		wantErr    error
+		wantStatus ApprovalStatus
+		wantQueued bool
+		// wantError is whether the decided approval records a failure.
+		wantError bool
+	}{
+		{
+			name:       "approve",
+			decider:    "api:bob",
+			approve:    true,
+			wantStatus: ApprovalApproved,
+			wantQueued: true,
+		},
+		{
+			name:       "reject",
+			decider:    "api:bob",
+			wantStatus: ApprovalRejected,
+		},
+		{
+			name:       "self approval",
+			decider:    "api:alice",
+			approve:    true,
+			wantErr:    ErrSelfApproval,
+			wantStatus: ApprovalPending,
+		},
+		{
+			name:    "expired",
+			decider: "api:bob",
+			approve: true,
+			setup: func(t *testing.T, s *Server, a *Approval) {
+				s.approvals[a.ID].ExpiresAt = time.Now().Add(-time.Minute)
+			},
+			wantErr:    ErrApprovalDecided,
+			wantStatus: ApprovalExpired,
+		},
+		{
+			name:    "already decided",
+			decider: "api:bob",
+			approve: true,
+			setup: func(t *testing.T, s *Server, a *Approval) {
+				if _, err := s.decide(a.ID, "api:bob", false); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr:    ErrApprovalDecided,
+			wantStatus: ApprovalRejected,
+		},
+		{
+			name:    "requester lost permission",
+			decider: "api:bob",
+			approve: true,
+			setup: func(t *testing.T, s *Server, a *Approval) {
+				s.policy.Operators[0].Grants = []Grant{{Role: RoleViewer}}
+			},
+			wantStatus: ApprovalApproved,
+			wantError:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newApprovalServer(t)
+			a := holdDelete(t, s, "api:alice")
+			if tt.setup != nil {
+				tt.setup(t, s, a)
+			}
+
+			decided, err := s.decide(a.ID, tt.decider, tt.approve)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("decide: got error %v, want %v", err, tt.wantErr)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("decide: %v", err)
+				}
+				if got := decided.Error != ""; got != tt.wantError {
+					t.Errorf("decided approval error = %q, want error: %v", decided.Error, tt.wantError)
+				}
+			}
+
+			stored, err := s.lookupApproval(a.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.Status != tt.wantStatus {
+				t.Errorf("status = %s, want %s", stored.Status, tt.wantStatus)
+			}
+
+			_, err = s.lookupQueueItem(a.ID)
+			if queued := err == nil; queued != tt.wantQueued {
+				t.Errorf("queued = %v, want %v", queued, tt.wantQueued)
+			}
+		})
+	}
+}
+
+func TestDecideUnknownApproval(t *testing.T) {
+	s := newApprovalServer(t)
+	if _, err := s.decide("missing", "api:bob", true); !errors.Is(err, ErrApprovalNotFound) {
+		t.Fatalf("got error %v, want %v", err, ErrApprovalNotFound)
+	}
+}
+
+func TestApprovalsSurviveRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "approvals.json")
+
+	store, err := NewFileApprovals(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending := holdDelete(t, newApprovalServer(t, WithApprovalStore(store)), "api:alice")
+
+	store, err = NewFileApprovals(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newApprovalServer(t, WithApprovalStore(store))
+
+	decided, err := s.decide(pending.ID, "api:bob", true)
+	if err != nil {
+		t.Fatalf("decide after restart: %v", err)
+	}
+	if decided.Status != ApprovalApproved || decided.Error != "" {
+		t.Fatalf("got %s (%q), want approved", decided.Status, decided.Error)
+	}
+	if item, err := s.lookupQueueItem(pending.ID); err != nil || item.Message.Type != protocol.TypeFileDelete {
+		t.Fatalf("approved operation not queued: %v", err)
+	}
+}
+
+func TestHeldFlowsAreRefused(t *testing.T) {
+	tests := []struct {
+		name string
+		held protocol.MessageType
+		run  func(op *Operator) error
+	}{
+		{
+			name: "download while reads are held",
+			held: protocol.TypeFileRead,
+			run: func(op *Operator) error {
+				_, err := op.StartDownload("c1", "/etc/passwd", "")
+				return err
+			},
+		},
+		{
+			name: "upload while writes are held",
+			held: protocol.TypeFileWrite,
+			run: func(op *Operator) error {
+				_, err := op.StartUpload("c1", "/tmp/x", "/tmp/x", 0644, "")
+				return err
+			},
+		},
+		{
+			name: "shell while commands are held",
+			held: protocol.TypeCommand,
+			run: func(op *Operator) error {
+				_, err := op.OpenSession(context.Background(), "c1", "", 80, 24)
+				return err
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newApprovalServer(t, WithApprovals([]protocol.MessageType{tt.held}, time.Hour))
+			op, err := s.Operator("api:alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.run(op); !errors.Is(err, ErrApprovalRequired) {
+				t.Fatalf("got error %v, want %v", err, ErrApprovalRequired)
+			}
+		})
+	}
+}
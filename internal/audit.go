@@ -0,0 +1,485 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/E2klime/HAXinceL2/internal/protocol"
+)
+
+// Audit record statuses.
+const (
+	AuditOK        = "ok"
+	AuditFailed    = "failed"
+	AuditDenied    = "denied"
+	AuditQueued    = "queued"
+	AuditPending   = "pending"
+	AuditStarted   = "started"
+	AuditExpired   = "expired"
+	AuditCancelled = "cancelled"
+)
+
+// maxAuditSummary bounds the payload excerpt kept per record; file contents
+// and long scripts are cut.
+const maxAuditSummary = 512
+
+var ErrAuditChain = errors.New("audit chain broken")
+
+// minAuditKey is the shortest audit key accepted, in bytes.
+const minAuditKey = 16
+
+// AuditRecord is one line of the audit log. Each record carries the hash of
+// the previous one, so editing, removing or reordering lines breaks the
+// chain from that point on. With a key the hashes are HMACs, which nobody
+// without the key can recompute after editing the log.
+type AuditRecord struct {
+	Seq       uint64    `json:"seq"`
+	Time      time.Time `json:"time"`
+	Operator  string    `json:"operator,omitempty"`
+	ClientID  string    `json:"client_id,omitempty"`
+	Action    string    `json:"action"`
+	RequestID string    `json:"request_id,omitempty"`
+	Summary   string    `json:"summary,omitempty"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	// DurationMS is how long the action took, for those that finished.
+	DurationMS int64  `json:"duration_ms,omitempty"`
+	PrevHash   string `json:"prev_hash"`
+	Hash       string `json:"hash"`
+}
+
+// computeHash returns the hex HMAC-SHA256 under key, or the plain SHA-256
+// without one, of the record's JSON encoding with Hash left empty.
+func (r AuditRecord) computeHash(key []byte) string {
+	r.Hash = ""
+	data, _ := json.Marshal(r)
+	if len(key) == 0 {
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// GenerateAuditKey writes a new random audit key to path. Keep it away from
+// the log, where whoever can rewrite the log cannot read it.
+func GenerateAuditKey(path string) error {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(f, hex.EncodeToString(key)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// LoadAuditKey reads a key written by GenerateAuditKey, or any file holding
+// at least 16 bytes of secret.
+func LoadAuditKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key := bytes.TrimSpace(data)
+	if len(key) < minAuditKey {
+		return nil, fmt.Errorf("audit key %s is shorter than %d bytes", path, minAuditKey)
+	}
+	return key, nil
+}
+
+// AuditLog appends hash-chained records to a JSON lines file. The file is
+// only ever appended to; rotate it by moving it away while the server is
+// stopped, which starts a new chain.
+type AuditLog struct {
+	path string
+	key  []byte
+
+	mutex sync.Mutex
+	file  *os.File
+	seq   uint64
+	last  string
+}
+
+// OpenAuditLog opens or creates the log at path and continues its chain,
+// hashing new records with key (see AuditRecord). A partial last line, left
+// by a crash in the middle of an append, is moved to a ".torn" file next to
+// the log and the recovery is itself recorded.
+func OpenAuditLog(path string, key []byte) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &AuditLog{path: path, key: key, file: f}
+	torn, err := a.resume()
+	if err == nil && torn != nil {
+		err = a.quarantine(torn)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	return a, nil
+}
+
+// tornLine is an unparsable last line of the log.
+type tornLine struct {
+	line   int
+	offset int64
+	data   []byte
+	err    error
+}
+
+// resume reads the existing records to continue the chain. An unparsable
+// line is only tolerated at the end of the file, where an interrupted append
+// leaves it; it is returned for quarantine.
+func (a *AuditLog) resume() (*tornLine, error) {
+	var (
+		torn   *tornLine
+		offset int64
+		line   int
+	)
+
+	r := bufio.NewReaderSize(a.file, 64<<10)
+	for {
+		data, err := r.ReadBytes('\n')
+		if len(data) > 0 {
+			line++
+			if len(bytes.TrimSpace(data)) > 0 {
+				if torn != nil {
+					return nil, fmt.Errorf("line %d: %w", torn.line, torn.err)
+				}
+				var rec AuditRecord
+				if jsonErr := json.Unmarshal(data, &rec); jsonErr != nil {
+					torn = &tornLine{line: line, offset: offset, data: data, err: jsonErr}
+				} else {
+					a.seq = rec.Seq
+					a.last = rec.Hash
+				}
+			}
+			offset += int64(len(data))
+		}
+		if errors.Is(err, io.EOF) {
+			return torn, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// quarantine moves a torn last line out of the log and records that it did.
+func (a *AuditLog) quarantine(torn *tornLine) error {
+	saved := a.path + ".torn"
+	f, err := os.OpenFile(saved, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(torn.data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("save partial record to %s: %w", saved, err)
+	}
+
+	if err := a.file.Truncate(torn.offset); err != nil {
+		return err
+	}
+	if err := a.file.Sync(); err != nil {
+		return err
+	}
+
+	log.Printf("Audit log %s ended in a partial record at line %d; moved %d bytes to %s", a.path, torn.line, len(torn.data), saved)
+	return a.Append(AuditRecord{
+		Action:  "audit.recover",
+		Summary: fmt.Sprintf("partial record at line %d (%d bytes) moved to %s", torn.line, len(torn.data), saved),
+		Status:  AuditFailed,
+	})
+}
+
+func (a *AuditLog) Path() string {
+	return a.path
+}
+
+// Append links rec to the chain and writes it through to disk. Seq, Time (if
+// zero), PrevHash and Hash are filled in.
+func (a *AuditLog) Append(rec AuditRecord) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+	rec.Time = rec.Time.UTC()
+	rec.Seq = a.seq + 1
+	rec.PrevHash = a.last
+	rec.Hash = rec.computeHash(a.key)
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := a.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err := a.file.Sync(); err != nil {
+		return err
+	}
+
+	a.seq = rec.Seq
+	a.last = rec.Hash
+	return nil
+}
+
+func (a *AuditLog) Close() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.file.Close()
+}
+
+// ReadAudit calls fn for every record in r, in order.
+func ReadAudit(r io.Reader, fn func(AuditRecord) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 16<<20)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var rec AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// VerifyAudit checks the chain in r against key, which must be the one the
+// log was written with, and returns the number of records it holds. Any edited, inserted, removed or reordered record is reported as an
+// error wrapping ErrAuditChain that names the first bad record. Records cut
+// from the end leave a valid chain; compare the last hash with one noted
+// earlier to detect that.
+func VerifyAudit(r io.Reader, key []byte) (int, error) {
+	var (
+		n    int
+		seq  uint64
+		prev string
+	)
+
+	err := ReadAudit(r, func(rec AuditRecord) error {
+		n++
+		switch {
+		case n == 1 && (rec.Seq != 1 || rec.PrevHash != ""):
+			return fmt.Errorf("%w: log starts at record %d, earlier records are missing", ErrAuditChain, rec.Seq)
+		case n > 1 && rec.Seq != seq+1:
+			return fmt.Errorf("%w: record %d follows %d, %d record(s) missing or reordered", ErrAuditChain, rec.Seq, seq, int64(rec.Seq)-int64(seq)-1)
+		case n > 1 && rec.PrevHash != prev:
+			return fmt.Errorf("%w: record %d does not follow record %d", ErrAuditChain, rec.Seq, seq)
+		case !hmac.Equal([]byte(rec.Hash), []byte(rec.computeHash(key))):
+			return fmt.Errorf("%w: record %d was modified", ErrAuditChain, rec.Seq)
+		}
+		seq = rec.Seq
+		prev = rec.Hash
+		return nil
+	})
+	return n, err
+}
+
+// AuditFilter selects audit records. Zero fields match everything.
+type AuditFilter struct {
+	Operator string
+	ClientID string
+	Action   string
+	Status   string
+	Since    time.Time
+	Until    time.Time
+	// Limit keeps only the most recent matches.
+	Limit int
+}
+
+func (f AuditFilter) Match(rec AuditRecord) bool {
+	return (f.Operator == "" || rec.Operator == f.Operator) &&
+		(f.ClientID == "" || rec.ClientID == f.ClientID) &&
+		(f.Action == "" || rec.Action == f.Action) &&
+		(f.Status == "" || rec.Status == f.Status) &&
+		(f.Since.IsZero() || !rec.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || rec.Time.Before(f.Until))
+}
+
+// QueryAudit returns the records of the log at path that match f, oldest
+// first.
+func QueryAudit(path string, f AuditFilter) ([]AuditRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []AuditRecord
+	err = ReadAudit(file, func(rec AuditRecord) error {
+		if f.Match(rec) {
+			records = append(records, rec)
+			if f.Limit > 0 && len(records) > 2*f.Limit {
+				records = append(records[:0], records[len(records)-f.Limit:]...)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if f.Limit > 0 && len(records) > f.Limit {
+		records = records[len(records)-f.Limit:]
+	}
+	return records, nil
+}
+
+// WithAuditLog records operator actions and client results in a.
+func WithAuditLog(a *AuditLog) ServerOption {
+	return func(s *Server) {
+		s.auditLog = a
+	}
+}
+
+func (s *Server) audit(rec AuditRecord) {
+	if s.auditLog == nil {
+		return
+	}
+	if err := s.auditLog.Append(rec); err != nil {
+		log.Printf("Failed to write audit record for %s on %s: %v", rec.Action, rec.ClientID, err)
+	}
+}
+
+// auditRecords queries the server's audit log.
+func (s *Server) auditRecords(f AuditFilter) ([]AuditRecord, error) {
+	if s.auditLog == nil {
+		return nil, errors.New("audit log is not configured")
+	}
+	return QueryAudit(s.auditLog.Path(), f)
+}
+
+// auditQueueItem records the outcome of a finished queue item.
+func (s *Server) auditQueueItem(item *QueueItem) {
+	rec := AuditRecord{
+		Operator:   item.Operator,
+		ClientID:   item.ClientID,
+		Action:     string(item.Message.Type),
+		RequestID:  item.ID,
+		Summary:    auditSummary(item.Message),
+		DurationMS: item.CompletedAt.Sub(item.CreatedAt).Milliseconds(),
+	}
+
+	switch item.Status {
+	case QueueExpired:
+		rec.Status = AuditExpired
+	case QueueCancelled:
+		rec.Status = AuditCancelled
+	default:
+		rec.Status, rec.Error = resultStatus(item.Result, nil)
+	}
+	s.audit(rec)
+}
+
+// auditTransfer records a transfer that completed, failed or was cancelled.
+func (s *Server) auditTransfer(t *Transfer) {
+	rec := AuditRecord{
+		Operator:   t.Operator,
+		ClientID:   t.ClientID,
+		Action:     transferAction(t.Direction),
+		RequestID:  t.ID,
+		Summary:    fmt.Sprintf("%s (%d bytes, sha256 %s)", t.RemotePath, t.Size, t.SHA256),
+		Error:      t.Error,
+		DurationMS: t.UpdatedAt.Sub(t.CreatedAt).Milliseconds(),
+	}
+
+	switch t.Status {
+	case TransferCompleted:
+		rec.Status = AuditOK
+	case TransferCancelled:
+		rec.Status = AuditCancelled
+	default:
+		rec.Status = AuditFailed
+	}
+	s.audit(rec)
+}
+
+func transferAction(direction string) string {
+	if direction == protocol.TransferUpload {
+		return string(protocol.TypeFileWrite)
+	}
+	return string(protocol.TypeFileDownload)
+}
+
+// resultStatus classifies the reply to an operation.
+func resultStatus(resp *protocol.Message, err error) (string, string) {
+	if err == nil && resp != nil {
+		_, err = replyData(resp)
+	}
+	switch {
+	case errors.Is(err, ErrForbidden), errors.Is(err, ErrClientPolicy), errors.Is(err, ErrClientConsent):
+		return AuditDenied, err.Error()
+	case err != nil:
+		return AuditFailed, err.Error()
+	case resp == nil:
+		return AuditFailed, "no result"
+	}
+	return AuditOK, ""
+}
+
+// auditSummary is a bounded excerpt of a message's payload.
+func auditSummary(msg *protocol.Message) string {
+	if msg == nil {
+		return ""
+	}
+
+	var compact bytes.Buffer
+	if json.Compact(&compact, msg.Payload) != nil {
+		compact.Reset()
+		compact.Write(msg.Payload)
+	}
+	summary := truncateUTF8(compact.String(), maxAuditSummary)
+	if len(msg.Binary) > 0 {
+		summary += fmt.Sprintf(" +%d bytes", len(msg.Binary))
+	}
+	return summary
+}
+
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	s = s[:n]
+	for !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return strings.TrimSpace(s) + "…"
+}
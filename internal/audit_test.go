@@ -0,0 +1,207 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testAuditKey = []byte("0123456789abcdef0123456789abcdef")
+
+// writeAudit appends n records to a new log and returns its lines.
+func writeAudit(t *testing.T, n int, key []byte) []string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	a, err := OpenAuditLog(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		err := a.Append(AuditRecord{
+			Operator: "api:alice",
+			ClientID: "c1",
+			Action:   "command",
+			Summary:  fmt.Sprintf(`{"command":"echo %d"}`, i),
+			Status:   AuditOK,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+// rehash re-signs an edited record with key, as someone covering their
+// tracks would.
+func rehash(t *testing.T, line string, key []byte, edit func(*AuditRecord)) string {
+	t.Helper()
+
+	var rec AuditRecord
+	if err := json.Unmarshal([]byte(line), &rec); err != nil {
+		t.Fatal(err)
+	}
+	edit(&rec)
+	rec.Hash = rec.computeHash(key)
+	data, _ := json.Marshal(rec)
+	return string(data)
+}
+
+func TestVerifyAudit(t *testing.T) {
+	tests := []struct {
+		name string
+		// tamper changes the lines of a five record log.
+		tamper    func(t *testing.T, lines []string) []string
+		verifyKey []byte
+		wantN     int
+		wantErr   bool
+	}{
+		{
+			name:      "intact",
+			tamper:    func(t *testing.T, lines []string) []string { return lines },
+			verifyKey: testAuditKey,
+			wantN:     5,
+		},
+		{
+			name: "edited summary",
+			tamper: func(t *testing.T, lines []string) []string {
+				lines[2] = strings.Replace(lines[2], "echo 2", "echo X", 1)
+				return lines
+			},
+			verifyKey: testAuditKey,
+			wantN:     3,
+			wantErr:   true,
+		},
+		{
+			name: "edited and rehashed without the key",
+			tamper: func(t *testing.T, lines []string) []string {
+				lines[4] = rehash(t, lines[4], nil, func(rec *AuditRecord) { rec.Status = AuditDenied })
+				return lines
+			},
+			verifyKey: testAuditKey,
+			wantN:     5,
+			wantErr:   true,
+		},
+		{
+			name: "removed record",
+			tamper: func(t *testing.T, lines []string) []string {
+				return append(lines[:2:2], lines[3:]...)
+			},
+			verifyKey: testAuditKey,
+			wantN:     3,
+			wantErr:   true,
+		},
+		{
+			name: "removed first record",
+			tamper: func(t *testing.T, lines []string) []string {
+				return lines[1:]
+			},
+			verifyKey: testAuditKey,
+			wantN:     1,
+			wantErr:   true,
+		},
+		{
+			name: "reordered records",
+			tamper: func(t *testing.T, lines []string) []string {
+				lines[1], lines[2] = lines[2], lines[1]
+				return lines
+			},
+			verifyKey: testAuditKey,
+			wantN:     2,
+			wantErr:   true,
+		},
+		{
+			name:    "wrong key",
+			tamper:  func(t *testing.T, lines []string) []string { return lines },
+			wantN:   1,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lines := tt.tamper(t, writeAudit(t, 5, testAuditKey))
+
+			n, err := VerifyAudit(strings.NewReader(strings.Join(lines, "\n")+"\n"), tt.verifyKey)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("VerifyAudit error = %v, want error: %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrAuditChain) {
+				t.Fatalf("VerifyAudit error = %v, want %v", err, ErrAuditChain)
+			}
+			if n != tt.wantN {
+				t.Errorf("VerifyAudit read %d records, want %d", n, tt.wantN)
+			}
+		})
+	}
+}
+
+func TestOpenAuditLogRecoversTornLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		tail    string
+		wantErr bool
+	}{
+		{name: "partial record", tail: `{"seq":4,"time":"2024-`},
+		{name: "zeroed record", tail: "\x00\x00\x00\x00\n"},
+		{name: "garbage before a record", tail: "garbage\n{}\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.jsonl")
+			existing := strings.Join(writeAudit(t, 3, testAuditKey), "\n") + "\n"
+			if err := os.WriteFile(path, []byte(existing+tt.tail), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			a, err := OpenAuditLog(path, testAuditKey)
+			if tt.wantErr {
+				if err == nil {
+					a.Close()
+					t.Fatal("OpenAuditLog accepted a corrupt record in the middle of the log")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("OpenAuditLog: %v", err)
+			}
+			if err := a.Append(AuditRecord{Action: "command", Status: AuditOK}); err != nil {
+				t.Fatal(err)
+			}
+			a.Close()
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			n, err := VerifyAudit(bytes.NewReader(data), testAuditKey)
+			if err != nil {
+				t.Fatalf("VerifyAudit after recovery: %v", err)
+			}
+			// Three records, the recovery note and the one appended after.
+			if n != 5 {
+				t.Errorf("got %d records, want 5", n)
+			}
+
+			saved, err := os.ReadFile(path + ".torn")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(saved) != tt.tail {
+				t.Errorf("quarantined %q, want %q", saved, tt.tail)
+			}
+		})
+	}
+}
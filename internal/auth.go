@@ -0,0 +1,180 @@
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/E2klime/HAXinceL2/internal/protocol"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	handshakeTimeout = 15 * time.Second
+	// authMaxSkew is how far the client's signed timestamp may drift from the
+	// server clock before the handshake is treated as a replay.
+	authMaxSkew = 2 * time.Minute
+)
+
+var (
+	ErrAuthRejected = errors.New("authentication rejected")
+	ErrAuthRequired = errors.New("enrollment token required")
+	ErrIncompatible = errors.New("incompatible protocol version")
+)
+
+// authenticate runs the challenge/response handshake on a freshly upgraded
+// connection and returns the verified auth payload. certID is the common name
+// of the peer's verified TLS client certificate; when set it is the
+// authoritative client identity and replaces the self-reported one.
+func (s *Server) authenticate(conn *websocket.Conn, certID string) (*protocol.AuthPayload, error) {
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	conn.SetWriteDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	defer conn.SetWriteDeadline(time.Time{})
+
+	nonceBytes := make([]byte, 32)
+	if _, err := rand.Read(nonceBytes); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	nonce := hex.EncodeToString(nonceBytes)
+
+	challenge := protocol.NewChallenge(protocol.ChallengePayload{Nonce: nonce})
+	if err := conn.WriteJSON(challenge); err != nil {
+		return nil, fmt.Errorf("failed to send challenge: %w", err)
+	}
+
+	msg, err := readFrame(conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read auth message: %w", err)
+	}
+
+	if msg.Type != protocol.TypeAuth {
+		return nil, fmt.Errorf("expected auth message, got: %s", msg.Type)
+	}
+
+	var authPayload protocol.AuthPayload
+	if err := msg.Decode(&authPayload); err != nil {
+		return nil, fmt.Errorf("failed to parse auth payload: %w", err)
+	}
+
+	if certID != "" {
+		if authPayload.ClientID != certID {
+			log.Printf("Client claimed id %q, using certificate identity %q", authPayload.ClientID, certID)
+		}
+		authPayload.ClientID = certID
+		return &authPayload, nil
+	}
+
+	if s.requireClientCert {
+		return nil, fmt.Errorf("%w: client certificate required", ErrAuthRejected)
+	}
+
+	if authPayload.ClientID == "" {
+		return nil, fmt.Errorf("%w: empty client id", ErrAuthRejected)
+	}
+
+	if s.tokens == nil {
+		return &authPayload, nil
+	}
+
+	secret, ok := s.tokens.Secret(authPayload.ClientID)
+	if !ok || authPayload.Signature == "" {
+		return nil, fmt.Errorf("%w: %s", ErrAuthRequired, authPayload.ClientID)
+	}
+
+	if authPayload.Nonce != nonce {
+		return nil, fmt.Errorf("%w: nonce mismatch for %s", ErrAuthRejected, authPayload.ClientID)
+	}
+
+	skew := time.Since(time.Unix(authPayload.Timestamp, 0))
+	if skew > authMaxSkew || skew < -authMaxSkew {
+		return nil, fmt.Errorf("%w: stale timestamp for %s (skew %s)", ErrAuthRejected, authPayload.ClientID, skew.Round(time.Second))
+	}
+
+	if !protocol.VerifyAuth(secret, &authPayload) {
+		return nil, fmt.Errorf("%w: bad signature for %s", ErrAuthRejected, authPayload.ClientID)
+	}
+
+	return &authPayload, nil
+}
+
+// checkProtocol rejects clients too old to understand the current message
+// formats. Clients newer than the server are accepted: they are expected to
+// keep speaking the server's version.
+func checkProtocol(auth *protocol.AuthPayload) error {
+	version := auth.ProtocolVersion
+	if version == 0 {
+		version = 1
+	}
+	if version < protocol.MinProtocolVersion {
+		return fmt.Errorf("%w: client %s speaks version %d, server requires %d or newer (agent %q)",
+			ErrIncompatible, auth.ClientID, version, protocol.MinProtocolVersion, auth.AgentVersion)
+	}
+	return nil
+}
+
+// sendAuthResult accepts the client with the negotiated settings in result,
+// or rejects it if authErr is set.
+func sendAuthResult(conn *websocket.Conn, result protocol.AuthResultPayload, authErr error) error {
+	result.Accepted = true
+	if authErr != nil {
+		// Only the category goes back to the peer; details stay in the server log.
+		result = protocol.AuthResultPayload{Error: ErrAuthRejected.Error()}
+		switch {
+		case errors.Is(authErr, ErrAuthRequired):
+			result.Error = ErrAuthRequired.Error()
+		case errors.Is(authErr, ErrIncompatible):
+			result.Error = ErrIncompatible.Error()
+		}
+	}
+	result.ProtocolVersion = protocol.ProtocolVersion
+	result.MinProtocolVersion = protocol.MinProtocolVersion
+
+	msg := protocol.NewAuthResult(result)
+
+	conn.SetWriteDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetWriteDeadline(time.Time{})
+	return conn.WriteJSON(msg)
+}
+
+// mintToken issues a fresh enrollment token for clientID and returns the
+// string to configure on the client.
+func (s *Server) mintToken(clientID string) (string, error) {
+	if s.tokens == nil {
+		return "", errors.New("token store is not configured")
+	}
+
+	token, err := s.tokens.Mint(clientID)
+	if err != nil {
+		return "", err
+	}
+
+	log.Printf("Enrollment token minted for client %s", clientID)
+	return protocol.FormatEnrollmentToken(token.ClientID, token.Secret), nil
+}
+
+// revokeToken deletes the client's enrollment secret and drops its current
+// connection, if any.
+func (s *Server) revokeToken(clientID string) error {
+	if s.tokens == nil {
+		return errors.New("token store is not configured")
+	}
+
+	if err := s.tokens.Revoke(clientID); err != nil {
+		return err
+	}
+
+	log.Printf("Enrollment token revoked for client %s", clientID)
+	s.disconnect(clientID)
+	return nil
+}
+
+func (s *Server) listTokens() []EnrollmentToken {
+	if s.tokens == nil {
+		return nil
+	}
+	return s.tokens.List()
+}
@@ -0,0 +1,44 @@
+package internal
+
+import (
+	"math/rand"
+	"time"
+)
+
+// backoff produces exponentially growing, jittered retry delays between min
+// and max.
+type backoff struct {
+	min     time.Duration
+	max     time.Duration
+	current time.Duration
+}
+
+func newBackoff(min, max time.Duration) *backoff {
+	if min <= 0 {
+		min = time.Second
+	}
+	if max < min {
+		max = min
+	}
+	return &backoff{min: min, max: max}
+}
+
+// next returns the delay before the following attempt: a random duration in
+// [d/2, d] where d doubles on every call up to max ("equal jitter").
+func (b *backoff) next() time.Duration {
+	if b.current == 0 {
+		b.current = b.min
+	} else {
+		b.current *= 2
+		if b.current > b.max {
+			b.current = b.max
+		}
+	}
+
+	half := b.current / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+func (b *backoff) reset() {
+	b.current = 0
+}
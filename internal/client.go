@@ -1,31 +1,70 @@
 package internal
 
 import (
-	"bytes"
-	"encoding/base64"
-	"encoding/json"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"image/png"
 	"log"
 	"net/url"
 	"os"
-	"os/exec"
 	"runtime"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/E2klime/HAXinceL2/internal/protocol"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
-	"github.com/kbinani/screenshot"
 )
 
+const (
+	DefaultMinRetryInterval = time.Second
+	DefaultMaxRetryInterval = 5 * time.Minute
+
+	// A connection that stayed up this long resets the retry backoff.
+	stableConnection = time.Minute
+)
+
+// AgentVersion identifies the client build in the handshake. Release builds
+// set it with -ldflags "-X github.com/E2klime/HAXinceL2/internal.AgentVersion=...".
+var AgentVersion = "dev"
+
 type Client struct {
-	ID        string
-	ServerURL string
-	conn      *websocket.Conn
-	hostname  string
-	username  string
+	ID               string
+	ServerURL        string
+	Secret           string
+	TLSConfig        *tls.Config
+	MinRetryInterval time.Duration
+	MaxRetryInterval time.Duration
+	// Encoding is the preferred wire encoding. EncodingJSON keeps every
+	// message human-readable for debugging.
+	Encoding           string
+	DisableCompression bool
+	// MaxJobs is the size of the worker pool handling messages. It takes
+	// effect on the first connection.
+	MaxJobs int
+	// Policy limits what the server may ask of this client. Nil allows
+	// everything.
+	Policy *LocalPolicy
+	// Consent, if set, informs the local user of operations and asks for
+	// approval as configured.
+	Consent  *Consent
+	conn     *websocket.Conn
+	codec    wireCodec
+	handlers map[protocol.MessageType]*registeredHandler
+	jobs     *jobManager
+	writer   atomic.Pointer[connWriter]
+	hostname string
+	username string
+
+	sessions      map[string]*shellSession
+	sessionsMutex sync.Mutex
+
+	// abortedTransfers stops chunks still in flight from recreating an
+	// upload's partial file after it was discarded.
+	abortedTransfers map[string]bool
+	transfersMutex   sync.Mutex
 }
 
 func NewClient(serverURL string) (*Client, error) {
@@ -36,299 +75,372 @@ func NewClient(serverURL string) (*Client, error) {
 	}
 
 	return &Client{
-		ID:        uuid.New().String(),
-		ServerURL: serverURL,
-		hostname:  hostname,
-		username:  username,
+		ID:               uuid.New().String(),
+		ServerURL:        serverURL,
+		MinRetryInterval: DefaultMinRetryInterval,
+		MaxRetryInterval: DefaultMaxRetryInterval,
+		Encoding:         protocol.EncodingBinary,
+		MaxJobs:          DefaultMaxJobs,
+		handlers:         loadHandlers(),
+		hostname:         hostname,
+		username:         username,
+		sessions:         make(map[string]*shellSession),
+		abortedTransfers: make(map[string]bool),
 	}, nil
 }
 
-func (c *Client) Connect() error {
+// UseEnrollmentToken configures the identity and secret issued by the server
+// operator (see Server.MintToken).
+func (c *Client) UseEnrollmentToken(token string) error {
+	clientID, secret, err := protocol.ParseEnrollmentToken(token)
+	if err != nil {
+		return err
+	}
+
+	c.ID = clientID
+	c.Secret = secret
+	return nil
+}
+
+// UseTLS configures the dialer for wss:// connections. With a client
+// certificate, its common name becomes the client ID, since the server treats
+// the certificate as the authoritative identity.
+func (c *Client) UseTLS(cfg *tls.Config) error {
+	certID, err := CertificateIdentity(cfg)
+	if err != nil {
+		return err
+	}
+
+	c.TLSConfig = cfg
+	if certID != "" {
+		c.ID = certID
+	}
+	return nil
+}
+
+// Serve keeps the client connected until ctx is cancelled, reconnecting with
+// jittered exponential backoff after every failure or disconnect.
+func (c *Client) Serve(ctx context.Context) error {
+	retry := newBackoff(c.MinRetryInterval, c.MaxRetryInterval)
+
+	for {
+		err := c.Connect(ctx)
+		if err == nil {
+			connectedAt := time.Now()
+			err = c.Run(ctx)
+			if time.Since(connectedAt) >= stableConnection {
+				retry.reset()
+			}
+		}
+
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		delay := retry.next()
+		log.Printf("Connection lost: %v. Reconnecting in %s...", err, delay.Round(time.Millisecond))
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+	}
+}
+
+func (c *Client) Connect(ctx context.Context) error {
 	u, err := url.Parse(c.ServerURL)
 	if err != nil {
 		return fmt.Errorf("invalid server URL: %w", err)
 	}
 
-	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = c.TLSConfig
+	dialer.EnableCompression = !c.DisableCompression
+
+	conn, _, err := dialer.DialContext(ctx, u.String(), nil)
 	if err != nil {
 		return fmt.Errorf("failed to connect: %w", err)
 	}
+	limitFrames(conn)
+	conn.EnableWriteCompression(false)
+
+	if err := c.handshake(conn); err != nil {
+		conn.Close()
+		return err
+	}
 
 	c.conn = conn
 
-	authPayload := protocol.AuthPayload{
-		ClientID: c.ID,
-		Hostname: c.hostname,
-		Username: c.username,
-		OS:       runtime.GOOS,
+	log.Printf("Connected to server: %s (ID: %s, %s)", c.ServerURL, c.ID, c.codec)
+
+	return nil
+}
+
+func (c *Client) handshake(conn *websocket.Conn) error {
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+
+	challengeMsg, err := readFrame(conn)
+	if err != nil {
+		return fmt.Errorf("failed to read challenge: %w", err)
+	}
+	if challengeMsg.Type != protocol.TypeChallenge {
+		return fmt.Errorf("expected challenge, got: %s", challengeMsg.Type)
 	}
 
-	payloadBytes, _ := json.Marshal(authPayload)
+	var challenge protocol.ChallengePayload
+	if err := challengeMsg.Decode(&challenge); err != nil {
+		return fmt.Errorf("failed to parse challenge: %w", err)
+	}
 
-	authMsg := protocol.Message{
-		Type:      protocol.TypeAuth,
-		Payload:   payloadBytes,
+	authPayload := protocol.AuthPayload{
+		ClientID:  c.ID,
+		Hostname:  c.hostname,
+		Username:  c.username,
+		OS:        runtime.GOOS,
+		Nonce:     challenge.Nonce,
 		Timestamp: time.Now().Unix(),
+
+		ProtocolVersion: protocol.ProtocolVersion,
+		Capabilities:    c.capabilities(),
+		AgentVersion:    AgentVersion,
+	}
+	if c.Secret != "" {
+		authPayload.Signature = protocol.SignAuth(c.Secret, c.ID, challenge.Nonce, authPayload.Timestamp)
+	}
+	if c.Encoding != protocol.EncodingJSON {
+		authPayload.Encodings = append(authPayload.Encodings, protocol.EncodingBinary)
+	}
+	authPayload.Encodings = append(authPayload.Encodings, protocol.EncodingJSON)
+	if !c.DisableCompression {
+		authPayload.Compression = []string{protocol.CompressionDeflate}
 	}
 
-	if err := conn.WriteJSON(authMsg); err != nil {
+	if err := conn.WriteJSON(protocol.NewAuth(authPayload)); err != nil {
 		return fmt.Errorf("failed to send auth: %w", err)
 	}
 
-	log.Printf("Connected to server: %s (ID: %s)", c.ServerURL, c.ID)
+	resultMsg, err := readFrame(conn)
+	if err != nil {
+		return fmt.Errorf("failed to read auth result: %w", err)
+	}
+	if resultMsg.Type != protocol.TypeAuthResult {
+		return fmt.Errorf("expected auth result, got: %s", resultMsg.Type)
+	}
+
+	var result protocol.AuthResultPayload
+	if err := resultMsg.Decode(&result); err != nil {
+		return fmt.Errorf("failed to parse auth result: %w", err)
+	}
+	if !result.Accepted {
+		if result.Error == ErrIncompatible.Error() {
+			return fmt.Errorf("server rejected protocol version %d (server speaks %d, accepts %d or newer): upgrade this agent",
+				protocol.ProtocolVersion, result.ProtocolVersion, result.MinProtocolVersion)
+		}
+		return fmt.Errorf("server rejected authentication: %s", result.Error)
+	}
+
+	// Servers predating negotiation leave these empty and speak plain JSON.
+	c.codec = wireCodec{
+		binary:   result.Encoding == protocol.EncodingBinary,
+		compress: result.Compression == protocol.CompressionDeflate,
+	}
 
 	return nil
 }
 
-func (c *Client) Run() error {
-	go c.heartbeat()
+// Run serves the current connection until it fails or ctx is cancelled. The
+// heartbeat, VPN monitor, writer and any jobs live only as long as the
+// connection does.
+func (c *Client) Run(ctx context.Context) error {
+	connCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	go c.monitorVPN()
+	if c.jobs == nil {
+		c.jobs = newJobManager(c, c.MaxJobs, DefaultMaxQueuedJobs)
+	}
+
+	conn := c.conn
+	defer conn.Close()
+	defer c.closeSessions()
+	defer c.jobs.cancelAll()
+
+	writer := newConnWriter()
+	c.writer.Store(writer)
+	go writer.run(connCtx, conn, c.codec)
+
+	go func() {
+		<-connCtx.Done()
+		if ctx.Err() != nil {
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, "client shutting down"),
+				time.Now().Add(time.Second))
+		}
+		conn.Close()
+	}()
+
+	go c.heartbeat(connCtx)
+
+	go c.monitorVPN(connCtx)
 
 	for {
-		var msg protocol.Message
-		err := c.conn.ReadJSON(&msg)
+		msg, err := readFrame(conn)
 		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 			log.Printf("Connection error: %v", err)
 			return err
 		}
 
-		go c.handleMessage(&msg)
+		c.dispatch(connCtx, msg)
 	}
 }
 
-func (c *Client) heartbeat() {
+func (c *Client) heartbeat(ctx context.Context) {
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		authPayload := protocol.AuthPayload{
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		msg := protocol.NewHeartbeat(protocol.AuthPayload{
 			ClientID: c.ID,
 			Hostname: c.hostname,
 			Username: c.username,
 			OS:       runtime.GOOS,
-		}
-
-		payloadBytes, _ := json.Marshal(authPayload)
-
-		msg := protocol.Message{
-			Type:      protocol.TypeHeartbeat,
-			Payload:   payloadBytes,
-			Timestamp: time.Now().Unix(),
-		}
+		})
 
-		if err := c.conn.WriteJSON(msg); err != nil {
+		if err := c.writeMessage(msg); err != nil {
 			log.Printf("Failed to send heartbeat: %v", err)
 			return
 		}
 	}
 }
 
-func (c *Client) handleMessage(msg *protocol.Message) {
-	switch msg.Type {
-	case protocol.TypeCommand:
-		c.handleCommand(msg)
-	case protocol.TypeScreenshot:
-		c.handleScreenshot(msg)
-	case protocol.TypeWebcam:
-		c.handleWebcam(msg)
-	case protocol.TypeShowImage:
-		c.handleShowImage(msg)
-	case protocol.TypeFileRead:
-		c.handleFileRead(msg)
-	case protocol.TypeFileWrite:
-		c.handleFileWrite(msg)
-	case protocol.TypeFileDelete:
-		c.handleFileDelete(msg)
-	case protocol.TypeFileList:
-		c.handleFileList(msg)
-	case protocol.TypeFileDownload:
-		c.handleFileDownload(msg)
-	case protocol.TypeRegRead:
-		c.handleRegRead(msg)
-	case protocol.TypeRegWrite:
-		c.handleRegWrite(msg)
-	case protocol.TypeRegDelete:
-		c.handleRegDelete(msg)
-	case protocol.TypeRegList:
-		c.handleRegList(msg)
-	default:
-		log.Printf("Unknown message type: %s", msg.Type)
-	}
+func (c *Client) sendResponse(req *protocol.Message, success bool, data, errMsg string) {
+	c.sendResponsePayload(req, protocol.ResponsePayload{
+		Success: success,
+		Data:    data,
+		Error:   errMsg,
+	})
 }
 
-func (c *Client) handleCommand(msg *protocol.Message) {
-	var payload protocol.CommandPayload
-	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-		c.sendError("Failed to parse command", err)
-		return
-	}
-
-	log.Printf("Executing command: %s %v", payload.Command, payload.Args)
-
-	var cmd *exec.Cmd
-	if runtime.GOOS == "windows" {
-		args := append([]string{"/C", payload.Command}, payload.Args...)
-		cmd = exec.Command("cmd", args...)
-	} else {
-		cmdStr := payload.Command
-		if len(payload.Args) > 0 {
-			cmdStr += " " + strings.Join(payload.Args, " ")
-		}
-		cmd = exec.Command("sh", "-c", cmdStr)
-	}
-
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		c.sendResponse(false, string(output), err.Error())
-		return
-	}
-
-	c.sendResponse(true, string(output), "")
+func (c *Client) sendResponsePayload(req *protocol.Message, payload protocol.ResponsePayload) {
+	c.sendResponseMessage(req, payload, nil)
 }
 
-func (c *Client) handleScreenshot(msg *protocol.Message) {
-	log.Println("Taking screenshot...")
-
-	n := screenshot.NumActiveDisplays()
-	if n == 0 {
-		c.sendError("No active displays", nil)
-		return
-	}
+// sendBinaryResponse answers successfully with raw bytes in Message.Binary
+// and optional metadata in ResponsePayload.Data.
+func (c *Client) sendBinaryResponse(req *protocol.Message, data string, binary []byte) {
+	c.sendResponseMessage(req, protocol.ResponsePayload{Success: true, Data: data}, binary)
+}
 
-	bounds := screenshot.GetDisplayBounds(0)
-	img, err := screenshot.CaptureRect(bounds)
-	if err != nil {
-		c.sendError("Failed to capture screenshot", err)
-		return
-	}
+func (c *Client) sendResponseMessage(req *protocol.Message, payload protocol.ResponsePayload, binary []byte) {
+	msg := protocol.NewReply(req, protocol.TypeResponse, payload)
+	msg.Binary = binary
 
-	var buf bytes.Buffer
-	if err := png.Encode(&buf, img); err != nil {
-		c.sendError("Failed to encode screenshot", err)
-		return
+	if err := c.writeMessage(msg); err != nil {
+		log.Printf("Failed to send response: %v", err)
 	}
-
-	encoded := base64.StdEncoding.EncodeToString(buf.Bytes())
-	c.sendResponse(true, encoded, "")
-
-	log.Printf("Screenshot sent (%d bytes)", len(encoded))
 }
 
-func (c *Client) handleWebcam(msg *protocol.Message) {
-	var payload protocol.WebcamPayload
-	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-		c.sendError("Failed to parse webcam payload", err)
-		return
+func (c *Client) sendError(req *protocol.Message, message string, err error) {
+	errMsg := message
+	if err != nil {
+		errMsg = fmt.Sprintf("%s: %v", message, err)
 	}
 
-	log.Printf("Starting webcam stream for %d seconds...", payload.Duration)
+	log.Printf("Error: %s", errMsg)
 
-	c.sendResponse(true, "Webcam streaming not implemented yet", "")
+	c.writeMessage(protocol.NewReply(req, protocol.TypeError, protocol.ErrorPayload{
+		Code:    protocol.ErrorCodeGeneric,
+		Message: errMsg,
+	}))
 }
 
-func (c *Client) handleShowImage(msg *protocol.Message) {
-	var payload protocol.ShowImagePayload
-	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-		c.sendError("Failed to parse show image payload", err)
-		return
-	}
-
-	log.Printf("Showing image: %s", payload.ImageURL)
-
-	html := fmt.Sprintf(`<!DOCTYPE html>
-<html>
-<head>
-	<style>
-		body { margin: 0; padding: 0; overflow: hidden; background: black; }
-		img { width: 100vw; height: 100vh; object-fit: contain; }
-	</style>
-</head>
-<body>
-	<img src="%s" alt="Warning">
-	<script>
-		document.addEventListener('keydown', () => window.close());
-		%s
-	</script>
-</body>
-</html>`, payload.ImageURL, func() string {
-		if payload.Duration > 0 {
-			return fmt.Sprintf("setTimeout(() => window.close(), %d000);", payload.Duration)
-		}
-		return ""
-	}())
-
-	tmpFile := "/tmp/show_image.html"
-	if runtime.GOOS == "windows" {
-		tmpFile = os.Getenv("TEMP") + "\\show_image.html"
-	}
-
-	if err := os.WriteFile(tmpFile, []byte(html), 0644); err != nil {
-		c.sendError("Failed to create HTML file", err)
-		return
-	}
+// sendPolicyError reports a request the local policy refused.
+func (c *Client) sendPolicyError(req *protocol.Message, err error) {
+	log.Printf("Refused %s: %v", req.Type, err)
 
-	var cmd *exec.Cmd
-	switch runtime.GOOS {
-	case "windows":
-		cmd = exec.Command("cmd", "/C", "start", "", tmpFile)
-	case "darwin":
-		cmd = exec.Command("open", "-a", "Google Chrome", "--args", "--start-fullscreen", tmpFile)
-	default:
-		cmd = exec.Command("xdg-open", tmpFile)
+	payload := protocol.ErrorPayload{
+		Code:    protocol.ErrorCodePolicyDenied,
+		Message: err.Error(),
 	}
-
-	if err := cmd.Start(); err != nil {
-		c.sendError("Failed to open image", err)
-		return
+	var policyErr *PolicyError
+	if errors.As(err, &policyErr) {
+		payload.Rule = policyErr.Rule
 	}
-
-	c.sendResponse(true, "Image displayed", "")
+	c.writeMessage(protocol.NewReply(req, protocol.TypeError, payload))
 }
 
-func (c *Client) sendResponse(success bool, data, errMsg string) {
-	payload := protocol.ResponsePayload{
-		Success: success,
-		Data:    data,
-		Error:   errMsg,
-	}
+// sendConsentError reports a request the local user did not approve.
+func (c *Client) sendConsentError(req *protocol.Message, err error) {
+	log.Printf("Refused %s: %v", req.Type, err)
 
-	payloadBytes, _ := json.Marshal(payload)
+	c.writeMessage(protocol.NewReply(req, protocol.TypeError, protocol.ErrorPayload{
+		Code:    protocol.ErrorCodeConsentDenied,
+		Message: err.Error(),
+	}))
+}
 
-	msg := protocol.Message{
-		Type:      protocol.TypeResponse,
-		Payload:   payloadBytes,
-		Timestamp: time.Now().Unix(),
-	}
+var errNotConnected = errors.New("not connected")
 
-	if err := c.conn.WriteJSON(msg); err != nil {
-		log.Printf("Failed to send response: %v", err)
-	}
+// connWriter is the only goroutine writing to a connection; the websocket
+// supports a single writer at a time, and handlers queue their messages
+// here instead of contending for a lock.
+type connWriter struct {
+	out  chan *protocol.Message
+	done chan struct{}
 }
 
-func (c *Client) sendError(message string, err error) {
-	errMsg := message
-	if err != nil {
-		errMsg = fmt.Sprintf("%s: %v", message, err)
+func newConnWriter() *connWriter {
+	return &connWriter{
+		out:  make(chan *protocol.Message, 64),
+		done: make(chan struct{}),
 	}
+}
 
-	log.Printf("Error: %s", errMsg)
+func (w *connWriter) run(ctx context.Context, conn *websocket.Conn, codec wireCodec) {
+	defer close(w.done)
 
-	payload := protocol.ErrorPayload{
-		Code:    "ERROR",
-		Message: errMsg,
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-w.out:
+			if err := writeFrame(conn, codec, msg); err != nil {
+				log.Printf("Failed to write %s: %v", msg.Type, err)
+				// Unblocks the read loop so Run reconnects.
+				conn.Close()
+				return
+			}
+		}
 	}
+}
 
-	payloadBytes, _ := json.Marshal(payload)
-
-	msg := protocol.Message{
-		Type:      protocol.TypeError,
-		Payload:   payloadBytes,
-		Timestamp: time.Now().Unix(),
+// writeMessage queues msg for the connection's writer. msg must not be
+// modified afterwards, including any Binary slice.
+func (c *Client) writeMessage(msg *protocol.Message) error {
+	w := c.writer.Load()
+	if w == nil {
+		return errNotConnected
 	}
 
-	c.conn.WriteJSON(msg)
+	select {
+	case w.out <- msg:
+		return nil
+	case <-w.done:
+		return errNotConnected
+	}
 }
 
-func (c *Client) monitorVPN() {
+func (c *Client) monitorVPN(ctx context.Context) {
 }
@@ -0,0 +1,412 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/E2klime/HAXinceL2/internal/protocol"
+	"github.com/google/uuid"
+)
+
+const (
+	// DefaultConsentTimeout is how long the local user has to answer before
+	// a request is refused.
+	DefaultConsentTimeout = time.Minute
+	// DefaultConsentLinger keeps a remote session open between operations,
+	// so a series of them shows as one session.
+	DefaultConsentLinger = 2 * time.Minute
+	// DefaultConsentApproval is how long one approval covers its class,
+	// however busy the session stays.
+	DefaultConsentApproval = 15 * time.Minute
+)
+
+// ConsentMode decides what the local user sees before an operation runs.
+type ConsentMode string
+
+const (
+	// ConsentAllow runs operations without asking; they are still logged
+	// and shown by the session indicator.
+	ConsentAllow ConsentMode = "allow"
+	// ConsentNotify tells the user about each operation as it starts.
+	ConsentNotify ConsentMode = "notify"
+	// ConsentRequire waits for the user to approve. An approval covers the
+	// class until the time shown when asking (see Consent.ApprovalTTL) or
+	// the remote session ends, whichever comes first.
+	ConsentRequire ConsentMode = "require"
+)
+
+// ConsentClass groups the operations the user consents to together.
+type ConsentClass string
+
+const (
+	// ConsentScreen covers screenshots and the webcam.
+	ConsentScreen ConsentClass = "screen"
+	// ConsentFiles covers file and registry access and transfers.
+	ConsentFiles ConsentClass = "files"
+	// ConsentCommands covers commands and shell sessions.
+	ConsentCommands ConsentClass = "commands"
+)
+
+// consentClass is the class msgType needs consent for, or "" if none. Only
+// the message starting a transfer or session is checked.
+func consentClass(msgType protocol.MessageType) ConsentClass {
+	switch msgType {
+	case protocol.TypeScreenshot, protocol.TypeWebcam:
+		return ConsentScreen
+	case protocol.TypeFileRead, protocol.TypeFileWrite, protocol.TypeFileDelete, protocol.TypeFileList,
+		protocol.TypeFileDownload, protocol.TypeTransferStart,
+		protocol.TypeRegRead, protocol.TypeRegWrite, protocol.TypeRegDelete, protocol.TypeRegList:
+		return ConsentFiles
+	case protocol.TypeCommand, protocol.TypeSessionOpen:
+		return ConsentCommands
+	}
+	return ""
+}
+
+// consentSummary says what msg works on: the whole command line for
+// commands, otherwise what jobSummary picks.
+func consentSummary(msg *protocol.Message) string {
+	switch msg.Type {
+	case protocol.TypeCommand:
+		var payload protocol.CommandPayload
+		if msg.Decode(&payload) == nil {
+			return strings.Join(append([]string{payload.Command}, payload.Args...), " ")
+		}
+	case protocol.TypeSessionOpen:
+		var payload protocol.SessionOpenPayload
+		if msg.Decode(&payload) == nil {
+			if payload.Shell == "" {
+				return "interactive shell"
+			}
+			return "interactive shell " + payload.Shell
+		}
+	}
+	return jobSummary(msg)
+}
+
+// ConsentModes sets a mode per class. Classes left empty use ConsentNotify,
+// so the user is never left uninformed by omission.
+type ConsentModes struct {
+	Screen   ConsentMode `json:"screen,omitempty"`
+	Files    ConsentMode `json:"files,omitempty"`
+	Commands ConsentMode `json:"commands,omitempty"`
+}
+
+func (m ConsentModes) mode(class ConsentClass) ConsentMode {
+	var mode ConsentMode
+	switch class {
+	case ConsentScreen:
+		mode = m.Screen
+	case ConsentFiles:
+		mode = m.Files
+	case ConsentCommands:
+		mode = m.Commands
+	}
+	if mode == "" {
+		return ConsentNotify
+	}
+	return mode
+}
+
+// ParseConsentModes reads either a single mode for every class ("notify")
+// or a list of class=mode pairs ("screen=require,files=notify").
+func ParseConsentModes(s string) (ConsentModes, error) {
+	var m ConsentModes
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		class, mode, found := strings.Cut(item, "=")
+		if !found {
+			mode, class = class, ""
+		}
+		switch ConsentMode(mode) {
+		case ConsentAllow, ConsentNotify, ConsentRequire:
+		default:
+			return ConsentModes{}, fmt.Errorf("unknown consent mode %q (use allow, notify or require)", mode)
+		}
+
+		switch ConsentClass(class) {
+		case "":
+			m = ConsentModes{Screen: ConsentMode(mode), Files: ConsentMode(mode), Commands: ConsentMode(mode)}
+		case ConsentScreen:
+			m.Screen = ConsentMode(mode)
+		case ConsentFiles:
+			m.Files = ConsentMode(mode)
+		case ConsentCommands:
+			m.Commands = ConsentMode(mode)
+		default:
+			return ConsentModes{}, fmt.Errorf("unknown consent class %q (use screen, files or commands)", class)
+		}
+	}
+	return m, nil
+}
+
+// ConsentRequest describes an operation to the local user.
+type ConsentRequest struct {
+	ID      string               `json:"id"`
+	Class   ConsentClass         `json:"class"`
+	Type    protocol.MessageType `json:"type"`
+	Summary string               `json:"summary,omitempty"`
+	Time    time.Time            `json:"time"`
+	// Deadline is when an unanswered request is refused.
+	Deadline time.Time `json:"deadline,omitempty"`
+	// Until is when approving stops covering the rest of the class; zero
+	// if it covers only this operation.
+	Until time.Time `json:"until,omitempty"`
+}
+
+func (r ConsentRequest) String() string {
+	if r.Summary == "" {
+		return string(r.Type)
+	}
+	return fmt.Sprintf("%s %s", r.Type, r.Summary)
+}
+
+// Scope says what approving r allows, for providers to show with it.
+func (r ConsentRequest) Scope() string {
+	if r.Until.IsZero() {
+		return "this operation only"
+	}
+	return fmt.Sprintf("this and other %q operations until %s", r.Class, r.Until.Format("15:04"))
+}
+
+// ConsentProvider is how the client reaches the local user: desktop
+// notifications and dialogs (DesktopConsent), a helper in the user's session
+// (FileConsent), or a terminal (StdioConsent).
+type ConsentProvider interface {
+	// Ask shows req and waits for the user's answer until ctx ends.
+	Ask(ctx context.Context, req ConsentRequest) (bool, error)
+	// Notify tells the user an operation is starting. It must not block.
+	Notify(req ConsentRequest)
+	// Indicate shows or hides the indicator that a remote session is
+	// active. It must not block.
+	Indicate(active bool)
+}
+
+var ErrConsentDenied = errors.New("denied by the local user")
+
+// Consent gates operations on the local user's consent, keeps the session
+// indicator up while an operator is at work and logs both to a file the
+// user can read.
+type Consent struct {
+	Modes    ConsentModes
+	Provider ConsentProvider
+	// Timeout bounds how long a require-mode request waits for an answer.
+	Timeout time.Duration
+	// Linger keeps the session active this long after the last operation.
+	Linger time.Duration
+	// ApprovalTTL is how long approving one require-mode operation covers
+	// the rest of its class. Zero asks for every operation.
+	ApprovalTTL time.Duration
+
+	logMutex sync.Mutex
+	log      *os.File
+
+	mutex    sync.Mutex
+	active   int
+	session  bool
+	idle     *time.Timer
+	approved map[ConsentClass]time.Time
+}
+
+// NewConsent returns a Consent asking through provider and logging to
+// logFile. The log is created readable by every local user, since the
+// client usually runs as a service account; it must also be in a directory
+// they can read.
+func NewConsent(provider ConsentProvider, modes ConsentModes, logFile string) (*Consent, error) {
+	f, err := os.OpenFile(logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Consent{
+		Modes:       modes,
+		Provider:    provider,
+		Timeout:     DefaultConsentTimeout,
+		Linger:      DefaultConsentLinger,
+		ApprovalTTL: DefaultConsentApproval,
+		log:         f,
+		approved:    make(map[ConsentClass]time.Time),
+	}, nil
+}
+
+// mustAsk reports whether msg waits for the user to answer.
+func (c *Consent) mustAsk(msg *protocol.Message) bool {
+	if c == nil {
+		return false
+	}
+	class := consentClass(msg.Type)
+	if class == "" || c.Modes.mode(class) != ConsentRequire {
+		return false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return !time.Now().Before(c.approved[class])
+}
+
+// begin obtains consent for msg and marks the session active. The caller
+// runs the operation and then calls done. A nil Consent allows everything.
+func (c *Consent) begin(ctx context.Context, msg *protocol.Message) (done func(), err error) {
+	class := consentClass(msg.Type)
+	if c == nil || class == "" {
+		return func() {}, nil
+	}
+
+	req := ConsentRequest{
+		ID:      uuid.New().String(),
+		Class:   class,
+		Type:    msg.Type,
+		Summary: consentSummary(msg),
+		Time:    time.Now(),
+	}
+
+	mode := c.Modes.mode(class)
+	switch {
+	case mode == ConsentRequire && c.mustAsk(msg):
+		if err := c.ask(ctx, &req); err != nil {
+			return nil, err
+		}
+		c.logf("%s allowed by the user for %s", req, req.Scope())
+	case mode == ConsentRequire:
+		c.logf("%s allowed (approved earlier, until %s)", req, c.approvedUntil(class).Format("15:04"))
+	case mode == ConsentNotify:
+		c.Provider.Notify(req)
+		c.logf("%s started (user notified)", req)
+	default:
+		c.logf("%s started", req)
+	}
+
+	c.hold()
+	return c.release, nil
+}
+
+func (c *Consent) ask(ctx context.Context, req *ConsentRequest) error {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = DefaultConsentTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req.Deadline = req.Time.Add(timeout)
+	if c.ApprovalTTL > 0 {
+		req.Until = req.Time.Add(c.ApprovalTTL)
+	}
+
+	ok, err := c.Provider.Ask(ctx, *req)
+	switch {
+	case err != nil && ctx.Err() != nil:
+		c.logf("%s refused: no answer within %s", req, timeout)
+		return fmt.Errorf("%w: no answer within %s", ErrConsentDenied, timeout)
+	case err != nil:
+		c.logf("%s refused: cannot ask the user: %v", req, err)
+		return fmt.Errorf("%w: cannot ask the user: %v", ErrConsentDenied, err)
+	case !ok:
+		c.logf("%s refused by the user", req)
+		return ErrConsentDenied
+	}
+
+	// Counted from when the user was asked, so the approval never outlasts
+	// the time they were shown.
+	if !req.Until.IsZero() {
+		c.mutex.Lock()
+		c.approved[req.Class] = req.Until
+		c.mutex.Unlock()
+	}
+	return nil
+}
+
+func (c *Consent) approvedUntil(class ConsentClass) time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.approved[class]
+}
+
+// hold marks an operation or shell session as running, starting the remote
+// session if there is none.
+func (c *Consent) hold() {
+	if c == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.active++
+	if c.idle != nil {
+		c.idle.Stop()
+		c.idle = nil
+	}
+	if !c.session {
+		c.session = true
+		c.Provider.Indicate(true)
+		c.logf("Remote session started")
+	}
+}
+
+// release undoes hold. The session ends once nothing has run for Linger.
+func (c *Consent) release() {
+	if c == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.active--
+	if c.active > 0 {
+		return
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(c.Linger, func() {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+
+		if c.idle != timer || c.active > 0 {
+			return
+		}
+		c.idle = nil
+		c.session = false
+		c.approved = make(map[ConsentClass]time.Time)
+		c.Provider.Indicate(false)
+		c.logf("Remote session ended")
+	})
+	c.idle = timer
+}
+
+func (c *Consent) logf(format string, args ...interface{}) {
+	c.logMutex.Lock()
+	defer c.logMutex.Unlock()
+
+	line := time.Now().Format("2006-01-02 15:04:05") + "  " + fmt.Sprintf(format, args...) + "\n"
+	c.log.WriteString(line)
+}
+
+// Close ends the session indicator and closes the log.
+func (c *Consent) Close() error {
+	c.mutex.Lock()
+	if c.idle != nil {
+		c.idle.Stop()
+		c.idle = nil
+	}
+	if c.session {
+		c.session = false
+		c.Provider.Indicate(false)
+		c.logf("Remote session ended")
+	}
+	c.mutex.Unlock()
+
+	c.logMutex.Lock()
+	defer c.logMutex.Unlock()
+	return c.log.Close()
+}
@@ -0,0 +1,156 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// DesktopConsent reaches the user with the desktop's own notifications and
+// dialogs: notify-send and zenity or kdialog on Linux, osascript on macOS
+// and PowerShell on Windows. It only works from inside the user's session;
+// a client running as a service uses FileConsent and the consent helper
+// instead.
+type DesktopConsent struct {
+	// Title heads every notification and dialog.
+	Title string
+}
+
+func NewDesktopConsent() *DesktopConsent {
+	return &DesktopConsent{Title: "HAXinceL2"}
+}
+
+// DesktopConsentAvailable reports whether this process runs in a desktop
+// session DesktopConsent can show things in.
+func DesktopConsentAvailable() bool {
+	var tool string
+	switch runtime.GOOS {
+	case "windows":
+		// Services run without a session name and cannot show windows.
+		if os.Getenv("SESSIONNAME") == "" {
+			return false
+		}
+		tool = "powershell"
+	case "darwin":
+		if os.Geteuid() == 0 {
+			return false
+		}
+		tool = "osascript"
+	default:
+		if os.Getenv("DISPLAY") == "" && os.Getenv("WAYLAND_DISPLAY") == "" {
+			return false
+		}
+		tool = "notify-send"
+	}
+	_, err := exec.LookPath(tool)
+	return err == nil
+}
+
+// The text of dialogs and notifications reaches osascript and PowerShell
+// through the environment, so nothing in it is ever parsed as script.
+const (
+	consentTextEnv  = "HAXINCEL2_CONSENT_TEXT"
+	consentTitleEnv = "HAXINCEL2_CONSENT_TITLE"
+)
+
+func (p *DesktopConsent) Ask(ctx context.Context, req ConsentRequest) (bool, error) {
+	text := fmt.Sprintf("A remote operator wants to run:\n\n%s\n\nAllow %s?", req, req.Scope())
+
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "windows":
+		cmd = exec.CommandContext(ctx, "powershell", "-NoProfile", "-NonInteractive", "-Command",
+			"Add-Type -AssemblyName System.Windows.Forms; "+
+				"[System.Windows.Forms.MessageBox]::Show($env:"+consentTextEnv+", $env:"+consentTitleEnv+", 'YesNo', 'Warning', 'Button2')")
+	case "darwin":
+		cmd = exec.CommandContext(ctx, "osascript", "-e",
+			`display dialog (system attribute "`+consentTextEnv+`") with title (system attribute "`+consentTitleEnv+`") `+
+				`buttons {"Deny", "Allow"} default button "Deny" cancel button "Deny" with icon caution`)
+	default:
+		if zenity, err := exec.LookPath("zenity"); err == nil {
+			cmd = exec.CommandContext(ctx, zenity, "--question", "--no-markup", "--title", p.Title, "--text", text,
+				"--ok-label", "Allow", "--cancel-label", "Deny")
+		} else if kdialog, err := exec.LookPath("kdialog"); err == nil {
+			cmd = exec.CommandContext(ctx, kdialog, "--title", p.Title, "--yesno", text,
+				"--yes-label", "Allow", "--no-label", "Deny")
+		} else {
+			return false, errors.New("neither zenity nor kdialog is installed")
+		}
+	}
+	cmd.Env = p.env(text)
+
+	out, err := cmd.Output()
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	var exitErr *exec.ExitError
+	switch {
+	case errors.As(err, &exitErr):
+		// Deny, or the dialog was closed.
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+
+	answer := strings.TrimSpace(string(out))
+	switch runtime.GOOS {
+	case "windows":
+		return answer == "Yes", nil
+	case "darwin":
+		return strings.HasSuffix(answer, ":Allow"), nil
+	}
+	return true, nil
+}
+
+func (p *DesktopConsent) Notify(req ConsentRequest) {
+	p.notify("A remote operator is running:\n"+req.String(), false)
+}
+
+func (p *DesktopConsent) Indicate(active bool) {
+	if active {
+		p.notify("Remote session active: an operator is working on this computer.", true)
+	} else {
+		p.notify("Remote session ended.", false)
+	}
+}
+
+// notify shows text without waiting for it to go away. Sticky
+// notifications stay until dismissed where the desktop supports that.
+func (p *DesktopConsent) notify(text string, sticky bool) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "windows":
+		cmd = exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command",
+			"Add-Type -AssemblyName System.Windows.Forms; "+
+				"$n = New-Object System.Windows.Forms.NotifyIcon; "+
+				"$n.Icon = [System.Drawing.SystemIcons]::Warning; "+
+				"$n.BalloonTipTitle = $env:"+consentTitleEnv+"; "+
+				"$n.BalloonTipText = $env:"+consentTextEnv+"; "+
+				"$n.Visible = $true; $n.ShowBalloonTip(10000); Start-Sleep -Seconds 10; $n.Dispose()")
+	case "darwin":
+		cmd = exec.Command("osascript", "-e",
+			`display notification (system attribute "`+consentTextEnv+`") with title (system attribute "`+consentTitleEnv+`")`)
+	default:
+		urgency := "normal"
+		if sticky {
+			urgency = "critical"
+		}
+		cmd = exec.Command("notify-send", "--app-name", p.Title, "--urgency", urgency, p.Title, text)
+	}
+	cmd.Env = p.env(text)
+
+	if err := cmd.Start(); err != nil {
+		log.Printf("Failed to show desktop notification: %v", err)
+		return
+	}
+	go cmd.Wait()
+}
+
+func (p *DesktopConsent) env(text string) []string {
+	return append(os.Environ(), consentTextEnv+"="+text, consentTitleEnv+"="+p.Title)
+}
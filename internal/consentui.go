@@ -0,0 +1,364 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StdioConsent asks on a terminal: requests and notices are written to Out
+// and answered by typing y or n on In. It stands in for a desktop provider
+// on headless machines and in tests.
+type StdioConsent struct {
+	Out io.Writer
+
+	askMutex sync.Mutex
+	lines    chan string
+}
+
+func NewStdioConsent(in io.Reader, out io.Writer) *StdioConsent {
+	p := &StdioConsent{Out: out, lines: make(chan string)}
+	go func() {
+		scanner := bufio.NewScanner(in)
+		for scanner.Scan() {
+			p.lines <- strings.TrimSpace(scanner.Text())
+		}
+		close(p.lines)
+	}()
+	return p
+}
+
+func (p *StdioConsent) Ask(ctx context.Context, req ConsentRequest) (bool, error) {
+	p.askMutex.Lock()
+	defer p.askMutex.Unlock()
+
+	// Drop anything typed while nobody was asking.
+	for drained := false; !drained; {
+		select {
+		case <-p.lines:
+		default:
+			drained = true
+		}
+	}
+
+	fmt.Fprintf(p.Out, "\n[consent] A remote operator wants to run: %s\n[consent] Allow %s? [y/N] ", req, req.Scope())
+	select {
+	case line, ok := <-p.lines:
+		if !ok {
+			return false, io.EOF
+		}
+		answer := strings.ToLower(line)
+		return answer == "y" || answer == "yes", nil
+	case <-ctx.Done():
+		fmt.Fprintln(p.Out, "\n[consent] No answer, refused.")
+		return false, ctx.Err()
+	}
+}
+
+func (p *StdioConsent) Notify(req ConsentRequest) {
+	fmt.Fprintf(p.Out, "[consent] A remote operator is running: %s\n", req)
+}
+
+func (p *StdioConsent) Indicate(active bool) {
+	if active {
+		fmt.Fprintln(p.Out, "[consent] ● Remote session active")
+	} else {
+		fmt.Fprintln(p.Out, "[consent] ○ Remote session ended")
+	}
+}
+
+// consentPollInterval is how often FileConsent looks for an answer and
+// WatchConsent for changes.
+const consentPollInterval = 500 * time.Millisecond
+
+// FileConsent talks to the user through files in Dir, for a helper running
+// in the user's desktop session (see WatchConsent and cmd/consent) or a
+// person with a shell:
+//
+//	ACTIVE                 exists while a remote session is active
+//	notices                a ConsentRequest as JSON per line for each
+//	                       operation started in notify mode
+//	<id>.request           a ConsentRequest as JSON waiting for approval
+//	answers/<id>.allow     created by the user to approve it,
+//	answers/<id>.deny      or to refuse it
+//
+// Dir stays owned by whoever runs the client; only answers is writable by
+// the user, and the client never writes there, so the user cannot point
+// the client's writes elsewhere with symlinks.
+type FileConsent struct {
+	Dir string
+}
+
+// NewFileConsent creates dir and its answers directory. On Unix the answers
+// directory is given to the local user owner; without one, any local user
+// may answer (it is world-writable and sticky, like /tmp). On Windows it
+// inherits the ProgramData default, which lets local users create files,
+// and owner is not supported.
+func NewFileConsent(dir, owner string) (*FileConsent, error) {
+	answers := filepath.Join(dir, "answers")
+	if err := os.MkdirAll(answers, 0755); err != nil {
+		return nil, err
+	}
+	// MkdirAll applies the umask and leaves existing directories alone.
+	if err := os.Chmod(dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := shareConsentAnswers(answers, owner); err != nil {
+		return nil, fmt.Errorf("give %s to %s: %w", answers, owner, err)
+	}
+	return &FileConsent{Dir: dir}, nil
+}
+
+func shareConsentAnswers(dir, owner string) error {
+	if runtime.GOOS == "windows" {
+		if owner != "" {
+			return errors.New("consent user is not supported on Windows")
+		}
+		return nil
+	}
+	if owner == "" {
+		return os.Chmod(dir, 0733|os.ModeSticky)
+	}
+
+	u, err := user.Lookup(owner)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return err
+	}
+	if err := os.Chown(dir, uid, gid); err != nil {
+		return err
+	}
+	return os.Chmod(dir, 0700)
+}
+
+func (p *FileConsent) Ask(ctx context.Context, req ConsentRequest) (bool, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return false, err
+	}
+	request := filepath.Join(p.Dir, filepath.Base(req.ID)+".request")
+	answer := filepath.Join(p.Dir, "answers", filepath.Base(req.ID))
+	if err := writeFileAtomic(request, append(data, '\n'), 0644); err != nil {
+		return false, err
+	}
+	defer func() {
+		for _, path := range []string{request, answer + ".allow", answer + ".deny"} {
+			os.Remove(path)
+		}
+	}()
+
+	ticker := time.NewTicker(consentPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := os.Stat(answer + ".deny"); err == nil {
+			return false, nil
+		}
+		if _, err := os.Stat(answer + ".allow"); err == nil {
+			return true, nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+}
+
+func (p *FileConsent) Notify(req ConsentRequest) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return
+	}
+
+	f, err := os.OpenFile(filepath.Join(p.Dir, "notices"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		log.Printf("Failed to write consent notice: %v", err)
+		return
+	}
+	defer f.Close()
+
+	f.Write(append(data, '\n'))
+}
+
+func (p *FileConsent) Indicate(active bool) {
+	path := filepath.Join(p.Dir, "ACTIVE")
+	var err error
+	if active {
+		err = os.WriteFile(path, []byte(time.Now().Format(time.RFC3339)+"\n"), 0644)
+	} else if err = os.Remove(path); errors.Is(err, os.ErrNotExist) {
+		err = nil
+	}
+	if err != nil {
+		log.Printf("Failed to update session indicator: %v", err)
+	}
+}
+
+// WatchConsent relays the FileConsent directory dir to provider until ctx
+// ends. It runs as the local user, in their desktop session: requests are
+// asked through provider and answered in dir/answers, and notices and the
+// session indicator are passed on. Notices written before it started are
+// skipped.
+func WatchConsent(ctx context.Context, dir string, provider ConsentProvider) error {
+	w := &consentWatcher{
+		dir:      dir,
+		provider: provider,
+		asking:   make(map[string]bool),
+	}
+	if info, err := os.Stat(filepath.Join(dir, "notices")); err == nil {
+		w.offset = info.Size()
+	}
+
+	ticker := time.NewTicker(consentPollInterval)
+	defer ticker.Stop()
+
+	for {
+		w.poll(ctx)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+type consentWatcher struct {
+	dir      string
+	provider ConsentProvider
+	active   bool
+	offset   int64
+
+	mutex  sync.Mutex
+	asking map[string]bool
+}
+
+func (w *consentWatcher) poll(ctx context.Context) {
+	_, err := os.Stat(filepath.Join(w.dir, "ACTIVE"))
+	if active := err == nil; active != w.active {
+		w.active = active
+		w.provider.Indicate(active)
+	}
+
+	w.readNotices()
+
+	requests, _ := filepath.Glob(filepath.Join(w.dir, "*.request"))
+	for _, path := range requests {
+		w.mutex.Lock()
+		asking := w.asking[path]
+		w.asking[path] = true
+		w.mutex.Unlock()
+
+		if !asking {
+			go w.ask(ctx, path)
+		}
+	}
+}
+
+// readNotices passes on the notices appended since the last poll.
+func (w *consentWatcher) readNotices() {
+	f, err := os.Open(filepath.Join(w.dir, "notices"))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	if info, err := f.Stat(); err == nil && info.Size() < w.offset {
+		// Truncated or replaced: start over.
+		w.offset = 0
+	}
+	if _, err := f.Seek(w.offset, io.SeekStart); err != nil {
+		return
+	}
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			// A partial line is read again once it is complete.
+			return
+		}
+		w.offset += int64(len(line))
+
+		var req ConsentRequest
+		if json.Unmarshal(line, &req) == nil {
+			w.provider.Notify(req)
+		}
+	}
+}
+
+// ask puts the request at path to the user and leaves their answer for the
+// client.
+func (w *consentWatcher) ask(ctx context.Context, path string) {
+	// The client removes the request once it is answered or given up on;
+	// forget it only then, so it is not asked twice.
+	defer func() {
+		for {
+			if _, err := os.Stat(path); err != nil {
+				break
+			}
+			select {
+			case <-time.After(consentPollInterval):
+			case <-ctx.Done():
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		w.mutex.Lock()
+		delete(w.asking, path)
+		w.mutex.Unlock()
+	}()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	var req ConsentRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		log.Printf("Ignoring consent request %s: %v", path, err)
+		return
+	}
+
+	askCtx := ctx
+	if !req.Deadline.IsZero() {
+		var cancel context.CancelFunc
+		askCtx, cancel = context.WithDeadline(ctx, req.Deadline)
+		defer cancel()
+	}
+
+	ok, err := w.provider.Ask(askCtx, req)
+	if err != nil {
+		log.Printf("Consent request %s not answered: %v", req.ID, err)
+		return
+	}
+
+	answer := ".deny"
+	if ok {
+		answer = ".allow"
+	}
+	answerPath := filepath.Join(w.dir, "answers", strings.TrimSuffix(filepath.Base(path), ".request")+answer)
+	if err := os.WriteFile(answerPath, nil, 0600); err != nil {
+		log.Printf("Failed to answer consent request %s: %v", req.ID, err)
+	}
+}
@@ -0,0 +1,32 @@
+package internal
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// DashboardPrefix is where DashboardHandler expects to be mounted.
+const DashboardPrefix = "/ui/"
+
+//go:embed web
+var webFiles embed.FS
+
+// DashboardHandler serves the embedded web dashboard. The pages themselves
+// are static and public; the browser signs in with the operator token and
+// reads everything through HandleAPI.
+func DashboardHandler() http.Handler {
+	root, err := fs.Sub(webFiles, "web")
+	if err != nil {
+		panic(err)
+	}
+	files := http.StripPrefix(DashboardPrefix, http.FileServer(http.FS(root)))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("Content-Security-Policy", "default-src 'self'; img-src 'self' data: blob:; frame-ancestors 'none'")
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("Referrer-Policy", "no-referrer")
+		files.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,141 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image/png"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+
+	"github.com/E2klime/HAXinceL2/internal/protocol"
+	"github.com/kbinani/screenshot"
+)
+
+func init() {
+	RegisterModule(Module{
+		Name:       "screenshot",
+		Capability: protocol.CapScreenshot,
+		Available:  func() bool { return screenshot.NumActiveDisplays() > 0 },
+		Handlers: []HandlerSpec{
+			{Type: protocol.TypeScreenshot, Handler: HandlerFunc((*Client).handleScreenshot), MaxConcurrent: 1},
+		},
+	})
+	RegisterModule(Module{
+		Name:       "webcam",
+		Capability: protocol.CapWebcam,
+		// Streaming is not implemented yet, so the capability is never
+		// advertised.
+		Available: func() bool { return false },
+		Handlers: []HandlerSpec{
+			{Type: protocol.TypeWebcam, Handler: HandlerFunc((*Client).handleWebcam), MaxConcurrent: 1},
+		},
+	})
+	RegisterModule(Module{
+		Name:       "show_image",
+		Capability: protocol.CapShowImage,
+		Handlers: []HandlerSpec{
+			{Type: protocol.TypeShowImage, Handler: HandlerFunc((*Client).handleShowImage), MaxConcurrent: 1},
+		},
+	})
+}
+
+func (c *Client) handleScreenshot(ctx context.Context, msg *protocol.Message) {
+	log.Println("Taking screenshot...")
+
+	n := screenshot.NumActiveDisplays()
+	if n == 0 {
+		c.sendError(msg, "No active displays", nil)
+		return
+	}
+
+	bounds := screenshot.GetDisplayBounds(0)
+	img, err := screenshot.CaptureRect(bounds)
+	if err != nil {
+		c.sendError(msg, "Failed to capture screenshot", err)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		c.sendError(msg, "Failed to encode screenshot", err)
+		return
+	}
+
+	c.sendBinaryResponse(msg, "", buf.Bytes())
+
+	log.Printf("Screenshot sent (%d bytes)", buf.Len())
+}
+
+func (c *Client) handleWebcam(ctx context.Context, msg *protocol.Message) {
+	var payload protocol.WebcamPayload
+	if err := msg.Decode(&payload); err != nil {
+		c.sendError(msg, "Failed to parse webcam payload", err)
+		return
+	}
+
+	log.Printf("Starting webcam stream for %d seconds...", payload.Duration)
+
+	c.sendResponse(msg, true, "Webcam streaming not implemented yet", "")
+}
+
+func (c *Client) handleShowImage(ctx context.Context, msg *protocol.Message) {
+	var payload protocol.ShowImagePayload
+	if err := msg.Decode(&payload); err != nil {
+		c.sendError(msg, "Failed to parse show image payload", err)
+		return
+	}
+
+	log.Printf("Showing image: %s", payload.ImageURL)
+
+	html := fmt.Sprintf(`<!DOCTYPE html>
+<html>
+<head>
+	<style>
+		body { margin: 0; padding: 0; overflow: hidden; background: black; }
+		img { width: 100vw; height: 100vh; object-fit: contain; }
+	</style>
+</head>
+<body>
+	<img src="%s" alt="Warning">
+	<script>
+		document.addEventListener('keydown', () => window.close());
+		%s
+	</script>
+</body>
+</html>`, payload.ImageURL, func() string {
+		if payload.Duration > 0 {
+			return fmt.Sprintf("setTimeout(() => window.close(), %d000);", payload.Duration)
+		}
+		return ""
+	}())
+
+	tmpFile := "/tmp/show_image.html"
+	if runtime.GOOS == "windows" {
+		tmpFile = os.Getenv("TEMP") + "\\show_image.html"
+	}
+
+	if err := os.WriteFile(tmpFile, []byte(html), 0644); err != nil {
+		c.sendError(msg, "Failed to create HTML file", err)
+		return
+	}
+
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "windows":
+		cmd = exec.Command("cmd", "/C", "start", "", tmpFile)
+	case "darwin":
+		cmd = exec.Command("open", "-a", "Google Chrome", "--args", "--start-fullscreen", tmpFile)
+	default:
+		cmd = exec.Command("xdg-open", tmpFile)
+	}
+
+	if err := cmd.Start(); err != nil {
+		c.sendError(msg, "Failed to open image", err)
+		return
+	}
+
+	c.sendResponse(msg, true, "Image displayed", "")
+}
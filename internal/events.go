@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Event types published to Subscribe callers.
+const (
+	// EventClient carries a *ClientRecord whenever a client connects or
+	// disconnects.
+	EventClient = "client"
+	// EventJob carries a *QueueItem whenever a queued operation changes.
+	EventJob = "job"
+	// EventApproval carries an *Approval whenever one is requested or
+	// decided.
+	EventApproval = "approval"
+)
+
+const (
+	eventBuffer       = 64
+	eventKeepAlive    = 20 * time.Second
+	eventWriteTimeout = 10 * time.Second
+)
+
+// Event is a change operators may want to see live.
+type Event struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+}
+
+type eventHub struct {
+	mutex       sync.Mutex
+	subscribers map[chan Event]struct{}
+}
+
+// subscribe returns a channel of server events and a function that ends the
+// subscription. Slow subscribers miss events rather than block the server.
+func (s *Server) subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, eventBuffer)
+
+	s.events.mutex.Lock()
+	if s.events.subscribers == nil {
+		s.events.subscribers = make(map[chan Event]struct{})
+	}
+	s.events.subscribers[ch] = struct{}{}
+	s.events.mutex.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			s.events.mutex.Lock()
+			delete(s.events.subscribers, ch)
+			s.events.mutex.Unlock()
+		})
+	}
+}
+
+func (s *Server) publish(ev Event) {
+	s.events.mutex.Lock()
+	defer s.events.mutex.Unlock()
+
+	for ch := range s.events.subscribers {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+func (s *Server) publishClient(clientID string) {
+	rec, err := s.lookupClientRecord(clientID)
+	if err != nil {
+		return
+	}
+	s.publish(Event{Type: EventClient, Data: rec})
+}
+
+func (s *Server) publishJob(item *QueueItem) {
+	s.publish(Event{Type: EventJob, Data: item.summary()})
+}
+
+// serveEvents streams the server events op may see as Server-Sent Events.
+func (s *Server) serveEvents(w http.ResponseWriter, r *http.Request, op *Operator) {
+	rc := http.NewResponseController(w)
+
+	events, unsubscribe := s.subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		log.Printf("API: event stream to %s not supported: %v", r.RemoteAddr, err)
+		return
+	}
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		var err error
+
+		rc.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+		case ev := <-events:
+			if !op.sees(ev) {
+				continue
+			}
+			data, _ := json.Marshal(ev.Data)
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
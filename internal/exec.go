@@ -0,0 +1,267 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/E2klime/HAXinceL2/internal/protocol"
+)
+
+const (
+	outputFlushInterval = 300 * time.Millisecond
+	outputChunkSize     = 16 << 10
+	// How long Wait keeps waiting for output pipes held open by orphaned
+	// grandchildren after the command itself exited or was killed.
+	commandWaitDelay = 5 * time.Second
+)
+
+func init() {
+	RegisterModule(Module{
+		Name:       "exec",
+		Capability: protocol.CapExec,
+		Handlers: []HandlerSpec{
+			{Type: protocol.TypeCommand, Handler: HandlerFunc((*Client).handleCommand), MaxConcurrent: 8},
+		},
+	})
+	RegisterModule(Module{
+		Name:       "stream",
+		Capability: protocol.CapStream,
+		Handlers: []HandlerSpec{
+			// Cancels any job, not only streamed commands; inline so it is
+			// never stuck behind the jobs it is meant to stop.
+			{Type: protocol.TypeCancel, Handler: HandlerFunc((*Client).handleCancel), Ordered: true},
+		},
+	})
+}
+
+func (c *Client) handleCommand(ctx context.Context, msg *protocol.Message) {
+	var payload protocol.CommandPayload
+	if err := msg.Decode(&payload); err != nil {
+		c.sendError(msg, "Failed to parse command", err)
+		return
+	}
+
+	log.Printf("Executing command: %s %v (stream: %t, timeout: %ds, dir: %q)",
+		payload.Command, payload.Args, payload.Stream, payload.Timeout, payload.WorkDir)
+
+	if payload.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(payload.Timeout)*time.Second)
+		defer cancel()
+	}
+
+	cmd := shellCommand(payload.Command, payload.Args)
+	cmd.Dir = payload.WorkDir
+	cmd.WaitDelay = commandWaitDelay
+	prepareProcessGroup(cmd)
+
+	var (
+		output   bytes.Buffer
+		streamer *outputStreamer
+	)
+	if payload.Stream {
+		streamer = newOutputStreamer(c, msg.RequestID)
+		cmd.Stdout = streamer.writer("stdout")
+		cmd.Stderr = streamer.writer("stderr")
+	} else {
+		cmd.Stdout = &output
+		cmd.Stderr = &output
+	}
+
+	if err := cmd.Start(); err != nil {
+		c.sendError(msg, "Failed to start command", err)
+		return
+	}
+
+	waitDone := make(chan error, 1)
+	go func() {
+		waitDone <- cmd.Wait()
+	}()
+
+	var (
+		err    error
+		killed bool
+	)
+	select {
+	case err = <-waitDone:
+	case <-ctx.Done():
+		killed = true
+		if killErr := killProcessTree(cmd); killErr != nil {
+			log.Printf("Failed to kill process tree of %d: %v", cmd.Process.Pid, killErr)
+		}
+		err = <-waitDone
+	}
+
+	if streamer != nil {
+		streamer.close()
+	}
+
+	result := protocol.ResponsePayload{
+		Success:  err == nil && !killed,
+		Data:     output.String(),
+		ExitCode: exitCode(err),
+	}
+
+	switch {
+	case killed && errors.Is(ctx.Err(), context.DeadlineExceeded):
+		result.Error = fmt.Sprintf("timed out after %ds", payload.Timeout)
+	case killed:
+		result.Error = "cancelled"
+	case err != nil:
+		result.Error = err.Error()
+	}
+
+	c.sendResponsePayload(msg, result)
+}
+
+func exitCode(err error) int {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	if err != nil {
+		return -1
+	}
+	return 0
+}
+
+// outputStreamer batches process output into TypeOutput messages tagged with
+// the job ID, flushing periodically or whenever a chunk fills up.
+type outputStreamer struct {
+	client *Client
+	jobID  string
+
+	mutex   sync.Mutex
+	buffers map[string]*bytes.Buffer
+	seq     int
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newOutputStreamer(c *Client, jobID string) *outputStreamer {
+	s := &outputStreamer{
+		client:  c,
+		jobID:   jobID,
+		buffers: make(map[string]*bytes.Buffer),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go s.loop()
+	return s
+}
+
+func (s *outputStreamer) writer(stream string) io.Writer {
+	s.mutex.Lock()
+	s.buffers[stream] = &bytes.Buffer{}
+	s.mutex.Unlock()
+
+	return &streamWriter{streamer: s, stream: stream}
+}
+
+func (s *outputStreamer) write(stream string, p []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	buf := s.buffers[stream]
+	buf.Write(p)
+	for buf.Len() >= outputChunkSize {
+		s.flushLocked(stream, outputChunkSize, false)
+	}
+}
+
+func (s *outputStreamer) loop() {
+	ticker := time.NewTicker(outputFlushInterval)
+	defer ticker.Stop()
+	defer close(s.done)
+
+	for {
+		select {
+		case <-s.stop:
+			s.flushAll(true)
+			return
+		case <-ticker.C:
+			s.flushAll(false)
+		}
+	}
+}
+
+func (s *outputStreamer) flushAll(final bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for stream, buf := range s.buffers {
+		if buf.Len() > 0 {
+			s.flushLocked(stream, buf.Len(), final)
+		}
+	}
+}
+
+// flushLocked sends up to limit bytes of stream. Unless final, a trailing
+// incomplete UTF-8 sequence is held back for the next chunk.
+func (s *outputStreamer) flushLocked(stream string, limit int, final bool) {
+	buf := s.buffers[stream]
+	data := buf.Bytes()
+	if len(data) > limit {
+		data = data[:limit]
+	}
+	if !final {
+		data = trimIncompleteRune(data)
+		if len(data) == 0 {
+			if buf.Len() < utf8.UTFMax {
+				return
+			}
+			data = buf.Bytes()[:1]
+		}
+	}
+
+	s.seq++
+	payload := protocol.OutputPayload{
+		JobID:  s.jobID,
+		Stream: stream,
+		Seq:    s.seq,
+		Data:   string(data),
+	}
+	buf.Next(len(data))
+
+	msg := protocol.NewOutput(payload)
+	msg.RequestID = s.jobID
+	if err := s.client.writeMessage(msg); err != nil {
+		log.Printf("Failed to send output of job %s: %v", s.jobID, err)
+	}
+}
+
+func (s *outputStreamer) close() {
+	close(s.stop)
+	<-s.done
+}
+
+type streamWriter struct {
+	streamer *outputStreamer
+	stream   string
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	w.streamer.write(w.stream, p)
+	return len(p), nil
+}
+
+func trimIncompleteRune(data []byte) []byte {
+	for i := 1; i <= utf8.UTFMax && i <= len(data); i++ {
+		if utf8.RuneStart(data[len(data)-i]) {
+			if !utf8.FullRune(data[len(data)-i:]) {
+				return data[:len(data)-i]
+			}
+			return data
+		}
+	}
+	return data
+}
@@ -0,0 +1,33 @@
+//go:build !windows
+
+package internal
+
+import (
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+func shellCommand(command string, args []string) *exec.Cmd {
+	cmdStr := command
+	if len(args) > 0 {
+		cmdStr += " " + strings.Join(args, " ")
+	}
+	return exec.Command("sh", "-c", cmdStr)
+}
+
+// prepareProcessGroup starts the command in its own process group so the
+// whole tree can be signalled at once.
+func prepareProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func killProcessTree(cmd *exec.Cmd) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err != nil {
+		return cmd.Process.Kill()
+	}
+	return nil
+}
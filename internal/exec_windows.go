@@ -0,0 +1,31 @@
+//go:build windows
+
+package internal
+
+import (
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+func shellCommand(command string, args []string) *exec.Cmd {
+	cmdArgs := append([]string{"/C", command}, args...)
+	return exec.Command("cmd", cmdArgs...)
+}
+
+func prepareProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// killProcessTree terminates the command and every process it spawned;
+// TerminateProcess alone would leave the children of cmd.exe running.
+func killProcessTree(cmd *exec.Cmd) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	kill := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid))
+	if err := kill.Run(); err != nil {
+		return cmd.Process.Kill()
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -12,40 +13,77 @@ import (
 	"github.com/E2klime/HAXinceL2/internal/protocol"
 )
 
-func (c *Client) handleFileRead(msg *protocol.Message) {
+// maxInlineFileSize bounds files returned whole in a single response; larger
+// files must go through a chunked transfer.
+const maxInlineFileSize = 16 << 20
+
+func checkInlineSize(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Size() > maxInlineFileSize {
+		return fmt.Errorf("file is %d bytes, use a chunked transfer for files over %d bytes", info.Size(), maxInlineFileSize)
+	}
+	return nil
+}
+
+func init() {
+	RegisterModule(Module{
+		Name:       "files",
+		Capability: protocol.CapFiles,
+		Handlers: []HandlerSpec{
+			{Type: protocol.TypeFileRead, Handler: HandlerFunc((*Client).handleFileRead), MaxConcurrent: 4},
+			{Type: protocol.TypeFileWrite, Handler: HandlerFunc((*Client).handleFileWrite), MaxConcurrent: 4},
+			{Type: protocol.TypeFileDelete, Handler: HandlerFunc((*Client).handleFileDelete), MaxConcurrent: 4},
+			{Type: protocol.TypeFileList, Handler: HandlerFunc((*Client).handleFileList), MaxConcurrent: 4},
+			{Type: protocol.TypeFileDownload, Handler: HandlerFunc((*Client).handleFileDownload), MaxConcurrent: 2},
+		},
+	})
+}
+
+func (c *Client) handleFileRead(ctx context.Context, msg *protocol.Message) {
 	var payload protocol.FileReadPayload
-	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-		c.sendError("Failed to parse file read payload", err)
+	if err := msg.Decode(&payload); err != nil {
+		c.sendError(msg, "Failed to parse file read payload", err)
 		return
 	}
 
 	log.Printf("Reading file: %s", payload.Path)
 
+	if err := checkInlineSize(payload.Path); err != nil {
+		c.sendError(msg, fmt.Sprintf("Failed to read file %s", payload.Path), err)
+		return
+	}
+
 	data, err := os.ReadFile(payload.Path)
 	if err != nil {
-		c.sendError(fmt.Sprintf("Failed to read file %s", payload.Path), err)
+		c.sendError(msg, fmt.Sprintf("Failed to read file %s", payload.Path), err)
 		return
 	}
 
-	encoded := base64.StdEncoding.EncodeToString(data)
-	c.sendResponse(true, encoded, "")
+	c.sendBinaryResponse(msg, "", data)
 
 	log.Printf("File read successfully: %s (%d bytes)", payload.Path, len(data))
 }
 
-func (c *Client) handleFileWrite(msg *protocol.Message) {
+func (c *Client) handleFileWrite(ctx context.Context, msg *protocol.Message) {
 	var payload protocol.FileWritePayload
-	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-		c.sendError("Failed to parse file write payload", err)
+	if err := msg.Decode(&payload); err != nil {
+		c.sendError(msg, "Failed to parse file write payload", err)
 		return
 	}
 
 	log.Printf("Writing file: %s", payload.Path)
 
-	data, err := base64.StdEncoding.DecodeString(payload.Content)
-	if err != nil {
-		c.sendError("Failed to decode file content", err)
-		return
+	data := msg.Binary
+	if data == nil {
+		var err error
+		data, err = base64.StdEncoding.DecodeString(payload.Content)
+		if err != nil {
+			c.sendError(msg, "Failed to decode file content", err)
+			return
+		}
 	}
 
 	mode := fs.FileMode(0644)
@@ -55,23 +93,23 @@ func (c *Client) handleFileWrite(msg *protocol.Message) {
 
 	dir := filepath.Dir(payload.Path)
 	if err := os.MkdirAll(dir, 0755); err != nil {
-		c.sendError("Failed to create directory", err)
+		c.sendError(msg, "Failed to create directory", err)
 		return
 	}
 
 	if err := os.WriteFile(payload.Path, data, mode); err != nil {
-		c.sendError(fmt.Sprintf("Failed to write file %s", payload.Path), err)
+		c.sendError(msg, fmt.Sprintf("Failed to write file %s", payload.Path), err)
 		return
 	}
 
-	c.sendResponse(true, fmt.Sprintf("File written successfully: %d bytes", len(data)), "")
+	c.sendResponse(msg, true, fmt.Sprintf("File written successfully: %d bytes", len(data)), "")
 	log.Printf("File written successfully: %s (%d bytes)", payload.Path, len(data))
 }
 
-func (c *Client) handleFileDelete(msg *protocol.Message) {
+func (c *Client) handleFileDelete(ctx context.Context, msg *protocol.Message) {
 	var payload protocol.FileDeletePayload
-	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-		c.sendError("Failed to parse file delete payload", err)
+	if err := msg.Decode(&payload); err != nil {
+		c.sendError(msg, "Failed to parse file delete payload", err)
 		return
 	}
 
@@ -79,7 +117,7 @@ func (c *Client) handleFileDelete(msg *protocol.Message) {
 
 	info, err := os.Stat(payload.Path)
 	if err != nil {
-		c.sendError(fmt.Sprintf("File/directory not found: %s", payload.Path), err)
+		c.sendError(msg, fmt.Sprintf("File/directory not found: %s", payload.Path), err)
 		return
 	}
 
@@ -90,18 +128,18 @@ func (c *Client) handleFileDelete(msg *protocol.Message) {
 	}
 
 	if err != nil {
-		c.sendError(fmt.Sprintf("Failed to delete %s", payload.Path), err)
+		c.sendError(msg, fmt.Sprintf("Failed to delete %s", payload.Path), err)
 		return
 	}
 
-	c.sendResponse(true, fmt.Sprintf("Deleted successfully: %s", payload.Path), "")
+	c.sendResponse(msg, true, fmt.Sprintf("Deleted successfully: %s", payload.Path), "")
 	log.Printf("Deleted successfully: %s", payload.Path)
 }
 
-func (c *Client) handleFileList(msg *protocol.Message) {
+func (c *Client) handleFileList(ctx context.Context, msg *protocol.Message) {
 	var payload protocol.FileListPayload
-	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-		c.sendError("Failed to parse file list payload", err)
+	if err := msg.Decode(&payload); err != nil {
+		c.sendError(msg, "Failed to parse file list payload", err)
 		return
 	}
 
@@ -109,7 +147,7 @@ func (c *Client) handleFileList(msg *protocol.Message) {
 
 	entries, err := os.ReadDir(payload.Path)
 	if err != nil {
-		c.sendError(fmt.Sprintf("Failed to read directory %s", payload.Path), err)
+		c.sendError(msg, fmt.Sprintf("Failed to read directory %s", payload.Path), err)
 		return
 	}
 
@@ -134,18 +172,18 @@ func (c *Client) handleFileList(msg *protocol.Message) {
 
 	jsonData, err := json.Marshal(files)
 	if err != nil {
-		c.sendError("Failed to serialize file list", err)
+		c.sendError(msg, "Failed to serialize file list", err)
 		return
 	}
 
-	c.sendResponse(true, string(jsonData), "")
+	c.sendResponse(msg, true, string(jsonData), "")
 	log.Printf("Directory listed successfully: %s (%d files)", payload.Path, len(files))
 }
 
-func (c *Client) handleFileDownload(msg *protocol.Message) {
+func (c *Client) handleFileDownload(ctx context.Context, msg *protocol.Message) {
 	var payload protocol.FileDownloadPayload
-	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-		c.sendError("Failed to parse file download payload", err)
+	if err := msg.Decode(&payload); err != nil {
+		c.sendError(msg, "Failed to parse file download payload", err)
 		return
 	}
 
@@ -153,18 +191,23 @@ func (c *Client) handleFileDownload(msg *protocol.Message) {
 
 	info, err := os.Stat(payload.Path)
 	if err != nil {
-		c.sendError(fmt.Sprintf("File not found: %s", payload.Path), err)
+		c.sendError(msg, fmt.Sprintf("File not found: %s", payload.Path), err)
 		return
 	}
 
 	if info.IsDir() {
-		c.sendError("Cannot download directory", fmt.Errorf("path is a directory"))
+		c.sendError(msg, "Cannot download directory", fmt.Errorf("path is a directory"))
+		return
+	}
+
+	if err := checkInlineSize(payload.Path); err != nil {
+		c.sendError(msg, fmt.Sprintf("Failed to read file %s", payload.Path), err)
 		return
 	}
 
 	data, err := os.ReadFile(payload.Path)
 	if err != nil {
-		c.sendError(fmt.Sprintf("Failed to read file %s", payload.Path), err)
+		c.sendError(msg, fmt.Sprintf("Failed to read file %s", payload.Path), err)
 		return
 	}
 
@@ -174,15 +217,14 @@ func (c *Client) handleFileDownload(msg *protocol.Message) {
 		"size":     info.Size(),
 		"mod_time": info.ModTime().Unix(),
 		"mode":     info.Mode().String(),
-		"content":  base64.StdEncoding.EncodeToString(data),
 	}
 
 	jsonData, err := json.Marshal(result)
 	if err != nil {
-		c.sendError("Failed to serialize download result", err)
+		c.sendError(msg, "Failed to serialize download result", err)
 		return
 	}
 
-	c.sendResponse(true, string(jsonData), "")
+	c.sendBinaryResponse(msg, string(jsonData), data)
 	log.Printf("File downloaded successfully: %s (%d bytes)", payload.Path, len(data))
 }
@@ -0,0 +1,286 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/E2klime/HAXinceL2/internal/protocol"
+)
+
+func init() {
+	RegisterModule(Module{
+		Name:       "transfer",
+		Capability: protocol.CapTransfer,
+		Handlers: []HandlerSpec{
+			{Type: protocol.TypeTransferStart, Handler: HandlerFunc((*Client).handleTransferStart)},
+			// Enough for a few transfers' windows without holding many
+			// megabyte buffers at once.
+			{Type: protocol.TypeTransferChunk, Handler: HandlerFunc((*Client).handleTransferChunk), MaxConcurrent: 8},
+			{Type: protocol.TypeTransferEnd, Handler: HandlerFunc((*Client).handleTransferEnd), MaxConcurrent: 2},
+			{Type: protocol.TypeTransferAbort, Handler: HandlerFunc((*Client).handleTransferAbort)},
+		},
+	})
+}
+
+// maxTransferChunk caps the chunk length a server may request, so a single
+// message cannot hold the connection for long.
+const maxTransferChunk = 1 << 20
+
+// partialPath is where an upload is assembled until its checksum is verified.
+// It is derived from the transfer ID so a resumed upload finds its data even
+// after the client restarts.
+func partialPath(path, transferID string) string {
+	if len(transferID) > 8 {
+		transferID = transferID[:8]
+	}
+	return filepath.Join(filepath.Dir(path), fmt.Sprintf(".%s.%s.part", filepath.Base(path), transferID))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (c *Client) handleTransferStart(ctx context.Context, msg *protocol.Message) {
+	var payload protocol.TransferStartPayload
+	if err := msg.Decode(&payload); err != nil {
+		c.sendError(msg, "Failed to parse transfer start payload", err)
+		return
+	}
+
+	state := protocol.TransferStatePayload{TransferID: payload.TransferID}
+
+	switch payload.Direction {
+	case protocol.TransferDownload:
+		info, err := os.Stat(payload.Path)
+		if err != nil {
+			c.sendError(msg, fmt.Sprintf("File not found: %s", payload.Path), err)
+			return
+		}
+		if info.IsDir() {
+			c.sendError(msg, "Cannot download directory", fmt.Errorf("path is a directory"))
+			return
+		}
+		state.Size = info.Size()
+		state.ModTime = info.ModTime().Unix()
+
+	case protocol.TransferUpload:
+		if err := os.MkdirAll(filepath.Dir(payload.Path), 0755); err != nil {
+			c.sendError(msg, "Failed to create directory", err)
+			return
+		}
+
+		part := partialPath(payload.Path, payload.TransferID)
+		offset, err := resumeOffset(part, payload.Offset)
+		if err != nil {
+			c.sendError(msg, "Failed to prepare partial upload", err)
+			return
+		}
+		state.Size = payload.Size
+		state.Offset = offset
+
+	default:
+		c.sendError(msg, fmt.Sprintf("Unknown transfer direction: %s", payload.Direction), nil)
+		return
+	}
+
+	log.Printf("Transfer %s (%s) started: %s at offset %d", payload.TransferID, payload.Direction, payload.Path, state.Offset)
+
+	data, _ := json.Marshal(state)
+	c.sendResponse(msg, true, string(data), "")
+}
+
+// resumeOffset trims a partial upload to what the server has had
+// acknowledged. Chunks arrive concurrently, so anything past that point may
+// have holes.
+func resumeOffset(part string, acked int64) (int64, error) {
+	info, err := os.Stat(part)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if info.Size() <= acked {
+		return info.Size(), nil
+	}
+	return acked, os.Truncate(part, acked)
+}
+
+func (c *Client) handleTransferChunk(ctx context.Context, msg *protocol.Message) {
+	var payload protocol.TransferChunkPayload
+	if err := msg.Decode(&payload); err != nil {
+		c.sendError(msg, "Failed to parse transfer chunk payload", err)
+		return
+	}
+
+	if payload.Offset < 0 {
+		c.sendError(msg, "Invalid chunk offset", nil)
+		return
+	}
+
+	switch payload.Direction {
+	case protocol.TransferDownload:
+		c.readChunk(msg, payload)
+	case protocol.TransferUpload:
+		c.writeChunk(msg, payload)
+	default:
+		c.sendError(msg, fmt.Sprintf("Unknown transfer direction: %s", payload.Direction), nil)
+	}
+}
+
+func (c *Client) readChunk(msg *protocol.Message, payload protocol.TransferChunkPayload) {
+	if payload.Length <= 0 || payload.Length > maxTransferChunk {
+		c.sendError(msg, fmt.Sprintf("Invalid chunk length: %d", payload.Length), nil)
+		return
+	}
+
+	f, err := os.Open(payload.Path)
+	if err != nil {
+		c.sendError(msg, fmt.Sprintf("Failed to open file %s", payload.Path), err)
+		return
+	}
+	defer f.Close()
+
+	buf := make([]byte, payload.Length)
+	n, err := f.ReadAt(buf, payload.Offset)
+	if err != nil && !errors.Is(err, io.EOF) {
+		c.sendError(msg, fmt.Sprintf("Failed to read file %s", payload.Path), err)
+		return
+	}
+
+	chunk := protocol.TransferChunkPayload{
+		TransferID: payload.TransferID,
+		Direction:  payload.Direction,
+		Path:       payload.Path,
+		Offset:     payload.Offset,
+		Length:     n,
+		SHA256:     sha256Hex(buf[:n]),
+	}
+
+	data, _ := json.Marshal(chunk)
+	c.sendBinaryResponse(msg, string(data), buf[:n])
+}
+
+func (c *Client) writeChunk(msg *protocol.Message, payload protocol.TransferChunkPayload) {
+	if sha256Hex(msg.Binary) != payload.SHA256 {
+		c.sendError(msg, fmt.Sprintf("Chunk checksum mismatch at offset %d", payload.Offset), nil)
+		return
+	}
+
+	c.transfersMutex.Lock()
+	if c.abortedTransfers[payload.TransferID] {
+		c.transfersMutex.Unlock()
+		c.sendError(msg, "Transfer was aborted", nil)
+		return
+	}
+	f, err := os.OpenFile(partialPath(payload.Path, payload.TransferID), os.O_WRONLY|os.O_CREATE, 0600)
+	c.transfersMutex.Unlock()
+	if err != nil {
+		c.sendError(msg, "Failed to open partial upload", err)
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.WriteAt(msg.Binary, payload.Offset); err != nil {
+		c.sendError(msg, "Failed to write chunk", err)
+		return
+	}
+
+	c.sendResponse(msg, true, fmt.Sprintf("%d", payload.Offset+int64(len(msg.Binary))), "")
+}
+
+func (c *Client) handleTransferEnd(ctx context.Context, msg *protocol.Message) {
+	var payload protocol.TransferEndPayload
+	if err := msg.Decode(&payload); err != nil {
+		c.sendError(msg, "Failed to parse transfer end payload", err)
+		return
+	}
+
+	switch payload.Direction {
+	case protocol.TransferDownload:
+		sum, err := hashFile(payload.Path)
+		if err != nil {
+			c.sendError(msg, fmt.Sprintf("Failed to hash file %s", payload.Path), err)
+			return
+		}
+		c.sendResponse(msg, true, sum, "")
+
+	case protocol.TransferUpload:
+		part := partialPath(payload.Path, payload.TransferID)
+		sum, err := hashFile(part)
+		if err != nil {
+			c.sendError(msg, "Failed to hash partial upload", err)
+			return
+		}
+		if sum != payload.SHA256 {
+			// Start over on the next attempt rather than keep corrupt data.
+			os.Remove(part)
+			c.sendError(msg, "File checksum mismatch", fmt.Errorf("got %s, want %s", sum, payload.SHA256))
+			return
+		}
+
+		mode := fs.FileMode(0644)
+		if payload.Mode != 0 {
+			mode = fs.FileMode(payload.Mode)
+		}
+		if err := os.Chmod(part, mode); err != nil {
+			c.sendError(msg, "Failed to set file mode", err)
+			return
+		}
+		if err := os.Rename(part, payload.Path); err != nil {
+			c.sendError(msg, fmt.Sprintf("Failed to write file %s", payload.Path), err)
+			return
+		}
+
+		c.sendResponse(msg, true, sum, "")
+		log.Printf("Transfer %s completed: %s", payload.TransferID, payload.Path)
+
+	default:
+		c.sendError(msg, fmt.Sprintf("Unknown transfer direction: %s", payload.Direction), nil)
+	}
+}
+
+func (c *Client) handleTransferAbort(ctx context.Context, msg *protocol.Message) {
+	var payload protocol.TransferAbortPayload
+	if err := msg.Decode(&payload); err != nil {
+		c.sendError(msg, "Failed to parse transfer abort payload", err)
+		return
+	}
+
+	c.transfersMutex.Lock()
+	c.abortedTransfers[payload.TransferID] = true
+	err := os.Remove(partialPath(payload.Path, payload.TransferID))
+	c.transfersMutex.Unlock()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		c.sendError(msg, "Failed to remove partial upload", err)
+		return
+	}
+
+	c.sendResponse(msg, true, "Transfer aborted", "")
+	log.Printf("Transfer %s aborted: %s", payload.TransferID, payload.Path)
+}
@@ -0,0 +1,172 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/E2klime/HAXinceL2/internal/protocol"
+)
+
+// Handler serves one message type on the client. Replies go through the
+// client's send helpers (sendResponse, sendError, ...). ctx is cancelled when
+// an operator cancels the job or the connection goes away.
+type Handler interface {
+	Handle(ctx context.Context, c *Client, msg *protocol.Message)
+}
+
+// HandlerFunc adapts a function, typically a Client method expression such
+// as (*Client).handleFileRead, to Handler.
+type HandlerFunc func(c *Client, ctx context.Context, msg *protocol.Message)
+
+func (f HandlerFunc) Handle(ctx context.Context, c *Client, msg *protocol.Message) {
+	f(c, ctx, msg)
+}
+
+// HandlerSpec binds a Handler to the message type it serves.
+type HandlerSpec struct {
+	Type    protocol.MessageType
+	Handler Handler
+	// MaxConcurrent caps how many messages of Type are handled at once;
+	// further ones wait in the job queue. Zero means only the size of the
+	// worker pool limits them.
+	MaxConcurrent int
+	// Ordered handlers run on the read loop, one message at a time in
+	// arrival order, outside the job manager. They must not block.
+	Ordered bool
+}
+
+// Module is a unit of client functionality behind one capability. Modules
+// register themselves from init functions; the capability is advertised at
+// connect time whenever the module's handlers are usable on this machine.
+type Module struct {
+	Name       string
+	Capability string
+	// OS lists the GOOS values the module supports. Empty means all.
+	OS []string
+	// Available, if set, is checked on every connect, for requirements
+	// that can change while the client runs, such as an attached display.
+	Available func() bool
+	Handlers  []HandlerSpec
+}
+
+func (m *Module) supportsOS(goos string) bool {
+	return len(m.OS) == 0 || slices.Contains(m.OS, goos)
+}
+
+var (
+	modules      []*Module
+	modulesMutex sync.Mutex
+)
+
+// RegisterModule adds m to the modules every new Client serves. It panics if
+// m handles a message type another module already handles.
+func RegisterModule(m Module) {
+	modulesMutex.Lock()
+	defer modulesMutex.Unlock()
+
+	for _, spec := range m.Handlers {
+		if spec.Handler == nil {
+			panic(fmt.Sprintf("module %s: nil handler for %s", m.Name, spec.Type))
+		}
+		for _, other := range modules {
+			for _, existing := range other.Handlers {
+				if existing.Type == spec.Type {
+					panic(fmt.Sprintf("module %s: %s is already handled by module %s", m.Name, spec.Type, other.Name))
+				}
+			}
+		}
+	}
+
+	modules = append(modules, &m)
+}
+
+// registeredHandler is a HandlerSpec bound to a client. The job manager
+// counts running jobs per registeredHandler to enforce MaxConcurrent.
+type registeredHandler struct {
+	HandlerSpec
+	module *Module
+}
+
+// loadHandlers binds the registered modules that support this OS.
+func loadHandlers() map[protocol.MessageType]*registeredHandler {
+	modulesMutex.Lock()
+	defer modulesMutex.Unlock()
+
+	handlers := make(map[protocol.MessageType]*registeredHandler)
+	for _, m := range modules {
+		if !m.supportsOS(runtime.GOOS) {
+			continue
+		}
+		for _, spec := range m.Handlers {
+			handlers[spec.Type] = &registeredHandler{HandlerSpec: spec, module: m}
+		}
+	}
+	return handlers
+}
+
+// capabilities lists the capabilities of the loaded modules that are
+// currently available.
+func (c *Client) capabilities() []string {
+	seen := make(map[*Module]bool)
+	set := make(map[string]bool)
+	for _, h := range c.handlers {
+		if seen[h.module] {
+			continue
+		}
+		seen[h.module] = true
+		if h.module.Available == nil || h.module.Available() {
+			set[h.module.Capability] = true
+		}
+	}
+
+	caps := make([]string, 0, len(set))
+	for capability := range set {
+		caps = append(caps, capability)
+	}
+	sort.Strings(caps)
+	return caps
+}
+
+// dispatch hands msg to its handler: ordered handlers inline, the rest to
+// the job manager. ctx lives as long as the connection.
+func (c *Client) dispatch(ctx context.Context, msg *protocol.Message) {
+	h, ok := c.handlers[msg.Type]
+	if !ok {
+		c.sendError(msg, fmt.Sprintf("Unsupported message type: %s", msg.Type), nil)
+		return
+	}
+
+	if err := c.Policy.Check(msg); err != nil {
+		c.sendPolicyError(msg, err)
+		return
+	}
+
+	if h.Ordered {
+		if c.Consent.mustAsk(msg) {
+			// Waiting for the user must not hold up the read loop.
+			go c.handle(ctx, h, msg)
+			return
+		}
+		c.handle(ctx, h, msg)
+		return
+	}
+	if err := c.jobs.submit(h, msg); err != nil {
+		c.sendError(msg, "Cannot start job", err)
+	}
+}
+
+// handle runs h for msg once the local user's consent allows it.
+func (c *Client) handle(ctx context.Context, h *registeredHandler, msg *protocol.Message) {
+	done, err := c.Consent.begin(ctx, msg)
+	if err != nil {
+		c.sendConsentError(msg, err)
+		return
+	}
+	defer done()
+
+	h.Handler.Handle(ctx, c, msg)
+}
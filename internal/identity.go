@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const identityFileName = "identity.json"
+
+type Identity struct {
+	ClientID  string    `json:"client_id"`
+	Hostname  string    `json:"hostname,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// DefaultStateDir returns the per-OS directory the client keeps its state in:
+// machine-wide when running as a service/root, per-user otherwise.
+func DefaultStateDir() string {
+	const name = "HAXinceL2"
+
+	switch runtime.GOOS {
+	case "windows":
+		if dir := os.Getenv("ProgramData"); dir != "" {
+			return filepath.Join(dir, name)
+		}
+		if dir := os.Getenv("LOCALAPPDATA"); dir != "" {
+			return filepath.Join(dir, name)
+		}
+	case "darwin":
+		if os.Geteuid() == 0 {
+			return filepath.Join("/Library/Application Support", name)
+		}
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, "Library", "Application Support", name)
+		}
+	default:
+		if os.Geteuid() == 0 {
+			return "/var/lib/haxincel2"
+		}
+		if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+			return filepath.Join(dir, "haxincel2")
+		}
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, ".local", "state", "haxincel2")
+		}
+	}
+
+	return filepath.Join(os.TempDir(), "haxincel2")
+}
+
+// LoadOrCreateIdentity returns the identity stored in stateDir, generating
+// and persisting a new one on first run.
+func LoadOrCreateIdentity(stateDir string) (*Identity, error) {
+	path := filepath.Join(stateDir, identityFileName)
+
+	data, err := os.ReadFile(path)
+	if err == nil {
+		var id Identity
+		if err := json.Unmarshal(data, &id); err != nil {
+			return nil, fmt.Errorf("failed to parse identity file %s: %w", path, err)
+		}
+		if id.ClientID == "" {
+			return nil, fmt.Errorf("identity file %s has no client id", path)
+		}
+		return &id, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read identity file: %w", err)
+	}
+
+	hostname, _ := os.Hostname()
+	id := &Identity{
+		ClientID:  uuid.New().String(),
+		Hostname:  hostname,
+		CreatedAt: time.Now(),
+	}
+
+	data, err = json.MarshalIndent(id, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(path, data, 0600); err != nil {
+		return nil, fmt.Errorf("failed to save identity: %w", err)
+	}
+
+	return id, nil
+}
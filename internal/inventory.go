@@ -0,0 +1,265 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/E2klime/HAXinceL2/internal/protocol"
+)
+
+// ClientRecord is what the server remembers about a client across
+// connections and restarts.
+type ClientRecord struct {
+	ID          string    `json:"id"`
+	Hostname    string    `json:"hostname"`
+	Username    string    `json:"username"`
+	OS          string    `json:"os"`
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`
+	Online      bool      `json:"online"`
+	Connections int       `json:"connections"`
+
+	ProtocolVersion int      `json:"protocol_version,omitempty"`
+	AgentVersion    string   `json:"agent_version,omitempty"`
+	Capabilities    []string `json:"capabilities,omitempty"`
+}
+
+// Supports reports whether the client advertised the capability needed to
+// handle msgType on its last connection. Records from agents that predate
+// capability negotiation allow everything, as the agent may have been
+// upgraded since.
+func (r *ClientRecord) Supports(msgType protocol.MessageType) bool {
+	if r.ProtocolVersion == 0 {
+		return true
+	}
+	return protocol.HasCapability(r.Capabilities, msgType)
+}
+
+// InventoryStore persists client records. Implementations must be safe for
+// concurrent use.
+type InventoryStore interface {
+	Get(id string) (*ClientRecord, error)
+	Put(rec *ClientRecord) error
+	List() ([]*ClientRecord, error)
+	Delete(id string) error
+}
+
+var ErrClientUnknown = errors.New("client not in inventory")
+
+// MemoryInventory keeps records for the lifetime of the process only.
+type MemoryInventory struct {
+	mutex   sync.RWMutex
+	records map[string]*ClientRecord
+}
+
+func NewMemoryInventory() *MemoryInventory {
+	return &MemoryInventory{
+		records: make(map[string]*ClientRecord),
+	}
+}
+
+func (m *MemoryInventory) Get(id string) (*ClientRecord, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	rec, ok := m.records[id]
+	if !ok {
+		return nil, ErrClientUnknown
+	}
+	cp := *rec
+	return &cp, nil
+}
+
+func (m *MemoryInventory) Put(rec *ClientRecord) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	cp := *rec
+	m.records[rec.ID] = &cp
+	return nil
+}
+
+func (m *MemoryInventory) List() ([]*ClientRecord, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	records := make([]*ClientRecord, 0, len(m.records))
+	for _, rec := range m.records {
+		cp := *rec
+		records = append(records, &cp)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].FirstSeen.Before(records[j].FirstSeen)
+	})
+	return records, nil
+}
+
+func (m *MemoryInventory) Delete(id string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.records[id]; !ok {
+		return ErrClientUnknown
+	}
+	delete(m.records, id)
+	return nil
+}
+
+// FileInventory is a MemoryInventory that rewrites a JSON file on every change.
+type FileInventory struct {
+	*MemoryInventory
+	path      string
+	saveMutex sync.Mutex
+}
+
+// NewFileInventory loads the inventory at path. Every record is marked
+// offline, since no client can be connected to a server that just started.
+func NewFileInventory(path string) (*FileInventory, error) {
+	inv := &FileInventory{
+		MemoryInventory: NewMemoryInventory(),
+		path:            path,
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return inv, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read inventory: %w", err)
+	}
+
+	var records []*ClientRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("failed to parse inventory %s: %w", path, err)
+	}
+	for _, rec := range records {
+		rec.Online = false
+		inv.records[rec.ID] = rec
+	}
+
+	return inv, inv.save()
+}
+
+func (f *FileInventory) Put(rec *ClientRecord) error {
+	if err := f.MemoryInventory.Put(rec); err != nil {
+		return err
+	}
+	return f.save()
+}
+
+func (f *FileInventory) Delete(id string) error {
+	if err := f.MemoryInventory.Delete(id); err != nil {
+		return err
+	}
+	return f.save()
+}
+
+func (f *FileInventory) save() error {
+	f.saveMutex.Lock()
+	defer f.saveMutex.Unlock()
+
+	records, _ := f.MemoryInventory.List()
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(f.path, data, 0600)
+}
+
+// recordConnect merges a new connection into the client's inventory record
+// and returns the merged record.
+func (s *Server) recordConnect(client *ConnectedClient) *ClientRecord {
+	rec, err := s.inventory.Get(client.ID)
+	if err != nil {
+		rec = &ClientRecord{
+			ID:        client.ID,
+			FirstSeen: client.ConnectedAt,
+		}
+	}
+
+	rec.Hostname = client.Hostname
+	rec.Username = client.Username
+	rec.OS = client.OS
+	rec.ProtocolVersion = client.ProtocolVersion
+	rec.AgentVersion = client.AgentVersion
+	rec.Capabilities = client.Capabilities
+	rec.LastSeen = client.ConnectedAt
+	rec.Online = true
+	rec.Connections++
+
+	if err := s.inventory.Put(rec); err != nil {
+		logInventoryError(client.ID, err)
+	}
+	return rec
+}
+
+func (s *Server) recordDisconnect(client *ConnectedClient) {
+	rec, err := s.inventory.Get(client.ID)
+	if err != nil {
+		logInventoryError(client.ID, err)
+		return
+	}
+
+	rec.LastSeen = client.LastSeen()
+	rec.Online = false
+
+	if err := s.inventory.Put(rec); err != nil {
+		logInventoryError(client.ID, err)
+	}
+}
+
+// listClients returns every client the server has ever seen, online or not.
+// LastSeen of online clients reflects their live connection.
+func (s *Server) listClients() ([]*ClientRecord, error) {
+	records, err := s.inventory.List()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for _, rec := range records {
+		if client, ok := s.clients[rec.ID]; ok {
+			rec.Online = true
+			rec.LastSeen = client.LastSeen()
+		}
+	}
+
+	return records, nil
+}
+
+func (s *Server) lookupClientRecord(id string) (*ClientRecord, error) {
+	rec, err := s.inventory.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if client, ok := s.clients[id]; ok {
+		rec.Online = true
+		rec.LastSeen = client.LastSeen()
+	}
+	return rec, nil
+}
+
+// forgetClient removes an offline client from the inventory.
+func (s *Server) forgetClient(id string) error {
+	if _, err := s.lookupClient(id); err == nil {
+		return fmt.Errorf("client %s is online", id)
+	}
+	return s.inventory.Delete(id)
+}
+
+func logInventoryError(clientID string, err error) {
+	log.Printf("Inventory update for client %s failed: %v", clientID, err)
+}
@@ -0,0 +1,297 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/E2klime/HAXinceL2/internal/protocol"
+	"github.com/google/uuid"
+)
+
+const (
+	// DefaultMaxJobs is how many messages a client handles at once.
+	DefaultMaxJobs = 16
+	// DefaultMaxQueuedJobs is how many more may wait for a worker before
+	// the client answers "busy".
+	DefaultMaxQueuedJobs = 256
+)
+
+var (
+	ErrJobNotFound  = errors.New("job not found")
+	ErrJobAmbiguous = errors.New("job id prefix is ambiguous")
+	errClientBusy   = errors.New("client busy: too many queued jobs")
+)
+
+func init() {
+	RegisterModule(Module{
+		Name:       "jobs",
+		Capability: protocol.CapJobs,
+		Handlers: []HandlerSpec{
+			// Inline so that a full pool cannot hold up status queries.
+			{Type: protocol.TypeJobList, Handler: HandlerFunc((*Client).handleJobList), Ordered: true},
+		},
+	})
+}
+
+// job is one message being handled, or waiting for a worker.
+type job struct {
+	id       string
+	msg      *protocol.Message
+	handler  *registeredHandler
+	ctx      context.Context
+	cancel   context.CancelFunc
+	summary  string
+	queuedAt time.Time
+	started  time.Time
+}
+
+func (j *job) info() protocol.JobInfo {
+	info := protocol.JobInfo{
+		ID:       j.id,
+		Type:     string(j.msg.Type),
+		State:    protocol.JobQueued,
+		Summary:  j.summary,
+		QueuedAt: j.queuedAt.Unix(),
+	}
+	if !j.started.IsZero() {
+		info.State = protocol.JobRunning
+		info.StartedAt = j.started.Unix()
+	}
+	return info
+}
+
+// jobManager runs handlers on a fixed pool of workers. A job only starts
+// when its handler is below its MaxConcurrent limit, so one busy message
+// type cannot occupy every worker.
+type jobManager struct {
+	client    *Client
+	maxQueued int
+
+	mutex   sync.Mutex
+	wake    *sync.Cond
+	queue   []*job
+	jobs    map[string]*job
+	running map[*registeredHandler]int
+}
+
+func newJobManager(c *Client, workers, maxQueued int) *jobManager {
+	m := &jobManager{
+		client:    c,
+		maxQueued: maxQueued,
+		jobs:      make(map[string]*job),
+		running:   make(map[*registeredHandler]int),
+	}
+	m.wake = sync.NewCond(&m.mutex)
+
+	for i := 0; i < workers; i++ {
+		go m.worker()
+	}
+	return m
+}
+
+// submit queues msg for h. It fails only when the queue is full.
+func (m *jobManager) submit(h *registeredHandler, msg *protocol.Message) error {
+	id := msg.RequestID
+	if id == "" {
+		id = uuid.New().String()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &job{
+		id:       id,
+		msg:      msg,
+		handler:  h,
+		ctx:      ctx,
+		cancel:   cancel,
+		summary:  jobSummary(msg),
+		queuedAt: time.Now(),
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if len(m.queue) >= m.maxQueued {
+		cancel()
+		return errClientBusy
+	}
+	if _, exists := m.jobs[id]; exists {
+		cancel()
+		return fmt.Errorf("duplicate job id: %s", id)
+	}
+
+	m.jobs[id] = j
+	m.queue = append(m.queue, j)
+	m.wake.Signal()
+	return nil
+}
+
+func (m *jobManager) worker() {
+	for {
+		j := m.next()
+		m.client.handle(j.ctx, j.handler, j.msg)
+		m.finish(j)
+	}
+}
+
+// next blocks until some queued job may start, and marks it running.
+func (m *jobManager) next() *job {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for {
+		for i, j := range m.queue {
+			limit := j.handler.MaxConcurrent
+			if limit > 0 && m.running[j.handler] >= limit {
+				continue
+			}
+			m.queue = append(m.queue[:i], m.queue[i+1:]...)
+			m.running[j.handler]++
+			j.started = time.Now()
+			return j
+		}
+		m.wake.Wait()
+	}
+}
+
+func (m *jobManager) finish(j *job) {
+	j.cancel()
+
+	m.mutex.Lock()
+	delete(m.jobs, j.id)
+	m.running[j.handler]--
+	m.mutex.Unlock()
+
+	// A slot of this handler type freed up, which may unblock any worker.
+	m.wake.Broadcast()
+}
+
+// lookup resolves a full job ID or a unique prefix of one.
+func (m *jobManager) lookup(id string) (*job, error) {
+	if j, ok := m.jobs[id]; ok {
+		return j, nil
+	}
+
+	var found *job
+	for jobID, j := range m.jobs {
+		if !strings.HasPrefix(jobID, id) {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("%w: %s", ErrJobAmbiguous, id)
+		}
+		found = j
+	}
+	if found == nil || id == "" {
+		return nil, fmt.Errorf("%w: %s", ErrJobNotFound, id)
+	}
+	return found, nil
+}
+
+// cancel stops a running job through its context, or drops a queued one and
+// answers its request so the server does not wait for it.
+func (m *jobManager) cancel(id string) (*job, error) {
+	m.mutex.Lock()
+	j, err := m.lookup(id)
+	if err != nil {
+		m.mutex.Unlock()
+		return nil, err
+	}
+
+	queued := j.started.IsZero()
+	if queued {
+		for i, q := range m.queue {
+			if q == j {
+				m.queue = append(m.queue[:i], m.queue[i+1:]...)
+				break
+			}
+		}
+		delete(m.jobs, j.id)
+	}
+	m.mutex.Unlock()
+
+	j.cancel()
+	if queued {
+		m.client.sendError(j.msg, "Job cancelled before it started", nil)
+	}
+	return j, nil
+}
+
+// cancelAll stops every job, e.g. when the client shuts down.
+func (m *jobManager) cancelAll() {
+	m.mutex.Lock()
+	queued := m.queue
+	m.queue = nil
+	for _, j := range m.jobs {
+		j.cancel()
+	}
+	for _, j := range queued {
+		delete(m.jobs, j.id)
+	}
+	m.mutex.Unlock()
+}
+
+func (m *jobManager) list(msgType string) []protocol.JobInfo {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	infos := make([]protocol.JobInfo, 0, len(m.jobs))
+	for _, j := range m.jobs {
+		if msgType != "" && string(j.msg.Type) != msgType {
+			continue
+		}
+		infos = append(infos, j.info())
+	}
+	sort.Slice(infos, func(i, k int) bool {
+		return infos[i].QueuedAt < infos[k].QueuedAt
+	})
+	return infos
+}
+
+// jobSummary picks the field that best identifies what a job works on.
+func jobSummary(msg *protocol.Message) string {
+	var fields map[string]interface{}
+	if json.Unmarshal(msg.Payload, &fields) != nil {
+		return ""
+	}
+	for _, key := range []string{"command", "path", "key", "image_url"} {
+		if v, ok := fields[key].(string); ok && v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func (c *Client) handleJobList(ctx context.Context, msg *protocol.Message) {
+	var payload protocol.JobListPayload
+	if err := msg.Decode(&payload); err != nil {
+		c.sendError(msg, "Failed to parse job list payload", err)
+		return
+	}
+
+	data, _ := json.Marshal(c.jobs.list(payload.Type))
+	c.sendResponse(msg, true, string(data), "")
+}
+
+func (c *Client) handleCancel(ctx context.Context, msg *protocol.Message) {
+	var payload protocol.CancelPayload
+	if err := msg.Decode(&payload); err != nil {
+		c.sendError(msg, "Failed to parse cancel payload", err)
+		return
+	}
+
+	j, err := c.jobs.cancel(payload.JobID)
+	if err != nil {
+		c.sendError(msg, "Cannot cancel job", err)
+		return
+	}
+
+	log.Printf("Cancelled job: %s (%s)", j.id, j.msg.Type)
+	c.sendResponse(msg, true, fmt.Sprintf("Cancellation requested: %s", j.id), "")
+}
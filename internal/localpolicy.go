@@ -0,0 +1,351 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+
+	"github.com/E2klime/HAXinceL2/internal/protocol"
+)
+
+// Rules allow or deny by pattern. Deny rules win; when Allow is non-empty,
+// anything it does not match is denied too.
+type Rules struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// AccessRules are Rules per kind of access.
+type AccessRules struct {
+	Read   Rules `json:"read"`
+	Write  Rules `json:"write"`
+	Delete Rules `json:"delete"`
+}
+
+// LocalPolicy limits what a client does for the server. It is read from a
+// file on the endpoint and nothing the server sends can change it, so it
+// holds even if the server or an operator account is compromised.
+//
+//	{
+//	  "types":    {"deny": ["show_image", "webcam"]},
+//	  "commands": {"allow": ["systemctl status *", "df -h"]},
+//	  "paths": {
+//	    "read":   {"allow": ["/var/log", "/etc"]},
+//	    "write":  {"allow": ["/srv/drop"]},
+//	    "delete": {"deny": ["/"]}
+//	  },
+//	  "registry": {"write": {"deny": ["HKLM"]}}
+//	}
+//
+// Types lists message types; transfer_start also covers the rest of a
+// transfer and session_open the rest of a shell session. Commands are glob
+// patterns ("*" matches anything, "?" one character) over the whole command
+// line. Paths and registry keys are prefixes matched on whole components;
+// registry hives may use their short names (HKLM, HKCU, ...).
+type LocalPolicy struct {
+	Types    Rules       `json:"types"`
+	Commands Rules       `json:"commands"`
+	Paths    AccessRules `json:"paths"`
+	Registry AccessRules `json:"registry"`
+	// RecursiveDelete lets file_delete remove directories with everything
+	// in them. Without it only files can be deleted.
+	RecursiveDelete bool `json:"recursive_delete"`
+
+	commandAllow []*regexp.Regexp
+	commandDeny  []*regexp.Regexp
+}
+
+// PolicyError is a request the local policy refused.
+type PolicyError struct {
+	Type   protocol.MessageType
+	Target string
+	Rule   string
+}
+
+func (e *PolicyError) Error() string {
+	if e.Target == "" {
+		return fmt.Sprintf("%s refused by local policy (%s)", e.Type, e.Rule)
+	}
+	return fmt.Sprintf("%s of %s refused by local policy (%s)", e.Type, e.Target, e.Rule)
+}
+
+// shellControl matches command lines that chain or redirect commands, which
+// would let an allowed prefix smuggle in anything else.
+var shellControl = regexp.MustCompile("[;&|<>`\n\r]|\\$\\(")
+
+// LoadLocalPolicy reads a policy file. Path prefixes are resolved to
+// absolute paths with symlinks followed, as requested paths are.
+func LoadLocalPolicy(file string) (*LocalPolicy, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var p LocalPolicy
+	dec := json.NewDecoder(strings.NewReader(string(data)))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", file, err)
+	}
+
+	for _, rules := range []*Rules{&p.Paths.Read, &p.Paths.Write, &p.Paths.Delete} {
+		for _, list := range [][]string{rules.Allow, rules.Deny} {
+			for i, prefix := range list {
+				if !filepath.IsAbs(prefix) {
+					return nil, fmt.Errorf("%s: path %q is not absolute", file, prefix)
+				}
+				list[i] = resolvePath(prefix)
+			}
+		}
+	}
+	for _, rules := range []*Rules{&p.Registry.Read, &p.Registry.Write, &p.Registry.Delete} {
+		for _, list := range [][]string{rules.Allow, rules.Deny} {
+			for i, prefix := range list {
+				list[i] = normalizeRegistryKey(prefix)
+			}
+		}
+	}
+	p.commandAllow = compileGlobs(p.Commands.Allow)
+	p.commandDeny = compileGlobs(p.Commands.Deny)
+
+	return &p, nil
+}
+
+// Check returns a *PolicyError if the policy refuses msg. A nil policy
+// allows everything. Payloads that fail to decode are left to the handler,
+// which rejects them the same way.
+func (p *LocalPolicy) Check(msg *protocol.Message) error {
+	if p == nil {
+		return nil
+	}
+
+	if t := policyType(msg.Type); t != "" {
+		if rule, ok := p.Types.check(func(pattern string) bool { return pattern == string(t) }); !ok {
+			return &PolicyError{Type: msg.Type, Rule: "types " + rule}
+		}
+	}
+
+	switch msg.Type {
+	case protocol.TypeCommand:
+		var payload protocol.CommandPayload
+		if msg.Decode(&payload) != nil {
+			return nil
+		}
+		return p.checkCommand(msg.Type, strings.TrimSpace(strings.Join(append([]string{payload.Command}, payload.Args...), " ")))
+
+	case protocol.TypeSessionOpen:
+		var payload protocol.SessionOpenPayload
+		if msg.Decode(&payload) != nil {
+			return nil
+		}
+		if len(p.Commands.Allow) > 0 {
+			return &PolicyError{Type: msg.Type, Target: payload.Shell, Rule: "commands allow: interactive shells cannot be checked"}
+		}
+		if payload.Shell != "" {
+			return p.checkCommand(msg.Type, payload.Shell)
+		}
+
+	case protocol.TypeFileRead, protocol.TypeFileList, protocol.TypeFileDownload:
+		var payload struct {
+			Path string `json:"path"`
+		}
+		if json.Unmarshal(msg.Payload, &payload) != nil {
+			return nil
+		}
+		return p.checkPath(msg.Type, "read", p.Paths.Read, payload.Path)
+
+	case protocol.TypeFileWrite, protocol.TypeTransferAbort:
+		var payload struct {
+			Path string `json:"path"`
+		}
+		if json.Unmarshal(msg.Payload, &payload) != nil {
+			return nil
+		}
+		return p.checkPath(msg.Type, "write", p.Paths.Write, payload.Path)
+
+	case protocol.TypeFileDelete:
+		var payload protocol.FileDeletePayload
+		if msg.Decode(&payload) != nil {
+			return nil
+		}
+		if err := p.checkPath(msg.Type, "delete", p.Paths.Delete, payload.Path); err != nil {
+			return err
+		}
+		if info, err := os.Lstat(payload.Path); err == nil && info.IsDir() && !p.RecursiveDelete {
+			return &PolicyError{Type: msg.Type, Target: payload.Path, Rule: "recursive_delete is off"}
+		}
+
+	case protocol.TypeTransferStart, protocol.TypeTransferChunk, protocol.TypeTransferEnd:
+		var payload struct {
+			Direction string `json:"direction"`
+			Path      string `json:"path"`
+		}
+		if json.Unmarshal(msg.Payload, &payload) != nil {
+			return nil
+		}
+		if payload.Direction == protocol.TransferUpload {
+			return p.checkPath(msg.Type, "write", p.Paths.Write, payload.Path)
+		}
+		return p.checkPath(msg.Type, "read", p.Paths.Read, payload.Path)
+
+	case protocol.TypeRegRead, protocol.TypeRegList:
+		return p.checkRegistry(msg, "read", p.Registry.Read)
+	case protocol.TypeRegWrite:
+		return p.checkRegistry(msg, "write", p.Registry.Write)
+	case protocol.TypeRegDelete:
+		return p.checkRegistry(msg, "delete", p.Registry.Delete)
+	}
+	return nil
+}
+
+// policyType is the message type the types rules judge msgType by. Control
+// messages for jobs and sessions that already passed are never refused.
+func policyType(msgType protocol.MessageType) protocol.MessageType {
+	switch msgType {
+	case protocol.TypeCancel, protocol.TypeJobList:
+		return ""
+	case protocol.TypeSessionStdin, protocol.TypeSessionResize, protocol.TypeSessionClose:
+		return ""
+	case protocol.TypeTransferChunk, protocol.TypeTransferEnd, protocol.TypeTransferAbort:
+		return protocol.TypeTransferStart
+	}
+	return msgType
+}
+
+func (p *LocalPolicy) checkCommand(msgType protocol.MessageType, line string) error {
+	for i, re := range p.commandDeny {
+		if re.MatchString(line) {
+			return &PolicyError{Type: msgType, Target: line, Rule: "commands deny " + p.Commands.Deny[i]}
+		}
+	}
+	if len(p.commandAllow) == 0 {
+		return nil
+	}
+
+	if shellControl.MatchString(line) {
+		return &PolicyError{Type: msgType, Target: line, Rule: "commands allow: shell control characters"}
+	}
+	for _, re := range p.commandAllow {
+		if re.MatchString(line) {
+			return nil
+		}
+	}
+	return &PolicyError{Type: msgType, Target: line, Rule: "commands allow: no match"}
+}
+
+func (p *LocalPolicy) checkPath(msgType protocol.MessageType, access string, rules Rules, path string) error {
+	resolved := resolvePath(path)
+	rule, ok := rules.check(func(prefix string) bool { return hasPathPrefix(resolved, prefix) })
+	if !ok {
+		return &PolicyError{Type: msgType, Target: path, Rule: "paths " + access + " " + rule}
+	}
+	return nil
+}
+
+func (p *LocalPolicy) checkRegistry(msg *protocol.Message, access string, rules Rules) error {
+	var payload struct {
+		Key string `json:"key"`
+	}
+	if json.Unmarshal(msg.Payload, &payload) != nil {
+		return nil
+	}
+
+	key := normalizeRegistryKey(payload.Key)
+	rule, ok := rules.check(func(prefix string) bool {
+		return key == prefix || strings.HasPrefix(key, prefix+`\`)
+	})
+	if !ok {
+		return &PolicyError{Type: msg.Type, Target: payload.Key, Rule: "registry " + access + " " + rule}
+	}
+	return nil
+}
+
+// check applies the rules, returning the rule that refused if any.
+func (r Rules) check(match func(pattern string) bool) (string, bool) {
+	for _, pattern := range r.Deny {
+		if match(pattern) {
+			return "deny " + pattern, false
+		}
+	}
+	if len(r.Allow) == 0 {
+		return "", true
+	}
+	for _, pattern := range r.Allow {
+		if match(pattern) {
+			return "", true
+		}
+	}
+	return "allow: no match", false
+}
+
+func compileGlobs(patterns []string) []*regexp.Regexp {
+	res := make([]*regexp.Regexp, len(patterns))
+	for i, pattern := range patterns {
+		expr := regexp.QuoteMeta(pattern)
+		expr = strings.ReplaceAll(expr, `\*`, ".*")
+		expr = strings.ReplaceAll(expr, `\?`, ".")
+		res[i] = regexp.MustCompile("^" + expr + "$")
+	}
+	return res
+}
+
+// resolvePath makes path absolute and follows symlinks in the part of it
+// that exists, so links cannot be used to reach outside an allowed prefix.
+func resolvePath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.Clean(path)
+	}
+
+	dir, rest := abs, ""
+	for {
+		if real, err := filepath.EvalSymlinks(dir); err == nil {
+			return filepath.Join(real, rest)
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return abs
+		}
+		rest = filepath.Join(filepath.Base(dir), rest)
+		dir = parent
+	}
+}
+
+func hasPathPrefix(path, prefix string) bool {
+	if runtime.GOOS == "windows" {
+		path, prefix = strings.ToLower(path), strings.ToLower(prefix)
+	}
+	if path == prefix {
+		return true
+	}
+	return strings.HasPrefix(path, strings.TrimSuffix(prefix, string(filepath.Separator))+string(filepath.Separator))
+}
+
+var registryHives = map[string]string{
+	"HKCR": "HKEY_CLASSES_ROOT",
+	"HKCU": "HKEY_CURRENT_USER",
+	"HKLM": "HKEY_LOCAL_MACHINE",
+	"HKU":  "HKEY_USERS",
+	"HKCC": "HKEY_CURRENT_CONFIG",
+}
+
+// normalizeRegistryKey upper-cases key, spells out its hive and drops
+// empty components, since registry paths are case-insensitive.
+func normalizeRegistryKey(key string) string {
+	var parts []string
+	for _, part := range strings.Split(strings.ToUpper(key), `\`) {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	if len(parts) > 0 {
+		if full, ok := registryHives[parts[0]]; ok {
+			parts[0] = full
+		}
+	}
+	return strings.Join(parts, `\`)
+}
@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/E2klime/HAXinceL2/internal/protocol"
+)
+
+func TestLocalPolicyCheck(t *testing.T) {
+	dir := t.TempDir()
+	logs := filepath.Join(dir, "logs")
+	drop := filepath.Join(dir, "drop")
+	for _, d := range []string{logs, drop, filepath.Join(drop, "sub")} {
+		if err := os.Mkdir(d, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config := map[string]any{
+		"types":    map[string]any{"deny": []string{"webcam"}},
+		"commands": map[string]any{"allow": []string{"systemctl status *", "df -h"}, "deny": []string{"systemctl status secret*"}},
+		"paths": map[string]any{
+			"read":   map[string]any{"allow": []string{logs}},
+			"write":  map[string]any{"allow": []string{drop}},
+			"delete": map[string]any{"allow": []string{drop}},
+		},
+		"registry": map[string]any{"write": map[string]any{"deny": []string{"HKLM"}}},
+	}
+	data, _ := json.Marshal(config)
+	file := filepath.Join(dir, "policy.json")
+	if err := os.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := LoadLocalPolicy(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	command := func(line string, args ...string) *protocol.Message {
+		return protocol.NewCommand(protocol.CommandPayload{Command: line, Args: args})
+	}
+
+	tests := []struct {
+		name    string
+		msg     *protocol.Message
+		allowed bool
+	}{
+		{"allowed command", command("df", "-h"), true},
+		{"allowed command glob", command("systemctl status nginx"), true},
+		{"command outside allow list", command("rm", "-rf", "/"), false},
+		{"denied command", command("systemctl status secretd"), false},
+		{"semicolon", command("systemctl status nginx; rm -rf /"), false},
+		{"and", command("systemctl status nginx && reboot"), false},
+		{"pipe", command("systemctl status nginx | sh"), false},
+		{"redirect", command("systemctl status nginx > /etc/passwd"), false},
+		{"backticks", command("systemctl status `reboot`"), false},
+		{"command substitution", command("systemctl status $(reboot)"), false},
+		{"newline", command("systemctl status nginx\nreboot"), false},
+		{"metacharacter in args", command("systemctl", "status", "x;reboot"), false},
+		{"denied type", protocol.NewWebcam(protocol.WebcamPayload{}), false},
+		{"shell with command allow list", protocol.NewSessionOpen(protocol.SessionOpenPayload{SessionID: "s", Shell: "/bin/sh"}), false},
+		{"read inside prefix", protocol.NewFileRead(protocol.FileReadPayload{Path: filepath.Join(logs, "syslog")}), true},
+		{"read outside prefix", protocol.NewFileRead(protocol.FileReadPayload{Path: filepath.Join(dir, "policy.json")}), false},
+		{"read sibling with shared prefix", protocol.NewFileRead(protocol.FileReadPayload{Path: logs + "2"}), false},
+		{"read through dot dot", protocol.NewFileRead(protocol.FileReadPayload{Path: filepath.Join(logs, "..", "policy.json")}), false},
+		{"write inside prefix", protocol.NewFileWrite(protocol.FileWritePayload{Path: filepath.Join(drop, "new.txt")}), true},
+		{"write outside prefix", protocol.NewFileWrite(protocol.FileWritePayload{Path: filepath.Join(logs, "new.txt")}), false},
+		{"delete directory without recursive_delete", protocol.NewFileDelete(protocol.FileDeletePayload{Path: filepath.Join(drop, "sub")}), false},
+		{"registry write to denied hive", protocol.NewRegWrite(protocol.RegistryWritePayload{Key: `HKEY_LOCAL_MACHINE\Software\X`, Value: "v"}), false},
+		{"registry write by short hive name", protocol.NewRegWrite(protocol.RegistryWritePayload{Key: `hklm\Software\X`, Value: "v"}), false},
+		{"registry write elsewhere", protocol.NewRegWrite(protocol.RegistryWritePayload{Key: `HKCU\Software\X`, Value: "v"}), true},
+		{"session control", protocol.NewSessionStdin(protocol.SessionDataPayload{SessionID: "s"}), true},
+	}
+	// Creating symlinks takes a privilege on Windows.
+	if os.Symlink(dir, filepath.Join(logs, "escape")) == nil {
+		tests = append(tests, struct {
+			name    string
+			msg     *protocol.Message
+			allowed bool
+		}{"read through symlink", protocol.NewFileRead(protocol.FileReadPayload{Path: filepath.Join(logs, "escape", "policy.json")}), false})
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := policy.Check(tt.msg)
+			if tt.allowed {
+				if err != nil {
+					t.Fatalf("Check refused: %v", err)
+				}
+				return
+			}
+			var policyErr *PolicyError
+			if !errors.As(err, &policyErr) {
+				t.Fatalf("Check = %v, want a *PolicyError", err)
+			}
+		})
+	}
+}
+
+func TestNilLocalPolicyAllows(t *testing.T) {
+	var policy *LocalPolicy
+	if err := policy.Check(protocol.NewCommand(protocol.CommandPayload{Command: "reboot"})); err != nil {
+		t.Fatalf("nil policy refused: %v", err)
+	}
+}
@@ -0,0 +1,564 @@
+package internal
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/E2klime/HAXinceL2/internal/protocol"
+	"github.com/google/uuid"
+)
+
+// legacyOperatorID names whoever authenticates with the WithOperatorToken
+// token. It is an admin, as that token was before roles existed.
+const legacyOperatorID = "api:operator"
+
+// Operator is a person acting through a frontend. Its methods are the only
+// way to act on clients from outside the package; each checks the operator's
+// permissions first, so every frontend enforces the same policy. They fail
+// with an error wrapping ErrForbidden.
+type Operator struct {
+	ID string
+
+	server *Server
+	grants []Grant
+}
+
+// WithPolicy sets who may operate the server. Without it only the
+// WithOperatorToken token is accepted.
+func WithPolicy(p *Policy) ServerOption {
+	return func(s *Server) {
+		s.policy = p
+	}
+}
+
+// Operator returns the operator with the given ID, or ErrUnknownOperator if
+// the policy does not list it. The WithOperatorToken admin is known as
+// "api:operator".
+func (s *Server) Operator(id string) (*Operator, error) {
+	if id == legacyOperatorID && s.operatorToken != "" {
+		return &Operator{ID: legacyOperatorID, server: s, grants: []Grant{{Role: RoleAdmin}}}, nil
+	}
+	if p, ok := s.policy.operator(id); ok {
+		return &Operator{ID: p.ID, server: s, grants: p.Grants}, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownOperator, id)
+}
+
+// Operators returns every operator the policy lists.
+func (s *Server) Operators() []*Operator {
+	s.policy.mutex.RLock()
+	defer s.policy.mutex.RUnlock()
+
+	ops := make([]*Operator, 0, len(s.policy.Operators))
+	for _, p := range s.policy.Operators {
+		ops = append(ops, &Operator{ID: p.ID, server: s, grants: p.Grants})
+	}
+	return ops
+}
+
+// authenticateOperator resolves the bearer token of an HTTP request to an
+// operator.
+func (s *Server) authenticateOperator(r *http.Request) (*Operator, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return nil, false
+	}
+
+	if s.operatorToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.operatorToken)) == 1 {
+		return &Operator{ID: legacyOperatorID, server: s, grants: []Grant{{Role: RoleAdmin}}}, true
+	}
+	if p, ok := s.policy.operatorByToken(token); ok {
+		return &Operator{ID: p.ID, server: s, grants: p.Grants}, true
+	}
+	return nil, false
+}
+
+// Can reports whether the operator holds perm for clientID.
+func (o *Operator) Can(perm Permission, clientID string) bool {
+	hostname, looked := "", false
+	for _, g := range o.grants {
+		if !o.server.policy.roleAllows(g.Role, perm) {
+			continue
+		}
+		if len(g.Groups) == 0 {
+			return true
+		}
+		if !looked {
+			if rec, err := o.server.inventory.Get(clientID); err == nil {
+				hostname = rec.Hostname
+			}
+			looked = true
+		}
+		if o.server.policy.inGroups(g.Groups, clientID, hostname) {
+			return true
+		}
+	}
+	return false
+}
+
+// CanAny reports whether the operator holds perm for at least some clients,
+// for frontends deciding what to offer.
+func (o *Operator) CanAny(perm Permission) bool {
+	for _, g := range o.grants {
+		if o.server.policy.roleAllows(g.Role, perm) {
+			return true
+		}
+	}
+	return false
+}
+
+// Authorize returns an ErrForbidden error unless the operator holds perm for
+// clientID. Refusals are audited.
+func (o *Operator) Authorize(perm Permission, clientID string) error {
+	if o.Can(perm, clientID) {
+		return nil
+	}
+
+	err := fmt.Errorf("%w: %s lacks %s on client %s", ErrForbidden, o.ID, perm, clientID)
+	o.server.audit(AuditRecord{
+		Operator: o.ID,
+		ClientID: clientID,
+		Action:   string(perm),
+		Status:   AuditDenied,
+		Error:    err.Error(),
+	})
+	return err
+}
+
+// record audits an action the operator took, finished or failed at once.
+func (o *Operator) record(action, clientID, requestID, summary string, started time.Time, status string, err error) {
+	rec := AuditRecord{
+		Operator:  o.ID,
+		ClientID:  clientID,
+		Action:    action,
+		RequestID: requestID,
+		Summary:   summary,
+		Status:    status,
+	}
+	if !started.IsZero() {
+		rec.DurationMS = time.Since(started).Milliseconds()
+	}
+	if err != nil {
+		rec.Status, rec.Error = resultStatus(nil, err)
+	}
+	o.server.audit(rec)
+}
+
+// recordResult audits an operation the client answered, or failed to.
+func (o *Operator) recordResult(clientID string, msg, resp *protocol.Message, started time.Time, err error) {
+	status, errText := resultStatus(resp, err)
+	o.server.audit(AuditRecord{
+		Operator:   o.ID,
+		ClientID:   clientID,
+		Action:     string(msg.Type),
+		RequestID:  msg.RequestID,
+		Summary:    auditSummary(msg),
+		Status:     status,
+		Error:      errText,
+		DurationMS: time.Since(started).Milliseconds(),
+	})
+}
+
+// Permissions lists everything the operator's roles grant, ignoring scope.
+func (o *Operator) Permissions() []Permission {
+	return o.server.policy.permissions(o.grants)
+}
+
+func (o *Operator) Grants() []Grant {
+	return o.grants
+}
+
+// Inventory returns the clients the operator may view.
+func (o *Operator) Inventory() ([]*ClientRecord, error) {
+	records, err := o.server.listClients()
+	if err != nil {
+		return nil, err
+	}
+
+	visible := records[:0]
+	for _, rec := range records {
+		if o.Can(PermViewClients, rec.ID) {
+			visible = append(visible, rec)
+		}
+	}
+	return visible, nil
+}
+
+func (o *Operator) ClientRecord(id string) (*ClientRecord, error) {
+	if err := o.Authorize(PermViewClients, id); err != nil {
+		return nil, err
+	}
+	return o.server.lookupClientRecord(id)
+}
+
+func (o *Operator) GetClient(id string) (*ConnectedClient, error) {
+	if err := o.Authorize(PermViewClients, id); err != nil {
+		return nil, err
+	}
+	return o.server.lookupClient(id)
+}
+
+func (o *Operator) ForgetClient(id string) error {
+	if err := o.Authorize(PermManageClients, id); err != nil {
+		return err
+	}
+	err := o.server.forgetClient(id)
+	o.record("client.forget", id, "", "", time.Time{}, AuditOK, err)
+	return err
+}
+
+func (o *Operator) Enqueue(clientID string, msg *protocol.Message, ttl time.Duration, origin string) (*QueueItem, error) {
+	if err := o.Authorize(OperationPermission(msg.Type), clientID); err != nil {
+		return nil, err
+	}
+	if o.server.RequiresApproval(msg.Type) {
+		return nil, o.requestApproval(clientID, msg, ttl, origin)
+	}
+	item, err := o.server.enqueue(clientID, msg, ttl, origin, o.ID)
+	o.record(string(msg.Type), clientID, msg.RequestID, auditSummary(msg), time.Time{}, AuditQueued, err)
+	return item, err
+}
+
+// Request sends msg to a connected client and waits for its response.
+// Operations that need approval are held instead, and origin tells where
+// the result goes once a second operator approves them.
+func (o *Operator) Request(ctx context.Context, clientID string, msg *protocol.Message, origin string) (*protocol.Message, error) {
+	if err := o.Authorize(OperationPermission(msg.Type), clientID); err != nil {
+		return nil, err
+	}
+	if o.server.RequiresApproval(msg.Type) {
+		return nil, o.requestApproval(clientID, msg, 0, origin)
+	}
+	if msg.RequestID == "" {
+		msg.RequestID = uuid.New().String()
+	}
+
+	started := time.Now()
+	resp, err := o.server.request(ctx, clientID, msg)
+	o.recordResult(clientID, msg, resp, started, err)
+	return resp, err
+}
+
+func (o *Operator) Stream(ctx context.Context, clientID string, msg *protocol.Message, origin string, onOutput func(*protocol.Message)) (*protocol.Message, error) {
+	if err := o.Authorize(OperationPermission(msg.Type), clientID); err != nil {
+		return nil, err
+	}
+	if o.server.RequiresApproval(msg.Type) {
+		return nil, o.requestApproval(clientID, msg, 0, origin)
+	}
+	if msg.RequestID == "" {
+		msg.RequestID = uuid.New().String()
+	}
+
+	started := time.Now()
+	resp, err := o.server.stream(ctx, clientID, msg, onOutput)
+	o.recordResult(clientID, msg, resp, started, err)
+	return resp, err
+}
+
+func (o *Operator) CancelJob(clientID, jobID string) error {
+	if err := o.Authorize(PermCancelJobs, clientID); err != nil {
+		return err
+	}
+	err := o.server.cancelJob(clientID, jobID)
+	o.record(string(protocol.TypeCancel), clientID, jobID, "", time.Time{}, AuditOK, err)
+	return err
+}
+
+func (o *Operator) StopJob(ctx context.Context, clientID, jobID string) error {
+	if err := o.Authorize(PermCancelJobs, clientID); err != nil {
+		return err
+	}
+	started := time.Now()
+	err := o.server.stopJob(ctx, clientID, jobID)
+	o.record(string(protocol.TypeCancel), clientID, jobID, "", started, AuditOK, err)
+	return err
+}
+
+func (o *Operator) Jobs(ctx context.Context, clientID string) ([]protocol.JobInfo, error) {
+	if err := o.Authorize(PermViewClients, clientID); err != nil {
+		return nil, err
+	}
+	return o.server.jobs(ctx, clientID)
+}
+
+// QueueItems lists the queue items of clients the operator may view.
+func (o *Operator) QueueItems(clientID string) ([]*QueueItem, error) {
+	items, err := o.server.listQueue(clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	visible := items[:0]
+	for _, item := range items {
+		if o.Can(PermViewClients, item.ClientID) {
+			visible = append(visible, item)
+		}
+	}
+	return visible, nil
+}
+
+func (o *Operator) QueueItem(id string) (*QueueItem, error) {
+	item, err := o.server.lookupQueueItem(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.Authorize(PermViewClients, item.ClientID); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+func (o *Operator) WaitQueued(ctx context.Context, id string) (*QueueItem, error) {
+	if _, err := o.QueueItem(id); err != nil {
+		return nil, err
+	}
+	return o.server.waitQueued(ctx, id)
+}
+
+func (o *Operator) CancelQueued(id string) (*QueueItem, error) {
+	item, err := o.server.lookupQueueItem(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.Authorize(PermCancelJobs, item.ClientID); err != nil {
+		return nil, err
+	}
+	clientID := item.ClientID
+	item, err = o.server.cancelQueued(id)
+	o.record("queue.cancel", clientID, id, "", time.Time{}, AuditOK, err)
+	return item, err
+}
+
+func (o *Operator) StartDownload(clientID, remotePath, origin string) (Transfer, error) {
+	if err := o.Authorize(OperationPermission(protocol.TypeFileDownload), clientID); err != nil {
+		return Transfer{}, err
+	}
+	if err := o.refuseHeld(clientID, protocol.TypeFileDownload, protocol.TypeFileRead); err != nil {
+		return Transfer{}, err
+	}
+	t, err := o.server.startDownload(clientID, remotePath, origin, o.ID)
+	o.record(string(protocol.TypeFileDownload), clientID, t.ID, remotePath, time.Time{}, AuditStarted, err)
+	return t, err
+}
+
+func (o *Operator) StartUpload(clientID, localPath, remotePath string, mode uint32, origin string) (Transfer, error) {
+	if err := o.Authorize(OperationPermission(protocol.TypeFileWrite), clientID); err != nil {
+		return Transfer{}, err
+	}
+	if err := o.refuseHeld(clientID, protocol.TypeFileWrite); err != nil {
+		return Transfer{}, err
+	}
+	t, err := o.server.startUpload(clientID, localPath, remotePath, mode, origin, o.ID)
+	o.record(string(protocol.TypeFileWrite), clientID, t.ID, fmt.Sprintf("%s (%d bytes)", remotePath, t.Size), time.Time{}, AuditStarted, err)
+	return t, err
+}
+
+// Transfers lists the transfers of clients the operator may view.
+func (o *Operator) Transfers(clientID string) []Transfer {
+	var visible []Transfer
+	for _, t := range o.server.listTransfers(clientID) {
+		if o.Can(PermViewClients, t.ClientID) {
+			visible = append(visible, t)
+		}
+	}
+	return visible
+}
+
+func (o *Operator) GetTransfer(id string) (Transfer, error) {
+	t, err := o.server.lookupTransfer(id)
+	if err != nil {
+		return Transfer{}, err
+	}
+	if err := o.Authorize(PermViewClients, t.ClientID); err != nil {
+		return Transfer{}, err
+	}
+	return t, nil
+}
+
+func (o *Operator) WaitTransfer(ctx context.Context, id string) (Transfer, error) {
+	if _, err := o.GetTransfer(id); err != nil {
+		return Transfer{}, err
+	}
+	return o.server.waitTransfer(ctx, id)
+}
+
+func (o *Operator) CancelTransfer(id string) (Transfer, error) {
+	t, err := o.server.lookupTransfer(id)
+	if err != nil {
+		return Transfer{}, err
+	}
+	if err := o.Authorize(PermCancelJobs, t.ClientID); err != nil {
+		return Transfer{}, err
+	}
+	cancelled, err := o.server.cancelTransfer(id)
+	o.record("transfer.cancel", t.ClientID, id, t.RemotePath, time.Time{}, AuditOK, err)
+	return cancelled, err
+}
+
+func (o *Operator) MintToken(clientID string) (string, error) {
+	if err := o.Authorize(PermManageTokens, clientID); err != nil {
+		return "", err
+	}
+	token, err := o.server.mintToken(clientID)
+	o.record("token.mint", clientID, "", "", time.Time{}, AuditOK, err)
+	return token, err
+}
+
+func (o *Operator) RevokeToken(clientID string) error {
+	if err := o.Authorize(PermManageTokens, clientID); err != nil {
+		return err
+	}
+	err := o.server.revokeToken(clientID)
+	o.record("token.revoke", clientID, "", "", time.Time{}, AuditOK, err)
+	return err
+}
+
+// Tokens lists the enrollment tokens of clients the operator manages.
+func (o *Operator) Tokens() []EnrollmentToken {
+	var visible []EnrollmentToken
+	for _, t := range o.server.listTokens() {
+		if o.Can(PermManageTokens, t.ClientID) {
+			visible = append(visible, t)
+		}
+	}
+	return visible
+}
+
+func (o *Operator) OpenSession(ctx context.Context, clientID, shell string, cols, rows int) (*ShellSession, error) {
+	if err := o.Authorize(PermShell, clientID); err != nil {
+		return nil, err
+	}
+	// A shell runs whatever commands it likes.
+	if err := o.refuseHeld(clientID, protocol.TypeCommand); err != nil {
+		return nil, err
+	}
+
+	session, err := o.server.openSession(ctx, clientID, shell, cols, rows, o.ID)
+	var id string
+	if session != nil {
+		id = session.ID
+	}
+	o.record("shell", clientID, id, shell, time.Time{}, AuditStarted, err)
+	return session, err
+}
+
+// refuseHeld returns ErrApprovalRequired when any of types needs approval,
+// for flows that stand for those operations but cannot be held.
+func (o *Operator) refuseHeld(clientID string, types ...protocol.MessageType) error {
+	for _, t := range types {
+		if o.server.RequiresApproval(t) {
+			err := fmt.Errorf("%w: %s", ErrApprovalRequired, t)
+			o.record("approval.refuse", clientID, "", string(t), time.Time{}, AuditDenied, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// requestApproval holds msg for a second operator instead of running it and
+// returns the resulting *PendingApprovalError.
+func (o *Operator) requestApproval(clientID string, msg *protocol.Message, ttl time.Duration, origin string) error {
+	a, err := o.server.hold(clientID, msg, ttl, origin, o.ID)
+	o.record("approval.request", clientID, msg.RequestID, auditSummary(msg), time.Time{}, AuditPending, err)
+	if err != nil {
+		return err
+	}
+	return &PendingApprovalError{Approval: a}
+}
+
+// Approvals lists the approvals of clients the operator may view.
+func (o *Operator) Approvals(clientID string) []*Approval {
+	approvals := o.server.listApprovals(clientID)
+
+	visible := approvals[:0]
+	for _, a := range approvals {
+		if o.Can(PermViewClients, a.ClientID) {
+			visible = append(visible, a)
+		}
+	}
+	return visible
+}
+
+func (o *Operator) Approval(id string) (*Approval, error) {
+	a, err := o.server.lookupApproval(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.Authorize(PermViewClients, a.ClientID); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Approve runs a held operation. The operator needs PermApprove on its
+// client and must not be the one who requested it.
+func (o *Operator) Approve(id string) (*Approval, error) {
+	return o.decide(id, true)
+}
+
+// Reject drops a held operation, with the same requirements as Approve.
+func (o *Operator) Reject(id string) (*Approval, error) {
+	return o.decide(id, false)
+}
+
+func (o *Operator) decide(id string, approve bool) (*Approval, error) {
+	a, err := o.server.lookupApproval(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.Authorize(PermApprove, a.ClientID); err != nil {
+		return nil, err
+	}
+
+	action := "approval.reject"
+	if approve {
+		action = "approval.approve"
+	}
+	decided, err := o.server.decide(id, o.ID, approve)
+	o.record(action, a.ClientID, id, auditSummary(a.Message), time.Time{}, AuditOK, err)
+	return decided, err
+}
+
+// AuditRecords queries the audit log for records about clients the operator
+// may audit.
+func (o *Operator) AuditRecords(f AuditFilter) ([]AuditRecord, error) {
+	if !o.CanAny(PermViewAudit) {
+		return nil, fmt.Errorf("%w: %s lacks %s", ErrForbidden, o.ID, PermViewAudit)
+	}
+
+	limit := f.Limit
+	f.Limit = 0
+	records, err := o.server.auditRecords(f)
+	if err != nil {
+		return nil, err
+	}
+
+	visible := records[:0]
+	for _, rec := range records {
+		if o.Can(PermViewAudit, rec.ClientID) {
+			visible = append(visible, rec)
+		}
+	}
+	if limit > 0 && len(visible) > limit {
+		visible = visible[len(visible)-limit:]
+	}
+	return visible, nil
+}
+
+// sees reports whether ev concerns a client the operator may view.
+func (o *Operator) sees(ev Event) bool {
+	switch data := ev.Data.(type) {
+	case *ClientRecord:
+		return o.Can(PermViewClients, data.ID)
+	case *QueueItem:
+		return o.Can(PermViewClients, data.ClientID)
+	case *Approval:
+		return o.Can(PermViewClients, data.ClientID)
+	}
+	return false
+}
@@ -0,0 +1,42 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SignAuth computes the HMAC-SHA256 a client returns in AuthPayload.Signature
+// to answer the server's challenge nonce.
+func SignAuth(secret, clientID, nonce string, timestamp int64) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(clientID))
+	mac.Write([]byte{'\n'})
+	mac.Write([]byte(nonce))
+	mac.Write([]byte{'\n'})
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyAuth reports whether the payload carries a valid signature for secret.
+func VerifyAuth(secret string, payload *AuthPayload) bool {
+	expected := SignAuth(secret, payload.ClientID, payload.Nonce, payload.Timestamp)
+	return hmac.Equal([]byte(expected), []byte(payload.Signature))
+}
+
+// FormatEnrollmentToken joins a client ID and its secret into the single
+// string handed to the client at install time.
+func FormatEnrollmentToken(clientID, secret string) string {
+	return clientID + ":" + secret
+}
+
+func ParseEnrollmentToken(token string) (clientID, secret string, err error) {
+	clientID, secret, ok := strings.Cut(strings.TrimSpace(token), ":")
+	if !ok || clientID == "" || secret == "" {
+		return "", "", fmt.Errorf("invalid enrollment token format")
+	}
+	return clientID, secret, nil
+}
@@ -0,0 +1,137 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Wire encodings and compression schemes negotiated in the auth handshake.
+// The handshake itself is always JSON over text frames.
+const (
+	EncodingJSON   = "json"
+	EncodingBinary = "binary"
+
+	CompressionNone    = "none"
+	CompressionDeflate = "deflate"
+)
+
+// Binary frames start with this version byte so the layout can change later.
+const frameVersion = 1
+
+var ErrMalformedFrame = errors.New("malformed binary frame")
+
+// EncodeFrame lays msg out as a binary WebSocket frame:
+//
+//	version   uint8
+//	type      uint8 length + bytes
+//	requestID uint8 length + bytes
+//	timestamp int64
+//	payload   uint32 length + JSON bytes
+//	binary    remaining bytes, unencoded
+//
+// All integers are big-endian.
+func EncodeFrame(msg *Message) ([]byte, error) {
+	if len(msg.Type) > math.MaxUint8 || len(msg.RequestID) > math.MaxUint8 {
+		return nil, fmt.Errorf("message type or request id too long for a binary frame")
+	}
+	if uint64(len(msg.Payload)) > math.MaxUint32 {
+		return nil, fmt.Errorf("payload too large for a binary frame")
+	}
+
+	size := 1 + 1 + len(msg.Type) + 1 + len(msg.RequestID) + 8 + 4 + len(msg.Payload) + len(msg.Binary)
+	buf := make([]byte, 0, size)
+
+	buf = append(buf, frameVersion)
+	buf = append(buf, byte(len(msg.Type)))
+	buf = append(buf, msg.Type...)
+	buf = append(buf, byte(len(msg.RequestID)))
+	buf = append(buf, msg.RequestID...)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(msg.Timestamp))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(msg.Payload)))
+	buf = append(buf, msg.Payload...)
+	buf = append(buf, msg.Binary...)
+
+	return buf, nil
+}
+
+// DecodeFrame parses a frame produced by EncodeFrame. The returned message
+// aliases data.
+func DecodeFrame(data []byte) (*Message, error) {
+	r := frameReader{data: data}
+
+	if version := r.byte(); version != frameVersion {
+		if r.err != nil {
+			return nil, r.err
+		}
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrMalformedFrame, version)
+	}
+
+	msg := &Message{}
+	msg.Type = MessageType(r.bytes(int(r.byte())))
+	msg.RequestID = string(r.bytes(int(r.byte())))
+	msg.Timestamp = int64(r.uint64())
+	msg.Payload = r.bytes(int(r.uint32()))
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	if rest := data[r.pos:]; len(rest) > 0 {
+		msg.Binary = rest
+	}
+	return msg, nil
+}
+
+type frameReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *frameReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || len(r.data)-r.pos < n {
+		r.err = fmt.Errorf("%w: truncated at offset %d", ErrMalformedFrame, r.pos)
+		return nil
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *frameReader) byte() byte {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *frameReader) uint32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *frameReader) uint64() uint64 {
+	if b := r.bytes(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+// Negotiate returns the first of the peer's offered options that is also in
+// supported, or fallback if there is none.
+func Negotiate(offered, supported []string, fallback string) string {
+	for _, o := range offered {
+		for _, s := range supported {
+			if o == s {
+				return o
+			}
+		}
+	}
+	return fallback
+}
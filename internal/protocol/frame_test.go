@@ -0,0 +1,105 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  *Message
+	}{
+		{
+			name: "payload only",
+			msg:  NewCommand(CommandPayload{Command: "uname", Args: []string{"-a"}}),
+		},
+		{
+			name: "payload and binary",
+			msg: func() *Message {
+				msg := NewSessionStdin(SessionDataPayload{SessionID: "s"})
+				msg.Binary = []byte{0, 1, 2, 0xFF}
+				return msg
+			}(),
+		},
+		{
+			name: "empty",
+			msg:  &Message{Type: TypeHeartbeat},
+		},
+		{
+			name: "longest type and request id",
+			msg: &Message{
+				Type:      MessageType(strings.Repeat("t", 255)),
+				RequestID: strings.Repeat("r", 255),
+				Timestamp: -1,
+				Payload:   []byte(`{}`),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := EncodeFrame(tt.msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := DecodeFrame(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Type != tt.msg.Type || got.RequestID != tt.msg.RequestID || got.Timestamp != tt.msg.Timestamp {
+				t.Errorf("header = %s %q %d, want %s %q %d", got.Type, got.RequestID, got.Timestamp,
+					tt.msg.Type, tt.msg.RequestID, tt.msg.Timestamp)
+			}
+			if !bytes.Equal(got.Payload, tt.msg.Payload) {
+				t.Errorf("payload = %q, want %q", got.Payload, tt.msg.Payload)
+			}
+			if !bytes.Equal(got.Binary, tt.msg.Binary) {
+				t.Errorf("binary = %x, want %x", got.Binary, tt.msg.Binary)
+			}
+		})
+	}
+}
+
+func TestEncodeFrameRejectsLongHeaders(t *testing.T) {
+	msg := &Message{Type: TypeCommand, RequestID: strings.Repeat("r", 256)}
+	if _, err := EncodeFrame(msg); err == nil {
+		t.Fatal("EncodeFrame accepted a request id longer than 255 bytes")
+	}
+}
+
+func TestDecodeFrameMalformed(t *testing.T) {
+	valid, err := EncodeFrame(NewCommand(CommandPayload{Command: "true"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"unknown version", append([]byte{frameVersion + 1}, valid[1:]...)},
+		{"truncated type", valid[:3]},
+		{"truncated payload", valid[:len(valid)-1]},
+		{"payload length past the end", func() []byte {
+			data := append([]byte(nil), valid...)
+			// The payload length follows version, type, request id and
+			// timestamp.
+			at := 1 + 1 + int(data[1])
+			at += 1 + int(data[at]) + 8
+			data[at] = 0xFF
+			return data
+		}()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := DecodeFrame(tt.data); !errors.Is(err, ErrMalformedFrame) {
+				t.Fatalf("DecodeFrame error = %v, want %v", err, ErrMalformedFrame)
+			}
+		})
+	}
+}
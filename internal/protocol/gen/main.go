@@ -0,0 +1,337 @@
+// Command gen generates the protocol message types, constructors and
+// validators from schema.json. It understands the subset of JSON Schema the
+// protocol uses: flat objects of strings, booleans, integers and string
+// arrays, with required, minLength (0 or 1), minimum and enum.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type schemaFile struct {
+	Messages []messageSpec   `json:"x-messages"`
+	Defs     json.RawMessage `json:"$defs"`
+}
+
+type messageSpec struct {
+	Type        string `json:"type"`
+	Payload     string `json:"payload"`
+	Description string `json:"description"`
+}
+
+type objectSpec struct {
+	Type        string          `json:"type"`
+	Description string          `json:"description"`
+	Properties  json.RawMessage `json:"properties"`
+	Required    []string        `json:"required"`
+}
+
+type propertySpec struct {
+	Type        string        `json:"type"`
+	Format      string        `json:"format"`
+	Description string        `json:"description"`
+	MinLength   *int          `json:"minLength"`
+	Minimum     *int64        `json:"minimum"`
+	Enum        []string      `json:"enum"`
+	Items       *propertySpec `json:"items"`
+}
+
+type field struct {
+	name     string
+	goName   string
+	goType   string
+	required bool
+	spec     propertySpec
+}
+
+type object struct {
+	name   string
+	doc    string
+	fields []field
+}
+
+// initialisms keeps Go naming conventions for the words that appear in
+// property names.
+var initialisms = map[string]string{
+	"id":     "ID",
+	"os":     "OS",
+	"url":    "URL",
+	"sha256": "SHA256",
+}
+
+func main() {
+	schemaPath := flag.String("schema", "schema.json", "Schema to generate from")
+	outPath := flag.String("out", "messages_gen.go", "Output Go file")
+	pkg := flag.String("package", "protocol", "Package name of the output file")
+	flag.Parse()
+
+	data, err := os.ReadFile(*schemaPath)
+	if err != nil {
+		log.Fatalf("Failed to read schema: %v", err)
+	}
+
+	var schema schemaFile
+	if err := json.Unmarshal(data, &schema); err != nil {
+		log.Fatalf("Failed to parse schema: %v", err)
+	}
+
+	objects, err := parseDefs(schema.Defs)
+	if err != nil {
+		log.Fatalf("Invalid schema: %v", err)
+	}
+
+	src, err := generate(*pkg, *schemaPath, schema.Messages, objects)
+	if err != nil {
+		log.Fatalf("Failed to generate code: %v", err)
+	}
+
+	if err := os.WriteFile(*outPath, src, 0644); err != nil {
+		log.Fatalf("Failed to write %s: %v", *outPath, err)
+	}
+}
+
+func parseDefs(raw json.RawMessage) ([]object, error) {
+	names, err := orderedKeys(raw)
+	if err != nil {
+		return nil, fmt.Errorf("$defs: %w", err)
+	}
+
+	var defs map[string]objectSpec
+	if err := json.Unmarshal(raw, &defs); err != nil {
+		return nil, fmt.Errorf("$defs: %w", err)
+	}
+
+	objects := make([]object, 0, len(names))
+	for _, name := range names {
+		def := defs[name]
+		if def.Type != "object" {
+			return nil, fmt.Errorf("%s: only object definitions are supported", name)
+		}
+
+		props, err := orderedKeys(def.Properties)
+		if err != nil {
+			return nil, fmt.Errorf("%s.properties: %w", name, err)
+		}
+		var specs map[string]propertySpec
+		if err := json.Unmarshal(def.Properties, &specs); err != nil {
+			return nil, fmt.Errorf("%s.properties: %w", name, err)
+		}
+
+		for _, req := range def.Required {
+			if _, ok := specs[req]; !ok {
+				return nil, fmt.Errorf("%s: required property %q is not defined", name, req)
+			}
+		}
+
+		obj := object{name: name, doc: def.Description}
+		for _, prop := range props {
+			spec := specs[prop]
+			goType, err := goType(spec)
+			if err != nil {
+				return nil, fmt.Errorf("%s.%s: %w", name, prop, err)
+			}
+			if spec.MinLength != nil && *spec.MinLength > 1 {
+				return nil, fmt.Errorf("%s.%s: only minLength 0 or 1 is supported", name, prop)
+			}
+			obj.fields = append(obj.fields, field{
+				name:     prop,
+				goName:   goName(prop),
+				goType:   goType,
+				required: slices.Contains(def.Required, prop),
+				spec:     spec,
+			})
+		}
+		objects = append(objects, obj)
+	}
+
+	return objects, nil
+}
+
+// orderedKeys returns the keys of a JSON object in document order, so the
+// generated code follows the schema's layout.
+func orderedKeys(raw json.RawMessage) ([]string, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, fmt.Errorf("expected an object")
+	}
+
+	var keys []string
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, tok.(string))
+
+		var skip json.RawMessage
+		if err := dec.Decode(&skip); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+func goType(spec propertySpec) (string, error) {
+	switch spec.Type {
+	case "string":
+		return "string", nil
+	case "boolean":
+		return "bool", nil
+	case "integer":
+		switch spec.Format {
+		case "":
+			return "int", nil
+		case "int64", "uint32":
+			return spec.Format, nil
+		}
+		return "", fmt.Errorf("unsupported integer format %q", spec.Format)
+	case "array":
+		if spec.Items == nil || spec.Items.Type != "string" {
+			return "", fmt.Errorf("only arrays of strings are supported")
+		}
+		return "[]string", nil
+	}
+	return "", fmt.Errorf("unsupported type %q", spec.Type)
+}
+
+func goName(snake string) string {
+	var b strings.Builder
+	for _, word := range strings.Split(snake, "_") {
+		if s, ok := initialisms[word]; ok {
+			b.WriteString(s)
+			continue
+		}
+		if word != "" {
+			b.WriteString(strings.ToUpper(word[:1]) + word[1:])
+		}
+	}
+	return b.String()
+}
+
+func generate(pkg, schemaPath string, messages []messageSpec, objects []object) ([]byte, error) {
+	known := make(map[string]bool, len(objects))
+	for _, obj := range objects {
+		known[obj.name] = true
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Code generated by protocol/gen from %s. DO NOT EDIT.\n\n", schemaPath)
+	fmt.Fprintf(&b, "package %s\n\n", pkg)
+
+	b.WriteString("const (\n")
+	for _, m := range messages {
+		if m.Description != "" {
+			writeComment(&b, "\t", m.Description)
+		}
+		fmt.Fprintf(&b, "\tType%s MessageType = %q\n", goName(m.Type), m.Type)
+	}
+	b.WriteString(")\n\n")
+
+	for _, m := range messages {
+		if !known[m.Payload] {
+			return nil, fmt.Errorf("message %s: unknown payload %q", m.Type, m.Payload)
+		}
+		name := goName(m.Type)
+		fmt.Fprintf(&b, "// New%s builds a message of type Type%s.\n", name, name)
+		fmt.Fprintf(&b, "func New%s(payload %s) *Message {\n\treturn NewMessage(Type%s, payload)\n}\n\n", name, m.Payload, name)
+	}
+
+	b.WriteString("// NewPayload returns an empty payload of the type msgType carries, for\n")
+	b.WriteString("// decoding messages whose type is only known at run time.\n")
+	b.WriteString("func NewPayload(msgType MessageType) (Payload, bool) {\n\tswitch msgType {\n")
+	for _, m := range messages {
+		fmt.Fprintf(&b, "\tcase Type%s:\n\t\treturn &%s{}, true\n", goName(m.Type), m.Payload)
+	}
+	b.WriteString("\t}\n\treturn nil, false\n}\n\n")
+
+	for _, obj := range objects {
+		writeObject(&b, obj)
+	}
+
+	return format.Source(b.Bytes())
+}
+
+func writeObject(b *bytes.Buffer, obj object) {
+	if obj.doc != "" {
+		writeComment(b, "", obj.doc)
+	}
+	fmt.Fprintf(b, "type %s struct {\n", obj.name)
+	for _, f := range obj.fields {
+		if f.spec.Description != "" {
+			writeComment(b, "\t", f.spec.Description)
+		}
+		tag := f.name
+		if !f.required {
+			tag += ",omitempty"
+		}
+		fmt.Fprintf(b, "\t%s %s `json:%q`\n", f.goName, f.goType, tag)
+	}
+	b.WriteString("}\n\n")
+
+	var required []string
+	for _, f := range obj.fields {
+		if f.required {
+			required = append(required, strconv.Quote(f.name))
+		}
+	}
+	fmt.Fprintf(b, "func (*%s) requiredFields() []string {\n", obj.name)
+	if len(required) == 0 {
+		b.WriteString("\treturn nil\n}\n\n")
+	} else {
+		fmt.Fprintf(b, "\treturn []string{%s}\n}\n\n", strings.Join(required, ", "))
+	}
+
+	fmt.Fprintf(b, "// Validate checks the constraints schema.json places on %s values.\n", obj.name)
+	fmt.Fprintf(b, "func (p *%s) Validate() error {\n", obj.name)
+	for _, f := range obj.fields {
+		writeChecks(b, f)
+	}
+	b.WriteString("\treturn nil\n}\n\n")
+}
+
+func writeChecks(b *bytes.Buffer, f field) {
+	value := "p." + f.goName
+
+	if f.spec.MinLength != nil && *f.spec.MinLength == 1 {
+		fmt.Fprintf(b, "\tif %s == \"\" {\n\t\treturn missingField(%q)\n\t}\n", value, f.name)
+	}
+
+	if len(f.spec.Enum) > 0 {
+		allowed := make([]string, 0, len(f.spec.Enum)+1)
+		if !f.required {
+			allowed = append(allowed, `""`)
+		}
+		for _, v := range f.spec.Enum {
+			allowed = append(allowed, strconv.Quote(v))
+		}
+		fmt.Fprintf(b, "\tswitch %s {\n\tcase %s:\n\tdefault:\n\t\treturn invalidField(%q, %s)\n\t}\n",
+			value, strings.Join(allowed, ", "), f.name, value)
+	}
+
+	if f.spec.Minimum != nil {
+		fmt.Fprintf(b, "\tif %s < %d {\n\t\treturn invalidField(%q, %s)\n\t}\n", value, *f.spec.Minimum, f.name, value)
+	}
+}
+
+func writeComment(b *bytes.Buffer, indent, text string) {
+	const width = 76
+
+	line := indent + "//"
+	for _, word := range strings.Fields(text) {
+		if len(line)+1+len(word) > width && line != indent+"//" {
+			b.WriteString(line + "\n")
+			line = indent + "//"
+		}
+		line += " " + word
+	}
+	b.WriteString(line + "\n")
+}
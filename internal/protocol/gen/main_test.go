@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestGeneratedUpToDate fails when schema.json changed without re-running
+// go generate.
+func TestGeneratedUpToDate(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("..", "schema.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var schema schemaFile
+	if err := json.Unmarshal(data, &schema); err != nil {
+		t.Fatal(err)
+	}
+	objects, err := parseDefs(schema.Defs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := generate("protocol", "schema.json", schema.Messages, objects)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	existing, err := os.ReadFile(filepath.Join("..", "messages_gen.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(src, existing) {
+		t.Error("messages_gen.go is stale; run go generate ./internal/protocol")
+	}
+}
+
+func TestGoName(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"command", "Command"},
+		{"file_read", "FileRead"},
+		{"client_id", "ClientID"},
+		{"os", "OS"},
+		{"image_url", "ImageURL"},
+		{"sha256", "SHA256"},
+		{"trailing_", "Trailing"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			if got := goName(tt.in); got != tt.want {
+				t.Errorf("goName = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDefs(t *testing.T) {
+	tests := []struct {
+		name string
+		defs string
+		// want lists the fields of the single definition as Go declarations.
+		want    []string
+		wantErr string
+	}{
+		{
+			name: "fields in document order",
+			defs: `{"P": {"type": "object", "required": ["path"], "properties": {
+				"path": {"type": "string", "minLength": 1},
+				"mode": {"type": "integer", "format": "uint32"},
+				"size": {"type": "integer", "format": "int64", "minimum": 0},
+				"force": {"type": "boolean"},
+				"args": {"type": "array", "items": {"type": "string"}},
+				"count": {"type": "integer"}
+			}}}`,
+			want: []string{"Path string required", "Mode uint32", "Size int64", "Force bool", "Args []string", "Count int"},
+		},
+		{
+			name:    "not an object",
+			defs:    `{"P": {"type": "string"}}`,
+			wantErr: "only object definitions",
+		},
+		{
+			name:    "undefined required property",
+			defs:    `{"P": {"type": "object", "required": ["path"], "properties": {}}}`,
+			wantErr: `required property "path"`,
+		},
+		{
+			name:    "unsupported type",
+			defs:    `{"P": {"type": "object", "properties": {"n": {"type": "number"}}}}`,
+			wantErr: `unsupported type "number"`,
+		},
+		{
+			name:    "unsupported integer format",
+			defs:    `{"P": {"type": "object", "properties": {"n": {"type": "integer", "format": "int8"}}}}`,
+			wantErr: `unsupported integer format "int8"`,
+		},
+		{
+			name:    "array of objects",
+			defs:    `{"P": {"type": "object", "properties": {"a": {"type": "array", "items": {"type": "object"}}}}}`,
+			wantErr: "only arrays of strings",
+		},
+		{
+			name:    "minLength over 1",
+			defs:    `{"P": {"type": "object", "properties": {"s": {"type": "string", "minLength": 2}}}}`,
+			wantErr: "only minLength 0 or 1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objects, err := parseDefs(json.RawMessage(tt.defs))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseDefs error = %v, want one mentioning %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, f := range objects[0].fields {
+				decl := f.goName + " " + f.goType
+				if f.required {
+					decl += " required"
+				}
+				got = append(got, decl)
+			}
+			if strings.Join(got, ", ") != strings.Join(tt.want, ", ") {
+				t.Errorf("fields = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGenerateChecks(t *testing.T) {
+	objects, err := parseDefs(json.RawMessage(`{"P": {"type": "object", "required": ["kind"], "properties": {
+		"kind": {"type": "string", "enum": ["a", "b"]},
+		"name": {"type": "string", "minLength": 1},
+		"mode": {"type": "string", "enum": ["x"]},
+		"count": {"type": "integer", "minimum": 1}
+	}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := generate("protocol", "test.json", []messageSpec{{Type: "thing", Payload: "P"}}, objects)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		`TypeThing MessageType = "thing"`,
+		"func NewThing(payload P) *Message",
+		"Kind  string `json:\"kind\"`",
+		"Name  string `json:\"name,omitempty\"`",
+		`return []string{"kind"}`,
+		// Optional enums accept the zero value, required ones do not.
+		`case "a", "b":`,
+		`case "", "x":`,
+		`if p.Name == "" {`,
+		`if p.Count < 1 {`,
+	} {
+		if !strings.Contains(string(src), want) {
+			t.Errorf("generated code lacks %q:\n%s", want, src)
+		}
+	}
+
+	if _, err := generate("protocol", "test.json", []messageSpec{{Type: "thing", Payload: "Missing"}}, objects); err == nil {
+		t.Error("generate accepted a message with an undefined payload")
+	}
+}
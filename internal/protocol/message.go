@@ -1,127 +1,123 @@
 package protocol
 
-import "encoding/json"
+//go:generate go run ./gen -schema schema.json -out messages_gen.go
 
-type MessageType string
-
-const (
-	TypeAuth         MessageType = "auth"
-	TypeHeartbeat    MessageType = "heartbeat"
-	TypeCommand      MessageType = "command"
-	TypeScreenshot   MessageType = "screenshot"
-	TypeWebcam       MessageType = "webcam"
-	TypeShowImage    MessageType = "show_image"
-	TypeResponse     MessageType = "response"
-	TypeError        MessageType = "error"
-	TypeFileRead     MessageType = "file_read"
-	TypeFileWrite    MessageType = "file_write"
-	TypeFileDelete   MessageType = "file_delete"
-	TypeFileList     MessageType = "file_list"
-	TypeFileDownload MessageType = "file_download"
-	TypeRegRead      MessageType = "reg_read"
-	TypeRegWrite     MessageType = "reg_write"
-	TypeRegDelete    MessageType = "reg_delete"
-	TypeRegList      MessageType = "reg_list"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
 )
 
+type MessageType string
+
 type Message struct {
 	Type      MessageType     `json:"type"`
+	RequestID string          `json:"request_id,omitempty"`
 	Payload   json.RawMessage `json:"payload"`
 	Timestamp int64           `json:"timestamp"`
+	// Binary carries raw bytes (screenshots, file contents, terminal I/O)
+	// next to the payload. Binary frames send it as-is; JSON frames fall
+	// back to base64.
+	Binary []byte `json:"binary,omitempty"`
 }
 
-type AuthPayload struct {
-	ClientID string `json:"client_id"`
-	Hostname string `json:"hostname"`
-	Username string `json:"username"`
-	OS       string `json:"os"`
-}
+// ErrInvalidPayload is returned by Decode when a payload does not match
+// schema.json.
+var ErrInvalidPayload = errors.New("invalid payload")
 
-type CommandPayload struct {
-	Command string   `json:"command"`
-	Args    []string `json:"args,omitempty"`
+// Payload is implemented by every payload type generated from schema.json.
+type Payload interface {
+	Validate() error
+	requiredFields() []string
 }
 
-type ScreenshotPayload struct {
-	Quality int `json:"quality"`
-}
+// NewMessage wraps payload in a message of type msgType. Prefer the typed
+// constructors in messages_gen.go (NewScreenshot, NewFileRead, ...).
+func NewMessage(msgType MessageType, payload interface{}) *Message {
+	payloadBytes, _ := json.Marshal(payload)
 
-type WebcamPayload struct {
-	Duration  int    `json:"duration"`
-	StreamURL string `json:"stream_url,omitempty"`
+	return &Message{
+		Type:      msgType,
+		Payload:   payloadBytes,
+		Timestamp: time.Now().Unix(),
+	}
 }
 
-type ShowImagePayload struct {
-	ImageURL string `json:"image_url"`
-	Duration int    `json:"duration"`
+// NewReply builds the response or error answering req.
+func NewReply(req *Message, msgType MessageType, payload interface{}) *Message {
+	msg := NewMessage(msgType, payload)
+	msg.RequestID = req.RequestID
+	return msg
 }
 
-type ResponsePayload struct {
-	Success bool   `json:"success"`
-	Data    string `json:"data,omitempty"`
-	Error   string `json:"error,omitempty"`
-}
-
-type ErrorPayload struct {
-	Code    string `json:"code"`
-	Message string `json:"message"`
-}
+// Decode unmarshals the payload into v. Schema payloads are also checked for
+// required fields and validated; errors wrap ErrInvalidPayload.
+func (m *Message) Decode(v interface{}) error {
+	p, isPayload := v.(Payload)
+	if isPayload {
+		if err := checkRequired(m.Payload, p.requiredFields()); err != nil {
+			return fmt.Errorf("%s: %w", m.Type, err)
+		}
+	}
 
-type FileReadPayload struct {
-	Path string `json:"path"`
-}
+	if err := json.Unmarshal(m.Payload, v); err != nil {
+		return fmt.Errorf("%s: %w: %v", m.Type, ErrInvalidPayload, err)
+	}
 
-type FileWritePayload struct {
-	Path    string `json:"path"`
-	Content string `json:"content"`
-	Mode    uint32 `json:"mode,omitempty"`
+	if isPayload {
+		if err := p.Validate(); err != nil {
+			return fmt.Errorf("%s: %w", m.Type, err)
+		}
+	}
+	return nil
 }
 
-type FileDeletePayload struct {
-	Path string `json:"path"`
-}
+func checkRequired(raw json.RawMessage, required []string) error {
+	if len(required) == 0 {
+		return nil
+	}
 
-type FileListPayload struct {
-	Path string `json:"path"`
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidPayload, err)
+	}
+	for _, name := range required {
+		if v, ok := fields[name]; !ok || string(v) == "null" {
+			return missingField(name)
+		}
+	}
+	return nil
 }
 
-type FileDownloadPayload struct {
-	Path string `json:"path"`
+func missingField(name string) error {
+	return fmt.Errorf("%w: %s is required", ErrInvalidPayload, name)
 }
 
-type FileInfo struct {
-	Name    string `json:"name"`
-	Path    string `json:"path"`
-	Size    int64  `json:"size"`
-	IsDir   bool   `json:"is_dir"`
-	ModTime int64  `json:"mod_time"`
-	Mode    string `json:"mode"`
+func invalidField(name string, value interface{}) error {
+	return fmt.Errorf("%w: %s has invalid value %v", ErrInvalidPayload, name, value)
 }
 
-type RegistryReadPayload struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
-}
-
-type RegistryWritePayload struct {
-	Key      string `json:"key"`
-	Value    string `json:"value"`
-	Data     string `json:"data"`
-	DataType string `json:"data_type"`
-}
-
-type RegistryDeletePayload struct {
-	Key   string `json:"key"`
-	Value string `json:"value,omitempty"`
-}
+// Transfer directions, seen from the server: downloads copy a client file to
+// the server, uploads copy a server file to the client.
+const (
+	TransferDownload = "download"
+	TransferUpload   = "upload"
+)
 
-type RegistryListPayload struct {
-	Key string `json:"key"`
-}
+// Job states reported in JobInfo.State.
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+)
 
-type RegistryInfo struct {
-	Name     string `json:"name"`
-	Type     string `json:"type"`
-	Value    string `json:"value"`
-	DataType string `json:"data_type"`
-}
+// Error codes reported in ErrorPayload.Code.
+const (
+	ErrorCodeGeneric = "ERROR"
+	// ErrorCodePolicyDenied means the client's local policy refused the
+	// request; the server cannot lift it.
+	ErrorCodePolicyDenied = "POLICY_DENIED"
+	// ErrorCodeConsentDenied means the local user refused the request or
+	// did not answer in time.
+	ErrorCodeConsentDenied = "CONSENT_DENIED"
+)
@@ -0,0 +1,952 @@
+// Code generated by protocol/gen from schema.json. DO NOT EDIT.
+
+package protocol
+
+const (
+	// Client's answer to the challenge.
+	TypeAuth MessageType = "auth"
+	// First message on every connection.
+	TypeChallenge  MessageType = "challenge"
+	TypeAuthResult MessageType = "auth_result"
+	// Periodic liveness ping; only the identity fields are set.
+	TypeHeartbeat  MessageType = "heartbeat"
+	TypeCommand    MessageType = "command"
+	TypeScreenshot MessageType = "screenshot"
+	TypeWebcam     MessageType = "webcam"
+	TypeShowImage  MessageType = "show_image"
+	// Successful reply; RequestID matches the request.
+	TypeResponse MessageType = "response"
+	// Failed reply; RequestID matches the request.
+	TypeError MessageType = "error"
+	// Streamed command output sent before the final response.
+	TypeOutput MessageType = "output"
+	// Cancels a queued or running job; job_id may be a unique prefix.
+	TypeCancel MessageType = "cancel"
+	// Lists the client's queued and running jobs as a JSON array of JobInfo.
+	TypeJobList       MessageType = "job_list"
+	TypeSessionOpen   MessageType = "session_open"
+	TypeSessionResize MessageType = "session_resize"
+	TypeSessionStdin  MessageType = "session_stdin"
+	TypeSessionStdout MessageType = "session_stdout"
+	TypeSessionClose  MessageType = "session_close"
+	TypeTransferStart MessageType = "transfer_start"
+	TypeTransferChunk MessageType = "transfer_chunk"
+	TypeTransferEnd   MessageType = "transfer_end"
+	TypeTransferAbort MessageType = "transfer_abort"
+	TypeFileRead      MessageType = "file_read"
+	TypeFileWrite     MessageType = "file_write"
+	TypeFileDelete    MessageType = "file_delete"
+	TypeFileList      MessageType = "file_list"
+	TypeFileDownload  MessageType = "file_download"
+	TypeRegRead       MessageType = "reg_read"
+	TypeRegWrite      MessageType = "reg_write"
+	TypeRegDelete     MessageType = "reg_delete"
+	TypeRegList       MessageType = "reg_list"
+)
+
+// NewAuth builds a message of type TypeAuth.
+func NewAuth(payload AuthPayload) *Message {
+	return NewMessage(TypeAuth, payload)
+}
+
+// NewChallenge builds a message of type TypeChallenge.
+func NewChallenge(payload ChallengePayload) *Message {
+	return NewMessage(TypeChallenge, payload)
+}
+
+// NewAuthResult builds a message of type TypeAuthResult.
+func NewAuthResult(payload AuthResultPayload) *Message {
+	return NewMessage(TypeAuthResult, payload)
+}
+
+// NewHeartbeat builds a message of type TypeHeartbeat.
+func NewHeartbeat(payload AuthPayload) *Message {
+	return NewMessage(TypeHeartbeat, payload)
+}
+
+// NewCommand builds a message of type TypeCommand.
+func NewCommand(payload CommandPayload) *Message {
+	return NewMessage(TypeCommand, payload)
+}
+
+// NewScreenshot builds a message of type TypeScreenshot.
+func NewScreenshot(payload ScreenshotPayload) *Message {
+	return NewMessage(TypeScreenshot, payload)
+}
+
+// NewWebcam builds a message of type TypeWebcam.
+func NewWebcam(payload WebcamPayload) *Message {
+	return NewMessage(TypeWebcam, payload)
+}
+
+// NewShowImage builds a message of type TypeShowImage.
+func NewShowImage(payload ShowImagePayload) *Message {
+	return NewMessage(TypeShowImage, payload)
+}
+
+// NewResponse builds a message of type TypeResponse.
+func NewResponse(payload ResponsePayload) *Message {
+	return NewMessage(TypeResponse, payload)
+}
+
+// NewError builds a message of type TypeError.
+func NewError(payload ErrorPayload) *Message {
+	return NewMessage(TypeError, payload)
+}
+
+// NewOutput builds a message of type TypeOutput.
+func NewOutput(payload OutputPayload) *Message {
+	return NewMessage(TypeOutput, payload)
+}
+
+// NewCancel builds a message of type TypeCancel.
+func NewCancel(payload CancelPayload) *Message {
+	return NewMessage(TypeCancel, payload)
+}
+
+// NewJobList builds a message of type TypeJobList.
+func NewJobList(payload JobListPayload) *Message {
+	return NewMessage(TypeJobList, payload)
+}
+
+// NewSessionOpen builds a message of type TypeSessionOpen.
+func NewSessionOpen(payload SessionOpenPayload) *Message {
+	return NewMessage(TypeSessionOpen, payload)
+}
+
+// NewSessionResize builds a message of type TypeSessionResize.
+func NewSessionResize(payload SessionResizePayload) *Message {
+	return NewMessage(TypeSessionResize, payload)
+}
+
+// NewSessionStdin builds a message of type TypeSessionStdin.
+func NewSessionStdin(payload SessionDataPayload) *Message {
+	return NewMessage(TypeSessionStdin, payload)
+}
+
+// NewSessionStdout builds a message of type TypeSessionStdout.
+func NewSessionStdout(payload SessionDataPayload) *Message {
+	return NewMessage(TypeSessionStdout, payload)
+}
+
+// NewSessionClose builds a message of type TypeSessionClose.
+func NewSessionClose(payload SessionClosePayload) *Message {
+	return NewMessage(TypeSessionClose, payload)
+}
+
+// NewTransferStart builds a message of type TypeTransferStart.
+func NewTransferStart(payload TransferStartPayload) *Message {
+	return NewMessage(TypeTransferStart, payload)
+}
+
+// NewTransferChunk builds a message of type TypeTransferChunk.
+func NewTransferChunk(payload TransferChunkPayload) *Message {
+	return NewMessage(TypeTransferChunk, payload)
+}
+
+// NewTransferEnd builds a message of type TypeTransferEnd.
+func NewTransferEnd(payload TransferEndPayload) *Message {
+	return NewMessage(TypeTransferEnd, payload)
+}
+
+// NewTransferAbort builds a message of type TypeTransferAbort.
+func NewTransferAbort(payload TransferAbortPayload) *Message {
+	return NewMessage(TypeTransferAbort, payload)
+}
+
+// NewFileRead builds a message of type TypeFileRead.
+func NewFileRead(payload FileReadPayload) *Message {
+	return NewMessage(TypeFileRead, payload)
+}
+
+// NewFileWrite builds a message of type TypeFileWrite.
+func NewFileWrite(payload FileWritePayload) *Message {
+	return NewMessage(TypeFileWrite, payload)
+}
+
+// NewFileDelete builds a message of type TypeFileDelete.
+func NewFileDelete(payload FileDeletePayload) *Message {
+	return NewMessage(TypeFileDelete, payload)
+}
+
+// NewFileList builds a message of type TypeFileList.
+func NewFileList(payload FileListPayload) *Message {
+	return NewMessage(TypeFileList, payload)
+}
+
+// NewFileDownload builds a message of type TypeFileDownload.
+func NewFileDownload(payload FileDownloadPayload) *Message {
+	return NewMessage(TypeFileDownload, payload)
+}
+
+// NewRegRead builds a message of type TypeRegRead.
+func NewRegRead(payload RegistryReadPayload) *Message {
+	return NewMessage(TypeRegRead, payload)
+}
+
+// NewRegWrite builds a message of type TypeRegWrite.
+func NewRegWrite(payload RegistryWritePayload) *Message {
+	return NewMessage(TypeRegWrite, payload)
+}
+
+// NewRegDelete builds a message of type TypeRegDelete.
+func NewRegDelete(payload RegistryDeletePayload) *Message {
+	return NewMessage(TypeRegDelete, payload)
+}
+
+// NewRegList builds a message of type TypeRegList.
+func NewRegList(payload RegistryListPayload) *Message {
+	return NewMessage(TypeRegList, payload)
+}
+
+// NewPayload returns an empty payload of the type msgType carries, for
+// decoding messages whose type is only known at run time.
+func NewPayload(msgType MessageType) (Payload, bool) {
+	switch msgType {
+	case TypeAuth:
+		return &AuthPayload{}, true
+	case TypeChallenge:
+		return &ChallengePayload{}, true
+	case TypeAuthResult:
+		return &AuthResultPayload{}, true
+	case TypeHeartbeat:
+		return &AuthPayload{}, true
+	case TypeCommand:
+		return &CommandPayload{}, true
+	case TypeScreenshot:
+		return &ScreenshotPayload{}, true
+	case TypeWebcam:
+		return &WebcamPayload{}, true
+	case TypeShowImage:
+		return &ShowImagePayload{}, true
+	case TypeResponse:
+		return &ResponsePayload{}, true
+	case TypeError:
+		return &ErrorPayload{}, true
+	case TypeOutput:
+		return &OutputPayload{}, true
+	case TypeCancel:
+		return &CancelPayload{}, true
+	case TypeJobList:
+		return &JobListPayload{}, true
+	case TypeSessionOpen:
+		return &SessionOpenPayload{}, true
+	case TypeSessionResize:
+		return &SessionResizePayload{}, true
+	case TypeSessionStdin:
+		return &SessionDataPayload{}, true
+	case TypeSessionStdout:
+		return &SessionDataPayload{}, true
+	case TypeSessionClose:
+		return &SessionClosePayload{}, true
+	case TypeTransferStart:
+		return &TransferStartPayload{}, true
+	case TypeTransferChunk:
+		return &TransferChunkPayload{}, true
+	case TypeTransferEnd:
+		return &TransferEndPayload{}, true
+	case TypeTransferAbort:
+		return &TransferAbortPayload{}, true
+	case TypeFileRead:
+		return &FileReadPayload{}, true
+	case TypeFileWrite:
+		return &FileWritePayload{}, true
+	case TypeFileDelete:
+		return &FileDeletePayload{}, true
+	case TypeFileList:
+		return &FileListPayload{}, true
+	case TypeFileDownload:
+		return &FileDownloadPayload{}, true
+	case TypeRegRead:
+		return &RegistryReadPayload{}, true
+	case TypeRegWrite:
+		return &RegistryWritePayload{}, true
+	case TypeRegDelete:
+		return &RegistryDeletePayload{}, true
+	case TypeRegList:
+		return &RegistryListPayload{}, true
+	}
+	return nil, false
+}
+
+type AuthPayload struct {
+	ClientID  string `json:"client_id"`
+	Hostname  string `json:"hostname"`
+	Username  string `json:"username"`
+	OS        string `json:"os"`
+	Nonce     string `json:"nonce,omitempty"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+	Signature string `json:"signature,omitempty"`
+	// Encodings and Compression list what the client can speak, most preferred
+	// first.
+	Encodings   []string `json:"encodings,omitempty"`
+	Compression []string `json:"compression,omitempty"`
+	// ProtocolVersion is zero for clients that predate versioning.
+	ProtocolVersion int      `json:"protocol_version,omitempty"`
+	Capabilities    []string `json:"capabilities,omitempty"`
+	AgentVersion    string   `json:"agent_version,omitempty"`
+}
+
+func (*AuthPayload) requiredFields() []string {
+	return []string{"client_id", "hostname", "username", "os"}
+}
+
+// Validate checks the constraints schema.json places on AuthPayload values.
+func (p *AuthPayload) Validate() error {
+	return nil
+}
+
+type ChallengePayload struct {
+	Nonce string `json:"nonce"`
+}
+
+func (*ChallengePayload) requiredFields() []string {
+	return []string{"nonce"}
+}
+
+// Validate checks the constraints schema.json places on ChallengePayload values.
+func (p *ChallengePayload) Validate() error {
+	if p.Nonce == "" {
+		return missingField("nonce")
+	}
+	return nil
+}
+
+// AuthResultPayload tells the client whether it was accepted and which
+// encoding and compression both sides use from the next message on.
+type AuthResultPayload struct {
+	Accepted    bool   `json:"accepted"`
+	Error       string `json:"error,omitempty"`
+	Encoding    string `json:"encoding,omitempty"`
+	Compression string `json:"compression,omitempty"`
+	// ProtocolVersion and MinProtocolVersion describe the server, so a
+	// rejected client can tell which side needs upgrading.
+	ProtocolVersion    int `json:"protocol_version,omitempty"`
+	MinProtocolVersion int `json:"min_protocol_version,omitempty"`
+}
+
+func (*AuthResultPayload) requiredFields() []string {
+	return []string{"accepted"}
+}
+
+// Validate checks the constraints schema.json places on AuthResultPayload values.
+func (p *AuthResultPayload) Validate() error {
+	return nil
+}
+
+type CommandPayload struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+	Stream  bool     `json:"stream,omitempty"`
+	Timeout int      `json:"timeout,omitempty"`
+	WorkDir string   `json:"work_dir,omitempty"`
+}
+
+func (*CommandPayload) requiredFields() []string {
+	return []string{"command"}
+}
+
+// Validate checks the constraints schema.json places on CommandPayload values.
+func (p *CommandPayload) Validate() error {
+	if p.Command == "" {
+		return missingField("command")
+	}
+	if p.Timeout < 0 {
+		return invalidField("timeout", p.Timeout)
+	}
+	return nil
+}
+
+type OutputPayload struct {
+	JobID  string `json:"job_id"`
+	Stream string `json:"stream"`
+	Seq    int    `json:"seq"`
+	Data   string `json:"data"`
+}
+
+func (*OutputPayload) requiredFields() []string {
+	return []string{"job_id", "stream", "seq", "data"}
+}
+
+// Validate checks the constraints schema.json places on OutputPayload values.
+func (p *OutputPayload) Validate() error {
+	if p.JobID == "" {
+		return missingField("job_id")
+	}
+	switch p.Stream {
+	case "stdout", "stderr":
+	default:
+		return invalidField("stream", p.Stream)
+	}
+	return nil
+}
+
+type CancelPayload struct {
+	JobID string `json:"job_id"`
+}
+
+func (*CancelPayload) requiredFields() []string {
+	return []string{"job_id"}
+}
+
+// Validate checks the constraints schema.json places on CancelPayload values.
+func (p *CancelPayload) Validate() error {
+	if p.JobID == "" {
+		return missingField("job_id")
+	}
+	return nil
+}
+
+type JobListPayload struct {
+	// Type limits the list to jobs of one message type.
+	Type string `json:"type,omitempty"`
+}
+
+func (*JobListPayload) requiredFields() []string {
+	return nil
+}
+
+// Validate checks the constraints schema.json places on JobListPayload values.
+func (p *JobListPayload) Validate() error {
+	return nil
+}
+
+type JobInfo struct {
+	ID    string `json:"id"`
+	Type  string `json:"type"`
+	State string `json:"state"`
+	// Summary is the command, path or key the job works on.
+	Summary   string `json:"summary,omitempty"`
+	QueuedAt  int64  `json:"queued_at"`
+	StartedAt int64  `json:"started_at,omitempty"`
+}
+
+func (*JobInfo) requiredFields() []string {
+	return []string{"id", "type", "state", "queued_at"}
+}
+
+// Validate checks the constraints schema.json places on JobInfo values.
+func (p *JobInfo) Validate() error {
+	if p.ID == "" {
+		return missingField("id")
+	}
+	switch p.State {
+	case "queued", "running":
+	default:
+		return invalidField("state", p.State)
+	}
+	return nil
+}
+
+type SessionOpenPayload struct {
+	SessionID string `json:"session_id"`
+	Shell     string `json:"shell,omitempty"`
+	Cols      int    `json:"cols"`
+	Rows      int    `json:"rows"`
+}
+
+func (*SessionOpenPayload) requiredFields() []string {
+	return []string{"session_id", "cols", "rows"}
+}
+
+// Validate checks the constraints schema.json places on SessionOpenPayload values.
+func (p *SessionOpenPayload) Validate() error {
+	if p.SessionID == "" {
+		return missingField("session_id")
+	}
+	if p.Cols < 0 {
+		return invalidField("cols", p.Cols)
+	}
+	if p.Rows < 0 {
+		return invalidField("rows", p.Rows)
+	}
+	return nil
+}
+
+type SessionResizePayload struct {
+	SessionID string `json:"session_id"`
+	Cols      int    `json:"cols"`
+	Rows      int    `json:"rows"`
+}
+
+func (*SessionResizePayload) requiredFields() []string {
+	return []string{"session_id", "cols", "rows"}
+}
+
+// Validate checks the constraints schema.json places on SessionResizePayload values.
+func (p *SessionResizePayload) Validate() error {
+	if p.SessionID == "" {
+		return missingField("session_id")
+	}
+	if p.Cols < 1 {
+		return invalidField("cols", p.Cols)
+	}
+	if p.Rows < 1 {
+		return invalidField("rows", p.Rows)
+	}
+	return nil
+}
+
+// SessionDataPayload accompanies terminal bytes in Message.Binary.
+type SessionDataPayload struct {
+	SessionID string `json:"session_id"`
+}
+
+func (*SessionDataPayload) requiredFields() []string {
+	return []string{"session_id"}
+}
+
+// Validate checks the constraints schema.json places on SessionDataPayload values.
+func (p *SessionDataPayload) Validate() error {
+	if p.SessionID == "" {
+		return missingField("session_id")
+	}
+	return nil
+}
+
+type SessionClosePayload struct {
+	SessionID string `json:"session_id"`
+	ExitCode  int    `json:"exit_code,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+func (*SessionClosePayload) requiredFields() []string {
+	return []string{"session_id"}
+}
+
+// Validate checks the constraints schema.json places on SessionClosePayload values.
+func (p *SessionClosePayload) Validate() error {
+	if p.SessionID == "" {
+		return missingField("session_id")
+	}
+	return nil
+}
+
+// TransferStartPayload opens or resumes a chunked transfer. For uploads,
+// Offset is how much the server has had acknowledged so far.
+type TransferStartPayload struct {
+	TransferID string `json:"transfer_id"`
+	Direction  string `json:"direction"`
+	Path       string `json:"path"`
+	Size       int64  `json:"size,omitempty"`
+	Offset     int64  `json:"offset,omitempty"`
+}
+
+func (*TransferStartPayload) requiredFields() []string {
+	return []string{"transfer_id", "direction", "path"}
+}
+
+// Validate checks the constraints schema.json places on TransferStartPayload values.
+func (p *TransferStartPayload) Validate() error {
+	if p.TransferID == "" {
+		return missingField("transfer_id")
+	}
+	switch p.Direction {
+	case "download", "upload":
+	default:
+		return invalidField("direction", p.Direction)
+	}
+	if p.Path == "" {
+		return missingField("path")
+	}
+	if p.Size < 0 {
+		return invalidField("size", p.Size)
+	}
+	if p.Offset < 0 {
+		return invalidField("offset", p.Offset)
+	}
+	return nil
+}
+
+// TransferStatePayload is the client's answer to transfer_start. For
+// downloads it describes the source file; for uploads Offset is where the
+// server should continue.
+type TransferStatePayload struct {
+	TransferID string `json:"transfer_id"`
+	Size       int64  `json:"size"`
+	ModTime    int64  `json:"mod_time,omitempty"`
+	Offset     int64  `json:"offset"`
+}
+
+func (*TransferStatePayload) requiredFields() []string {
+	return []string{"transfer_id", "size", "offset"}
+}
+
+// Validate checks the constraints schema.json places on TransferStatePayload values.
+func (p *TransferStatePayload) Validate() error {
+	if p.TransferID == "" {
+		return missingField("transfer_id")
+	}
+	if p.Size < 0 {
+		return invalidField("size", p.Size)
+	}
+	if p.Offset < 0 {
+		return invalidField("offset", p.Offset)
+	}
+	return nil
+}
+
+// TransferChunkPayload describes one chunk of file data, carried in
+// Message.Binary, and its SHA-256. A download chunk request only sets
+// Length.
+type TransferChunkPayload struct {
+	TransferID string `json:"transfer_id"`
+	Direction  string `json:"direction"`
+	Path       string `json:"path"`
+	Offset     int64  `json:"offset"`
+	Length     int    `json:"length,omitempty"`
+	SHA256     string `json:"sha256,omitempty"`
+}
+
+func (*TransferChunkPayload) requiredFields() []string {
+	return []string{"transfer_id", "direction", "path", "offset"}
+}
+
+// Validate checks the constraints schema.json places on TransferChunkPayload values.
+func (p *TransferChunkPayload) Validate() error {
+	if p.TransferID == "" {
+		return missingField("transfer_id")
+	}
+	switch p.Direction {
+	case "download", "upload":
+	default:
+		return invalidField("direction", p.Direction)
+	}
+	if p.Path == "" {
+		return missingField("path")
+	}
+	if p.Offset < 0 {
+		return invalidField("offset", p.Offset)
+	}
+	if p.Length < 0 {
+		return invalidField("length", p.Length)
+	}
+	return nil
+}
+
+// TransferEndPayload completes a transfer. For uploads the client checks
+// the whole file against SHA256 before moving it into place; for downloads
+// it replies with the file's SHA-256.
+type TransferEndPayload struct {
+	TransferID string `json:"transfer_id"`
+	Direction  string `json:"direction"`
+	Path       string `json:"path"`
+	SHA256     string `json:"sha256,omitempty"`
+	Mode       uint32 `json:"mode,omitempty"`
+}
+
+func (*TransferEndPayload) requiredFields() []string {
+	return []string{"transfer_id", "direction", "path"}
+}
+
+// Validate checks the constraints schema.json places on TransferEndPayload values.
+func (p *TransferEndPayload) Validate() error {
+	if p.TransferID == "" {
+		return missingField("transfer_id")
+	}
+	switch p.Direction {
+	case "download", "upload":
+	default:
+		return invalidField("direction", p.Direction)
+	}
+	if p.Path == "" {
+		return missingField("path")
+	}
+	return nil
+}
+
+type TransferAbortPayload struct {
+	TransferID string `json:"transfer_id"`
+	Path       string `json:"path"`
+}
+
+func (*TransferAbortPayload) requiredFields() []string {
+	return []string{"transfer_id", "path"}
+}
+
+// Validate checks the constraints schema.json places on TransferAbortPayload values.
+func (p *TransferAbortPayload) Validate() error {
+	if p.TransferID == "" {
+		return missingField("transfer_id")
+	}
+	if p.Path == "" {
+		return missingField("path")
+	}
+	return nil
+}
+
+type ScreenshotPayload struct {
+	Quality int `json:"quality"`
+}
+
+func (*ScreenshotPayload) requiredFields() []string {
+	return []string{"quality"}
+}
+
+// Validate checks the constraints schema.json places on ScreenshotPayload values.
+func (p *ScreenshotPayload) Validate() error {
+	if p.Quality < 0 {
+		return invalidField("quality", p.Quality)
+	}
+	return nil
+}
+
+type WebcamPayload struct {
+	Duration  int    `json:"duration"`
+	StreamURL string `json:"stream_url,omitempty"`
+}
+
+func (*WebcamPayload) requiredFields() []string {
+	return []string{"duration"}
+}
+
+// Validate checks the constraints schema.json places on WebcamPayload values.
+func (p *WebcamPayload) Validate() error {
+	if p.Duration < 0 {
+		return invalidField("duration", p.Duration)
+	}
+	return nil
+}
+
+type ShowImagePayload struct {
+	ImageURL string `json:"image_url"`
+	Duration int    `json:"duration"`
+}
+
+func (*ShowImagePayload) requiredFields() []string {
+	return []string{"image_url", "duration"}
+}
+
+// Validate checks the constraints schema.json places on ShowImagePayload values.
+func (p *ShowImagePayload) Validate() error {
+	if p.ImageURL == "" {
+		return missingField("image_url")
+	}
+	if p.Duration < 0 {
+		return invalidField("duration", p.Duration)
+	}
+	return nil
+}
+
+type ResponsePayload struct {
+	Success  bool   `json:"success"`
+	Data     string `json:"data,omitempty"`
+	Error    string `json:"error,omitempty"`
+	ExitCode int    `json:"exit_code,omitempty"`
+}
+
+func (*ResponsePayload) requiredFields() []string {
+	return []string{"success"}
+}
+
+// Validate checks the constraints schema.json places on ResponsePayload values.
+func (p *ResponsePayload) Validate() error {
+	return nil
+}
+
+type ErrorPayload struct {
+	// Machine-readable error class, one of the ErrorCode constants.
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// The local policy rule that refused the request, for POLICY_DENIED.
+	Rule string `json:"rule,omitempty"`
+}
+
+func (*ErrorPayload) requiredFields() []string {
+	return []string{"code", "message"}
+}
+
+// Validate checks the constraints schema.json places on ErrorPayload values.
+func (p *ErrorPayload) Validate() error {
+	return nil
+}
+
+type FileReadPayload struct {
+	Path string `json:"path"`
+}
+
+func (*FileReadPayload) requiredFields() []string {
+	return []string{"path"}
+}
+
+// Validate checks the constraints schema.json places on FileReadPayload values.
+func (p *FileReadPayload) Validate() error {
+	if p.Path == "" {
+		return missingField("path")
+	}
+	return nil
+}
+
+// FileWritePayload takes the file contents from Message.Binary, or from
+// base64 Content when Binary is empty.
+type FileWritePayload struct {
+	Path    string `json:"path"`
+	Content string `json:"content,omitempty"`
+	Mode    uint32 `json:"mode,omitempty"`
+}
+
+func (*FileWritePayload) requiredFields() []string {
+	return []string{"path"}
+}
+
+// Validate checks the constraints schema.json places on FileWritePayload values.
+func (p *FileWritePayload) Validate() error {
+	if p.Path == "" {
+		return missingField("path")
+	}
+	return nil
+}
+
+type FileDeletePayload struct {
+	Path string `json:"path"`
+}
+
+func (*FileDeletePayload) requiredFields() []string {
+	return []string{"path"}
+}
+
+// Validate checks the constraints schema.json places on FileDeletePayload values.
+func (p *FileDeletePayload) Validate() error {
+	if p.Path == "" {
+		return missingField("path")
+	}
+	return nil
+}
+
+type FileListPayload struct {
+	Path string `json:"path"`
+}
+
+func (*FileListPayload) requiredFields() []string {
+	return []string{"path"}
+}
+
+// Validate checks the constraints schema.json places on FileListPayload values.
+func (p *FileListPayload) Validate() error {
+	if p.Path == "" {
+		return missingField("path")
+	}
+	return nil
+}
+
+type FileDownloadPayload struct {
+	Path string `json:"path"`
+}
+
+func (*FileDownloadPayload) requiredFields() []string {
+	return []string{"path"}
+}
+
+// Validate checks the constraints schema.json places on FileDownloadPayload values.
+func (p *FileDownloadPayload) Validate() error {
+	if p.Path == "" {
+		return missingField("path")
+	}
+	return nil
+}
+
+type FileInfo struct {
+	Name    string `json:"name"`
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	IsDir   bool   `json:"is_dir"`
+	ModTime int64  `json:"mod_time"`
+	Mode    string `json:"mode"`
+}
+
+func (*FileInfo) requiredFields() []string {
+	return []string{"name", "path", "size", "is_dir", "mod_time", "mode"}
+}
+
+// Validate checks the constraints schema.json places on FileInfo values.
+func (p *FileInfo) Validate() error {
+	return nil
+}
+
+type RegistryReadPayload struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+func (*RegistryReadPayload) requiredFields() []string {
+	return []string{"key", "value"}
+}
+
+// Validate checks the constraints schema.json places on RegistryReadPayload values.
+func (p *RegistryReadPayload) Validate() error {
+	if p.Key == "" {
+		return missingField("key")
+	}
+	return nil
+}
+
+type RegistryWritePayload struct {
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	Data     string `json:"data"`
+	DataType string `json:"data_type"`
+}
+
+func (*RegistryWritePayload) requiredFields() []string {
+	return []string{"key", "value", "data", "data_type"}
+}
+
+// Validate checks the constraints schema.json places on RegistryWritePayload values.
+func (p *RegistryWritePayload) Validate() error {
+	if p.Key == "" {
+		return missingField("key")
+	}
+	if p.DataType == "" {
+		return missingField("data_type")
+	}
+	return nil
+}
+
+type RegistryDeletePayload struct {
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+func (*RegistryDeletePayload) requiredFields() []string {
+	return []string{"key"}
+}
+
+// Validate checks the constraints schema.json places on RegistryDeletePayload values.
+func (p *RegistryDeletePayload) Validate() error {
+	if p.Key == "" {
+		return missingField("key")
+	}
+	return nil
+}
+
+type RegistryListPayload struct {
+	Key string `json:"key"`
+}
+
+func (*RegistryListPayload) requiredFields() []string {
+	return []string{"key"}
+}
+
+// Validate checks the constraints schema.json places on RegistryListPayload values.
+func (p *RegistryListPayload) Validate() error {
+	if p.Key == "" {
+		return missingField("key")
+	}
+	return nil
+}
+
+type RegistryInfo struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Value    string `json:"value"`
+	DataType string `json:"data_type"`
+}
+
+func (*RegistryInfo) requiredFields() []string {
+	return []string{"name", "type", "value", "data_type"}
+}
+
+// Validate checks the constraints schema.json places on RegistryInfo values.
+func (p *RegistryInfo) Validate() error {
+	return nil
+}
@@ -0,0 +1,16 @@
+package protocol
+
+// Operator shell sockets (/shell) carry terminal bytes as binary WebSocket
+// frames in both directions. Text frames hold a JSON ShellControl.
+const (
+	ShellResize = "resize"
+	ShellExit   = "exit"
+)
+
+type ShellControl struct {
+	Type     string `json:"type"`
+	Cols     int    `json:"cols,omitempty"`
+	Rows     int    `json:"rows,omitempty"`
+	ExitCode int    `json:"exit_code,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
@@ -0,0 +1,65 @@
+package protocol
+
+import "slices"
+
+// ProtocolVersion is sent in the handshake and bumped whenever a message
+// changes in a way older peers cannot understand. Version 2 moved raw bytes
+// (screenshots, file contents, transfer chunks, shell I/O) into Message.Binary.
+const ProtocolVersion = 2
+
+// MinProtocolVersion is the oldest client protocol the server still accepts.
+// Clients predating versioning send no version and count as version 1.
+const MinProtocolVersion = 2
+
+// Capabilities a client advertises in AuthPayload.Capabilities. The server
+// only sends a message type to clients that advertise its capability.
+const (
+	CapExec       = "exec"
+	CapStream     = "stream"
+	CapJobs       = "jobs"
+	CapScreenshot = "screenshot"
+	CapWebcam     = "webcam"
+	CapShowImage  = "show_image"
+	CapFiles      = "files"
+	CapTransfer   = "transfer"
+	CapShell      = "shell"
+	CapRegistry   = "registry"
+)
+
+var requiredCapability = map[MessageType]string{
+	TypeCommand:       CapExec,
+	TypeCancel:        CapStream,
+	TypeJobList:       CapJobs,
+	TypeScreenshot:    CapScreenshot,
+	TypeWebcam:        CapWebcam,
+	TypeShowImage:     CapShowImage,
+	TypeFileRead:      CapFiles,
+	TypeFileWrite:     CapFiles,
+	TypeFileDelete:    CapFiles,
+	TypeFileList:      CapFiles,
+	TypeFileDownload:  CapFiles,
+	TypeTransferStart: CapTransfer,
+	TypeTransferChunk: CapTransfer,
+	TypeTransferEnd:   CapTransfer,
+	TypeTransferAbort: CapTransfer,
+	TypeSessionOpen:   CapShell,
+	TypeSessionResize: CapShell,
+	TypeSessionStdin:  CapShell,
+	TypeSessionClose:  CapShell,
+	TypeRegRead:       CapRegistry,
+	TypeRegWrite:      CapRegistry,
+	TypeRegDelete:     CapRegistry,
+	TypeRegList:       CapRegistry,
+}
+
+// RequiredCapability returns the capability a client must advertise to
+// handle msgType, or "" for messages every client understands.
+func RequiredCapability(msgType MessageType) string {
+	return requiredCapability[msgType]
+}
+
+// HasCapability reports whether capabilities allow msgType.
+func HasCapability(capabilities []string, msgType MessageType) bool {
+	required := RequiredCapability(msgType)
+	return required == "" || slices.Contains(capabilities, required)
+}
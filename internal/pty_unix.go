@@ -0,0 +1,70 @@
+//go:build !windows
+
+package internal
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+
+	"github.com/creack/pty"
+)
+
+type unixPTY struct {
+	tty *os.File
+	cmd *exec.Cmd
+}
+
+func defaultShell() string {
+	if shell := os.Getenv("SHELL"); shell != "" {
+		return shell
+	}
+	return "/bin/sh"
+}
+
+func startPTY(shell string, cols, rows int) (ptyProcess, error) {
+	cmd := exec.Command(shell)
+	cmd.Env = append(os.Environ(), "TERM=xterm-256color")
+
+	tty, err := pty.StartWithSize(cmd, &pty.Winsize{Cols: uint16(cols), Rows: uint16(rows)})
+	if err != nil {
+		return nil, err
+	}
+
+	return &unixPTY{tty: tty, cmd: cmd}, nil
+}
+
+func (p *unixPTY) Read(b []byte) (int, error) {
+	return p.tty.Read(b)
+}
+
+func (p *unixPTY) Write(b []byte) (int, error) {
+	return p.tty.Write(b)
+}
+
+func (p *unixPTY) Close() error {
+	return p.tty.Close()
+}
+
+func (p *unixPTY) Resize(cols, rows int) error {
+	return pty.Setsize(p.tty, &pty.Winsize{Cols: uint16(cols), Rows: uint16(rows)})
+}
+
+func (p *unixPTY) Wait() (int, error) {
+	err := p.cmd.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), nil
+	}
+	if err != nil {
+		return -1, err
+	}
+	return 0, nil
+}
+
+func (p *unixPTY) Kill() error {
+	if p.cmd.Process == nil {
+		return nil
+	}
+	return p.cmd.Process.Kill()
+}
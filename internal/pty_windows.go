@@ -0,0 +1,147 @@
+//go:build windows
+
+package internal
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// conPTY runs a shell attached to a Windows pseudo console (Windows 10 1809+).
+type conPTY struct {
+	console windows.Handle
+	process windows.Handle
+	input   *os.File
+	output  *os.File
+
+	closeOnce sync.Once
+}
+
+func defaultShell() string {
+	if shell := os.Getenv("COMSPEC"); shell != "" {
+		return shell
+	}
+	return "cmd.exe"
+}
+
+func startPTY(shell string, cols, rows int) (ptyProcess, error) {
+	var inRead, inWrite, outRead, outWrite windows.Handle
+	if err := windows.CreatePipe(&inRead, &inWrite, nil, 0); err != nil {
+		return nil, fmt.Errorf("create input pipe: %w", err)
+	}
+	if err := windows.CreatePipe(&outRead, &outWrite, nil, 0); err != nil {
+		windows.CloseHandle(inRead)
+		windows.CloseHandle(inWrite)
+		return nil, fmt.Errorf("create output pipe: %w", err)
+	}
+
+	var console windows.Handle
+	size := windows.Coord{X: int16(cols), Y: int16(rows)}
+	err := windows.CreatePseudoConsole(size, inRead, outWrite, 0, &console)
+	// The pseudo console holds its own references to these ends.
+	windows.CloseHandle(inRead)
+	windows.CloseHandle(outWrite)
+	if err != nil {
+		windows.CloseHandle(inWrite)
+		windows.CloseHandle(outRead)
+		return nil, fmt.Errorf("create pseudo console: %w", err)
+	}
+
+	process, err := spawnInConsole(console, shell)
+	if err != nil {
+		windows.ClosePseudoConsole(console)
+		windows.CloseHandle(inWrite)
+		windows.CloseHandle(outRead)
+		return nil, err
+	}
+
+	return &conPTY{
+		console: console,
+		process: process,
+		input:   os.NewFile(uintptr(inWrite), "conpty-in"),
+		output:  os.NewFile(uintptr(outRead), "conpty-out"),
+	}, nil
+}
+
+func spawnInConsole(console windows.Handle, shell string) (windows.Handle, error) {
+	attrs, err := windows.NewProcThreadAttributeList(1)
+	if err != nil {
+		return 0, fmt.Errorf("allocate attribute list: %w", err)
+	}
+	defer attrs.Delete()
+
+	// The attribute value is the HPCON itself, not a pointer to it.
+	value := *(*unsafe.Pointer)(unsafe.Pointer(&console))
+	if err := attrs.Update(windows.PROC_THREAD_ATTRIBUTE_PSEUDOCONSOLE, value, unsafe.Sizeof(console)); err != nil {
+		return 0, fmt.Errorf("attach pseudo console: %w", err)
+	}
+
+	si := &windows.StartupInfoEx{
+		ProcThreadAttributeList: attrs.List(),
+	}
+	si.Cb = uint32(unsafe.Sizeof(*si))
+
+	cmdLine, err := windows.UTF16PtrFromString(shell)
+	if err != nil {
+		return 0, err
+	}
+
+	var pi windows.ProcessInformation
+	err = windows.CreateProcess(nil, cmdLine, nil, nil, false,
+		windows.EXTENDED_STARTUPINFO_PRESENT|windows.CREATE_UNICODE_ENVIRONMENT,
+		nil, nil, &si.StartupInfo, &pi)
+	if err != nil {
+		return 0, fmt.Errorf("start %s: %w", shell, err)
+	}
+
+	windows.CloseHandle(pi.Thread)
+	return pi.Process, nil
+}
+
+func (p *conPTY) Read(b []byte) (int, error) {
+	return p.output.Read(b)
+}
+
+func (p *conPTY) Write(b []byte) (int, error) {
+	return p.input.Write(b)
+}
+
+func (p *conPTY) Resize(cols, rows int) error {
+	return windows.ResizePseudoConsole(p.console, windows.Coord{X: int16(cols), Y: int16(rows)})
+}
+
+func (p *conPTY) Wait() (int, error) {
+	if _, err := windows.WaitForSingleObject(p.process, windows.INFINITE); err != nil {
+		return -1, err
+	}
+
+	var code uint32
+	if err := windows.GetExitCodeProcess(p.process, &code); err != nil {
+		return -1, err
+	}
+	return int(code), nil
+}
+
+func (p *conPTY) Kill() error {
+	err := windows.TerminateProcess(p.process, 1)
+	// Closing the console breaks the output pipe so the pump's Read returns.
+	p.closeConsole()
+	return err
+}
+
+func (p *conPTY) Close() error {
+	p.closeConsole()
+	p.input.Close()
+	p.output.Close()
+	return windows.CloseHandle(p.process)
+}
+
+func (p *conPTY) closeConsole() {
+	p.closeOnce.Do(func() {
+		windows.ClosePseudoConsole(p.console)
+	})
+}
@@ -0,0 +1,644 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/E2klime/HAXinceL2/internal/protocol"
+	"github.com/google/uuid"
+)
+
+const (
+	DefaultQueueTTL = 24 * time.Hour
+
+	queueSweepInterval = 30 * time.Second
+	// Finished items are kept this long so operators can still look up results.
+	queueRetention = 7 * 24 * time.Hour
+)
+
+type QueueStatus string
+
+const (
+	QueueQueued    QueueStatus = "queued"
+	QueueSent      QueueStatus = "sent"
+	QueueCompleted QueueStatus = "completed"
+	QueueExpired   QueueStatus = "expired"
+	QueueCancelled QueueStatus = "cancelled"
+)
+
+var (
+	ErrQueued        = errors.New("client offline, message queued")
+	ErrQueueNotFound = errors.New("queue item not found")
+)
+
+// QueueItem is a message waiting to be delivered to, or answered by, a client.
+// Its ID doubles as the message RequestID so the reply can be matched.
+type QueueItem struct {
+	ID          string            `json:"id"`
+	ClientID    string            `json:"client_id"`
+	Origin      string            `json:"origin,omitempty"`
+	Operator    string            `json:"operator,omitempty"`
+	Message     *protocol.Message `json:"message"`
+	Status      QueueStatus       `json:"status"`
+	CreatedAt   time.Time         `json:"created_at"`
+	ExpiresAt   time.Time         `json:"expires_at"`
+	SentAt      time.Time         `json:"sent_at,omitempty"`
+	CompletedAt time.Time         `json:"completed_at,omitempty"`
+	Result      *protocol.Message `json:"result,omitempty"`
+}
+
+func (q *QueueItem) Done() bool {
+	return q.Status == QueueCompleted || q.Status == QueueExpired || q.Status == QueueCancelled
+}
+
+// summary returns a snapshot of q without the raw bytes of its message and
+// result, for listings and event streams. Fetch the item itself for those.
+func (q *QueueItem) summary() *QueueItem {
+	cp := *q
+	cp.Message = withoutBinary(q.Message)
+	cp.Result = withoutBinary(q.Result)
+	return &cp
+}
+
+func withoutBinary(msg *protocol.Message) *protocol.Message {
+	if msg == nil || msg.Binary == nil {
+		return msg
+	}
+	cp := *msg
+	cp.Binary = nil
+	return &cp
+}
+
+// QueueStore persists queue items. Implementations must be safe for
+// concurrent use.
+type QueueStore interface {
+	Get(id string) (*QueueItem, error)
+	Put(item *QueueItem) error
+	// List returns the items of clientID, or of all clients when it is empty,
+	// oldest first. Listed items may lack their result and the raw bytes of
+	// their message; Get returns them whole.
+	List(clientID string) ([]*QueueItem, error)
+	Delete(id string) error
+}
+
+type MemoryQueue struct {
+	mutex sync.RWMutex
+	items map[string]*QueueItem
+}
+
+func NewMemoryQueue() *MemoryQueue {
+	return &MemoryQueue{
+		items: make(map[string]*QueueItem),
+	}
+}
+
+func (m *MemoryQueue) Get(id string) (*QueueItem, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	item, ok := m.items[id]
+	if !ok {
+		return nil, ErrQueueNotFound
+	}
+	cp := *item
+	return &cp, nil
+}
+
+func (m *MemoryQueue) Put(item *QueueItem) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	cp := *item
+	m.items[item.ID] = &cp
+	return nil
+}
+
+func (m *MemoryQueue) List(clientID string) ([]*QueueItem, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	items := make([]*QueueItem, 0)
+	for _, item := range m.items {
+		if clientID == "" || item.ClientID == clientID {
+			cp := *item
+			items = append(items, &cp)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].CreatedAt.Before(items[j].CreatedAt)
+	})
+	return items, nil
+}
+
+func (m *MemoryQueue) Delete(id string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.items[id]; !ok {
+		return ErrQueueNotFound
+	}
+	delete(m.items, id)
+	return nil
+}
+
+// FileQueue is a MemoryQueue that rewrites a JSON index on every change.
+// Results and the raw bytes of messages, which can be whole files, are kept
+// out of the index in one file each under path + ".d", written once.
+type FileQueue struct {
+	*MemoryQueue
+	path      string
+	dataDir   string
+	saveMutex sync.Mutex
+}
+
+func NewFileQueue(path string) (*FileQueue, error) {
+	q := &FileQueue{
+		MemoryQueue: NewMemoryQueue(),
+		path:        path,
+		dataDir:     path + ".d",
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read queue: %w", err)
+	}
+
+	var items []*QueueItem
+	if err := json.Unmarshal(data, &items); err != nil {
+		return nil, fmt.Errorf("failed to parse queue %s: %w", path, err)
+	}
+
+	// Queues written before results moved out of the index still hold
+	// them inline; move them out on the way in.
+	migrate := false
+	for _, item := range items {
+		if item.Result != nil || (item.Message != nil && item.Message.Binary != nil) {
+			if err := q.storeData(item); err != nil {
+				return nil, err
+			}
+			migrate = true
+		}
+		q.items[item.ID] = indexEntry(item)
+	}
+	if migrate {
+		return q, q.save()
+	}
+	return q, nil
+}
+
+// indexEntry is item as kept in the index: without its result and the raw
+// bytes of its message.
+func indexEntry(item *QueueItem) *QueueItem {
+	cp := *item
+	cp.Message = withoutBinary(item.Message)
+	cp.Result = nil
+	return &cp
+}
+
+func (f *FileQueue) Get(id string) (*QueueItem, error) {
+	item, err := f.MemoryQueue.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if data, err := os.ReadFile(f.dataPath(id, "message")); err == nil {
+		msg := *item.Message
+		msg.Binary = data
+		item.Message = &msg
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read queue item %s: %w", id, err)
+	}
+
+	if data, err := os.ReadFile(f.dataPath(id, "result")); err == nil {
+		var result protocol.Message
+		if err := json.Unmarshal(data, &result); err != nil {
+			return nil, fmt.Errorf("failed to parse result of queue item %s: %w", id, err)
+		}
+		item.Result = &result
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read queue item %s: %w", id, err)
+	}
+
+	return item, nil
+}
+
+func (f *FileQueue) Put(item *QueueItem) error {
+	if err := f.storeData(item); err != nil {
+		return err
+	}
+	if err := f.MemoryQueue.Put(indexEntry(item)); err != nil {
+		return err
+	}
+	return f.save()
+}
+
+func (f *FileQueue) Delete(id string) error {
+	if err := f.MemoryQueue.Delete(id); err != nil {
+		return err
+	}
+	for _, kind := range []string{"message", "result"} {
+		if err := os.Remove(f.dataPath(id, kind)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Failed to remove %s of queue item %s: %v", kind, id, err)
+		}
+	}
+	return f.save()
+}
+
+// storeData writes the message bytes and result of item that are not on
+// disk yet. Neither changes once set, so existing files are left alone.
+func (f *FileQueue) storeData(item *QueueItem) error {
+	if item.Message != nil && item.Message.Binary != nil {
+		if err := f.storeOnce(f.dataPath(item.ID, "message"), item.Message.Binary); err != nil {
+			return err
+		}
+	}
+	if item.Result != nil {
+		data, err := json.Marshal(item.Result)
+		if err != nil {
+			return err
+		}
+		if err := f.storeOnce(f.dataPath(item.ID, "result"), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *FileQueue) storeOnce(path string, data []byte) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	return writeFileAtomic(path, data, 0600)
+}
+
+func (f *FileQueue) dataPath(id, kind string) string {
+	return filepath.Join(f.dataDir, filepath.Base(id)+"."+kind)
+}
+
+func (f *FileQueue) save() error {
+	f.saveMutex.Lock()
+	defer f.saveMutex.Unlock()
+
+	items, _ := f.MemoryQueue.List("")
+	data, err := json.MarshalIndent(items, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(f.path, data, 0600)
+}
+
+// OnQueueUpdate registers fn to be called whenever a queue item changes
+// status. fn runs on server goroutines and must not block.
+func (s *Server) OnQueueUpdate(fn func(item *QueueItem)) {
+	s.queueMutex.Lock()
+	s.queueListeners = append(s.queueListeners, fn)
+	s.queueMutex.Unlock()
+}
+
+// enqueue stores msg for delivery to clientID, now if the client is online or
+// on its next connect otherwise. Undelivered or unanswered items expire after
+// ttl (DefaultQueueTTL when zero).
+func (s *Server) enqueue(clientID string, msg *protocol.Message, ttl time.Duration, origin, operator string) (*QueueItem, error) {
+	if err := s.checkOperation(clientID, msg.Type); err != nil {
+		return nil, err
+	}
+
+	if ttl <= 0 {
+		ttl = DefaultQueueTTL
+	}
+	if msg.RequestID == "" {
+		msg.RequestID = uuid.New().String()
+	}
+
+	now := time.Now()
+	item := &QueueItem{
+		ID:        msg.RequestID,
+		ClientID:  clientID,
+		Origin:    origin,
+		Operator:  operator,
+		Message:   msg,
+		Status:    QueueQueued,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+
+	if err := s.queue.Put(item); err != nil {
+		return nil, fmt.Errorf("failed to store queue item: %w", err)
+	}
+	log.Printf("Queued %s %s for client %s (expires %s)", msg.Type, item.ID, clientID, item.ExpiresAt.Format(time.RFC3339))
+	s.publishJob(item)
+
+	if client, err := s.lookupClient(clientID); err == nil {
+		go s.flushQueue(client)
+	}
+
+	return item, nil
+}
+
+// checkOperation fails unless clientID is known and, as far as the server
+// knows, can handle msgType.
+func (s *Server) checkOperation(clientID string, msgType protocol.MessageType) error {
+	if client, err := s.lookupClient(clientID); err == nil {
+		if !client.Supports(msgType) {
+			return unsupportedError(clientID, msgType)
+		}
+	} else if rec, err := s.inventory.Get(clientID); err != nil {
+		return fmt.Errorf("%w: %s", ErrClientUnknown, clientID)
+	} else if !rec.Supports(msgType) {
+		return unsupportedError(clientID, msgType)
+	}
+	return nil
+}
+
+func (s *Server) listQueue(clientID string) ([]*QueueItem, error) {
+	return s.queue.List(clientID)
+}
+
+func (s *Server) lookupQueueItem(id string) (*QueueItem, error) {
+	return s.queue.Get(id)
+}
+
+// waitQueued blocks until the item is done (completed, expired or cancelled)
+// or ctx ends, and returns its latest state either way.
+func (s *Server) waitQueued(ctx context.Context, id string) (*QueueItem, error) {
+	s.queueMutex.Lock()
+	item, err := s.queue.Get(id)
+	if err != nil || item.Done() {
+		s.queueMutex.Unlock()
+		return item, err
+	}
+	ch := make(chan struct{})
+	s.queueWaiters[id] = append(s.queueWaiters[id], ch)
+	s.queueMutex.Unlock()
+
+	select {
+	case <-ch:
+	case <-ctx.Done():
+		s.queueMutex.Lock()
+		s.queueWaiters[id] = slices.DeleteFunc(s.queueWaiters[id], func(w chan struct{}) bool { return w == ch })
+		if len(s.queueWaiters[id]) == 0 {
+			delete(s.queueWaiters, id)
+		}
+		s.queueMutex.Unlock()
+	}
+	return s.queue.Get(id)
+}
+
+// cancelQueued cancels an item that has not been delivered yet.
+func (s *Server) cancelQueued(id string) (*QueueItem, error) {
+	s.queueMutex.Lock()
+	item, err := s.queue.Get(id)
+	if err != nil {
+		s.queueMutex.Unlock()
+		return nil, err
+	}
+	if item.Status != QueueQueued {
+		s.queueMutex.Unlock()
+		return nil, fmt.Errorf("queue item %s is already %s", id, item.Status)
+	}
+
+	item.Status = QueueCancelled
+	item.CompletedAt = time.Now()
+	s.updateQueueItem(item)
+	s.queueMutex.Unlock()
+
+	s.notifyQueueItems(item)
+	return item, nil
+}
+
+// flushQueue delivers every queued item of a connected client, oldest first.
+// Flushes of one client run one at a time so its items keep their order.
+func (s *Server) flushQueue(client *ConnectedClient) {
+	client.flushMutex.Lock()
+	defer client.flushMutex.Unlock()
+
+	deliver, updated := s.claimQueued(client)
+	s.notifyQueueItems(updated...)
+
+	for i, item := range deliver {
+		if err := s.send(client, item.Message); err != nil {
+			log.Printf("Queue delivery to %s paused: %v", client.ID, err)
+			s.unclaimQueued(deliver[i:])
+			return
+		}
+		log.Printf("Delivered queued %s %s to client %s", item.Message.Type, item.ID, client.ID)
+	}
+}
+
+// claimQueued marks the queued items of client as sent and returns them for
+// delivery. They are marked before they go out so that a quick reply finds
+// them sent. Items that expired or that the client cannot handle are
+// finished instead; updated lists every item changed.
+func (s *Server) claimQueued(client *ConnectedClient) (deliver, updated []*QueueItem) {
+	s.queueMutex.Lock()
+	defer s.queueMutex.Unlock()
+
+	items, err := s.queue.List(client.ID)
+	if err != nil {
+		log.Printf("Failed to list queue for client %s: %v", client.ID, err)
+		return nil, nil
+	}
+
+	now := time.Now()
+	for _, item := range items {
+		if item.Status != QueueQueued {
+			continue
+		}
+
+		switch {
+		case now.After(item.ExpiresAt):
+			item.Status = QueueExpired
+			item.CompletedAt = now
+
+		// The client may have come back as a different build than the one
+		// the item was queued for.
+		case !client.Supports(item.Message.Type):
+			item.Status = QueueCompleted
+			item.CompletedAt = now
+			item.Result = protocol.NewReply(item.Message, protocol.TypeError, protocol.ErrorPayload{
+				Code:    "UNSUPPORTED",
+				Message: unsupportedError(client.ID, item.Message.Type).Error(),
+			})
+
+		default:
+			// Listings may lack the message bytes the client needs.
+			whole, err := s.queue.Get(item.ID)
+			if err != nil {
+				log.Printf("Failed to load queue item %s: %v", item.ID, err)
+				continue
+			}
+			item = whole
+			item.Status = QueueSent
+			item.SentAt = now
+			deliver = append(deliver, item)
+		}
+
+		s.updateQueueItem(item)
+		updated = append(updated, item)
+	}
+	return deliver, updated
+}
+
+// unclaimQueued puts items that could not be sent back in the queue, unless
+// they changed since claimQueued marked them.
+func (s *Server) unclaimQueued(items []*QueueItem) {
+	var updated []*QueueItem
+
+	s.queueMutex.Lock()
+	for _, claimed := range items {
+		item, err := s.queue.Get(claimed.ID)
+		if err != nil || item.Status != QueueSent || !item.SentAt.Equal(claimed.SentAt) {
+			continue
+		}
+		item.Status = QueueQueued
+		item.SentAt = time.Time{}
+		s.updateQueueItem(item)
+		updated = append(updated, item)
+	}
+	s.queueMutex.Unlock()
+
+	s.notifyQueueItems(updated...)
+}
+
+// completeQueued records a client reply for a queued item. It reports whether
+// msg belonged to one.
+func (s *Server) completeQueued(client *ConnectedClient, msg *protocol.Message) bool {
+	if msg.RequestID == "" {
+		return false
+	}
+
+	s.queueMutex.Lock()
+	item, err := s.queue.Get(msg.RequestID)
+	if err != nil || item.ClientID != client.ID || item.Done() {
+		s.queueMutex.Unlock()
+		return false
+	}
+
+	item.Status = QueueCompleted
+	item.CompletedAt = time.Now()
+	item.Result = msg
+	s.updateQueueItem(item)
+	s.queueMutex.Unlock()
+
+	s.notifyQueueItems(item)
+	return true
+}
+
+// sweepQueue expires stale items, prunes old finished ones and retries
+// delivery to online clients whose send buffer was full. Items sent over a
+// connection that is still up are left to the client's reply, however long
+// the operation runs.
+func (s *Server) sweepQueue() {
+	listed, err := s.queue.List("")
+	if err != nil {
+		log.Printf("Failed to list queue: %v", err)
+		return
+	}
+
+	connectedAt := make(map[string]time.Time)
+	s.mutex.RLock()
+	for id, client := range s.clients {
+		connectedAt[id] = client.ConnectedAt
+	}
+	s.mutex.RUnlock()
+
+	now := time.Now()
+	retry := make(map[string]bool)
+	var expired []*QueueItem
+
+	s.queueMutex.Lock()
+	for _, listedItem := range listed {
+		// The list is a snapshot; a reply may have completed the item since.
+		item, err := s.queue.Get(listedItem.ID)
+		if err != nil {
+			continue
+		}
+		switch {
+		case item.Done():
+			if now.Sub(item.CompletedAt) > queueRetention {
+				s.queue.Delete(item.ID)
+			}
+		case item.Status == QueueSent && sentOver(item, connectedAt):
+		case now.After(item.ExpiresAt):
+			item.Status = QueueExpired
+			item.CompletedAt = now
+			s.updateQueueItem(item)
+			expired = append(expired, item)
+		case item.Status == QueueQueued:
+			retry[item.ClientID] = true
+		}
+	}
+	s.queueMutex.Unlock()
+
+	s.notifyQueueItems(expired...)
+
+	for clientID := range retry {
+		if client, err := s.lookupClient(clientID); err == nil {
+			s.flushQueue(client)
+		}
+	}
+}
+
+// sentOver reports whether item went out over its client's current
+// connection, given when each online client connected.
+func sentOver(item *QueueItem, connectedAt map[string]time.Time) bool {
+	since, ok := connectedAt[item.ClientID]
+	return ok && !item.SentAt.Before(since)
+}
+
+func (s *Server) runQueueSweeper() {
+	ticker := time.NewTicker(queueSweepInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.sweepQueue()
+	}
+}
+
+// updateQueueItem persists item and, once it is done, wakes those waiting
+// for it. Callers hold queueMutex and pass item to notifyQueueItems after
+// releasing it.
+func (s *Server) updateQueueItem(item *QueueItem) {
+	if err := s.queue.Put(item); err != nil {
+		log.Printf("Failed to update queue item %s: %v", item.ID, err)
+	}
+
+	if item.Done() {
+		for _, ch := range s.queueWaiters[item.ID] {
+			close(ch)
+		}
+		delete(s.queueWaiters, item.ID)
+	}
+}
+
+// notifyQueueItems tells listeners and event subscribers about updated items
+// and audits the finished ones. Callers must not hold queueMutex: listeners
+// and audit writes may take a while.
+func (s *Server) notifyQueueItems(items ...*QueueItem) {
+	s.queueMutex.Lock()
+	listeners := s.queueListeners
+	s.queueMutex.Unlock()
+
+	for _, item := range items {
+		for _, fn := range listeners {
+			fn(item)
+		}
+		s.publishJob(item)
+		if item.Done() {
+			s.auditQueueItem(item)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/E2klime/HAXinceL2/internal/protocol"
+)
+
+func TestSweepQueue(t *testing.T) {
+	now := time.Now()
+	past := now.Add(-time.Minute)
+
+	tests := []struct {
+		name string
+		item QueueItem
+		// connectedAt is when c1 connected; zero leaves it offline.
+		connectedAt time.Time
+		want        QueueStatus
+	}{
+		{
+			name: "expired while queued",
+			item: QueueItem{Status: QueueQueued, ExpiresAt: past},
+			want: QueueExpired,
+		},
+		{
+			name: "not yet expired",
+			item: QueueItem{Status: QueueQueued, ExpiresAt: now.Add(time.Hour)},
+			want: QueueQueued,
+		},
+		{
+			name:        "sent over the current connection",
+			item:        QueueItem{Status: QueueSent, ExpiresAt: past, SentAt: now.Add(-time.Second)},
+			connectedAt: now.Add(-time.Hour),
+			want:        QueueSent,
+		},
+		{
+			name:        "sent over an earlier connection",
+			item:        QueueItem{Status: QueueSent, ExpiresAt: past, SentAt: now.Add(-time.Hour)},
+			connectedAt: now.Add(-time.Second),
+			want:        QueueExpired,
+		},
+		{
+			name: "sent to an offline client",
+			item: QueueItem{Status: QueueSent, ExpiresAt: past, SentAt: now.Add(-time.Second)},
+			want: QueueExpired,
+		},
+		{
+			name: "completed after it expired",
+			item: QueueItem{Status: QueueCompleted, ExpiresAt: past, CompletedAt: now},
+			want: QueueCompleted,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer()
+			if !tt.connectedAt.IsZero() {
+				s.clients["c1"] = &ConnectedClient{ID: "c1", ConnectedAt: tt.connectedAt, done: make(chan struct{})}
+			}
+			item := tt.item
+			item.ID = "q1"
+			item.ClientID = "c1"
+			item.Message = protocol.NewCommand(protocol.CommandPayload{Command: "true"})
+			if err := s.queue.Put(&item); err != nil {
+				t.Fatal(err)
+			}
+
+			s.sweepQueue()
+
+			got, err := s.queue.Get("q1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Status != tt.want {
+				t.Errorf("status = %s, want %s", got.Status, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,300 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/E2klime/HAXinceL2/internal/protocol"
+)
+
+// Permission names one thing an operator may do. Operations sent to clients
+// are named after their message type, see OperationPermission.
+type Permission string
+
+const (
+	// PermViewClients covers the inventory, client details, job and
+	// transfer lists.
+	PermViewClients Permission = "clients.view"
+	// PermManageClients allows removing clients from the inventory.
+	PermManageClients Permission = "clients.manage"
+	PermManageTokens  Permission = "tokens.manage"
+	// PermCancelJobs allows stopping jobs, queued operations and transfers.
+	PermCancelJobs Permission = "jobs.cancel"
+	PermShell      Permission = "shell"
+	PermViewAudit  Permission = "audit.view"
+	// PermApprove allows deciding on operations held for a second
+	// operator's approval.
+	PermApprove Permission = "approvals.decide"
+
+	// PermAll grants every permission; "op:*" grants every operation.
+	PermAll Permission = "*"
+)
+
+const operationPrefix = "op:"
+
+// OperationPermission is the permission needed to send msgType to a client.
+func OperationPermission(msgType protocol.MessageType) Permission {
+	switch msgType {
+	case protocol.TypeCancel:
+		return PermCancelJobs
+	case protocol.TypeJobList:
+		return PermViewClients
+	}
+	return Permission(operationPrefix + string(msgType))
+}
+
+// Built-in roles. A policy file may redefine them or add its own.
+const (
+	RoleViewer   = "viewer"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+// DefaultRoles returns the built-in roles: viewers look, operators act
+// without destroying data or managing access, admins do everything.
+func DefaultRoles() map[string][]Permission {
+	viewer := []Permission{
+		PermViewClients,
+		OperationPermission(protocol.TypeScreenshot),
+		OperationPermission(protocol.TypeFileList),
+		OperationPermission(protocol.TypeRegList),
+		OperationPermission(protocol.TypeRegRead),
+	}
+	operator := append(slices.Clone(viewer),
+		PermCancelJobs,
+		PermShell,
+		OperationPermission(protocol.TypeCommand),
+		OperationPermission(protocol.TypeWebcam),
+		OperationPermission(protocol.TypeShowImage),
+		OperationPermission(protocol.TypeFileRead),
+		OperationPermission(protocol.TypeFileDownload),
+		OperationPermission(protocol.TypeFileWrite),
+	)
+
+	return map[string][]Permission{
+		RoleViewer:   viewer,
+		RoleOperator: operator,
+		RoleAdmin:    {PermAll},
+	}
+}
+
+var (
+	ErrForbidden       = errors.New("forbidden")
+	ErrUnknownOperator = errors.New("unknown operator")
+)
+
+// Grant gives an operator a role, limited to clients in Groups. No groups
+// means every client.
+type Grant struct {
+	Role   string   `json:"role"`
+	Groups []string `json:"groups,omitempty"`
+}
+
+// OperatorPolicy lists what one operator may do. IDs are namespaced by
+// frontend: "telegram:<user id>" for the bot, "api:<name>" for API tokens.
+type OperatorPolicy struct {
+	ID string `json:"id"`
+	// TokenSHA256 is the hex SHA-256 of the operator's API bearer token.
+	TokenSHA256 string  `json:"token_sha256,omitempty"`
+	Grants      []Grant `json:"grants"`
+}
+
+// Policy is the access control configuration shared by every frontend. A
+// policy file looks like:
+//
+//	{
+//	  "groups": {"lab": ["lab-*"]},
+//	  "operators": [
+//	    {"id": "telegram:123456", "grants": [{"role": "admin"}]},
+//	    {"id": "api:ci", "token_sha256": "<hex>", "grants": [{"role": "viewer", "groups": ["lab"]}]}
+//	  ]
+//	}
+type Policy struct {
+	// Roles maps role names to permissions, on top of DefaultRoles.
+	Roles map[string][]Permission `json:"roles,omitempty"`
+	// Groups maps group names to client ID or hostname patterns
+	// (path.Match syntax, e.g. "lab-*").
+	Groups    map[string][]string `json:"groups,omitempty"`
+	Operators []OperatorPolicy    `json:"operators"`
+
+	mutex sync.RWMutex
+}
+
+// NewPolicy returns a policy with the built-in roles and no operators.
+func NewPolicy() *Policy {
+	return &Policy{Roles: DefaultRoles(), Groups: make(map[string][]string)}
+}
+
+// LoadPolicy reads a policy file. Roles it does not define keep their
+// built-in permissions.
+func LoadPolicy(file string) (*Policy, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var p Policy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", file, err)
+	}
+
+	roles := DefaultRoles()
+	for name, perms := range p.Roles {
+		roles[name] = perms
+	}
+	p.Roles = roles
+	if p.Groups == nil {
+		p.Groups = make(map[string][]string)
+	}
+
+	if err := p.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return &p, nil
+}
+
+func (p *Policy) validate() error {
+	for group, patterns := range p.Groups {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("group %s: bad pattern %q", group, pattern)
+			}
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, op := range p.Operators {
+		if op.ID == "" {
+			return errors.New("operator without id")
+		}
+		if seen[op.ID] {
+			return fmt.Errorf("operator %s is listed twice", op.ID)
+		}
+		seen[op.ID] = true
+
+		if op.TokenSHA256 != "" {
+			if b, err := hex.DecodeString(op.TokenSHA256); err != nil || len(b) != sha256.Size {
+				return fmt.Errorf("operator %s: token_sha256 must be a hex SHA-256 digest", op.ID)
+			}
+		}
+		for _, g := range op.Grants {
+			if err := p.checkGrant(g); err != nil {
+				return fmt.Errorf("operator %s: %w", op.ID, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (p *Policy) checkGrant(g Grant) error {
+	if _, ok := p.Roles[g.Role]; !ok {
+		return fmt.Errorf("unknown role %q", g.Role)
+	}
+	for _, group := range g.Groups {
+		if _, ok := p.Groups[group]; !ok {
+			return fmt.Errorf("unknown group %q", group)
+		}
+	}
+	return nil
+}
+
+// AddGrant gives operator id another grant, adding the operator if needed.
+// cmd/server uses it to turn -admin-ids into admins.
+func (p *Policy) AddGrant(id string, g Grant) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if err := p.checkGrant(g); err != nil {
+		return err
+	}
+	for i := range p.Operators {
+		if p.Operators[i].ID == id {
+			p.Operators[i].Grants = append(p.Operators[i].Grants, g)
+			return nil
+		}
+	}
+	p.Operators = append(p.Operators, OperatorPolicy{ID: id, Grants: []Grant{g}})
+	return nil
+}
+
+func (p *Policy) operator(id string) (OperatorPolicy, bool) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	for _, op := range p.Operators {
+		if op.ID == id {
+			return op, true
+		}
+	}
+	return OperatorPolicy{}, false
+}
+
+// operatorByToken finds the operator whose token hashes to TokenSHA256.
+func (p *Policy) operatorByToken(token string) (OperatorPolicy, bool) {
+	sum := sha256.Sum256([]byte(token))
+
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	for _, op := range p.Operators {
+		want, err := hex.DecodeString(op.TokenSHA256)
+		if err == nil && subtle.ConstantTimeCompare(sum[:], want) == 1 {
+			return op, true
+		}
+	}
+	return OperatorPolicy{}, false
+}
+
+func (p *Policy) roleAllows(role string, perm Permission) bool {
+	for _, granted := range p.Roles[role] {
+		if granted == PermAll || granted == perm {
+			return true
+		}
+		if granted == operationPrefix+"*" && strings.HasPrefix(string(perm), operationPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// inGroups reports whether a client matches any of the groups.
+func (p *Policy) inGroups(groups []string, clientID, hostname string) bool {
+	for _, group := range groups {
+		for _, pattern := range p.Groups[group] {
+			if ok, _ := path.Match(pattern, clientID); ok {
+				return true
+			}
+			if ok, _ := path.Match(pattern, hostname); ok && hostname != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// permissions lists what a grant set allows anywhere, for display.
+func (p *Policy) permissions(grants []Grant) []Permission {
+	set := make(map[Permission]bool)
+	for _, g := range grants {
+		for _, perm := range p.Roles[g.Role] {
+			set[perm] = true
+		}
+	}
+
+	perms := make([]Permission, 0, len(set))
+	for perm := range set {
+		perms = append(perms, perm)
+	}
+	sort.Slice(perms, func(i, j int) bool { return perms[i] < perms[j] })
+	return perms
+}
@@ -0,0 +1,83 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/E2klime/HAXinceL2/internal/protocol"
+)
+
+func TestOperatorCan(t *testing.T) {
+	policy := NewPolicy()
+	policy.Groups = map[string][]string{
+		"lab":   {"lab-*"},
+		"web":   {"web?.example.com"},
+		"exact": {"db1"},
+	}
+	policy.Operators = []OperatorPolicy{
+		{ID: "api:admin", Grants: []Grant{{Role: RoleAdmin}}},
+		{ID: "api:viewer", Grants: []Grant{{Role: RoleViewer}}},
+		{ID: "api:lab", Grants: []Grant{{Role: RoleOperator, Groups: []string{"lab"}}}},
+		{ID: "api:web", Grants: []Grant{{Role: RoleAdmin, Groups: []string{"web", "exact"}}}},
+		{ID: "api:mixed", Grants: []Grant{
+			{Role: RoleViewer},
+			{Role: RoleAdmin, Groups: []string{"lab"}},
+		}},
+	}
+	if err := policy.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	inventory := NewMemoryInventory()
+	for _, rec := range []*ClientRecord{
+		{ID: "lab-01", Hostname: "bench"},
+		{ID: "c7", Hostname: "web1.example.com"},
+		{ID: "c8", Hostname: "web10.example.com"},
+		{ID: "db1"},
+		{ID: "prod-01", Hostname: "lab-host"},
+	} {
+		if err := inventory.Put(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := NewServer(WithPolicy(policy), WithInventory(inventory))
+
+	command := OperationPermission(protocol.TypeCommand)
+	fileDelete := OperationPermission(protocol.TypeFileDelete)
+
+	tests := []struct {
+		operator string
+		perm     Permission
+		clientID string
+		want     bool
+	}{
+		{"api:admin", fileDelete, "anything", true},
+		{"api:viewer", PermViewClients, "lab-01", true},
+		{"api:viewer", command, "lab-01", false},
+		{"api:lab", command, "lab-01", true},
+		{"api:lab", command, "db1", false},
+		{"api:lab", fileDelete, "lab-01", false},
+		{"api:lab", command, "unknown-client", false},
+		// Groups match hostnames as well as IDs.
+		{"api:lab", command, "prod-01", true},
+		{"api:web", fileDelete, "c7", true},
+		{"api:web", fileDelete, "c8", false},
+		{"api:web", fileDelete, "db1", true},
+		{"api:web", fileDelete, "lab-01", false},
+		// Each grant counts on its own.
+		{"api:mixed", PermViewClients, "db1", true},
+		{"api:mixed", fileDelete, "db1", false},
+		{"api:mixed", fileDelete, "lab-01", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.operator+" "+string(tt.perm)+" "+tt.clientID, func(t *testing.T) {
+			op, err := s.Operator(tt.operator)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := op.Can(tt.perm, tt.clientID); got != tt.want {
+				t.Errorf("Can = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
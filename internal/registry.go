@@ -3,6 +3,7 @@
 package internal
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -13,6 +14,20 @@ import (
 	"golang.org/x/sys/windows/registry"
 )
 
+func init() {
+	RegisterModule(Module{
+		Name:       "registry",
+		Capability: protocol.CapRegistry,
+		OS:         []string{"windows"},
+		Handlers: []HandlerSpec{
+			{Type: protocol.TypeRegRead, Handler: HandlerFunc((*Client).handleRegRead), MaxConcurrent: 4},
+			{Type: protocol.TypeRegWrite, Handler: HandlerFunc((*Client).handleRegWrite), MaxConcurrent: 1},
+			{Type: protocol.TypeRegDelete, Handler: HandlerFunc((*Client).handleRegDelete), MaxConcurrent: 1},
+			{Type: protocol.TypeRegList, Handler: HandlerFunc((*Client).handleRegList), MaxConcurrent: 4},
+		},
+	})
+}
+
 func parseRegistryKey(keyPath string) (registry.Key, string, error) {
 	parts := strings.SplitN(keyPath, "\\", 2)
 	if len(parts) < 2 {
@@ -38,10 +53,10 @@ func parseRegistryKey(keyPath string) (registry.Key, string, error) {
 	return rootKey, parts[1], nil
 }
 
-func (c *Client) handleRegRead(msg *protocol.Message) {
+func (c *Client) handleRegRead(ctx context.Context, msg *protocol.Message) {
 	var payload protocol.RegistryReadPayload
-	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-		c.sendError("Failed to parse registry read payload", err)
+	if err := msg.Decode(&payload); err != nil {
+		c.sendError(msg, "Failed to parse registry read payload", err)
 		return
 	}
 
@@ -49,13 +64,13 @@ func (c *Client) handleRegRead(msg *protocol.Message) {
 
 	rootKey, subKey, err := parseRegistryKey(payload.Key)
 	if err != nil {
-		c.sendError("Invalid registry key", err)
+		c.sendError(msg, "Invalid registry key", err)
 		return
 	}
 
 	k, err := registry.OpenKey(rootKey, subKey, registry.QUERY_VALUE)
 	if err != nil {
-		c.sendError(fmt.Sprintf("Failed to open registry key %s", payload.Key), err)
+		c.sendError(msg, fmt.Sprintf("Failed to open registry key %s", payload.Key), err)
 		return
 	}
 	defer k.Close()
@@ -71,7 +86,7 @@ func (c *Client) handleRegRead(msg *protocol.Message) {
 				"data_type": "dword",
 			}
 			jsonData, _ := json.Marshal(result)
-			c.sendResponse(true, string(jsonData), "")
+			c.sendResponse(msg, true, string(jsonData), "")
 			return
 		}
 
@@ -84,11 +99,11 @@ func (c *Client) handleRegRead(msg *protocol.Message) {
 				"data_type": "binary",
 			}
 			jsonData, _ := json.Marshal(result)
-			c.sendResponse(true, string(jsonData), "")
+			c.sendResponse(msg, true, string(jsonData), "")
 			return
 		}
 
-		c.sendError(fmt.Sprintf("Failed to read registry value %s", payload.Value), err)
+		c.sendError(msg, fmt.Sprintf("Failed to read registry value %s", payload.Value), err)
 		return
 	}
 
@@ -113,18 +128,18 @@ func (c *Client) handleRegRead(msg *protocol.Message) {
 
 	jsonData, err := json.Marshal(result)
 	if err != nil {
-		c.sendError("Failed to serialize registry data", err)
+		c.sendError(msg, "Failed to serialize registry data", err)
 		return
 	}
 
-	c.sendResponse(true, string(jsonData), "")
+	c.sendResponse(msg, true, string(jsonData), "")
 	log.Printf("Registry value read successfully: %s\\%s", payload.Key, payload.Value)
 }
 
-func (c *Client) handleRegWrite(msg *protocol.Message) {
+func (c *Client) handleRegWrite(ctx context.Context, msg *protocol.Message) {
 	var payload protocol.RegistryWritePayload
-	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-		c.sendError("Failed to parse registry write payload", err)
+	if err := msg.Decode(&payload); err != nil {
+		c.sendError(msg, "Failed to parse registry write payload", err)
 		return
 	}
 
@@ -132,13 +147,13 @@ func (c *Client) handleRegWrite(msg *protocol.Message) {
 
 	rootKey, subKey, err := parseRegistryKey(payload.Key)
 	if err != nil {
-		c.sendError("Invalid registry key", err)
+		c.sendError(msg, "Invalid registry key", err)
 		return
 	}
 
 	k, _, err := registry.CreateKey(rootKey, subKey, registry.SET_VALUE)
 	if err != nil {
-		c.sendError(fmt.Sprintf("Failed to create/open registry key %s", payload.Key), err)
+		c.sendError(msg, fmt.Sprintf("Failed to create/open registry key %s", payload.Key), err)
 		return
 	}
 	defer k.Close()
@@ -151,35 +166,35 @@ func (c *Client) handleRegWrite(msg *protocol.Message) {
 	case "dword":
 		val, parseErr := strconv.ParseUint(payload.Data, 0, 32)
 		if parseErr != nil {
-			c.sendError("Invalid DWORD value", parseErr)
+			c.sendError(msg, "Invalid DWORD value", parseErr)
 			return
 		}
 		err = k.SetDWordValue(payload.Value, uint32(val))
 	case "qword":
 		val, parseErr := strconv.ParseUint(payload.Data, 0, 64)
 		if parseErr != nil {
-			c.sendError("Invalid QWORD value", parseErr)
+			c.sendError(msg, "Invalid QWORD value", parseErr)
 			return
 		}
 		err = k.SetQWordValue(payload.Value, val)
 	default:
-		c.sendError("Unsupported data type", fmt.Errorf("type: %s", payload.DataType))
+		c.sendError(msg, "Unsupported data type", fmt.Errorf("type: %s", payload.DataType))
 		return
 	}
 
 	if err != nil {
-		c.sendError(fmt.Sprintf("Failed to write registry value %s", payload.Value), err)
+		c.sendError(msg, fmt.Sprintf("Failed to write registry value %s", payload.Value), err)
 		return
 	}
 
-	c.sendResponse(true, fmt.Sprintf("Registry value written successfully: %s\\%s", payload.Key, payload.Value), "")
+	c.sendResponse(msg, true, fmt.Sprintf("Registry value written successfully: %s\\%s", payload.Key, payload.Value), "")
 	log.Printf("Registry value written successfully: %s\\%s", payload.Key, payload.Value)
 }
 
-func (c *Client) handleRegDelete(msg *protocol.Message) {
+func (c *Client) handleRegDelete(ctx context.Context, msg *protocol.Message) {
 	var payload protocol.RegistryDeletePayload
-	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-		c.sendError("Failed to parse registry delete payload", err)
+	if err := msg.Decode(&payload); err != nil {
+		c.sendError(msg, "Failed to parse registry delete payload", err)
 		return
 	}
 
@@ -187,41 +202,41 @@ func (c *Client) handleRegDelete(msg *protocol.Message) {
 
 	rootKey, subKey, err := parseRegistryKey(payload.Key)
 	if err != nil {
-		c.sendError("Invalid registry key", err)
+		c.sendError(msg, "Invalid registry key", err)
 		return
 	}
 
 	if payload.Value == "" {
 		err = registry.DeleteKey(rootKey, subKey)
 		if err != nil {
-			c.sendError(fmt.Sprintf("Failed to delete registry key %s", payload.Key), err)
+			c.sendError(msg, fmt.Sprintf("Failed to delete registry key %s", payload.Key), err)
 			return
 		}
-		c.sendResponse(true, fmt.Sprintf("Registry key deleted successfully: %s", payload.Key), "")
+		c.sendResponse(msg, true, fmt.Sprintf("Registry key deleted successfully: %s", payload.Key), "")
 		log.Printf("Registry key deleted successfully: %s", payload.Key)
 	} else {
 		k, err := registry.OpenKey(rootKey, subKey, registry.SET_VALUE)
 		if err != nil {
-			c.sendError(fmt.Sprintf("Failed to open registry key %s", payload.Key), err)
+			c.sendError(msg, fmt.Sprintf("Failed to open registry key %s", payload.Key), err)
 			return
 		}
 		defer k.Close()
 
 		err = k.DeleteValue(payload.Value)
 		if err != nil {
-			c.sendError(fmt.Sprintf("Failed to delete registry value %s", payload.Value), err)
+			c.sendError(msg, fmt.Sprintf("Failed to delete registry value %s", payload.Value), err)
 			return
 		}
 
-		c.sendResponse(true, fmt.Sprintf("Registry value deleted successfully: %s\\%s", payload.Key, payload.Value), "")
+		c.sendResponse(msg, true, fmt.Sprintf("Registry value deleted successfully: %s\\%s", payload.Key, payload.Value), "")
 		log.Printf("Registry value deleted successfully: %s\\%s", payload.Key, payload.Value)
 	}
 }
 
-func (c *Client) handleRegList(msg *protocol.Message) {
+func (c *Client) handleRegList(ctx context.Context, msg *protocol.Message) {
 	var payload protocol.RegistryListPayload
-	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-		c.sendError("Failed to parse registry list payload", err)
+	if err := msg.Decode(&payload); err != nil {
+		c.sendError(msg, "Failed to parse registry list payload", err)
 		return
 	}
 
@@ -229,13 +244,13 @@ func (c *Client) handleRegList(msg *protocol.Message) {
 
 	rootKey, subKey, err := parseRegistryKey(payload.Key)
 	if err != nil {
-		c.sendError("Invalid registry key", err)
+		c.sendError(msg, "Invalid registry key", err)
 		return
 	}
 
 	k, err := registry.OpenKey(rootKey, subKey, registry.ENUMERATE_SUB_KEYS|registry.QUERY_VALUE)
 	if err != nil {
-		c.sendError(fmt.Sprintf("Failed to open registry key %s", payload.Key), err)
+		c.sendError(msg, fmt.Sprintf("Failed to open registry key %s", payload.Key), err)
 		return
 	}
 	defer k.Close()
@@ -311,10 +326,10 @@ func (c *Client) handleRegList(msg *protocol.Message) {
 
 	jsonData, err := json.Marshal(items)
 	if err != nil {
-		c.sendError("Failed to serialize registry list", err)
+		c.sendError(msg, "Failed to serialize registry list", err)
 		return
 	}
 
-	c.sendResponse(true, string(jsonData), "")
+	c.sendResponse(msg, true, string(jsonData), "")
 	log.Printf("Registry listed successfully: %s (%d items)", payload.Key, len(items))
 }
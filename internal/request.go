@@ -0,0 +1,205 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/E2klime/HAXinceL2/internal/protocol"
+	"github.com/google/uuid"
+)
+
+// DefaultRequestTimeout bounds Request calls whose context carries no deadline.
+const DefaultRequestTimeout = 2 * time.Minute
+
+var (
+	ErrClientOffline      = errors.New("client not connected")
+	ErrClientDisconnected = errors.New("client disconnected before responding")
+	ErrUnsupported        = errors.New("operation not supported by client")
+	// ErrClientPolicy wraps refusals by the client's local policy, which
+	// no operator permission overrides.
+	ErrClientPolicy = errors.New("client policy")
+	// ErrClientConsent wraps operations the client's local user refused
+	// or did not answer.
+	ErrClientConsent = errors.New("client consent")
+)
+
+func unsupportedError(clientID string, msgType protocol.MessageType) error {
+	return fmt.Errorf("%w: %s cannot handle %s (needs %q)", ErrUnsupported, clientID, msgType, protocol.RequiredCapability(msgType))
+}
+
+type pendingRequest struct {
+	client   *ConnectedClient
+	resp     chan *protocol.Message
+	onOutput func(*protocol.Message)
+}
+
+// request sends msg to the client and blocks until the client answers with a
+// response or error carrying the same RequestID, the context is done, or the
+// client disconnects.
+func (s *Server) request(ctx context.Context, clientID string, msg *protocol.Message) (*protocol.Message, error) {
+	return s.roundTrip(ctx, clientID, msg, nil)
+}
+
+// stream is request for jobs that report incremental TypeOutput messages
+// before their final response; each one is passed to onOutput in order, on
+// the connection's read goroutine, so onOutput must not block. If ctx ends
+// first, the job is cancelled on the client.
+func (s *Server) stream(ctx context.Context, clientID string, msg *protocol.Message, onOutput func(*protocol.Message)) (*protocol.Message, error) {
+	resp, err := s.roundTrip(ctx, clientID, msg, onOutput)
+	if err != nil && ctx.Err() != nil {
+		s.cancelJob(clientID, msg.RequestID)
+	}
+	return resp, err
+}
+
+// cancelJob asks the client to stop the job started by the request with
+// the given ID. It does not wait for the client to acknowledge.
+func (s *Server) cancelJob(clientID, jobID string) error {
+	client, err := s.lookupClient(clientID)
+	if err != nil {
+		return err
+	}
+
+	msg := protocol.NewCancel(protocol.CancelPayload{JobID: jobID})
+	msg.RequestID = uuid.New().String()
+	return s.send(client, msg)
+}
+
+// stopJob cancels a job on the client, like cancelJob, but waits for the
+// client to confirm. jobID may be a unique prefix of the job's ID.
+func (s *Server) stopJob(ctx context.Context, clientID, jobID string) error {
+	resp, err := s.request(ctx, clientID, protocol.NewCancel(protocol.CancelPayload{JobID: jobID}))
+	if err != nil {
+		return err
+	}
+	_, err = replyData(resp)
+	return err
+}
+
+// jobs lists the jobs queued or running on the client, oldest first.
+func (s *Server) jobs(ctx context.Context, clientID string) ([]protocol.JobInfo, error) {
+	resp, err := s.request(ctx, clientID, protocol.NewJobList(protocol.JobListPayload{}))
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := replyData(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []protocol.JobInfo
+	if err := json.Unmarshal([]byte(data), &jobs); err != nil {
+		return nil, fmt.Errorf("malformed job list: %w", err)
+	}
+	return jobs, nil
+}
+
+func (s *Server) roundTrip(ctx context.Context, clientID string, msg *protocol.Message, onOutput func(*protocol.Message)) (*protocol.Message, error) {
+	if msg.RequestID == "" {
+		msg.RequestID = uuid.New().String()
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultRequestTimeout)
+		defer cancel()
+	}
+
+	client, err := s.lookupClient(clientID)
+	if err != nil {
+		return nil, err
+	}
+	if !client.Supports(msg.Type) {
+		return nil, unsupportedError(clientID, msg.Type)
+	}
+
+	p := &pendingRequest{
+		client:   client,
+		resp:     make(chan *protocol.Message, 1),
+		onOutput: onOutput,
+	}
+
+	s.pendingMutex.Lock()
+	if _, exists := s.pending[msg.RequestID]; exists {
+		s.pendingMutex.Unlock()
+		return nil, fmt.Errorf("duplicate request id: %s", msg.RequestID)
+	}
+	s.pending[msg.RequestID] = p
+	s.pendingMutex.Unlock()
+
+	defer s.dropPending(msg.RequestID)
+
+	if err := s.send(client, msg); err != nil {
+		return nil, err
+	}
+
+	select {
+	case resp, ok := <-p.resp:
+		if !ok {
+			return nil, ErrClientDisconnected
+		}
+		return resp, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("request %s to client %s: %w", msg.RequestID, clientID, ctx.Err())
+	}
+}
+
+func (s *Server) dropPending(requestID string) {
+	s.pendingMutex.Lock()
+	delete(s.pending, requestID)
+	s.pendingMutex.Unlock()
+}
+
+// resolvePending hands a client reply to the waiting Request call. It reports
+// whether the message was claimed.
+func (s *Server) resolvePending(client *ConnectedClient, msg *protocol.Message) bool {
+	if msg.RequestID == "" {
+		return false
+	}
+
+	s.pendingMutex.Lock()
+	defer s.pendingMutex.Unlock()
+
+	p, ok := s.pending[msg.RequestID]
+	if !ok || p.client != client {
+		return false
+	}
+
+	delete(s.pending, msg.RequestID)
+	p.resp <- msg
+	return true
+}
+
+// routeOutput passes an incremental output message to the Stream call that
+// started the job. Output for jobs nobody is waiting on is dropped.
+func (s *Server) routeOutput(client *ConnectedClient, msg *protocol.Message) {
+	s.pendingMutex.Lock()
+	p, ok := s.pending[msg.RequestID]
+	s.pendingMutex.Unlock()
+
+	if !ok || p.client != client || p.onOutput == nil {
+		return
+	}
+
+	// Called from the connection's read pump, so chunks arrive in order.
+	p.onOutput(msg)
+}
+
+// failPending wakes every Request still waiting on a connection that went
+// away. Requests already sent over a newer connection of the same client are
+// left alone.
+func (s *Server) failPending(client *ConnectedClient) {
+	s.pendingMutex.Lock()
+	defer s.pendingMutex.Unlock()
+
+	for id, p := range s.pending {
+		if p.client == client {
+			delete(s.pending, id)
+			close(p.resp)
+		}
+	}
+}
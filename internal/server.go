@@ -1,11 +1,13 @@
 package internal
 
 import (
-	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/E2klime/HAXinceL2/internal/protocol"
@@ -16,16 +18,37 @@ var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
 		return true
 	},
+	// Offer permessage-deflate; whether a client connection actually
+	// compresses is negotiated in the auth handshake.
+	EnableCompression: true,
 }
 
 type ConnectedClient struct {
-	ID       string
-	Conn     *websocket.Conn
-	Send     chan *protocol.Message
-	Hostname string
-	Username string
-	OS       string
-	LastSeen time.Time
+	ID          string
+	Conn        *websocket.Conn
+	Send        chan *protocol.Message
+	Hostname    string
+	Username    string
+	OS          string
+	FirstSeen   time.Time
+	ConnectedAt time.Time
+	Reconnects  int
+
+	ProtocolVersion int
+	AgentVersion    string
+	Capabilities    []string
+
+	// flushMutex serializes deliveries of queued items to the client.
+	flushMutex sync.Mutex
+
+	// lastSeen is the Unix time in nanoseconds of the last frame received.
+	// The read pump updates it without holding any lock.
+	lastSeen atomic.Int64
+
+	// done is closed once the connection is unregistered. Send is never
+	// closed so that concurrent senders cannot panic.
+	done  chan struct{}
+	codec wireCodec
 }
 
 type Server struct {
@@ -34,34 +57,157 @@ type Server struct {
 	register   chan *ConnectedClient
 	unregister chan *ConnectedClient
 	broadcast  chan *protocol.Message
+
+	pending      map[string]*pendingRequest
+	pendingMutex sync.Mutex
+
+	tokens            *TokenStore
+	requireClientCert bool
+	inventory         InventoryStore
+
+	queue          QueueStore
+	queueMutex     sync.Mutex
+	queueListeners []func(*QueueItem)
+	queueWaiters   map[string][]chan struct{}
+
+	sessions      map[string]*ShellSession
+	sessionsMutex sync.Mutex
+	operatorToken string
+	policy        *Policy
+
+	transfers      map[string]*Transfer
+	transfersMutex sync.Mutex
+	transferDir    string
+
+	events   eventHub
+	auditLog *AuditLog
+
+	approvals         map[string]*Approval
+	approvalStore     ApprovalStore
+	approvalsMutex    sync.Mutex
+	approvalListeners []func(*Approval)
+	approvalTypes     map[protocol.MessageType]bool
+	approvalTTL       time.Duration
+}
+
+type ServerOption func(*Server)
+
+// WithTokenStore requires every client to authenticate with an enrollment
+// token from ts. Without it the server accepts any client.
+func WithTokenStore(ts *TokenStore) ServerOption {
+	return func(s *Server) {
+		s.tokens = ts
+	}
+}
+
+// WithClientCertAuth rejects WebSocket clients that did not present a
+// certificate verified against the configured client CA.
+func WithClientCertAuth() ServerOption {
+	return func(s *Server) {
+		s.requireClientCert = true
+	}
+}
+
+// WithInventory persists client records in store instead of memory.
+func WithInventory(store InventoryStore) ServerOption {
+	return func(s *Server) {
+		s.inventory = store
+	}
+}
+
+// WithQueue persists queued messages for offline clients in store instead
+// of memory.
+func WithQueue(store QueueStore) ServerOption {
+	return func(s *Server) {
+		s.queue = store
+	}
+}
+
+// WithOperatorToken lets callers that present token as a bearer credential
+// use the operator endpoints as an admin. WithPolicy adds per-operator
+// tokens with narrower roles.
+func WithOperatorToken(token string) ServerOption {
+	return func(s *Server) {
+		s.operatorToken = token
+	}
+}
+
+// WithTransferDir stores files downloaded from clients in dir instead of the
+// system temp directory.
+func WithTransferDir(dir string) ServerOption {
+	return func(s *Server) {
+		s.transferDir = dir
+	}
 }
 
-func NewServer() *Server {
-	return &Server{
-		clients:    make(map[string]*ConnectedClient),
-		register:   make(chan *ConnectedClient),
-		unregister: make(chan *ConnectedClient),
-		broadcast:  make(chan *protocol.Message),
+func NewServer(opts ...ServerOption) *Server {
+	s := &Server{
+		clients:      make(map[string]*ConnectedClient),
+		register:     make(chan *ConnectedClient),
+		unregister:   make(chan *ConnectedClient),
+		broadcast:    make(chan *protocol.Message),
+		pending:      make(map[string]*pendingRequest),
+		inventory:    NewMemoryInventory(),
+		queue:        NewMemoryQueue(),
+		queueWaiters: make(map[string][]chan struct{}),
+		sessions:     make(map[string]*ShellSession),
+		transfers:    make(map[string]*Transfer),
+		transferDir:  filepath.Join(os.TempDir(), "haxincel2-transfers"),
+		policy:       NewPolicy(),
+		approvals:    make(map[string]*Approval),
 	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.loadApprovals()
+
+	return s
 }
 
 func (s *Server) Run() {
+	go s.runQueueSweeper()
+	go s.runApprovalSweeper()
+	go s.runTransferSweeper()
+
 	for {
 		select {
 		case client := <-s.register:
 			s.mutex.Lock()
+			if prev, ok := s.clients[client.ID]; ok && prev != client {
+				// Same machine reconnected before the old connection timed
+				// out: keep its history and drop the stale socket.
+				client.FirstSeen = prev.FirstSeen
+				client.Reconnects = prev.Reconnects + 1
+				prev.Conn.Close()
+				log.Printf("Client reconnected: %s, replacing previous connection", client.ID)
+			}
 			s.clients[client.ID] = client
 			s.mutex.Unlock()
-			log.Printf("Client registered: %s (%s@%s)", client.ID, client.Username, client.Hostname)
+			if rec := s.recordConnect(client); rec.FirstSeen.Before(client.FirstSeen) {
+				client.FirstSeen = rec.FirstSeen
+			}
+			log.Printf("Client registered: %s (%s@%s, agent %s, protocol %d, %s)",
+				client.ID, client.Username, client.Hostname, client.AgentVersion, client.ProtocolVersion, client.codec)
+			go s.publishClient(client.ID)
+			go s.flushQueue(client)
+			go s.resumeTransfers(client)
 
 		case client := <-s.unregister:
 			s.mutex.Lock()
-			if _, ok := s.clients[client.ID]; ok {
+			current, ok := s.clients[client.ID]
+			if ok && current == client {
 				delete(s.clients, client.ID)
-				close(client.Send)
 				log.Printf("Client unregistered: %s", client.ID)
 			}
 			s.mutex.Unlock()
+			if ok && current == client {
+				s.recordDisconnect(client)
+				go s.publishClient(client.ID)
+			}
+			close(client.done)
+			s.failPending(client)
+			s.failSessions(client)
 		}
 	}
 }
@@ -73,28 +219,33 @@ func (s *Server) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	limitFrames(conn)
+	conn.EnableWriteCompression(false)
+
+	now := time.Now()
 	client := &ConnectedClient{
-		Conn:     conn,
-		Send:     make(chan *protocol.Message, 256),
-		LastSeen: time.Now(),
+		Conn:        conn,
+		Send:        make(chan *protocol.Message, 256),
+		FirstSeen:   now,
+		ConnectedAt: now,
+		done:        make(chan struct{}),
 	}
+	client.lastSeen.Store(now.UnixNano())
 
-	var msg protocol.Message
-	if err := conn.ReadJSON(&msg); err != nil {
-		log.Printf("Failed to read auth message: %v", err)
-		conn.Close()
-		return
+	authPayload, err := s.authenticate(conn, peerIdentity(r))
+	if err == nil {
+		err = checkProtocol(authPayload)
 	}
-
-	if msg.Type != protocol.TypeAuth {
-		log.Printf("Expected auth message, got: %s", msg.Type)
+	if err != nil {
+		log.Printf("Handshake from %s rejected: %v", r.RemoteAddr, err)
+		sendAuthResult(conn, protocol.AuthResultPayload{}, err)
 		conn.Close()
 		return
 	}
 
-	var authPayload protocol.AuthPayload
-	if err := json.Unmarshal(msg.Payload, &authPayload); err != nil {
-		log.Printf("Failed to parse auth payload: %v", err)
+	codec, result := negotiateCodec(authPayload)
+	if err := sendAuthResult(conn, result, nil); err != nil {
+		log.Printf("Failed to send auth result to %s: %v", authPayload.ClientID, err)
 		conn.Close()
 		return
 	}
@@ -103,6 +254,10 @@ func (s *Server) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 	client.Hostname = authPayload.Hostname
 	client.Username = authPayload.Username
 	client.OS = authPayload.OS
+	client.ProtocolVersion = authPayload.ProtocolVersion
+	client.AgentVersion = authPayload.AgentVersion
+	client.Capabilities = authPayload.Capabilities
+	client.codec = codec
 
 	s.register <- client
 
@@ -123,8 +278,7 @@ func (s *Server) readPump(client *ConnectedClient) {
 	})
 
 	for {
-		var msg protocol.Message
-		err := client.Conn.ReadJSON(&msg)
+		msg, err := readFrame(client.Conn)
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("WebSocket error: %v", err)
@@ -132,7 +286,20 @@ func (s *Server) readPump(client *ConnectedClient) {
 			break
 		}
 
-		client.LastSeen = time.Now()
+		client.lastSeen.Store(time.Now().UnixNano())
+
+		switch msg.Type {
+		case protocol.TypeOutput:
+			s.routeOutput(client, msg)
+		case protocol.TypeSessionStdout:
+			s.routeSessionOutput(client, msg)
+		case protocol.TypeSessionClose:
+			s.closeSession(client, msg)
+		case protocol.TypeResponse, protocol.TypeError:
+			if !s.resolvePending(client, msg) && !s.completeQueued(client, msg) {
+				log.Printf("Unsolicited %s from client %s (request %q)", msg.Type, client.ID, msg.RequestID)
+			}
+		}
 	}
 }
 
@@ -145,14 +312,14 @@ func (s *Server) writePump(client *ConnectedClient) {
 
 	for {
 		select {
-		case message, ok := <-client.Send:
+		case <-client.done:
 			client.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			if !ok {
-				client.Conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
+			client.Conn.WriteMessage(websocket.CloseMessage, []byte{})
+			return
 
-			if err := client.Conn.WriteJSON(message); err != nil {
+		case message := <-client.Send:
+			client.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := writeFrame(client.Conn, client.codec, message); err != nil {
 				return
 			}
 
@@ -165,38 +332,44 @@ func (s *Server) writePump(client *ConnectedClient) {
 	}
 }
 
-func (s *Server) GetClients() []*ConnectedClient {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
-
-	clients := make([]*ConnectedClient, 0, len(s.clients))
-	for _, client := range s.clients {
-		clients = append(clients, client)
-	}
-	return clients
-}
-
-func (s *Server) GetClient(id string) (*ConnectedClient, error) {
+func (s *Server) lookupClient(id string) (*ConnectedClient, error) {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
 	client, ok := s.clients[id]
 	if !ok {
-		return nil, fmt.Errorf("client not found: %s", id)
+		return nil, fmt.Errorf("%w: %s", ErrClientOffline, id)
 	}
 	return client, nil
 }
 
-func (s *Server) SendCommand(clientID string, msg *protocol.Message) error {
-	client, err := s.GetClient(clientID)
+// LastSeen returns when the client last sent anything.
+func (c *ConnectedClient) LastSeen() time.Time {
+	return time.Unix(0, c.lastSeen.Load())
+}
+
+// Supports reports whether the client advertised the capability needed to
+// handle msgType.
+func (c *ConnectedClient) Supports(msgType protocol.MessageType) bool {
+	return protocol.HasCapability(c.Capabilities, msgType)
+}
+
+// disconnect closes the client's connection; the read pump then unregisters it.
+func (s *Server) disconnect(clientID string) {
+	client, err := s.lookupClient(clientID)
 	if err != nil {
-		return err
+		return
 	}
+	client.Conn.Close()
+}
 
+func (s *Server) send(client *ConnectedClient, msg *protocol.Message) error {
 	select {
 	case client.Send <- msg:
 		return nil
+	case <-client.done:
+		return fmt.Errorf("client disconnected: %s", client.ID)
 	case <-time.After(5 * time.Second):
-		return fmt.Errorf("timeout sending command to client %s", clientID)
+		return fmt.Errorf("timeout sending command to client %s", client.ID)
 	}
 }
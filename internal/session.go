@@ -0,0 +1,235 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/E2klime/HAXinceL2/internal/protocol"
+)
+
+const (
+	sessionReadBuffer = 32 << 10
+	// sessionStdinQueue bounds the input waiting for a shell that is not
+	// reading it.
+	sessionStdinQueue = 256
+	defaultPTYCols    = 80
+	defaultPTYRows    = 24
+)
+
+// ptyProcess is a shell attached to a pseudo-terminal: a PTY on Unix, a
+// ConPTY on Windows.
+type ptyProcess interface {
+	io.ReadWriteCloser
+	Resize(cols, rows int) error
+	// Wait blocks until the shell exits and returns its exit code.
+	Wait() (int, error)
+	Kill() error
+}
+
+type shellSession struct {
+	id   string
+	proc ptyProcess
+	// stdin feeds the writer goroutine, so a shell that stops reading does
+	// not block the read loop.
+	stdin chan []byte
+	// done is closed once the shell has exited.
+	done chan struct{}
+}
+
+// Session handlers run on the read loop rather than in their own goroutines
+// so that keystrokes reach the shell in the order they were typed. Input is
+// handed to a writer goroutine per session, since writes to a PTY block once
+// its buffer is full.
+func init() {
+	RegisterModule(Module{
+		Name:       "shell",
+		Capability: protocol.CapShell,
+		Handlers: []HandlerSpec{
+			{Type: protocol.TypeSessionOpen, Handler: HandlerFunc((*Client).handleSessionOpen), Ordered: true},
+			{Type: protocol.TypeSessionResize, Handler: HandlerFunc((*Client).handleSessionResize), Ordered: true},
+			{Type: protocol.TypeSessionStdin, Handler: HandlerFunc((*Client).handleSessionStdin), Ordered: true},
+			{Type: protocol.TypeSessionClose, Handler: HandlerFunc((*Client).handleSessionClose), Ordered: true},
+		},
+	})
+}
+
+func (c *Client) handleSessionOpen(ctx context.Context, msg *protocol.Message) {
+	var payload protocol.SessionOpenPayload
+	if err := msg.Decode(&payload); err != nil {
+		c.sendError(msg, "Failed to parse session open payload", err)
+		return
+	}
+
+	if payload.SessionID == "" {
+		c.sendError(msg, "Session ID is required", nil)
+		return
+	}
+	if payload.Cols <= 0 || payload.Rows <= 0 {
+		payload.Cols, payload.Rows = defaultPTYCols, defaultPTYRows
+	}
+
+	c.sessionsMutex.Lock()
+	if _, exists := c.sessions[payload.SessionID]; exists {
+		c.sessionsMutex.Unlock()
+		c.sendError(msg, fmt.Sprintf("Session already exists: %s", payload.SessionID), nil)
+		return
+	}
+
+	shell := payload.Shell
+	if shell == "" {
+		shell = defaultShell()
+	}
+
+	proc, err := startPTY(shell, payload.Cols, payload.Rows)
+	if err != nil {
+		c.sessionsMutex.Unlock()
+		c.sendError(msg, "Failed to start shell", err)
+		return
+	}
+
+	session := &shellSession{
+		id:    payload.SessionID,
+		proc:  proc,
+		stdin: make(chan []byte, sessionStdinQueue),
+		done:  make(chan struct{}),
+	}
+	c.sessions[session.id] = session
+	c.sessionsMutex.Unlock()
+	c.Consent.hold()
+
+	log.Printf("Shell session %s opened (%s, %dx%d)", session.id, shell, payload.Cols, payload.Rows)
+	c.sendResponse(msg, true, session.id, "")
+
+	go c.pumpSession(session)
+	go c.feedSession(session)
+}
+
+func (c *Client) pumpSession(session *shellSession) {
+	buf := make([]byte, sessionReadBuffer)
+	for {
+		n, err := session.proc.Read(buf)
+		if n > 0 {
+			out := protocol.NewSessionStdout(protocol.SessionDataPayload{SessionID: session.id})
+			out.RequestID = session.id
+			// The writer encodes later, so buf cannot be handed over.
+			out.Binary = bytes.Clone(buf[:n])
+			if werr := c.writeMessage(out); werr != nil {
+				log.Printf("Failed to send session %s output: %v", session.id, werr)
+				session.proc.Kill()
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	exitCode, err := session.proc.Wait()
+	close(session.done)
+	session.proc.Close()
+
+	c.sessionsMutex.Lock()
+	delete(c.sessions, session.id)
+	c.sessionsMutex.Unlock()
+	c.Consent.release()
+
+	closePayload := protocol.SessionClosePayload{
+		SessionID: session.id,
+		ExitCode:  exitCode,
+	}
+	if err != nil {
+		closePayload.Reason = err.Error()
+	}
+
+	msg := protocol.NewSessionClose(closePayload)
+	msg.RequestID = session.id
+	c.writeMessage(msg)
+
+	log.Printf("Shell session %s closed (exit %d)", session.id, exitCode)
+}
+
+// feedSession writes queued input to the shell until it exits.
+func (c *Client) feedSession(session *shellSession) {
+	for {
+		select {
+		case data := <-session.stdin:
+			if _, err := session.proc.Write(data); err != nil {
+				log.Printf("Failed to write to session %s: %v", session.id, err)
+			}
+		case <-session.done:
+			return
+		}
+	}
+}
+
+func (c *Client) lookupSession(id string) *shellSession {
+	c.sessionsMutex.Lock()
+	defer c.sessionsMutex.Unlock()
+
+	return c.sessions[id]
+}
+
+func (c *Client) handleSessionStdin(ctx context.Context, msg *protocol.Message) {
+	var payload protocol.SessionDataPayload
+	if err := msg.Decode(&payload); err != nil {
+		log.Printf("Failed to parse session stdin: %v", err)
+		return
+	}
+
+	session := c.lookupSession(payload.SessionID)
+	if session == nil {
+		return
+	}
+
+	select {
+	case session.stdin <- msg.Binary:
+	default:
+		// Dropping keystrokes could run half a command line, so a shell
+		// that stopped reading its input is closed instead.
+		log.Printf("Session %s is not reading its input, closing it", session.id)
+		session.proc.Kill()
+	}
+}
+
+func (c *Client) handleSessionResize(ctx context.Context, msg *protocol.Message) {
+	var payload protocol.SessionResizePayload
+	if err := msg.Decode(&payload); err != nil {
+		log.Printf("Failed to parse session resize: %v", err)
+		return
+	}
+
+	session := c.lookupSession(payload.SessionID)
+	if session == nil || payload.Cols <= 0 || payload.Rows <= 0 {
+		return
+	}
+
+	if err := session.proc.Resize(payload.Cols, payload.Rows); err != nil {
+		log.Printf("Failed to resize session %s: %v", session.id, err)
+	}
+}
+
+func (c *Client) handleSessionClose(ctx context.Context, msg *protocol.Message) {
+	var payload protocol.SessionClosePayload
+	if err := msg.Decode(&payload); err != nil {
+		log.Printf("Failed to parse session close: %v", err)
+		return
+	}
+
+	// The pump notices the dead shell and reports session_close back.
+	if session := c.lookupSession(payload.SessionID); session != nil {
+		session.proc.Kill()
+	}
+}
+
+// closeSessions kills every shell; their operators went away with the
+// connection.
+func (c *Client) closeSessions() {
+	c.sessionsMutex.Lock()
+	defer c.sessionsMutex.Unlock()
+
+	for _, session := range c.sessions {
+		session.proc.Kill()
+	}
+}
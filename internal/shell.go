@@ -0,0 +1,348 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/E2klime/HAXinceL2/internal/protocol"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+var ErrSessionClosed = errors.New("shell session closed")
+
+// maxSessionInput bounds the keystrokes of a session kept for its audit
+// record.
+const maxSessionInput = 4096
+
+// ShellSession is an interactive shell running in a PTY on a client,
+// multiplexed over the client's connection.
+type ShellSession struct {
+	ID       string
+	ClientID string
+
+	server *Server
+	client *ConnectedClient
+	output chan []byte
+	done   chan struct{}
+
+	operator string
+	shell    string
+	started  time.Time
+
+	// input is the start of what the operator typed, for the audit log.
+	inputMutex sync.Mutex
+	input      []byte
+	inputBytes int
+
+	exitCode int
+	reason   string
+	endOnce  sync.Once
+}
+
+// openSession starts shell (the client's default shell if empty) in a
+// cols x rows terminal on the client. The session lives until the shell
+// exits, Close is called, or the client disconnects; its end is audited on
+// behalf of operator with what was typed into it.
+func (s *Server) openSession(ctx context.Context, clientID, shell string, cols, rows int, operator string) (*ShellSession, error) {
+	client, err := s.lookupClient(clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	session := &ShellSession{
+		ID:       uuid.New().String(),
+		ClientID: clientID,
+		server:   s,
+		client:   client,
+		output:   make(chan []byte, 256),
+		done:     make(chan struct{}),
+		operator: operator,
+		shell:    shell,
+		started:  time.Now(),
+	}
+
+	// Register before asking so no early output is dropped.
+	s.sessionsMutex.Lock()
+	s.sessions[session.ID] = session
+	s.sessionsMutex.Unlock()
+
+	msg := protocol.NewSessionOpen(protocol.SessionOpenPayload{
+		SessionID: session.ID,
+		Shell:     shell,
+		Cols:      cols,
+		Rows:      rows,
+	})
+	msg.RequestID = session.ID
+
+	resp, err := s.request(ctx, clientID, msg)
+	if err == nil && resp.Type == protocol.TypeError {
+		var payload protocol.ErrorPayload
+		resp.Decode(&payload)
+		err = fmt.Errorf("client refused session: %s", payload.Message)
+	}
+	if err != nil {
+		s.sessionsMutex.Lock()
+		delete(s.sessions, session.ID)
+		s.sessionsMutex.Unlock()
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// Output yields terminal output until the session ends, then is closed.
+func (ss *ShellSession) Output() <-chan []byte {
+	return ss.output
+}
+
+// Done is closed once the session has ended.
+func (ss *ShellSession) Done() <-chan struct{} {
+	return ss.done
+}
+
+// ExitStatus returns the shell's exit code and, if the session ended
+// abnormally, why. It is only meaningful after Done is closed.
+func (ss *ShellSession) ExitStatus() (int, string) {
+	return ss.exitCode, ss.reason
+}
+
+// Write sends keystrokes to the shell.
+func (ss *ShellSession) Write(p []byte) (int, error) {
+	select {
+	case <-ss.done:
+		return 0, ErrSessionClosed
+	default:
+	}
+
+	msg := protocol.NewSessionStdin(protocol.SessionDataPayload{SessionID: ss.ID})
+	// The message sits in the send queue, so it must not alias the caller's
+	// buffer.
+	msg.Binary = bytes.Clone(p)
+	if err := ss.send(msg); err != nil {
+		return 0, err
+	}
+
+	ss.inputMutex.Lock()
+	if room := maxSessionInput - len(ss.input); room > 0 {
+		ss.input = append(ss.input, p[:min(room, len(p))]...)
+	}
+	ss.inputBytes += len(p)
+	ss.inputMutex.Unlock()
+	return len(p), nil
+}
+
+func (ss *ShellSession) Resize(cols, rows int) error {
+	return ss.send(protocol.NewSessionResize(protocol.SessionResizePayload{
+		SessionID: ss.ID,
+		Cols:      cols,
+		Rows:      rows,
+	}))
+}
+
+// Close kills the shell. The session ends when the client confirms.
+func (ss *ShellSession) Close() error {
+	select {
+	case <-ss.done:
+		return nil
+	default:
+	}
+
+	return ss.send(protocol.NewSessionClose(protocol.SessionClosePayload{SessionID: ss.ID}))
+}
+
+func (ss *ShellSession) send(msg *protocol.Message) error {
+	msg.RequestID = ss.ID
+	return ss.server.send(ss.client, msg)
+}
+
+func (ss *ShellSession) end(exitCode int, reason string) {
+	ss.endOnce.Do(func() {
+		ss.exitCode = exitCode
+		ss.reason = reason
+		close(ss.output)
+		close(ss.done)
+		ss.audit()
+	})
+}
+
+// audit records the end of the session, how long it lasted and what was
+// typed into it, including anything typed at password prompts.
+func (ss *ShellSession) audit() {
+	ss.inputMutex.Lock()
+	summary := fmt.Sprintf("exit %d, input %q", ss.exitCode, ss.input)
+	if ss.inputBytes > len(ss.input) {
+		summary += fmt.Sprintf(" +%d bytes", ss.inputBytes-len(ss.input))
+	}
+	ss.inputMutex.Unlock()
+
+	status := AuditOK
+	if ss.reason != "" {
+		status = AuditFailed
+	}
+	ss.server.audit(AuditRecord{
+		Operator:   ss.operator,
+		ClientID:   ss.ClientID,
+		Action:     "shell",
+		RequestID:  ss.ID,
+		Summary:    summary,
+		Status:     status,
+		Error:      ss.reason,
+		DurationMS: time.Since(ss.started).Milliseconds(),
+	})
+}
+
+func (s *Server) lookupSession(client *ConnectedClient, id string) *ShellSession {
+	s.sessionsMutex.Lock()
+	defer s.sessionsMutex.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok || session.client != client {
+		return nil
+	}
+	return session
+}
+
+// routeSessionOutput runs on the connection's read pump. It blocks while the
+// operator falls behind, which in turn stops reading from the client.
+func (s *Server) routeSessionOutput(client *ConnectedClient, msg *protocol.Message) {
+	var payload protocol.SessionDataPayload
+	if err := msg.Decode(&payload); err != nil {
+		return
+	}
+
+	session := s.lookupSession(client, payload.SessionID)
+	if session == nil {
+		return
+	}
+
+	select {
+	case session.output <- msg.Binary:
+	case <-client.done:
+	}
+}
+
+func (s *Server) closeSession(client *ConnectedClient, msg *protocol.Message) {
+	var payload protocol.SessionClosePayload
+	if err := msg.Decode(&payload); err != nil {
+		return
+	}
+
+	session := s.lookupSession(client, payload.SessionID)
+	if session == nil {
+		return
+	}
+
+	s.sessionsMutex.Lock()
+	delete(s.sessions, session.ID)
+	s.sessionsMutex.Unlock()
+
+	session.end(payload.ExitCode, payload.Reason)
+}
+
+// failSessions ends every session on a connection that went away.
+func (s *Server) failSessions(client *ConnectedClient) {
+	var failed []*ShellSession
+	s.sessionsMutex.Lock()
+	for id, session := range s.sessions {
+		if session.client == client {
+			delete(s.sessions, id)
+			failed = append(failed, session)
+		}
+	}
+	s.sessionsMutex.Unlock()
+
+	// Ended outside the lock: ending a session writes its audit record.
+	for _, session := range failed {
+		session.end(-1, "client disconnected")
+	}
+}
+
+// HandleShell attaches an operator WebSocket to a new shell session on the
+// client named by the "client" query parameter. "cols", "rows" and "shell"
+// are optional. The operator needs PermShell on the client.
+func (s *Server) HandleShell(w http.ResponseWriter, r *http.Request) {
+	op, ok := s.authenticateOperator(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	clientID := query.Get("client")
+	if clientID == "" {
+		http.Error(w, "client parameter is required", http.StatusBadRequest)
+		return
+	}
+	cols, _ := strconv.Atoi(query.Get("cols"))
+	rows, _ := strconv.Atoi(query.Get("rows"))
+
+	session, err := op.OpenSession(r.Context(), clientID, query.Get("shell"), cols, rows)
+	if errors.Is(err, ErrForbidden) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Shell upgrade error: %v", err)
+		session.Close()
+		return
+	}
+	defer conn.Close()
+
+	log.Printf("Operator %s (%s) attached to shell %s on client %s", op.ID, r.RemoteAddr, session.ID, clientID)
+
+	go func() {
+		// The operator went away: kill the shell, which ends Output below.
+		defer session.Close()
+
+		for {
+			frameType, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+
+			switch frameType {
+			case websocket.BinaryMessage:
+				if _, err := session.Write(data); err != nil {
+					return
+				}
+			case websocket.TextMessage:
+				var ctrl protocol.ShellControl
+				if json.Unmarshal(data, &ctrl) == nil && ctrl.Type == protocol.ShellResize {
+					session.Resize(ctrl.Cols, ctrl.Rows)
+				}
+			}
+		}
+	}()
+
+	for data := range session.Output() {
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if err := conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+			session.Close()
+			break
+		}
+	}
+	<-session.Done()
+
+	exitCode, reason := session.ExitStatus()
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	conn.WriteJSON(protocol.ShellControl{Type: protocol.ShellExit, ExitCode: exitCode, Reason: reason})
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+
+	log.Printf("Shell %s on client %s ended (exit %d)", session.ID, clientID, exitCode)
+}
@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// LoadServerTLS builds the server TLS configuration. When clientCAFile is set,
+// client certificates signed by that CA are verified; whether one is required
+// is decided per endpoint (see WithClientCertAuth), so /health and operator
+// endpoints stay reachable without one.
+func LoadServerTLS(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load server certificate: %w", err)
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if clientCAFile != "" {
+		pool, err := loadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return cfg, nil
+}
+
+// LoadClientTLS builds the client TLS configuration. caFile pins the CA the
+// server certificate must chain to instead of the system roots; certFile and
+// keyFile supply the client certificate for mutual TLS.
+func LoadClientTLS(caFile, certFile, keyFile string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("both client certificate and key are required")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+// CertificateIdentity returns the common name of the client certificate in
+// cfg, or "" if there is none.
+func CertificateIdentity(cfg *tls.Config) (string, error) {
+	if cfg == nil || len(cfg.Certificates) == 0 {
+		return "", nil
+	}
+
+	leaf := cfg.Certificates[0].Leaf
+	if leaf == nil {
+		var err error
+		leaf, err = x509.ParseCertificate(cfg.Certificates[0].Certificate[0])
+		if err != nil {
+			return "", fmt.Errorf("failed to parse client certificate: %w", err)
+		}
+	}
+
+	return leaf.Subject.CommonName, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+
+	return pool, nil
+}
+
+// peerIdentity returns the common name of the verified client certificate on
+// the request, or "" if the peer did not present one.
+func peerIdentity(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
@@ -0,0 +1,184 @@
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTokenNotFound   = errors.New("enrollment token not found")
+	ErrInvalidClientID = errors.New("invalid client id")
+)
+
+type EnrollmentToken struct {
+	ClientID  string    `json:"client_id"`
+	Secret    string    `json:"secret"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TokenStore holds the per-client enrollment secrets used to authenticate
+// handshakes. It is persisted as a JSON file readable only by the owner.
+type TokenStore struct {
+	path   string
+	mutex  sync.RWMutex
+	tokens map[string]*EnrollmentToken
+}
+
+func NewTokenStore(path string) (*TokenStore, error) {
+	ts := &TokenStore{
+		path:   path,
+		tokens: make(map[string]*EnrollmentToken),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ts, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token store: %w", err)
+	}
+
+	var tokens []*EnrollmentToken
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("failed to parse token store %s: %w", path, err)
+	}
+	for _, t := range tokens {
+		ts.tokens[t.ClientID] = t
+	}
+
+	return ts, nil
+}
+
+// Mint creates a new secret for clientID, replacing any previous one. The
+// ID must be non-empty and free of ':', which separates it from the secret
+// in the enrollment token.
+func (ts *TokenStore) Mint(clientID string) (*EnrollmentToken, error) {
+	if clientID == "" || strings.Contains(clientID, ":") {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidClientID, clientID)
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, fmt.Errorf("failed to generate secret: %w", err)
+	}
+
+	token := &EnrollmentToken{
+		ClientID:  clientID,
+		Secret:    hex.EncodeToString(buf),
+		CreatedAt: time.Now(),
+	}
+
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	prev := ts.tokens[clientID]
+	ts.tokens[clientID] = token
+	if err := ts.save(); err != nil {
+		if prev != nil {
+			ts.tokens[clientID] = prev
+		} else {
+			delete(ts.tokens, clientID)
+		}
+		return nil, err
+	}
+
+	return token, nil
+}
+
+func (ts *TokenStore) Revoke(clientID string) error {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	prev, ok := ts.tokens[clientID]
+	if !ok {
+		return ErrTokenNotFound
+	}
+
+	delete(ts.tokens, clientID)
+	if err := ts.save(); err != nil {
+		ts.tokens[clientID] = prev
+		return err
+	}
+
+	return nil
+}
+
+func (ts *TokenStore) Secret(clientID string) (string, bool) {
+	ts.mutex.RLock()
+	defer ts.mutex.RUnlock()
+
+	t, ok := ts.tokens[clientID]
+	if !ok {
+		return "", false
+	}
+	return t.Secret, true
+}
+
+func (ts *TokenStore) List() []EnrollmentToken {
+	ts.mutex.RLock()
+	defer ts.mutex.RUnlock()
+
+	tokens := make([]EnrollmentToken, 0, len(ts.tokens))
+	for _, t := range ts.tokens {
+		tokens = append(tokens, *t)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.Before(tokens[j].CreatedAt)
+	})
+	return tokens
+}
+
+func (ts *TokenStore) save() error {
+	tokens := make([]*EnrollmentToken, 0, len(ts.tokens))
+	for _, t := range ts.tokens {
+		tokens = append(tokens, t)
+	}
+
+	data, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(ts.path, data, 0600)
+}
+
+// writeFileAtomic replaces path with data via a temporary file and rename so
+// a crash never leaves a truncated file behind.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", dir, err)
+	}
+
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
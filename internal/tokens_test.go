@@ -0,0 +1,53 @@
+package internal
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/E2klime/HAXinceL2/internal/protocol"
+)
+
+func TestMint(t *testing.T) {
+	tests := []struct {
+		clientID string
+		wantErr  bool
+	}{
+		{clientID: "c1"},
+		{clientID: "web1.example.com"},
+		{clientID: "", wantErr: true},
+		{clientID: "host:8080", wantErr: true},
+		{clientID: ":", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.clientID, func(t *testing.T) {
+			ts, err := NewTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			token, err := ts.Mint(tt.clientID)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidClientID) {
+					t.Fatalf("Mint error = %v, want %v", err, ErrInvalidClientID)
+				}
+				if _, ok := ts.Secret(tt.clientID); ok {
+					t.Error("Mint stored a secret for an invalid id")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			clientID, secret, err := protocol.ParseEnrollmentToken(protocol.FormatEnrollmentToken(token.ClientID, token.Secret))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if clientID != tt.clientID || secret != token.Secret {
+				t.Errorf("token parsed as %q %q, want %q %q", clientID, secret, tt.clientID, token.Secret)
+			}
+		})
+	}
+}
@@ -0,0 +1,663 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/E2klime/HAXinceL2/internal/protocol"
+	"github.com/google/uuid"
+)
+
+const (
+	TransferChunkSize = 256 << 10
+
+	// At most this many chunks are in flight per transfer, so a large
+	// transfer never fills the connection's send buffer ahead of heartbeats
+	// and other requests.
+	transferWindow = 4
+	// Hashing a multi-GB file at the end of a transfer takes a while.
+	transferEndTimeout = 30 * time.Minute
+
+	transferSweepInterval = time.Minute
+	// Finished transfers are kept this long so operators can look them up.
+	// Downloaded files stay in the transfer directory.
+	transferRetention = 24 * time.Hour
+)
+
+type TransferStatus string
+
+const (
+	TransferRunning   TransferStatus = "running"
+	TransferPaused    TransferStatus = "paused"
+	TransferCompleted TransferStatus = "completed"
+	TransferFailed    TransferStatus = "failed"
+	TransferCancelled TransferStatus = "cancelled"
+)
+
+var ErrTransferNotFound = errors.New("transfer not found")
+
+// Transfer is a chunked file copy between the server and a client. Transfers
+// interrupted by a disconnect are paused and resume from the last
+// acknowledged chunk when the client reconnects.
+type Transfer struct {
+	ID         string         `json:"id"`
+	ClientID   string         `json:"client_id"`
+	Direction  string         `json:"direction"`
+	RemotePath string         `json:"remote_path"`
+	LocalPath  string         `json:"local_path"`
+	Origin     string         `json:"origin,omitempty"`
+	Operator   string         `json:"operator,omitempty"`
+	Size       int64          `json:"size"`
+	Done       int64          `json:"done"`
+	SHA256     string         `json:"sha256,omitempty"`
+	Status     TransferStatus `json:"status"`
+	Error      string         `json:"error,omitempty"`
+	CreatedAt  time.Time      `json:"created_at"`
+	UpdatedAt  time.Time      `json:"updated_at"`
+
+	mode     uint32
+	modTime  int64
+	cancel   context.CancelFunc
+	finished chan struct{}
+}
+
+func (t *Transfer) Finished() bool {
+	return t.Status == TransferCompleted || t.Status == TransferFailed || t.Status == TransferCancelled
+}
+
+// startDownload copies remotePath from the client into the server's transfer
+// directory. It returns immediately; use waitTransfer for the outcome.
+// Downloads from offline clients start when they next connect.
+func (s *Server) startDownload(clientID, remotePath, origin, operator string) (Transfer, error) {
+	if err := os.MkdirAll(s.transferDir, 0700); err != nil {
+		return Transfer{}, fmt.Errorf("create transfer directory: %w", err)
+	}
+
+	id := uuid.New().String()
+	t := &Transfer{
+		ID:         id,
+		Direction:  protocol.TransferDownload,
+		RemotePath: remotePath,
+		LocalPath:  filepath.Join(s.transferDir, id[:8]+"-"+remoteBase(remotePath)),
+		Operator:   operator,
+	}
+
+	return s.startTransfer(clientID, origin, t)
+}
+
+// startUpload copies localPath on the server to remotePath on the client,
+// creating it with mode (0644 if zero).
+func (s *Server) startUpload(clientID, localPath, remotePath string, mode uint32, origin, operator string) (Transfer, error) {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return Transfer{}, err
+	}
+	if info.IsDir() {
+		return Transfer{}, fmt.Errorf("%s is a directory", localPath)
+	}
+
+	t := &Transfer{
+		ID:         uuid.New().String(),
+		Direction:  protocol.TransferUpload,
+		RemotePath: remotePath,
+		LocalPath:  localPath,
+		Size:       info.Size(),
+		Operator:   operator,
+		mode:       mode,
+	}
+
+	return s.startTransfer(clientID, origin, t)
+}
+
+func (s *Server) startTransfer(clientID, origin string, t *Transfer) (Transfer, error) {
+	_, err := s.lookupClient(clientID)
+	if err != nil {
+		if _, invErr := s.inventory.Get(clientID); invErr != nil {
+			return Transfer{}, err
+		}
+	}
+	online := err == nil
+
+	now := time.Now()
+	t.ClientID = clientID
+	t.Origin = origin
+	t.Status = TransferPaused
+	t.CreatedAt = now
+	t.UpdatedAt = now
+	t.finished = make(chan struct{})
+
+	s.transfersMutex.Lock()
+	s.transfers[t.ID] = t
+	if online {
+		t.Status = TransferRunning
+	}
+	snapshot := *t
+	s.transfersMutex.Unlock()
+
+	if online {
+		go s.runTransfer(t)
+	}
+
+	log.Printf("Transfer %s (%s) queued: %s on client %s", t.ID, t.Direction, t.RemotePath, clientID)
+	return snapshot, nil
+}
+
+// listTransfers lists the transfers of clientID, or of all clients when it is
+// empty, oldest first.
+func (s *Server) listTransfers(clientID string) []Transfer {
+	s.transfersMutex.Lock()
+	defer s.transfersMutex.Unlock()
+
+	var transfers []Transfer
+	for _, t := range s.transfers {
+		if clientID == "" || t.ClientID == clientID {
+			transfers = append(transfers, *t)
+		}
+	}
+
+	sort.Slice(transfers, func(i, j int) bool {
+		return transfers[i].CreatedAt.Before(transfers[j].CreatedAt)
+	})
+	return transfers
+}
+
+func (s *Server) lookupTransfer(id string) (Transfer, error) {
+	s.transfersMutex.Lock()
+	defer s.transfersMutex.Unlock()
+
+	t, ok := s.transfers[id]
+	if !ok {
+		return Transfer{}, ErrTransferNotFound
+	}
+	return *t, nil
+}
+
+// waitTransfer blocks until the transfer completes, fails or is cancelled.
+// A paused transfer keeps the caller waiting until its client reconnects.
+func (s *Server) waitTransfer(ctx context.Context, id string) (Transfer, error) {
+	s.transfersMutex.Lock()
+	t, ok := s.transfers[id]
+	s.transfersMutex.Unlock()
+	if !ok {
+		return Transfer{}, ErrTransferNotFound
+	}
+
+	select {
+	case <-t.finished:
+		return s.lookupTransfer(id)
+	case <-ctx.Done():
+		return Transfer{}, ctx.Err()
+	}
+}
+
+// cancelTransfer stops a transfer and discards its partial data.
+func (s *Server) cancelTransfer(id string) (Transfer, error) {
+	s.transfersMutex.Lock()
+	t, ok := s.transfers[id]
+	if !ok {
+		s.transfersMutex.Unlock()
+		return Transfer{}, ErrTransferNotFound
+	}
+	if t.Finished() {
+		s.transfersMutex.Unlock()
+		return Transfer{}, fmt.Errorf("transfer already %s", t.Status)
+	}
+
+	t.Status = TransferCancelled
+	t.UpdatedAt = time.Now()
+	if t.cancel != nil {
+		t.cancel()
+	}
+	close(t.finished)
+	snapshot := *t
+	s.transfersMutex.Unlock()
+	s.auditTransfer(&snapshot)
+
+	if t.Direction == protocol.TransferDownload {
+		os.Remove(t.LocalPath + ".part")
+	} else {
+		go s.abortUpload(snapshot)
+	}
+
+	log.Printf("Transfer %s cancelled", id)
+	return snapshot, nil
+}
+
+func (s *Server) runTransferSweeper() {
+	ticker := time.NewTicker(transferSweepInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.sweepTransfers()
+	}
+}
+
+// sweepTransfers forgets transfers that finished more than transferRetention
+// ago.
+func (s *Server) sweepTransfers() {
+	s.transfersMutex.Lock()
+	defer s.transfersMutex.Unlock()
+
+	now := time.Now()
+	for id, t := range s.transfers {
+		if t.Finished() && now.Sub(t.UpdatedAt) > transferRetention {
+			delete(s.transfers, id)
+		}
+	}
+}
+
+func (s *Server) abortUpload(t Transfer) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	msg := protocol.NewTransferAbort(protocol.TransferAbortPayload{
+		TransferID: t.ID,
+		Path:       t.RemotePath,
+	})
+	if _, err := s.request(ctx, t.ClientID, msg); err != nil {
+		log.Printf("Failed to discard partial upload %s on client %s: %v", t.ID, t.ClientID, err)
+	}
+}
+
+// resumeTransfers restarts the paused transfers of a client that just
+// connected.
+func (s *Server) resumeTransfers(client *ConnectedClient) {
+	s.transfersMutex.Lock()
+	defer s.transfersMutex.Unlock()
+
+	for _, t := range s.transfers {
+		if t.ClientID == client.ID && t.Status == TransferPaused {
+			t.Status = TransferRunning
+			t.UpdatedAt = time.Now()
+			go s.runTransfer(t)
+		}
+	}
+}
+
+func (s *Server) runTransfer(t *Transfer) {
+	for {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		s.transfersMutex.Lock()
+		if t.Status == TransferCancelled {
+			s.transfersMutex.Unlock()
+			cancel()
+			return
+		}
+		t.cancel = cancel
+		s.transfersMutex.Unlock()
+
+		var err error
+		if t.Direction == protocol.TransferDownload {
+			err = s.download(ctx, t)
+		} else {
+			err = s.upload(ctx, t)
+		}
+		cancel()
+
+		if !s.settleTransfer(t, err) {
+			return
+		}
+	}
+}
+
+// settleTransfer records the outcome of a transfer attempt. It reports
+// whether the transfer should be retried right away because its client has
+// already reconnected.
+func (s *Server) settleTransfer(t *Transfer, err error) bool {
+	s.transfersMutex.Lock()
+	defer s.transfersMutex.Unlock()
+
+	if t.Status == TransferCancelled {
+		return false
+	}
+
+	t.cancel = nil
+	t.UpdatedAt = time.Now()
+
+	switch {
+	case err == nil:
+		t.Status = TransferCompleted
+		log.Printf("Transfer %s completed: %s (%d bytes)", t.ID, t.RemotePath, t.Size)
+
+	case errors.Is(err, ErrClientDisconnected) || !s.isOnline(t.ClientID):
+		// The status change and resumeTransfers are both made under
+		// transfersMutex, so a reconnect cannot slip in between.
+		if s.isOnline(t.ClientID) {
+			return true
+		}
+		t.Status = TransferPaused
+		log.Printf("Transfer %s paused at %d/%d bytes: %v", t.ID, t.Done, t.Size, err)
+		return false
+
+	default:
+		t.Status = TransferFailed
+		t.Error = err.Error()
+		log.Printf("Transfer %s failed: %v", t.ID, err)
+	}
+
+	s.auditTransfer(t)
+	close(t.finished)
+	return false
+}
+
+func (s *Server) isOnline(clientID string) bool {
+	_, err := s.lookupClient(clientID)
+	return err == nil
+}
+
+func (s *Server) setTransferProgress(t *Transfer, update func()) {
+	s.transfersMutex.Lock()
+	update()
+	t.UpdatedAt = time.Now()
+	s.transfersMutex.Unlock()
+}
+
+func (s *Server) download(ctx context.Context, t *Transfer) error {
+	var state protocol.TransferStatePayload
+	err := s.transferRequest(ctx, t.ClientID, protocol.NewTransferStart(protocol.TransferStartPayload{
+		TransferID: t.ID,
+		Direction:  t.Direction,
+		Path:       t.RemotePath,
+	}), &state)
+	if err != nil {
+		return err
+	}
+
+	s.setTransferProgress(t, func() {
+		if t.Done > 0 && (state.Size != t.Size || state.ModTime != t.modTime) {
+			log.Printf("Transfer %s: %s changed on the client, starting over", t.ID, t.RemotePath)
+			t.Done = 0
+		}
+		t.Size = state.Size
+		t.modTime = state.ModTime
+	})
+
+	part := t.LocalPath + ".part"
+	f, err := os.OpenFile(part, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	start := t.Done
+	if err := f.Truncate(start); err != nil {
+		return err
+	}
+
+	err = s.pipelineChunks(ctx, t.ClientID, start, t.Size,
+		func(offset int64, length int) (*protocol.Message, error) {
+			return protocol.NewTransferChunk(protocol.TransferChunkPayload{
+				TransferID: t.ID,
+				Direction:  t.Direction,
+				Path:       t.RemotePath,
+				Offset:     offset,
+				Length:     length,
+			}), nil
+		},
+		func(offset int64, length int, data string, content []byte) error {
+			var chunk protocol.TransferChunkPayload
+			if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+				return fmt.Errorf("parse chunk at %d: %w", offset, err)
+			}
+			if chunk.Offset != offset || len(content) != length {
+				return fmt.Errorf("short chunk at %d: got %d bytes, want %d (file changed?)", offset, len(content), length)
+			}
+			if sha256Hex(content) != chunk.SHA256 {
+				return fmt.Errorf("chunk checksum mismatch at offset %d", offset)
+			}
+			if _, err := f.WriteAt(content, offset); err != nil {
+				return err
+			}
+			s.setTransferProgress(t, func() { t.Done = offset + int64(length) })
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	endCtx, cancel := context.WithTimeout(ctx, transferEndTimeout)
+	defer cancel()
+
+	var remoteSum string
+	err = s.transferRequest(endCtx, t.ClientID, protocol.NewTransferEnd(protocol.TransferEndPayload{
+		TransferID: t.ID,
+		Direction:  t.Direction,
+		Path:       t.RemotePath,
+	}), &remoteSum)
+	if err != nil {
+		return err
+	}
+
+	localSum, err := hashFile(part)
+	if err != nil {
+		return err
+	}
+	if localSum != remoteSum {
+		// Corrupt data must not be resumed from.
+		s.setTransferProgress(t, func() { t.Done = 0 })
+		os.Remove(part)
+		return fmt.Errorf("file checksum mismatch: got %s, client has %s", localSum, remoteSum)
+	}
+
+	if err := os.Rename(part, t.LocalPath); err != nil {
+		return err
+	}
+
+	s.setTransferProgress(t, func() { t.SHA256 = localSum })
+	return nil
+}
+
+func (s *Server) upload(ctx context.Context, t *Transfer) error {
+	f, err := os.Open(t.LocalPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if t.SHA256 == "" {
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return err
+		}
+		sum := hex.EncodeToString(h.Sum(nil))
+		s.setTransferProgress(t, func() { t.SHA256 = sum })
+	}
+
+	var state protocol.TransferStatePayload
+	err = s.transferRequest(ctx, t.ClientID, protocol.NewTransferStart(protocol.TransferStartPayload{
+		TransferID: t.ID,
+		Direction:  t.Direction,
+		Path:       t.RemotePath,
+		Size:       t.Size,
+		Offset:     t.Done,
+	}), &state)
+	if err != nil {
+		return err
+	}
+
+	s.setTransferProgress(t, func() { t.Done = state.Offset })
+
+	err = s.pipelineChunks(ctx, t.ClientID, state.Offset, t.Size,
+		func(offset int64, length int) (*protocol.Message, error) {
+			buf := make([]byte, length)
+			if _, err := f.ReadAt(buf, offset); err != nil && !errors.Is(err, io.EOF) {
+				return nil, err
+			}
+			msg := protocol.NewTransferChunk(protocol.TransferChunkPayload{
+				TransferID: t.ID,
+				Direction:  t.Direction,
+				Path:       t.RemotePath,
+				Offset:     offset,
+				SHA256:     sha256Hex(buf),
+			})
+			msg.Binary = buf
+			return msg, nil
+		},
+		func(offset int64, length int, data string, content []byte) error {
+			s.setTransferProgress(t, func() { t.Done = offset + int64(length) })
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+
+	endCtx, cancel := context.WithTimeout(ctx, transferEndTimeout)
+	defer cancel()
+
+	err = s.transferRequest(endCtx, t.ClientID, protocol.NewTransferEnd(protocol.TransferEndPayload{
+		TransferID: t.ID,
+		Direction:  t.Direction,
+		Path:       t.RemotePath,
+		SHA256:     t.SHA256,
+		Mode:       t.mode,
+	}), nil)
+	if err != nil && !errors.Is(err, ErrClientDisconnected) && s.isOnline(t.ClientID) {
+		// The client discards a corrupt upload, so start over next time.
+		s.setTransferProgress(t, func() { t.Done = 0 })
+	}
+	return err
+}
+
+// pipelineChunks requests the chunks covering [start, size) with up to
+// transferWindow requests in flight and hands the replies to handle in
+// offset order, so progress only ever advances over contiguous data.
+func (s *Server) pipelineChunks(ctx context.Context, clientID string, start, size int64,
+	build func(offset int64, length int) (*protocol.Message, error),
+	handle func(offset int64, length int, data string, content []byte) error) error {
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type chunkResult struct {
+		offset int64
+		length int
+		resp   *protocol.Message
+		err    error
+	}
+
+	inflight := make(chan chan chunkResult, transferWindow)
+
+	go func() {
+		defer close(inflight)
+
+		for offset := start; offset < size && ctx.Err() == nil; offset += TransferChunkSize {
+			length := int(min(TransferChunkSize, size-offset))
+			result := make(chan chunkResult, 1)
+
+			select {
+			case inflight <- result:
+			case <-ctx.Done():
+				return
+			}
+
+			msg, err := build(offset, length)
+			if err != nil {
+				result <- chunkResult{err: err}
+				return
+			}
+
+			go func(offset int64, length int) {
+				resp, err := s.request(ctx, clientID, msg)
+				result <- chunkResult{offset: offset, length: length, resp: resp, err: err}
+			}(offset, length)
+		}
+	}()
+
+	for result := range inflight {
+		r := <-result
+		if r.err == nil {
+			var data string
+			if data, r.err = replyData(r.resp); r.err == nil {
+				r.err = handle(r.offset, r.length, data, r.resp.Binary)
+			}
+		}
+		if r.err != nil {
+			cancel()
+			for range inflight {
+			}
+			return r.err
+		}
+	}
+
+	return ctx.Err()
+}
+
+// transferRequest sends a transfer message and decodes the reply's data into
+// out: a *string takes it verbatim, anything else is JSON-decoded.
+func (s *Server) transferRequest(ctx context.Context, clientID string, msg *protocol.Message, out interface{}) error {
+	resp, err := s.request(ctx, clientID, msg)
+	if err != nil {
+		return err
+	}
+
+	data, err := replyData(resp)
+	if err != nil {
+		return err
+	}
+
+	switch out := out.(type) {
+	case nil:
+		return nil
+	case *string:
+		*out = data
+		return nil
+	default:
+		return json.Unmarshal([]byte(data), out)
+	}
+}
+
+// replyData extracts ResponsePayload.Data from a successful reply and turns
+// error replies into errors.
+func replyData(resp *protocol.Message) (string, error) {
+	if resp.Type == protocol.TypeError {
+		var payload protocol.ErrorPayload
+		if err := resp.Decode(&payload); err != nil {
+			return "", fmt.Errorf("malformed error reply: %w", err)
+		}
+		switch payload.Code {
+		case protocol.ErrorCodePolicyDenied:
+			return "", fmt.Errorf("%w: %s", ErrClientPolicy, payload.Message)
+		case protocol.ErrorCodeConsentDenied:
+			return "", fmt.Errorf("%w: %s", ErrClientConsent, payload.Message)
+		}
+		return "", errors.New(payload.Message)
+	}
+
+	var payload protocol.ResponsePayload
+	if err := resp.Decode(&payload); err != nil {
+		return "", fmt.Errorf("malformed response: %w", err)
+	}
+	if !payload.Success {
+		return "", errors.New(payload.Error)
+	}
+	return payload.Data, nil
+}
+
+// remoteBase returns the last element of a client path, which may use either
+// separator regardless of the server's OS.
+func remoteBase(path string) string {
+	path = strings.TrimRight(path, `/\`)
+	if i := strings.LastIndexAny(path, `/\`); i >= 0 {
+		path = path[i+1:]
+	}
+	if path == "" || path == "." || path == ".." || strings.HasSuffix(path, ":") {
+		return "file"
+	}
+	return path
+}
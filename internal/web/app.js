@@ -0,0 +1,494 @@
+"use strict";
+
+// The dashboard talks only to /api/v1 and authenticates every request with
+// the operator token kept in sessionStorage.
+
+const API = "/api/v1";
+const TOKEN_KEY = "operatorToken";
+const REGISTRY_ROOTS = ["HKLM", "HKCU", "HKCR", "HKU", "HKCC"];
+
+const state = {
+  clients: new Map(),
+  client: null,
+  jobs: new Map(),
+  tab: "files",
+  path: "",
+  events: null,
+};
+
+const $ = (id) => document.getElementById(id);
+
+function el(tag, props, ...children) {
+  const node = document.createElement(tag);
+  Object.assign(node, props || {});
+  for (const child of children) {
+    if (child != null) node.append(child);
+  }
+  return node;
+}
+
+function setStatus(text) {
+  $("status").textContent = text || "";
+}
+
+function formatTime(value) {
+  const date = typeof value === "number" ? new Date(value * 1000) : new Date(value);
+  return isNaN(date) || date.getFullYear() < 2000 ? "-" : date.toLocaleString();
+}
+
+function formatSize(bytes) {
+  const units = ["B", "KB", "MB", "GB", "TB"];
+  let i = 0;
+  while (bytes >= 1024 && i < units.length - 1) {
+    bytes /= 1024;
+    i++;
+  }
+  return (i ? bytes.toFixed(1) : bytes) + " " + units[i];
+}
+
+// --- API -------------------------------------------------------------------
+
+class AuthError extends Error {}
+
+async function api(method, path, body) {
+  const resp = await fetch(API + path, {
+    method,
+    headers: {
+      Authorization: "Bearer " + sessionStorage.getItem(TOKEN_KEY),
+      "Content-Type": "application/json",
+    },
+    body: body === undefined ? undefined : JSON.stringify(body),
+  });
+  if (resp.status === 401) {
+    logout();
+    throw new AuthError("Требуется вход");
+  }
+  const data = await resp.json();
+  if (!resp.ok) throw new Error(data.error || resp.statusText);
+  return data;
+}
+
+// operation submits one protocol message and waits for its result. It
+// resolves with the client's response: {data, binary, exitCode}.
+async function operation(type, payload, binary) {
+  const clientID = state.client;
+  let item = await api("POST", `/clients/${encodeURIComponent(clientID)}/operations`, {
+    type, payload, binary, wait: 30,
+  });
+  // Operations held for a second operator come back as an approval.
+  if (item.status === "pending") throw new Error(`Ожидает подтверждения второго оператора (${item.id.slice(0, 8)})`);
+  while (item.status === "queued" || item.status === "sent") {
+    item = await api("GET", `/jobs/${item.id}?wait=30`);
+  }
+  if (item.status !== "completed") throw new Error(`Задача ${item.status}`);
+
+  const result = item.result;
+  if (result.type === "error") throw new Error(result.payload.message);
+  const resp = result.payload;
+  if (!resp.success && type !== "command") throw new Error(resp.error || "ошибка");
+  return { data: resp.data || "", error: resp.error || "", binary: result.binary, exitCode: resp.exit_code || 0 };
+}
+
+// --- Live events -------------------------------------------------------------
+
+// EventSource cannot send an Authorization header, so the stream is read
+// with fetch instead.
+async function watchEvents() {
+  const controller = new AbortController();
+  state.events = controller;
+
+  while (!controller.signal.aborted) {
+    try {
+      const resp = await fetch(API + "/events", {
+        headers: { Authorization: "Bearer " + sessionStorage.getItem(TOKEN_KEY) },
+        signal: controller.signal,
+      });
+      if (resp.status === 401) return logout();
+      if (!resp.ok) throw new Error(resp.statusText);
+
+      $("live").classList.add("on");
+      const reader = resp.body.pipeThrough(new TextDecoderStream()).getReader();
+      let buffer = "";
+      for (;;) {
+        const { value, done } = await reader.read();
+        if (done) break;
+        buffer += value;
+        let end;
+        while ((end = buffer.indexOf("\n\n")) >= 0) {
+          handleEvent(buffer.slice(0, end));
+          buffer = buffer.slice(end + 2);
+        }
+      }
+    } catch (err) {
+      if (controller.signal.aborted) return;
+    }
+    $("live").classList.remove("on");
+    await new Promise((resolve) => setTimeout(resolve, 3000));
+  }
+}
+
+function handleEvent(block) {
+  let type = "";
+  let data = "";
+  for (const line of block.split("\n")) {
+    if (line.startsWith("event: ")) type = line.slice(7);
+    else if (line.startsWith("data: ")) data += line.slice(6);
+  }
+  if (!data) return;
+  const value = JSON.parse(data);
+
+  if (type === "client") {
+    state.clients.set(value.id, value);
+    renderClients();
+    if (value.id === state.client) renderClientInfo();
+  } else if (type === "job" && value.client_id === state.client) {
+    state.jobs.set(value.id, value);
+    renderJobs();
+  }
+}
+
+// --- Login -----------------------------------------------------------------
+
+function logout() {
+  sessionStorage.removeItem(TOKEN_KEY);
+  if (state.events) state.events.abort();
+  state.events = null;
+  route();
+}
+
+$("login-form").addEventListener("submit", async (e) => {
+  e.preventDefault();
+  sessionStorage.setItem(TOKEN_KEY, $("token").value);
+  $("login-error").textContent = "";
+  try {
+    await api("GET", "/clients");
+    $("token").value = "";
+    route();
+  } catch (err) {
+    $("login-error").textContent = "Неверный токен";
+  }
+});
+
+$("logout").addEventListener("click", logout);
+
+// --- Client table ----------------------------------------------------------
+
+async function loadClients() {
+  const records = await api("GET", "/clients");
+  state.clients = new Map(records.map((rec) => [rec.id, rec]));
+  renderClients();
+}
+
+function renderClients() {
+  const rows = [...state.clients.values()].sort((a, b) =>
+    (b.online - a.online) || a.hostname.localeCompare(b.hostname));
+
+  $("client-rows").replaceChildren(...rows.map((rec) => {
+    const row = el("tr", { className: "clickable", title: rec.online ? "онлайн" : "офлайн" },
+      el("td", {}, el("span", { className: "dot" + (rec.online ? " online" : "") })),
+      el("td", { className: "mono", textContent: rec.id }),
+      el("td", { textContent: rec.hostname }),
+      el("td", { textContent: rec.username }),
+      el("td", { textContent: rec.os }),
+      el("td", { textContent: rec.agent_version || "-" }),
+      el("td", { textContent: rec.online ? "онлайн" : formatTime(rec.last_seen) }));
+    row.addEventListener("click", () => { location.hash = "#/client/" + encodeURIComponent(rec.id); });
+    return row;
+  }));
+}
+
+// --- Client page -----------------------------------------------------------
+
+function currentClient() {
+  return state.clients.get(state.client) || { id: state.client, capabilities: [] };
+}
+
+function supports(capability) {
+  const rec = currentClient();
+  return !rec.protocol_version || (rec.capabilities || []).includes(capability);
+}
+
+function renderClientInfo() {
+  const rec = currentClient();
+  $("client-title").textContent = `${rec.hostname || rec.id} (${rec.id})`;
+  $("client-info").textContent = [
+    rec.online ? "онлайн" : "офлайн с " + formatTime(rec.last_seen),
+    `${rec.username || "?"} · ${rec.os || "?"}`,
+    "агент " + (rec.agent_version || "-"),
+  ].join(" · ");
+}
+
+async function openClient(id) {
+  if (state.client !== id) {
+    state.client = id;
+    state.path = "";
+    state.jobs = new Map();
+    $("console-output").textContent = "";
+    $("reg-tree").replaceChildren();
+    $("file-rows").replaceChildren();
+  }
+  if (!state.clients.has(id)) await loadClients();
+  renderClientInfo();
+
+  for (const button of document.querySelectorAll(".tabs button")) {
+    const tab = button.dataset.tab;
+    button.hidden = (tab === "registry" && !supports("registry")) ||
+      (tab === "files" && !supports("files")) ||
+      (tab === "console" && !supports("exec"));
+  }
+  const visible = [...document.querySelectorAll(".tabs button")].filter((b) => !b.hidden);
+  if (!visible.some((b) => b.dataset.tab === state.tab)) state.tab = "jobs";
+  showTab(state.tab);
+}
+
+function showTab(tab) {
+  state.tab = tab;
+  for (const button of document.querySelectorAll(".tabs button")) {
+    button.classList.toggle("active", button.dataset.tab === tab);
+  }
+  for (const panel of document.querySelectorAll(".tab")) {
+    panel.classList.toggle("active", panel.id === "tab-" + tab);
+  }
+
+  if (tab === "files" && !$("file-rows").children.length) {
+    listFiles(state.path || (currentClient().os === "windows" ? "C:\\" : "/"));
+  } else if (tab === "registry" && !$("reg-tree").children.length) {
+    renderRegistryRoots();
+  } else if (tab === "jobs") {
+    loadJobs().catch((err) => setStatus(err.message));
+  } else if (tab === "console") {
+    $("console-input").focus();
+  }
+}
+
+for (const button of document.querySelectorAll(".tabs button")) {
+  button.addEventListener("click", () => showTab(button.dataset.tab));
+}
+
+// --- Files -----------------------------------------------------------------
+
+function parentPath(path) {
+  const trimmed = path.replace(/[\\/]+$/, "");
+  const i = Math.max(trimmed.lastIndexOf("/"), trimmed.lastIndexOf("\\"));
+  if (i < 0) return path;
+  const parent = trimmed.slice(0, i + 1);
+  return /^[A-Za-z]:$/.test(parent) ? parent + "\\" : parent;
+}
+
+async function listFiles(path) {
+  setStatus("");
+  $("files-path").value = path;
+  try {
+    const { data } = await operation("file_list", { path });
+    const entries = (JSON.parse(data) || []).sort((a, b) =>
+      (b.is_dir - a.is_dir) || a.name.localeCompare(b.name));
+    state.path = path;
+    $("file-rows").replaceChildren(...entries.map(fileRow));
+  } catch (err) {
+    setStatus(err.message);
+  }
+}
+
+function fileRow(entry) {
+  const name = el("td", { className: "mono", textContent: entry.name + (entry.is_dir ? "/" : "") });
+  const action = el("td");
+  const row = el("tr", {},
+    name,
+    el("td", { className: "num", textContent: entry.is_dir ? "" : formatSize(entry.size) }),
+    el("td", { textContent: formatTime(entry.mod_time) }),
+    el("td", { className: "mono", textContent: entry.mode }),
+    action);
+
+  if (entry.is_dir) {
+    row.className = "clickable";
+    row.addEventListener("click", () => listFiles(entry.path));
+  } else {
+    const button = el("button", { textContent: "Скачать" });
+    button.addEventListener("click", () => downloadFile(entry, button));
+    action.append(button);
+  }
+  return row;
+}
+
+async function downloadFile(entry, button) {
+  button.disabled = true;
+  try {
+    const { binary } = await operation("file_download", { path: entry.path });
+    const bytes = Uint8Array.from(atob(binary || ""), (c) => c.charCodeAt(0));
+    const url = URL.createObjectURL(new Blob([bytes]));
+    el("a", { href: url, download: entry.name }).click();
+    setTimeout(() => URL.revokeObjectURL(url), 10000);
+  } catch (err) {
+    setStatus(err.message);
+  } finally {
+    button.disabled = false;
+  }
+}
+
+$("files-form").addEventListener("submit", (e) => {
+  e.preventDefault();
+  listFiles($("files-path").value);
+});
+$("files-up").addEventListener("click", () => listFiles(parentPath($("files-path").value)));
+
+// --- Registry ----------------------------------------------------------------
+
+function renderRegistryRoots() {
+  $("reg-tree").replaceChildren(...REGISTRY_ROOTS.map((root) => registryNode(root, root + "\\")));
+}
+
+function registryNode(name, key) {
+  const label = el("span", { textContent: name });
+  const node = el("li", {}, label);
+  label.addEventListener("click", () => toggleKey(node, label, key));
+  return node;
+}
+
+async function toggleKey(node, label, key) {
+  setStatus("");
+  for (const selected of document.querySelectorAll(".tree span.selected")) {
+    selected.classList.remove("selected");
+  }
+  label.classList.add("selected");
+
+  if (node.classList.contains("open")) {
+    node.classList.remove("open");
+    node.querySelector("ul")?.remove();
+    return;
+  }
+
+  try {
+    const { data } = await operation("reg_list", { key });
+    const items = JSON.parse(data) || [];
+    const base = key.endsWith("\\") ? key : key + "\\";
+
+    const children = items.filter((item) => item.type === "key")
+      .sort((a, b) => a.name.localeCompare(b.name))
+      .map((item) => registryNode(item.name, base + item.name));
+    node.append(el("ul", {}, ...children));
+    node.classList.add("open");
+
+    $("reg-key").textContent = key;
+    $("reg-values").replaceChildren(...items.filter((item) => item.type === "value").map((item) =>
+      el("tr", {},
+        el("td", { className: "mono", textContent: item.name || "(по умолчанию)" }),
+        el("td", { textContent: item.data_type }),
+        el("td", { className: "mono", textContent: item.value }))));
+  } catch (err) {
+    setStatus(err.message);
+  }
+}
+
+// --- Console -----------------------------------------------------------------
+
+$("console-form").addEventListener("submit", async (e) => {
+  e.preventDefault();
+  const command = $("console-input").value.trim();
+  if (!command) return;
+
+  const out = $("console-output");
+  const print = (text) => {
+    out.textContent += text;
+    out.scrollTop = out.scrollHeight;
+  };
+
+  $("console-input").value = "";
+  print(`$ ${command}\n`);
+  try {
+    const timeout = parseInt($("console-timeout").value, 10) || 0;
+    const result = await operation("command", { command, timeout });
+    print(result.data);
+    if (result.error) print(result.error + "\n");
+    print(`[код выхода ${result.exitCode}]\n\n`);
+  } catch (err) {
+    print(`ошибка: ${err.message}\n\n`);
+  }
+});
+
+// --- Jobs --------------------------------------------------------------------
+
+function jobSummary(item) {
+  const payload = (item.message && item.message.payload) || {};
+  return payload.command || payload.path || payload.key || payload.image_url || "";
+}
+
+async function loadJobs() {
+  const items = await api("GET", `/jobs?client=${encodeURIComponent(state.client)}`);
+  state.jobs = new Map(items.map((item) => [item.id, item]));
+  renderJobs();
+}
+
+function renderJobs() {
+  const items = [...state.jobs.values()].sort((a, b) => new Date(b.created_at) - new Date(a.created_at));
+
+  $("job-rows").replaceChildren(...items.map((item) => {
+    const action = el("td");
+    if (item.status === "queued" || item.status === "sent") {
+      const button = el("button", { className: "danger", textContent: "Отменить" });
+      button.addEventListener("click", async (e) => {
+        e.stopPropagation();
+        try {
+          await api("DELETE", `/jobs/${item.id}`);
+        } catch (err) {
+          setStatus(err.message);
+        }
+      });
+      action.append(button);
+    }
+
+    const row = el("tr", { className: "clickable" },
+      el("td", { className: "mono", textContent: item.id.slice(0, 8) }),
+      el("td", { textContent: item.message.type }),
+      el("td", { textContent: item.status }),
+      el("td", { textContent: formatTime(item.created_at) }),
+      el("td", { className: "mono", textContent: jobSummary(item) }),
+      action);
+    row.addEventListener("click", () => showJob(item.id));
+    return row;
+  }));
+}
+
+async function showJob(id) {
+  const detail = $("job-detail");
+  try {
+    const item = await api("GET", `/jobs/${id}`);
+    for (const msg of [item.message, item.result]) {
+      if (msg && msg.binary) msg.binary = `<${formatSize(atob(msg.binary).length)}>`;
+    }
+    detail.textContent = JSON.stringify(item, null, 2);
+    detail.hidden = false;
+  } catch (err) {
+    setStatus(err.message);
+  }
+}
+
+// --- Routing -----------------------------------------------------------------
+
+async function route() {
+  setStatus("");
+  const loggedIn = !!sessionStorage.getItem(TOKEN_KEY);
+  $("login").hidden = loggedIn;
+  $("logout").hidden = !loggedIn;
+  $("clients").hidden = true;
+  $("client").hidden = true;
+  if (!loggedIn) return;
+
+  if (!state.events) watchEvents();
+
+  const match = location.hash.match(/^#\/client\/(.+)$/);
+  try {
+    if (match) {
+      $("client").hidden = false;
+      await openClient(decodeURIComponent(match[1]));
+    } else {
+      state.client = null;
+      $("clients").hidden = false;
+      await loadClients();
+    }
+  } catch (err) {
+    if (!(err instanceof AuthError)) setStatus(err.message);
+  }
+}
+
+window.addEventListener("hashchange", route);
+route();
@@ -0,0 +1,127 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/E2klime/HAXinceL2/internal/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// maxFrameSize bounds every frame a peer may send, on the wire and once
+// inflated. The largest messages are operations submitted through the API,
+// whose bodies maxAPIBody caps; the rest leaves room for the envelope.
+const maxFrameSize = maxAPIBody + 1<<20
+
+var errFrameTooLarge = fmt.Errorf("frame exceeds %d bytes", maxFrameSize)
+
+var (
+	supportedEncodings   = []string{protocol.EncodingBinary, protocol.EncodingJSON}
+	supportedCompression = []string{protocol.CompressionDeflate}
+)
+
+// wireCodec is how messages are framed on one connection once the handshake
+// has negotiated it. The zero value is uncompressed JSON, which is also what
+// the handshake itself uses.
+type wireCodec struct {
+	binary   bool
+	compress bool
+}
+
+func negotiateCodec(auth *protocol.AuthPayload) (wireCodec, protocol.AuthResultPayload) {
+	result := protocol.AuthResultPayload{
+		Encoding:    protocol.Negotiate(auth.Encodings, supportedEncodings, protocol.EncodingJSON),
+		Compression: protocol.Negotiate(auth.Compression, supportedCompression, protocol.CompressionNone),
+	}
+
+	return wireCodec{
+		binary:   result.Encoding == protocol.EncodingBinary,
+		compress: result.Compression == protocol.CompressionDeflate,
+	}, result
+}
+
+func (w wireCodec) String() string {
+	s := protocol.EncodingJSON
+	if w.binary {
+		s = protocol.EncodingBinary
+	}
+	if w.compress {
+		s += "+" + protocol.CompressionDeflate
+	}
+	return s
+}
+
+// writeFrame writes msg to conn. Callers must serialize writes. Compression
+// uses the permessage-deflate extension, so it only takes effect when both
+// ends enabled it in the WebSocket handshake as well.
+func writeFrame(conn *websocket.Conn, codec wireCodec, msg *protocol.Message) error {
+	conn.EnableWriteCompression(codec.compress && compressible(msg.Binary))
+
+	if !codec.binary {
+		return conn.WriteJSON(msg)
+	}
+
+	data, err := protocol.EncodeFrame(msg)
+	if err != nil {
+		return err
+	}
+	return conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
+// limitFrames makes conn refuse frames over maxFrameSize. readFrame checks
+// the inflated size as well, which the limit on conn does not cover.
+func limitFrames(conn *websocket.Conn) {
+	conn.SetReadLimit(maxFrameSize)
+}
+
+// readFrame reads the next message in whichever encoding the peer sent it.
+func readFrame(conn *websocket.Conn) (*protocol.Message, error) {
+	frameType, r, err := conn.NextReader()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r, maxFrameSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxFrameSize {
+		return nil, errFrameTooLarge
+	}
+
+	switch frameType {
+	case websocket.TextMessage:
+		var msg protocol.Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return nil, err
+		}
+		return &msg, nil
+
+	case websocket.BinaryMessage:
+		return protocol.DecodeFrame(data)
+
+	default:
+		return nil, fmt.Errorf("unexpected websocket frame type %d", frameType)
+	}
+}
+
+var compressedMagic = [][]byte{
+	{0x89, 'P', 'N', 'G'},  // PNG
+	{0xFF, 0xD8, 0xFF},     // JPEG
+	{0x1F, 0x8B},           // gzip
+	{'P', 'K', 0x03, 0x04}, // zip, docx, xlsx, jar
+	{'7', 'z', 0xBC, 0xAF}, // 7-Zip
+}
+
+// compressible reports whether deflating data is likely to pay off; already
+// compressed formats only cost CPU.
+func compressible(data []byte) bool {
+	for _, magic := range compressedMagic {
+		if bytes.HasPrefix(data, magic) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/E2klime/HAXinceL2/internal/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// framePair returns the two ends of a WebSocket connection that negotiated
+// permessage-deflate, the server one limited as HandleWebSocket limits it.
+func framePair(t *testing.T) (server, client *websocket.Conn) {
+	t.Helper()
+
+	conns := make(chan *websocket.Conn, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		limitFrames(conn)
+		conns <- conn
+	}))
+	t.Cleanup(ts.Close)
+
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = true
+	client, _, err := dialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server = <-conns
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return server, client
+}
+
+func TestReadFrame(t *testing.T) {
+	small := protocol.NewCommand(protocol.CommandPayload{Command: "true"})
+	small.Binary = []byte("output")
+	frame, err := protocol.EncodeFrame(small)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, err := json.Marshal(small)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		frameType int
+		data      []byte
+		compress  bool
+		wantErr   bool
+	}{
+		{name: "binary", frameType: websocket.BinaryMessage, data: frame},
+		{name: "json", frameType: websocket.TextMessage, data: text},
+		{name: "compressed", frameType: websocket.BinaryMessage, data: frame, compress: true},
+		// Inflates past the limit from a few hundred kilobytes on the wire.
+		{name: "deflate bomb", frameType: websocket.BinaryMessage, data: make([]byte, maxFrameSize+1), compress: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := framePair(t)
+			client.EnableWriteCompression(tt.compress)
+
+			go client.WriteMessage(tt.frameType, tt.data)
+
+			msg, err := readFrame(server)
+			if tt.wantErr {
+				if !errors.Is(err, errFrameTooLarge) {
+					t.Fatalf("readFrame error = %v, want %v", err, errFrameTooLarge)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Type != small.Type || msg.RequestID != small.RequestID || !bytes.Equal(msg.Binary, small.Binary) {
+				t.Errorf("readFrame = %+v, want %+v", msg, small)
+			}
+		})
+	}
+}
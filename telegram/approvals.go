@@ -0,0 +1,165 @@
+package telegram
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/E2klime/HAXinceL2/internal"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// maxApprovalsShown caps how many pending approvals /approvals posts.
+const maxApprovalsShown = 10
+
+// approvalMessage is a request for a decision posted to an approver, kept so
+// it can be updated once someone decides.
+type approvalMessage struct {
+	chatID    int64
+	messageID int
+}
+
+// onApprovalUpdate asks the other Telegram operators who may decide on a new
+// approval, and reports decisions to the requester and the approvers.
+func (b *Bot) onApprovalUpdate(a *internal.Approval) {
+	if a.Status == internal.ApprovalPending {
+		go b.announceApproval(a)
+		return
+	}
+	go b.settleApproval(a)
+}
+
+func (b *Bot) announceApproval(a *internal.Approval) {
+	for _, op := range b.server.Operators() {
+		userID, ok := parseTelegramOrigin(op.ID)
+		if !ok || op.ID == a.Operator || !op.Can(internal.PermApprove, a.ClientID) {
+			continue
+		}
+		b.postApproval(userID, a)
+	}
+}
+
+// postApproval sends a with approve and reject buttons to chatID.
+func (b *Bot) postApproval(chatID int64, a *internal.Approval) {
+	msg := tgbotapi.NewMessage(chatID, approvalText(a))
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("✅ Одобрить", "approve:"+a.ID),
+		tgbotapi.NewInlineKeyboardButtonData("🚫 Отклонить", "reject:"+a.ID),
+	))
+
+	sent, err := b.api.Send(msg)
+	if err != nil {
+		log.Printf("Failed to send approval request %s to %d: %v", a.ID, chatID, err)
+		return
+	}
+
+	b.approvalsMutex.Lock()
+	b.approvalMessages[a.ID] = append(b.approvalMessages[a.ID], approvalMessage{chatID: chatID, messageID: sent.MessageID})
+	b.approvalsMutex.Unlock()
+}
+
+// settleApproval replaces the buttons of every posted request with the
+// outcome and tells the requester.
+func (b *Bot) settleApproval(a *internal.Approval) {
+	b.approvalsMutex.Lock()
+	posted := b.approvalMessages[a.ID]
+	delete(b.approvalMessages, a.ID)
+	b.approvalsMutex.Unlock()
+
+	outcome := approvalOutcome(a)
+	for _, m := range posted {
+		edit := tgbotapi.NewEditMessageText(m.chatID, m.messageID, approvalText(a)+"\n\n"+outcome)
+		if _, err := b.api.Send(edit); err != nil {
+			log.Printf("Failed to update approval request %s in %d: %v", a.ID, m.chatID, err)
+		}
+	}
+
+	if chatID, ok := parseTelegramOrigin(a.Origin); ok {
+		b.sendText(chatID, fmt.Sprintf("%s\n%s → %s (%s)", outcome, a.Message.Type, a.ClientID, shortID(a.ID)))
+	}
+}
+
+func approvalText(a *internal.Approval) string {
+	return fmt.Sprintf("🔐 Требуется подтверждение\n\nОператор: %s\nКлиент: %s\nОперация: %s\nПараметры: %s\nИстекает: %s",
+		a.Operator, a.ClientID, a.Message.Type, string(a.Message.Payload), a.ExpiresAt.Local().Format("2006-01-02 15:04"))
+}
+
+func approvalOutcome(a *internal.Approval) string {
+	switch a.Status {
+	case internal.ApprovalApproved:
+		if a.Error != "" {
+			return fmt.Sprintf("⚠️ Одобрено (%s), но не поставлено в очередь: %s", a.DecidedBy, a.Error)
+		}
+		return fmt.Sprintf("✅ Одобрено (%s), выполняется", a.DecidedBy)
+	case internal.ApprovalRejected:
+		return fmt.Sprintf("🚫 Отклонено (%s)", a.DecidedBy)
+	case internal.ApprovalExpired:
+		return "⌛ Истекло без решения"
+	}
+	return string(a.Status)
+}
+
+func (b *Bot) handleApprovalCallback(op *internal.Operator, callback *tgbotapi.CallbackQuery, id string, approve bool) {
+	var err error
+	if approve {
+		_, err = op.Approve(id)
+	} else {
+		_, err = op.Reject(id)
+	}
+
+	text := ""
+	if err != nil {
+		text = "❌ " + err.Error()
+		if errors.Is(err, internal.ErrSelfApproval) {
+			text = "❌ Нельзя подтвердить собственный запрос"
+		}
+	}
+	// Success is shown by settleApproval editing the message.
+	b.api.Request(tgbotapi.NewCallbackWithAlert(callback.ID, text))
+}
+
+// handleApprovalList posts the pending approvals of the operator's clients,
+// with buttons on those the operator may decide on.
+func (b *Bot) handleApprovalList(op *internal.Operator, message *tgbotapi.Message) {
+	chatID := message.Chat.ID
+
+	args, err := splitArgs(message.CommandArguments())
+	if err != nil || len(args) > 1 {
+		b.sendText(chatID, "Использование: /approvals [client_id]")
+		return
+	}
+
+	clientID := ""
+	if len(args) == 1 {
+		clientID = args[0]
+	}
+
+	var pending []*internal.Approval
+	for _, a := range op.Approvals(clientID) {
+		if a.Status == internal.ApprovalPending {
+			pending = append(pending, a)
+		}
+	}
+	if len(pending) == 0 {
+		b.sendText(chatID, "📭 Нет операций, ожидающих подтверждения")
+		return
+	}
+
+	if len(pending) > maxApprovalsShown {
+		b.sendText(chatID, fmt.Sprintf("🔐 Ожидают подтверждения: %d, показаны последние %d", len(pending), maxApprovalsShown))
+		pending = pending[len(pending)-maxApprovalsShown:]
+	}
+	for _, a := range pending {
+		if a.Operator != op.ID && op.Can(internal.PermApprove, a.ClientID) {
+			b.postApproval(chatID, a)
+		} else {
+			b.sendText(chatID, approvalText(a))
+		}
+	}
+}
+
+// approvalHeld describes an operation held for approval to its requester.
+func approvalHeld(a *internal.Approval) string {
+	return fmt.Sprintf("🔐 %s → %s ожидает подтверждения второго оператора\nЗапрос %s, срок до %s",
+		a.Message.Type, a.ClientID, shortID(a.ID), a.ExpiresAt.Local().Format("2006-01-02 15:04"))
+}
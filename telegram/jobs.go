@@ -0,0 +1,93 @@
+package telegram
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/E2klime/HAXinceL2/internal"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// jobClient resolves the client a job command targets: the one given as an
+// argument, or the user's selected client.
+func (b *Bot) jobClient(message *tgbotapi.Message, args []string) (string, bool) {
+	if len(args) > 0 {
+		return args[0], true
+	}
+	return b.selectedClient(messageSession(message))
+}
+
+func (b *Bot) handleJobList(op *internal.Operator, message *tgbotapi.Message) {
+	chatID := message.Chat.ID
+
+	args, err := splitArgs(message.CommandArguments())
+	if err != nil || len(args) > 1 {
+		b.sendText(chatID, "Использование: /jobs [client_id]")
+		return
+	}
+
+	clientID, ok := b.jobClient(message, args)
+	if !ok {
+		b.sendText(chatID, "❌ Сначала выберите клиента: /clients")
+		return
+	}
+
+	// The round trip to the client must not hold up the update loop.
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		jobs, err := op.Jobs(ctx, clientID)
+		if err != nil {
+			b.sendText(chatID, fmt.Sprintf("❌ %v", err))
+			return
+		}
+		if len(jobs) == 0 {
+			b.sendText(chatID, fmt.Sprintf("📭 На %s нет активных задач", clientID))
+			return
+		}
+
+		var sb strings.Builder
+		for _, job := range jobs {
+			since := job.QueuedAt
+			if job.StartedAt != 0 {
+				since = job.StartedAt
+			}
+			age := time.Since(time.Unix(since, 0)).Round(time.Second)
+			fmt.Fprintf(&sb, "%s %-7s %-13s %6s %s\n", shortID(job.ID), job.State, job.Type, age, job.Summary)
+		}
+
+		b.sendTable(chatID, fmt.Sprintf("⚙️ Задачи на %s (%d)", clientID, len(jobs)), sb.String(), "jobs.txt")
+	}()
+}
+
+func (b *Bot) handleJobCancel(op *internal.Operator, message *tgbotapi.Message) {
+	chatID := message.Chat.ID
+
+	args, err := splitArgs(message.CommandArguments())
+	if err != nil || len(args) < 1 || len(args) > 2 {
+		b.sendText(chatID, "Использование: /job_cancel <id> [client_id]")
+		return
+	}
+
+	clientID, ok := b.jobClient(message, args[1:])
+	if !ok {
+		b.sendText(chatID, "❌ Сначала выберите клиента: /clients")
+		return
+	}
+
+	jobID := args[0]
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		if err := op.StopJob(ctx, clientID, jobID); err != nil {
+			b.sendText(chatID, fmt.Sprintf("❌ %v", err))
+			return
+		}
+
+		b.sendText(chatID, fmt.Sprintf("🚫 Задача %s на %s отменена", jobID, clientID))
+	}()
+}
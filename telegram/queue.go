@@ -0,0 +1,138 @@
+package telegram
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/E2klime/HAXinceL2/internal"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const telegramOriginPrefix = "telegram:"
+
+func telegramOrigin(chatID int64) string {
+	return telegramOriginPrefix + strconv.FormatInt(chatID, 10)
+}
+
+func parseTelegramOrigin(origin string) (int64, bool) {
+	if !strings.HasPrefix(origin, telegramOriginPrefix) {
+		return 0, false
+	}
+	chatID, err := strconv.ParseInt(strings.TrimPrefix(origin, telegramOriginPrefix), 10, 64)
+	return chatID, err == nil
+}
+
+func shortID(id string) string {
+	if len(id) > 8 {
+		return id[:8]
+	}
+	return id
+}
+
+// onQueueUpdate reports results of queued messages back to the chat that
+// queued them.
+func (b *Bot) onQueueUpdate(item *internal.QueueItem) {
+	chatID, ok := parseTelegramOrigin(item.Origin)
+	if !ok {
+		return
+	}
+
+	switch item.Status {
+	case internal.QueueCompleted:
+		go func() {
+			b.sendText(chatID, fmt.Sprintf("📬 Результат из очереди %s (%s, %s)", shortID(item.ID), item.Message.Type, item.ClientID))
+			b.deliverResult(chatID, item.ClientID, item.Message, item.Result)
+		}()
+	case internal.QueueExpired:
+		go b.sendText(chatID, fmt.Sprintf("⌛ Команда %s (%s) для %s истекла без ответа", shortID(item.ID), item.Message.Type, item.ClientID))
+	}
+}
+
+func (b *Bot) handleQueueList(op *internal.Operator, message *tgbotapi.Message) {
+	chatID := message.Chat.ID
+
+	args, err := splitArgs(message.CommandArguments())
+	if err != nil || len(args) > 1 {
+		b.sendText(chatID, "Использование: /queue [client_id]")
+		return
+	}
+
+	clientID := ""
+	if len(args) == 1 {
+		clientID = args[0]
+	}
+
+	items, err := op.QueueItems(clientID)
+	if err != nil {
+		b.sendText(chatID, fmt.Sprintf("❌ %v", err))
+		return
+	}
+
+	var sb strings.Builder
+	shown := 0
+	for _, item := range items {
+		// Finished items stay for result lookups but would drown the list.
+		if item.Done() && time.Since(item.CompletedAt) > 24*time.Hour {
+			continue
+		}
+		fmt.Fprintf(&sb, "%s %-9s %-12s %s  до %s\n",
+			shortID(item.ID), item.Status, item.Message.Type, item.ClientID, item.ExpiresAt.Format("01-02 15:04"))
+		shown++
+	}
+
+	if shown == 0 {
+		b.sendText(chatID, "📭 Очередь пуста")
+		return
+	}
+
+	b.sendTable(chatID, fmt.Sprintf("🕓 Очередь (%d)", shown), sb.String(), "queue.txt")
+}
+
+func (b *Bot) handleQueueCancel(op *internal.Operator, message *tgbotapi.Message) {
+	chatID := message.Chat.ID
+
+	args, err := splitArgs(message.CommandArguments())
+	if err != nil || len(args) != 1 {
+		b.sendText(chatID, "Использование: /queue_cancel <id>")
+		return
+	}
+
+	id, err := b.resolveQueueID(op, args[0])
+	if err != nil {
+		b.sendText(chatID, fmt.Sprintf("❌ %v", err))
+		return
+	}
+
+	item, err := op.CancelQueued(id)
+	if err != nil {
+		b.sendText(chatID, fmt.Sprintf("❌ %v", err))
+		return
+	}
+
+	b.sendText(chatID, fmt.Sprintf("🚫 Команда %s (%s) для %s отменена", shortID(item.ID), item.Message.Type, item.ClientID))
+}
+
+// resolveQueueID expands the short ID prefix shown by /queue.
+func (b *Bot) resolveQueueID(op *internal.Operator, prefix string) (string, error) {
+	items, err := op.QueueItems("")
+	if err != nil {
+		return "", err
+	}
+
+	var match string
+	for _, item := range items {
+		if strings.HasPrefix(item.ID, prefix) {
+			if match != "" {
+				return "", fmt.Errorf("неоднозначный id: %s", prefix)
+			}
+			match = item.ID
+		}
+	}
+
+	if match == "" {
+		return "", internal.ErrQueueNotFound
+	}
+	return match, nil
+}
@@ -0,0 +1,394 @@
+package telegram
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+
+	"github.com/E2klime/HAXinceL2/internal"
+	"github.com/E2klime/HAXinceL2/internal/protocol"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	resultTimeout = 5 * time.Minute
+
+	// Telegram rejects messages longer than 4096 characters; leave room for
+	// the <pre> wrapper and HTML escaping.
+	maxChunkLen = 3500
+	// Output that would take more messages than this is sent as a .txt file.
+	maxTextChunks = 3
+)
+
+// dispatch sends msg to the client and delivers the reply to chatID once it
+// arrives. It returns immediately; errors after the send are reported to the
+// chat. Messages for offline clients are queued and an error wrapping
+// internal.ErrQueued is returned; those held for a second operator return an
+// *internal.PendingApprovalError.
+func (b *Bot) dispatch(op *internal.Operator, chatID int64, clientID string, msg *protocol.Message) error {
+	// Operations held for approval go through the queue too, so that their
+	// result finds its way back to this chat once approved.
+	if _, err := op.GetClient(clientID); err != nil || b.server.RequiresApproval(msg.Type) {
+		item, err := op.Enqueue(clientID, msg, 0, telegramOrigin(chatID))
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: %s, срок до %s", internal.ErrQueued, shortID(item.ID), item.ExpiresAt.Format("2006-01-02 15:04"))
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), resultTimeout)
+		defer cancel()
+
+		resp, err := op.Request(ctx, clientID, msg, telegramOrigin(chatID))
+		if err != nil {
+			b.sendText(chatID, fmt.Sprintf("❌ %s: %v", clientID, err))
+			return
+		}
+
+		b.deliverResult(chatID, clientID, msg, resp)
+	}()
+
+	return nil
+}
+
+func (b *Bot) reportDispatchError(chatID int64, err error) {
+	var pending *internal.PendingApprovalError
+	if errors.As(err, &pending) {
+		b.sendText(chatID, approvalHeld(pending.Approval))
+		return
+	}
+	if errors.Is(err, internal.ErrQueued) {
+		b.sendText(chatID, fmt.Sprintf("🕓 %v\nРезультат придёт сюда после подключения клиента. Очередь: /queue", err))
+		return
+	}
+	b.sendText(chatID, fmt.Sprintf("❌ Ошибка отправки команды: %v", err))
+}
+
+func (b *Bot) deliverResult(chatID int64, clientID string, req, resp *protocol.Message) {
+	if resp.Type == protocol.TypeError {
+		var payload protocol.ErrorPayload
+		if err := resp.Decode(&payload); err != nil {
+			b.sendText(chatID, fmt.Sprintf("❌ %s: malformed error reply", clientID))
+			return
+		}
+		switch payload.Code {
+		case protocol.ErrorCodePolicyDenied:
+			b.sendText(chatID, fmt.Sprintf("🛡️ %s: запрещено локальной политикой клиента\n%s", clientID, payload.Message))
+			return
+		case protocol.ErrorCodeConsentDenied:
+			b.sendText(chatID, fmt.Sprintf("🙅 %s: пользователь не дал согласия\n%s", clientID, payload.Message))
+			return
+		}
+		b.sendText(chatID, fmt.Sprintf("❌ %s: %s", clientID, payload.Message))
+		return
+	}
+
+	var payload protocol.ResponsePayload
+	if err := resp.Decode(&payload); err != nil {
+		b.sendText(chatID, fmt.Sprintf("❌ %s: malformed response", clientID))
+		return
+	}
+
+	if !payload.Success {
+		b.sendText(chatID, fmt.Sprintf("❌ %s: %s", clientID, payload.Error))
+		if payload.Data != "" {
+			b.sendOutput(chatID, clientID, payload.Data)
+		}
+		return
+	}
+
+	var err error
+	switch req.Type {
+	case protocol.TypeScreenshot:
+		err = b.sendScreenshot(chatID, clientID, responseBytes(resp, payload.Data))
+	case protocol.TypeFileDownload:
+		err = b.sendDownload(chatID, payload.Data, resp.Binary)
+	case protocol.TypeFileRead:
+		err = b.sendFileRead(chatID, req, responseBytes(resp, payload.Data))
+	case protocol.TypeFileList:
+		err = b.sendFileList(chatID, req, payload.Data)
+	case protocol.TypeRegList:
+		err = b.sendRegList(chatID, req, payload.Data)
+	case protocol.TypeRegRead:
+		err = b.sendRegRead(chatID, payload.Data)
+	case protocol.TypeCommand:
+		b.sendOutput(chatID, clientID, payload.Data)
+	default:
+		b.sendText(chatID, fmt.Sprintf("✅ %s: %s", clientID, payload.Data))
+	}
+
+	if err != nil {
+		log.Printf("Failed to deliver %s result from %s: %v", req.Type, clientID, err)
+		b.sendText(chatID, fmt.Sprintf("❌ Не удалось отправить результат: %v", err))
+	}
+}
+
+// responseBytes returns the raw bytes of a reply: Message.Binary, or the
+// base64 Data older clients send.
+func responseBytes(resp *protocol.Message, data string) []byte {
+	if resp.Binary != nil {
+		return resp.Binary
+	}
+	decoded, _ := base64.StdEncoding.DecodeString(data)
+	return decoded
+}
+
+func (b *Bot) sendScreenshot(chatID int64, clientID string, img []byte) error {
+	if len(img) == 0 {
+		return errors.New("empty screenshot")
+	}
+
+	file := tgbotapi.FileBytes{
+		Name:  fmt.Sprintf("screenshot_%s_%s.png", clientID, time.Now().Format("20060102_150405")),
+		Bytes: img,
+	}
+
+	photo := tgbotapi.NewPhoto(chatID, file)
+	photo.Caption = fmt.Sprintf("📸 %s", clientID)
+	_, err := b.api.Send(photo)
+	if err == nil {
+		return nil
+	}
+
+	// Telegram refuses photos that are too large or oddly proportioned
+	// (multi-monitor captures); fall back to sending the PNG untouched.
+	log.Printf("Failed to send screenshot as photo, retrying as document: %v", err)
+	doc := tgbotapi.NewDocument(chatID, file)
+	doc.Caption = photo.Caption
+	_, err = b.api.Send(doc)
+	return err
+}
+
+func (b *Bot) sendDownload(chatID int64, data string, content []byte) error {
+	var file struct {
+		Name    string `json:"name"`
+		Path    string `json:"path"`
+		Size    int64  `json:"size"`
+		Content string `json:"content"`
+	}
+	if err := json.Unmarshal([]byte(data), &file); err != nil {
+		return fmt.Errorf("parse download result: %w", err)
+	}
+
+	if content == nil {
+		var err error
+		if content, err = base64.StdEncoding.DecodeString(file.Content); err != nil {
+			return fmt.Errorf("decode file content: %w", err)
+		}
+	}
+
+	doc := tgbotapi.NewDocument(chatID, tgbotapi.FileBytes{
+		Name:  file.Name,
+		Bytes: content,
+	})
+	doc.Caption = fmt.Sprintf("📄 %s (%s)", file.Path, formatSize(file.Size))
+
+	_, err := b.api.Send(doc)
+	return err
+}
+
+func (b *Bot) sendFileRead(chatID int64, req *protocol.Message, content []byte) error {
+	var reqPayload protocol.FileReadPayload
+	req.Decode(&reqPayload)
+
+	if utf8.Valid(content) && len(content) <= maxChunkLen {
+		b.sendPre(chatID, reqPayload.Path, string(content))
+		return nil
+	}
+
+	doc := tgbotapi.NewDocument(chatID, tgbotapi.FileBytes{
+		Name:  filepath.Base(reqPayload.Path),
+		Bytes: content,
+	})
+	doc.Caption = fmt.Sprintf("📄 %s", reqPayload.Path)
+
+	_, err := b.api.Send(doc)
+	return err
+}
+
+func (b *Bot) sendFileList(chatID int64, req *protocol.Message, data string) error {
+	var reqPayload protocol.FileListPayload
+	req.Decode(&reqPayload)
+
+	var files []protocol.FileInfo
+	if err := json.Unmarshal([]byte(data), &files); err != nil {
+		return fmt.Errorf("parse file list: %w", err)
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].IsDir != files[j].IsDir {
+			return files[i].IsDir
+		}
+		return strings.ToLower(files[i].Name) < strings.ToLower(files[j].Name)
+	})
+
+	var sb strings.Builder
+	w := tabwriter.NewWriter(&sb, 0, 0, 2, ' ', 0)
+	for _, f := range files {
+		size := formatSize(f.Size)
+		name := f.Name
+		if f.IsDir {
+			size = "<DIR>"
+			name += "/"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", f.Mode, size, time.Unix(f.ModTime, 0).Format("2006-01-02 15:04"), name)
+	}
+	w.Flush()
+
+	if len(files) == 0 {
+		sb.WriteString("(empty)")
+	}
+
+	b.sendTable(chatID, fmt.Sprintf("📁 %s (%d)", reqPayload.Path, len(files)), sb.String(), "listing.txt")
+	return nil
+}
+
+func (b *Bot) sendRegList(chatID int64, req *protocol.Message, data string) error {
+	var reqPayload protocol.RegistryListPayload
+	req.Decode(&reqPayload)
+
+	var items []protocol.RegistryInfo
+	if err := json.Unmarshal([]byte(data), &items); err != nil {
+		return fmt.Errorf("parse registry list: %w", err)
+	}
+
+	var sb strings.Builder
+	w := tabwriter.NewWriter(&sb, 0, 0, 2, ' ', 0)
+	for _, item := range items {
+		if item.Type == "key" {
+			fmt.Fprintf(w, "[%s]\t\t\n", item.Name)
+			continue
+		}
+		name := item.Name
+		if name == "" {
+			name = "(Default)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", name, item.DataType, item.Value)
+	}
+	w.Flush()
+
+	if len(items) == 0 {
+		sb.WriteString("(empty)")
+	}
+
+	b.sendTable(chatID, fmt.Sprintf("🗂️ %s (%d)", reqPayload.Key, len(items)), sb.String(), "registry.txt")
+	return nil
+}
+
+func (b *Bot) sendRegRead(chatID int64, data string) error {
+	var value struct {
+		Key      string `json:"key"`
+		Value    string `json:"value"`
+		Data     string `json:"data"`
+		DataType string `json:"data_type"`
+	}
+	if err := json.Unmarshal([]byte(data), &value); err != nil {
+		return fmt.Errorf("parse registry value: %w", err)
+	}
+
+	b.sendPre(chatID, fmt.Sprintf("🗂️ %s\\%s (%s)", value.Key, value.Value, value.DataType), value.Data)
+	return nil
+}
+
+// sendOutput delivers command output as one or more <pre> messages, or as a
+// text file when it would not fit into a few messages.
+func (b *Bot) sendOutput(chatID int64, clientID, output string) {
+	if strings.TrimSpace(output) == "" {
+		b.sendText(chatID, fmt.Sprintf("✅ %s: (нет вывода)", clientID))
+		return
+	}
+
+	chunks := splitText(output, maxChunkLen)
+	if len(chunks) > maxTextChunks {
+		b.sendTextFile(chatID, fmt.Sprintf("💻 %s", clientID), "output.txt", output)
+		return
+	}
+
+	for i, chunk := range chunks {
+		title := fmt.Sprintf("💻 %s", clientID)
+		if len(chunks) > 1 {
+			title = fmt.Sprintf("💻 %s (%d/%d)", clientID, i+1, len(chunks))
+		}
+		b.sendPre(chatID, title, chunk)
+	}
+}
+
+func (b *Bot) sendTable(chatID int64, title, table, fileName string) {
+	if len(table) > maxChunkLen {
+		b.sendTextFile(chatID, title, fileName, table)
+		return
+	}
+	b.sendPre(chatID, title, table)
+}
+
+func (b *Bot) sendPre(chatID int64, title, body string) {
+	msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("<b>%s</b>\n<pre>%s</pre>", html.EscapeString(title), html.EscapeString(body)))
+	msg.ParseMode = tgbotapi.ModeHTML
+	if _, err := b.api.Send(msg); err != nil {
+		log.Printf("Failed to send message to %d: %v", chatID, err)
+	}
+}
+
+func (b *Bot) sendTextFile(chatID int64, caption, fileName, content string) {
+	doc := tgbotapi.NewDocument(chatID, tgbotapi.FileBytes{
+		Name:  fileName,
+		Bytes: []byte(content),
+	})
+	doc.Caption = caption
+	if _, err := b.api.Send(doc); err != nil {
+		log.Printf("Failed to send document to %d: %v", chatID, err)
+	}
+}
+
+func (b *Bot) sendText(chatID int64, text string) {
+	if _, err := b.api.Send(tgbotapi.NewMessage(chatID, text)); err != nil {
+		log.Printf("Failed to send message to %d: %v", chatID, err)
+	}
+}
+
+// splitText cuts s into pieces of at most limit bytes, preferring line
+// boundaries and never splitting a UTF-8 sequence.
+func splitText(s string, limit int) []string {
+	var chunks []string
+	for len(s) > limit {
+		cut := strings.LastIndexByte(s[:limit], '\n')
+		if cut <= 0 {
+			cut = limit
+			for cut > 0 && !utf8.RuneStart(s[cut]) {
+				cut--
+			}
+		} else {
+			cut++
+		}
+		chunks = append(chunks, s[:cut])
+		s = s[cut:]
+	}
+	if s != "" {
+		chunks = append(chunks, s)
+	}
+	return chunks
+}
+
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,160 @@
+package telegram
+
+import (
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+type pendingAction string
+
+const (
+	actionNone      pendingAction = ""
+	actionCommand   pendingAction = "command"
+	actionShowImage pendingAction = "show_image"
+)
+
+const (
+	pendingActionTTL = 5 * time.Minute
+	sessionIdleTTL   = 12 * time.Hour
+	sessionSweepTick = time.Minute
+)
+
+type session struct {
+	ClientID      string
+	Pending       pendingAction
+	PendingClient string
+	PendingUntil  time.Time
+	LastActive    time.Time
+}
+
+// sessionKey identifies one user's conversation in one chat, so operators
+// sharing a group chat keep their own selected client and prompts.
+type sessionKey struct {
+	chatID int64
+	userID int64
+}
+
+func messageSession(message *tgbotapi.Message) sessionKey {
+	return sessionKey{chatID: message.Chat.ID, userID: message.From.ID}
+}
+
+func callbackSession(callback *tgbotapi.CallbackQuery) sessionKey {
+	return sessionKey{chatID: callback.Message.Chat.ID, userID: callback.From.ID}
+}
+
+// sessionStore keeps per-user conversational state: which client the user is
+// working with and which prompt, if any, their next text message answers.
+type sessionStore struct {
+	mutex    sync.Mutex
+	sessions map[sessionKey]*session
+}
+
+func newSessionStore() *sessionStore {
+	return &sessionStore{
+		sessions: make(map[sessionKey]*session),
+	}
+}
+
+func (s *sessionStore) get(key sessionKey) *session {
+	sess, ok := s.sessions[key]
+	if !ok {
+		sess = &session{}
+		s.sessions[key] = sess
+	}
+	sess.LastActive = time.Now()
+	return sess
+}
+
+func (s *sessionStore) selectClient(key sessionKey, clientID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sess := s.get(key)
+	if sess.ClientID != clientID {
+		sess.Pending = actionNone
+	}
+	sess.ClientID = clientID
+}
+
+func (s *sessionStore) selectedClient(key sessionKey) (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sess, ok := s.sessions[key]
+	if !ok || sess.ClientID == "" {
+		return "", false
+	}
+	sess.LastActive = time.Now()
+	return sess.ClientID, true
+}
+
+func (s *sessionStore) expect(key sessionKey, action pendingAction, clientID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sess := s.get(key)
+	sess.ClientID = clientID
+	sess.Pending = action
+	sess.PendingClient = clientID
+	sess.PendingUntil = time.Now().Add(pendingActionTTL)
+}
+
+// take returns and clears the pending action of the session. expired reports
+// that there was one but it timed out.
+func (s *sessionStore) take(key sessionKey) (action pendingAction, clientID string, expired bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sess, ok := s.sessions[key]
+	if !ok || sess.Pending == actionNone {
+		return actionNone, "", false
+	}
+
+	action, clientID = sess.Pending, sess.PendingClient
+	sess.Pending = actionNone
+	sess.PendingClient = ""
+	sess.LastActive = time.Now()
+
+	if time.Now().After(sess.PendingUntil) {
+		return actionNone, "", true
+	}
+	return action, clientID, false
+}
+
+func (s *sessionStore) cancel(key sessionKey) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sess, ok := s.sessions[key]
+	if !ok || sess.Pending == actionNone {
+		return false
+	}
+	sess.Pending = actionNone
+	sess.PendingClient = ""
+	return true
+}
+
+// sweep deletes sessions idle for longer than sessionIdleTTL. Expired
+// prompts stay for take to report to the user.
+func (s *sessionStore) sweep() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	for key, sess := range s.sessions {
+		if now.Sub(sess.LastActive) > sessionIdleTTL {
+			delete(s.sessions, key)
+		}
+	}
+}
+
+func (s *sessionStore) runSweeper() {
+	ticker := time.NewTicker(sessionSweepTick)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.sweep()
+	}
+}
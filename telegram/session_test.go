@@ -0,0 +1,39 @@
+package telegram
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionSweep(t *testing.T) {
+	key := sessionKey{chatID: 1, userID: 2}
+
+	tests := []struct {
+		name string
+		// age moves the session's activity and prompt into the past.
+		age         time.Duration
+		wantAction  pendingAction
+		wantExpired bool
+	}{
+		{name: "fresh prompt", wantAction: actionCommand},
+		{name: "expired prompt", age: pendingActionTTL + time.Minute, wantExpired: true},
+		{name: "idle session", age: sessionIdleTTL + time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSessionStore()
+			s.expect(key, actionCommand, "c1")
+			sess := s.sessions[key]
+			sess.LastActive = sess.LastActive.Add(-tt.age)
+			sess.PendingUntil = sess.PendingUntil.Add(-tt.age)
+
+			s.sweep()
+
+			action, _, expired := s.take(key)
+			if action != tt.wantAction || expired != tt.wantExpired {
+				t.Errorf("take = %q, expired %v; want %q, expired %v", action, expired, tt.wantAction, tt.wantExpired)
+			}
+		})
+	}
+}
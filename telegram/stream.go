@@ -0,0 +1,233 @@
+package telegram
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/E2klime/HAXinceL2/internal"
+	"github.com/E2klime/HAXinceL2/internal/protocol"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/google/uuid"
+)
+
+const (
+	commandTimeout = 10 * time.Minute
+	// Telegram allows roughly one edit per second per chat; stay well below.
+	liveEditInterval = 2 * time.Second
+	liveTailLen      = 3000
+	// Output beyond this is dropped from the .txt attachment as well.
+	maxCapturedOutput = 8 << 20
+)
+
+// liveJob is a streaming command whose output is shown by editing a single
+// Telegram message as chunks arrive.
+type liveJob struct {
+	op        *internal.Operator
+	chatID    int64
+	clientID  string
+	jobID     string
+	command   string
+	messageID int
+
+	mutex     sync.Mutex
+	output    strings.Builder
+	truncated bool
+	dirty     bool
+}
+
+func (j *liveJob) append(msg *protocol.Message) {
+	var payload protocol.OutputPayload
+	if err := msg.Decode(&payload); err != nil {
+		return
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if j.output.Len()+len(payload.Data) > maxCapturedOutput {
+		j.truncated = true
+		return
+	}
+	j.output.WriteString(payload.Data)
+	j.dirty = true
+}
+
+func (j *liveJob) render(status string) string {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	j.dirty = false
+
+	tail := j.output.String()
+	if len(tail) > liveTailLen {
+		tail = "…" + tail[len(tail)-liveTailLen:]
+		tail = strings.ToValidUTF8(tail, "")
+	}
+	if strings.TrimSpace(tail) == "" {
+		tail = "…"
+	}
+
+	return fmt.Sprintf("<b>💻 %s</b> <code>$ %s</code>\n<pre>%s</pre>\n%s",
+		html.EscapeString(j.clientID), html.EscapeString(j.command), html.EscapeString(tail), status)
+}
+
+// runStreamingCommand executes command on an online client, streaming its
+// output into one message that is edited live and offers a stop button.
+func (b *Bot) runStreamingCommand(op *internal.Operator, chatID int64, clientID, command string) error {
+	if err := op.Authorize(internal.OperationPermission(protocol.TypeCommand), clientID); err != nil {
+		return err
+	}
+
+	payload := protocol.CommandPayload{
+		Command: command,
+		Stream:  true,
+		Timeout: int(commandTimeout.Seconds()),
+	}
+	msg := protocol.NewCommand(payload)
+	msg.RequestID = uuid.New().String()
+
+	job := &liveJob{
+		op:       op,
+		chatID:   chatID,
+		clientID: clientID,
+		jobID:    msg.RequestID,
+		command:  command,
+	}
+
+	initial := tgbotapi.NewMessage(chatID, job.render("⏳ выполняется…"))
+	initial.ParseMode = tgbotapi.ModeHTML
+	initial.ReplyMarkup = stopKeyboard(job.jobID)
+	sent, err := b.api.Send(initial)
+	if err != nil {
+		return fmt.Errorf("failed to send status message: %w", err)
+	}
+	job.messageID = sent.MessageID
+
+	b.jobsMutex.Lock()
+	b.jobs[shortID(job.jobID)] = job
+	b.jobsMutex.Unlock()
+
+	go b.followJob(job, msg)
+	return nil
+}
+
+func (b *Bot) followJob(job *liveJob, msg *protocol.Message) {
+	defer func() {
+		b.jobsMutex.Lock()
+		delete(b.jobs, shortID(job.jobID))
+		b.jobsMutex.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout+time.Minute)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(liveEditInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				job.mutex.Lock()
+				dirty := job.dirty
+				job.mutex.Unlock()
+				if dirty {
+					b.editJob(job, "⏳ выполняется…", true)
+				}
+			}
+		}
+	}()
+
+	resp, err := job.op.Stream(ctx, job.clientID, msg, telegramOrigin(job.chatID), job.append)
+	close(done)
+
+	status := b.jobStatus(resp, err)
+	b.editJob(job, status, false)
+
+	job.mutex.Lock()
+	full := job.output.String()
+	truncated := job.truncated
+	job.mutex.Unlock()
+
+	if len(full) > liveTailLen || truncated {
+		caption := fmt.Sprintf("💻 %s: полный вывод", job.clientID)
+		if truncated {
+			caption += fmt.Sprintf(" (обрезан до %s)", formatSize(maxCapturedOutput))
+		}
+		b.sendTextFile(job.chatID, caption, "output.txt", full)
+	}
+}
+
+func (b *Bot) jobStatus(resp *protocol.Message, err error) string {
+	if err != nil {
+		return "❌ " + html.EscapeString(err.Error())
+	}
+
+	if resp.Type == protocol.TypeError {
+		var payload protocol.ErrorPayload
+		resp.Decode(&payload)
+		switch payload.Code {
+		case protocol.ErrorCodePolicyDenied:
+			return "🛡️ " + html.EscapeString(payload.Message)
+		case protocol.ErrorCodeConsentDenied:
+			return "🙅 " + html.EscapeString(payload.Message)
+		}
+		return "❌ " + html.EscapeString(payload.Message)
+	}
+
+	var payload protocol.ResponsePayload
+	if err := resp.Decode(&payload); err != nil {
+		return "❌ malformed response"
+	}
+	if payload.Success {
+		return "✅ exit 0"
+	}
+	if payload.Error == "cancelled" {
+		return "⛔ остановлено"
+	}
+	return fmt.Sprintf("❌ exit %d: %s", payload.ExitCode, html.EscapeString(payload.Error))
+}
+
+func (b *Bot) editJob(job *liveJob, status string, running bool) {
+	edit := tgbotapi.NewEditMessageText(job.chatID, job.messageID, job.render(status))
+	edit.ParseMode = tgbotapi.ModeHTML
+	if running {
+		keyboard := stopKeyboard(job.jobID)
+		edit.ReplyMarkup = &keyboard
+	}
+
+	if _, err := b.api.Send(edit); err != nil && !strings.Contains(err.Error(), "message is not modified") {
+		log.Printf("Failed to update live output of job %s: %v", job.jobID, err)
+	}
+}
+
+func (b *Bot) stopJob(op *internal.Operator, chatID int64, short string) {
+	b.jobsMutex.Lock()
+	job, ok := b.jobs[short]
+	b.jobsMutex.Unlock()
+
+	if !ok {
+		b.sendText(chatID, "Команда уже завершилась")
+		return
+	}
+
+	if err := op.CancelJob(job.clientID, job.jobID); err != nil {
+		b.sendText(chatID, fmt.Sprintf("❌ Не удалось остановить: %v", err))
+	}
+}
+
+func stopKeyboard(jobID string) tgbotapi.InlineKeyboardMarkup {
+	return tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("⛔ Остановить", fmt.Sprintf("stop:%s", shortID(jobID))),
+		),
+	)
+}
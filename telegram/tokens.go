@@ -0,0 +1,75 @@
+package telegram
+
+import (
+	"fmt"
+	"html"
+	"strings"
+
+	"github.com/E2klime/HAXinceL2/internal"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/google/uuid"
+)
+
+func (b *Bot) handleTokenNew(op *internal.Operator, message *tgbotapi.Message) {
+	chatID := message.Chat.ID
+
+	args, err := splitArgs(message.CommandArguments())
+	if err != nil || len(args) > 1 {
+		b.sendText(chatID, "Использование: /token_new [client_id]")
+		return
+	}
+
+	clientID := uuid.New().String()
+	if len(args) == 1 {
+		clientID = args[0]
+	}
+	if strings.Contains(clientID, ":") {
+		b.sendText(chatID, "❌ client_id не может содержать ':'")
+		return
+	}
+
+	token, err := op.MintToken(clientID)
+	if err != nil {
+		b.sendText(chatID, fmt.Sprintf("❌ Не удалось создать токен: %v", err))
+		return
+	}
+
+	text := fmt.Sprintf("🔑 Токен для клиента <b>%s</b>:\n\n<code>%s</code>\n\nЗапуск клиента: <code>-token %s</code>\nПредыдущий токен этого клиента больше недействителен.",
+		html.EscapeString(clientID), html.EscapeString(token), html.EscapeString(token))
+
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ParseMode = tgbotapi.ModeHTML
+	b.api.Send(msg)
+}
+
+func (b *Bot) handleTokenRevoke(op *internal.Operator, message *tgbotapi.Message) {
+	chatID := message.Chat.ID
+
+	args, err := splitArgs(message.CommandArguments())
+	if err != nil || len(args) != 1 {
+		b.sendText(chatID, "Использование: /token_revoke <client_id>")
+		return
+	}
+
+	if err := op.RevokeToken(args[0]); err != nil {
+		b.sendText(chatID, fmt.Sprintf("❌ Не удалось отозвать токен: %v", err))
+		return
+	}
+
+	b.sendText(chatID, fmt.Sprintf("🚫 Токен клиента %s отозван", args[0]))
+}
+
+func (b *Bot) listTokens(op *internal.Operator, chatID int64) {
+	tokens := op.Tokens()
+	if len(tokens) == 0 {
+		b.sendText(chatID, "Нет выданных токенов. Создать: /token_new [client_id]")
+		return
+	}
+
+	var sb strings.Builder
+	for _, t := range tokens {
+		fmt.Fprintf(&sb, "%s  %s\n", t.CreatedAt.Format("2006-01-02 15:04"), t.ClientID)
+	}
+
+	b.sendPre(chatID, fmt.Sprintf("🔑 Токены (%d)", len(tokens)), sb.String())
+}
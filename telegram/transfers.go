@@ -0,0 +1,192 @@
+package telegram
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/E2klime/HAXinceL2/internal"
+	"github.com/E2klime/HAXinceL2/internal/protocol"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Bots may send documents up to 50 MB; larger downloads stay on the server.
+const maxSendSize = 50 << 20
+
+func (b *Bot) handleFileDownloadCommand(op *internal.Operator, message *tgbotapi.Message) {
+	chatID := message.Chat.ID
+
+	clientID, ok := b.selectedClient(messageSession(message))
+	if !ok {
+		b.sendText(chatID, "❌ Сначала выберите клиента: /clients")
+		return
+	}
+
+	args, err := splitArgs(message.CommandArguments())
+	if err != nil || len(args) != 1 {
+		b.sendText(chatID, "Использование: /file_download <path>")
+		return
+	}
+
+	t, err := op.StartDownload(clientID, args[0], telegramOrigin(chatID))
+	if err != nil {
+		b.sendText(chatID, fmt.Sprintf("❌ %v", err))
+		return
+	}
+
+	b.announceTransfer(chatID, t)
+	go b.followTransfer(op, chatID, t.ID)
+}
+
+// uploadDocument saves a Telegram document to a temporary file and starts a
+// chunked upload of it to the client.
+func (b *Bot) uploadDocument(op *internal.Operator, chatID int64, clientID, fileID, path string) error {
+	if err := op.Authorize(internal.OperationPermission(protocol.TypeFileWrite), clientID); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp("", "telegram-upload-*")
+	if err != nil {
+		return err
+	}
+	defer tmp.Close()
+
+	if err := b.downloadDocument(fileID, tmp); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("не удалось получить файл: %w", err)
+	}
+
+	t, err := op.StartUpload(clientID, tmp.Name(), path, 0, telegramOrigin(chatID))
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	b.announceTransfer(chatID, t)
+	go b.followTransfer(op, chatID, t.ID)
+	return nil
+}
+
+func (b *Bot) announceTransfer(chatID int64, t internal.Transfer) {
+	arrow := "⬇️"
+	if t.Direction == protocol.TransferUpload {
+		arrow = "⬆️"
+	}
+
+	text := fmt.Sprintf("%s Передача %s: %s (%s)", arrow, shortID(t.ID), t.RemotePath, t.ClientID)
+	if t.Status == internal.TransferPaused {
+		text += "\nКлиент офлайн, передача начнётся после подключения."
+	}
+	b.sendText(chatID, text+"\nПрогресс: /transfers")
+}
+
+// followTransfer reports the outcome of a transfer started from chatID and
+// cleans up the temporary files the bot created for it.
+func (b *Bot) followTransfer(op *internal.Operator, chatID int64, id string) {
+	t, err := op.WaitTransfer(context.Background(), id)
+	if err != nil {
+		log.Printf("Failed to wait for transfer %s: %v", id, err)
+		return
+	}
+
+	if t.Direction == protocol.TransferUpload {
+		os.Remove(t.LocalPath)
+	}
+
+	switch t.Status {
+	case internal.TransferCancelled:
+		return
+	case internal.TransferFailed:
+		b.sendText(chatID, fmt.Sprintf("❌ Передача %s (%s) не удалась: %s", shortID(t.ID), t.RemotePath, t.Error))
+		return
+	}
+
+	if t.Direction == protocol.TransferUpload {
+		b.sendText(chatID, fmt.Sprintf("✅ %s записан на %s (%s, sha256 %s)", t.RemotePath, t.ClientID, formatSize(t.Size), t.SHA256[:16]))
+		return
+	}
+
+	caption := fmt.Sprintf("📄 %s (%s)\nsha256 %s", t.RemotePath, formatSize(t.Size), t.SHA256)
+	if t.Size > maxSendSize {
+		b.sendText(chatID, fmt.Sprintf("%s\nФайл больше %s и сохранён на сервере: %s", caption, formatSize(maxSendSize), t.LocalPath))
+		return
+	}
+
+	doc := tgbotapi.NewDocument(chatID, tgbotapi.FilePath(t.LocalPath))
+	doc.Caption = caption
+	if _, err := b.api.Send(doc); err != nil {
+		log.Printf("Failed to send transfer %s: %v", t.ID, err)
+		b.sendText(chatID, fmt.Sprintf("❌ Не удалось отправить файл: %v\nОн сохранён на сервере: %s", err, t.LocalPath))
+		return
+	}
+	os.Remove(t.LocalPath)
+}
+
+func (b *Bot) handleTransferList(op *internal.Operator, message *tgbotapi.Message) {
+	chatID := message.Chat.ID
+
+	args, err := splitArgs(message.CommandArguments())
+	if err != nil || len(args) > 1 {
+		b.sendText(chatID, "Использование: /transfers [client_id]")
+		return
+	}
+
+	clientID := ""
+	if len(args) == 1 {
+		clientID = args[0]
+	}
+
+	transfers := op.Transfers(clientID)
+	if len(transfers) == 0 {
+		b.sendText(chatID, "📭 Передач нет")
+		return
+	}
+
+	var sb strings.Builder
+	for _, t := range transfers {
+		progress := "-"
+		if t.Size > 0 {
+			progress = fmt.Sprintf("%d%%", t.Done*100/t.Size)
+		}
+		fmt.Fprintf(&sb, "%s %-8s %-9s %4s %9s %s %s\n",
+			shortID(t.ID), t.Direction, t.Status, progress, formatSize(t.Size), t.ClientID, filepath.Base(t.RemotePath))
+	}
+
+	b.sendTable(chatID, fmt.Sprintf("🔁 Передачи (%d)", len(transfers)), sb.String(), "transfers.txt")
+}
+
+func (b *Bot) handleTransferCancel(op *internal.Operator, message *tgbotapi.Message) {
+	chatID := message.Chat.ID
+
+	args, err := splitArgs(message.CommandArguments())
+	if err != nil || len(args) != 1 {
+		b.sendText(chatID, "Использование: /transfer_cancel <id>")
+		return
+	}
+
+	var match string
+	for _, t := range op.Transfers("") {
+		if strings.HasPrefix(t.ID, args[0]) {
+			if match != "" {
+				b.sendText(chatID, fmt.Sprintf("❌ неоднозначный id: %s", args[0]))
+				return
+			}
+			match = t.ID
+		}
+	}
+	if match == "" {
+		b.sendText(chatID, fmt.Sprintf("❌ %v", internal.ErrTransferNotFound))
+		return
+	}
+
+	t, err := op.CancelTransfer(match)
+	if err != nil {
+		b.sendText(chatID, fmt.Sprintf("❌ %v", err))
+		return
+	}
+
+	b.sendText(chatID, fmt.Sprintf("🚫 Передача %s (%s) отменена", shortID(t.ID), t.RemotePath))
+}